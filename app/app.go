@@ -1,8 +1,11 @@
 package app
 
 import (
+	"errors"
 	"io"
+	"net"
 	"net/http"
+	"time"
 
 	"goji.io"
 	"goji.io/pat"
@@ -17,6 +20,8 @@ import (
 	"github.com/metcalf/saypi/reqlog"
 	"github.com/metcalf/saypi/respond"
 	"github.com/metcalf/saypi/say"
+
+	"golang.org/x/net/context"
 )
 
 // Configuration represents the configuration for an App
@@ -28,18 +33,58 @@ type Configuration struct {
 	IPPerMinute int // maximum number of requests per IP per minute
 	IPRateBurst int // maximum burst of requests from an IP
 
+	SharePerMinute int // maximum number of views per share link per minute
+	ShareRateBurst int // maximum burst of views of a share link
+
+	SessionPerMinute int // maximum number of messages per session connection per minute
+	SessionRateBurst int // maximum burst of messages on a session connection
+
 	UserSecret []byte // secret for generating secure user tokens
+
+	MaxConversations     int64 // maximum number of conversations per user, unlimited if zero
+	MaxConversationLines int64 // maximum number of lines per conversation, unlimited if zero
+	MaxMoods             int64 // maximum number of moods per user, unlimited if zero
+	MaxTextBytes         int64 // maximum bytes of line text per user, unlimited if zero
+
+	TrashRetention     time.Duration // how long deleted items can be restored, forever if zero
+	TrashPurgeInterval time.Duration // how often to purge expired items from the trash
+
+	ReapInterval  time.Duration // how often to delete expired conversations, never if zero
+	ReapBatchSize int           // maximum number of expired conversations deleted at once
+
+	WebhookInterval    time.Duration // how often to check for due webhook deliveries, never if zero
+	WebhookRetryDelay  time.Duration // delay before the first retry of a failed webhook delivery
+	WebhookAllowedNets []*net.IPNet  // private networks webhooks may be sent to, such as loopback for tests
+
+	MoodCatalog string // path to a JSON or YAML file of built-in moods
 }
 
 var Routes = struct {
-	CreateUser, GetUser,
+	CreateUser, GetUser, GetUsage,
 	GetAnimals,
 	ListMoods, SetMood, GetMood, DeleteMood,
+	ListMoodSets, SetMoodSet, GetMoodSet, DeleteMoodSet,
+	GetSentimentMoods, SetSentimentMoods, DeleteSentimentMoods,
+	GetPublisher, SetPublisher, PublishMood, UnpublishMood,
+	ListGallery, GetGalleryMood, InstallMood, UninstallMood, CopyMood,
 	ListConversations, CreateConversation, GetConversation, DeleteConversation,
-	CreateLine, GetLine, DeleteLine *pat.Pattern
+	UpdateConversation, ListConversationRevisions,
+	ExportConversation, ImportConversation, GetTranscript,
+	RenderConversation,
+	ImportScript, GetScript, StreamEvents, JoinSession,
+	ForkConversation, RestoreConversation, RestoreLine, ListTrash,
+	CreateLine, CreateLines, CreateCowsayLine, GetLine, DeleteLine,
+	UpdateLine, ListLineRevisions, MoveLine, ListLines,
+	Search,
+	CreateShare, ListShares, RevokeShare, GetShared,
+	CreateCharacter, ListCharacters, DeleteCharacter,
+	CreateInvite, ListInvites, RevokeInvite, AcceptInvite,
+	ListMembers, UpdateMember, DeleteMember,
+	CreateWebhook, ListWebhooks, DeleteWebhook, ListDeliveries *pat.Pattern
 }{
 	CreateUser: pat.Post("/users"),
 	GetUser:    pat.Get("/users/:id"),
+	GetUsage:   pat.Get("/usage"),
 
 	GetAnimals: pat.Get("/animals"),
 
@@ -48,20 +93,90 @@ var Routes = struct {
 	GetMood:    pat.Get("/moods/:mood"),
 	DeleteMood: pat.Delete("/moods/:mood"),
 
+	ListMoodSets:  pat.Get("/mood_sets"),
+	SetMoodSet:    pat.Put("/mood_sets/:set"),
+	GetMoodSet:    pat.Get("/mood_sets/:set"),
+	DeleteMoodSet: pat.Delete("/mood_sets/:set"),
+
+	GetSentimentMoods:    pat.Get("/sentiment_moods"),
+	SetSentimentMoods:    pat.Put("/sentiment_moods"),
+	DeleteSentimentMoods: pat.Delete("/sentiment_moods"),
+
+	GetPublisher:  pat.Get("/publisher"),
+	SetPublisher:  pat.Put("/publisher"),
+	PublishMood:   pat.Post("/moods/:mood/publish"),
+	UnpublishMood: pat.Post("/moods/:mood/unpublish"),
+
+	ListGallery:    pat.Get("/gallery"),
+	GetGalleryMood: pat.Get("/gallery/:publisher/:mood"),
+	InstallMood:    pat.Post("/gallery/:publisher/:mood/install"),
+	UninstallMood:  pat.Delete("/gallery/:publisher/:mood/install"),
+	CopyMood:       pat.Post("/gallery/:publisher/:mood/copy"),
+
 	ListConversations:  pat.Get("/conversations"),
 	CreateConversation: pat.Post("/conversations"),
 	GetConversation:    pat.Get("/conversations/:conversation"),
 	DeleteConversation: pat.Delete("/conversations/:conversation"),
-
-	CreateLine: pat.Post("/conversations/:conversation/lines"),
-	GetLine:    pat.Get("/conversations/:conversation/lines/:line"),
-	DeleteLine: pat.Delete("/conversations/:conversation/lines/:line"),
+	UpdateConversation: pat.Patch("/conversations/:conversation"),
+	ForkConversation:   pat.Post("/conversations/:conversation/fork"),
+
+	ListConversationRevisions: pat.Get("/conversations/:conversation/revisions"),
+
+	RestoreConversation: pat.Post("/conversations/:conversation/restore"),
+	RestoreLine:         pat.Post("/conversations/:conversation/lines/:line/restore"),
+	ListTrash:           pat.Get("/trash"),
+
+	CreateLine:       pat.Post("/conversations/:conversation/lines"),
+	CreateLines:      pat.Post("/conversations/:conversation/lines/batch"),
+	CreateCowsayLine: pat.Post("/conversations/:conversation/lines/cowsay"),
+	GetLine:          pat.Get("/conversations/:conversation/lines/:line"),
+	DeleteLine:       pat.Delete("/conversations/:conversation/lines/:line"),
+
+	UpdateLine:        pat.Patch("/conversations/:conversation/lines/:line"),
+	ListLineRevisions: pat.Get("/conversations/:conversation/lines/:line/revisions"),
+	MoveLine:          pat.Post("/conversations/:conversation/lines/:line/move"),
+	ListLines:         pat.Get("/conversations/:conversation/lines"),
+
+	Search: pat.Get("/search"),
+
+	ExportConversation: pat.Get("/conversations/:conversation/export"),
+	ImportConversation: pat.Post("/conversations/import"),
+	GetTranscript:      pat.Get("/conversations/:conversation/transcript"),
+	RenderConversation: pat.Get("/conversations/:conversation/render"),
+	ImportScript:       pat.Post("/conversations/script"),
+	GetScript:          pat.Get("/conversations/:conversation/script"),
+	StreamEvents:       pat.Get("/conversations/:conversation/events"),
+	JoinSession:        pat.Get("/conversations/:conversation/session"),
+
+	CreateShare: pat.Post("/conversations/:conversation/shares"),
+	ListShares:  pat.Get("/conversations/:conversation/shares"),
+	RevokeShare: pat.Delete("/conversations/:conversation/shares/:share"),
+	GetShared:   pat.Get("/shared/:token"),
+
+	CreateCharacter: pat.Post("/conversations/:conversation/characters"),
+	ListCharacters:  pat.Get("/conversations/:conversation/characters"),
+	DeleteCharacter: pat.Delete("/conversations/:conversation/characters/:character"),
+
+	CreateInvite: pat.Post("/conversations/:conversation/invites"),
+	ListInvites:  pat.Get("/conversations/:conversation/invites"),
+	RevokeInvite: pat.Delete("/conversations/:conversation/invites/:invite"),
+	AcceptInvite: pat.Post("/invites/:token/accept"),
+
+	ListMembers:  pat.Get("/conversations/:conversation/members"),
+	UpdateMember: pat.Patch("/conversations/:conversation/members/:member"),
+	DeleteMember: pat.Delete("/conversations/:conversation/members/:member"),
+
+	CreateWebhook:  pat.Post("/webhooks"),
+	ListWebhooks:   pat.Get("/webhooks"),
+	DeleteWebhook:  pat.Delete("/webhooks/:webhook"),
+	ListDeliveries: pat.Get("/webhooks/:webhook/deliveries"),
 }
 
 // App encapsulates the handlers for the saypi API
 type App struct {
 	srv     http.Handler
 	closers []io.Closer
+	sayCtrl *say.Controller
 }
 
 // Close cleans up any resources used by the app such as database connections.
@@ -69,6 +184,13 @@ func (a *App) Close() error {
 	return closeAll(a.closers)
 }
 
+// CloseStreams ends long-lived responses such as event streams and
+// sessions. Call it when a graceful shutdown begins so that the
+// shutdown does not wait for streaming clients to disconnect.
+func (a *App) CloseStreams() {
+	a.sayCtrl.CloseStreams()
+}
+
 func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	a.srv.ServeHTTP(w, r)
 }
@@ -85,7 +207,25 @@ func New(config *Configuration) (*App, error) {
 	app.closers = append(app.closers, db)
 
 	ipQuota := throttled.RateQuota{throttled.PerMin(config.IPPerMinute), config.IPRateBurst}
-	ipLimiter, err := buildLimiter(ipQuota)
+	ipLimiter, err := buildLimiter(ipQuota, &throttled.VaryBy{RemoteAddr: true})
+	if err != nil {
+		defer app.Close()
+		return nil, err
+	}
+
+	shareQuota := throttled.RateQuota{MaxRate: throttled.PerMin(config.SharePerMinute), MaxBurst: config.ShareRateBurst}
+	shareLimiter, err := buildLimiter(shareQuota, &throttled.VaryBy{Path: true})
+	if err != nil {
+		defer app.Close()
+		return nil, err
+	}
+
+	sessionQuota := throttled.RateQuota{MaxRate: throttled.PerMin(config.SessionPerMinute), MaxBurst: config.SessionRateBurst}
+	sessionLimiter, err := buildRateLimiter(sessionQuota)
+	if err != nil {
+		defer app.Close()
+		return nil, err
+	}
 
 	authCtrl, err := auth.New(config.UserSecret)
 	if err != nil {
@@ -93,12 +233,54 @@ func New(config *Configuration) (*App, error) {
 		return nil, err
 	}
 
-	sayCtrl, err := say.New(db)
+	var builtins []say.Mood
+	if config.MoodCatalog != "" {
+		builtins, err = say.LoadMoods(config.MoodCatalog)
+		if err != nil {
+			defer app.Close()
+			return nil, err
+		}
+	}
+
+	sayCtrl, err := say.New(db, builtins, config.UserSecret)
 	if err != nil {
 		defer app.Close()
 		return nil, err
 	}
 	app.closers = append(app.closers, sayCtrl)
+	app.sayCtrl = sayCtrl
+	sayCtrl.SetSessionLimiter(sessionLimiter)
+	sayCtrl.SetQuotas(say.Quotas{
+		Conversations:        config.MaxConversations,
+		LinesPerConversation: config.MaxConversationLines,
+		Moods:                config.MaxMoods,
+		TextBytes:            config.MaxTextBytes,
+	})
+	sayCtrl.SetWebhookAllowedNets(config.WebhookAllowedNets)
+
+	if config.TrashRetention > 0 {
+		if config.TrashPurgeInterval <= 0 {
+			defer app.Close()
+			return nil, errors.New("TrashPurgeInterval must be positive to purge the trash")
+		}
+		sayCtrl.StartPurger(config.TrashRetention, config.TrashPurgeInterval)
+	}
+
+	if config.ReapInterval > 0 {
+		if config.ReapBatchSize <= 0 {
+			defer app.Close()
+			return nil, errors.New("ReapBatchSize must be positive to delete expired conversations")
+		}
+		sayCtrl.StartReaper(config.ReapInterval, config.ReapBatchSize)
+	}
+
+	if config.WebhookInterval > 0 {
+		if config.WebhookRetryDelay <= 0 {
+			defer app.Close()
+			return nil, errors.New("WebhookRetryDelay must be positive to send webhooks")
+		}
+		sayCtrl.StartDeliveries(config.WebhookInterval, config.WebhookRetryDelay)
+	}
 
 	// TODO: Proper not found handler
 	privMux := goji.NewMux()
@@ -106,24 +288,85 @@ func New(config *Configuration) (*App, error) {
 	privMux.UseC(authCtrl.WrapC)
 
 	privMux.HandleFuncC(Routes.GetAnimals, sayCtrl.GetAnimals)
+	privMux.HandleFuncC(Routes.GetUsage, sayCtrl.GetUsage)
 
 	privMux.HandleFuncC(Routes.ListMoods, sayCtrl.ListMoods)
 	privMux.HandleFuncC(Routes.SetMood, sayCtrl.SetMood)
 	privMux.HandleFuncC(Routes.GetMood, sayCtrl.GetMood)
 	privMux.HandleFuncC(Routes.DeleteMood, sayCtrl.DeleteMood)
 
+	privMux.HandleFuncC(Routes.ListMoodSets, sayCtrl.ListMoodSets)
+	privMux.HandleFuncC(Routes.SetMoodSet, sayCtrl.SetMoodSet)
+	privMux.HandleFuncC(Routes.GetMoodSet, sayCtrl.GetMoodSet)
+	privMux.HandleFuncC(Routes.DeleteMoodSet, sayCtrl.DeleteMoodSet)
+
+	privMux.HandleFuncC(Routes.GetSentimentMoods, sayCtrl.GetSentimentMoods)
+	privMux.HandleFuncC(Routes.SetSentimentMoods, sayCtrl.SetSentimentMoods)
+	privMux.HandleFuncC(Routes.DeleteSentimentMoods, sayCtrl.DeleteSentimentMoods)
+
+	privMux.HandleFuncC(Routes.GetPublisher, sayCtrl.GetPublisher)
+	privMux.HandleFuncC(Routes.SetPublisher, sayCtrl.SetPublisher)
+	privMux.HandleFuncC(Routes.PublishMood, sayCtrl.PublishMood)
+	privMux.HandleFuncC(Routes.UnpublishMood, sayCtrl.UnpublishMood)
+
+	privMux.HandleFuncC(Routes.ListGallery, sayCtrl.ListGallery)
+	privMux.HandleFuncC(Routes.GetGalleryMood, sayCtrl.GetGalleryMood)
+	privMux.HandleFuncC(Routes.InstallMood, sayCtrl.InstallMood)
+	privMux.HandleFuncC(Routes.UninstallMood, sayCtrl.UninstallMood)
+	privMux.HandleFuncC(Routes.CopyMood, sayCtrl.CopyMood)
+
 	privMux.HandleFuncC(Routes.ListConversations, sayCtrl.ListConversations)
 	privMux.HandleFuncC(Routes.CreateConversation, sayCtrl.CreateConversation)
 	privMux.HandleFuncC(Routes.GetConversation, sayCtrl.GetConversation)
 	privMux.HandleFuncC(Routes.DeleteConversation, sayCtrl.DeleteConversation)
+	privMux.HandleFuncC(Routes.UpdateConversation, sayCtrl.UpdateConversation)
+	privMux.HandleFuncC(Routes.ListConversationRevisions, sayCtrl.ListConversationRevisions)
+	privMux.HandleFuncC(Routes.ForkConversation, sayCtrl.ForkConversation)
+	privMux.HandleFuncC(Routes.RestoreConversation, sayCtrl.RestoreConversation)
+	privMux.HandleFuncC(Routes.RestoreLine, sayCtrl.RestoreLine)
+	privMux.HandleFuncC(Routes.ListTrash, sayCtrl.ListTrash)
 
 	privMux.HandleFuncC(Routes.CreateLine, sayCtrl.CreateLine)
+	privMux.HandleFuncC(Routes.CreateLines, sayCtrl.CreateLines)
+	privMux.HandleFuncC(Routes.CreateCowsayLine, sayCtrl.CreateCowsayLine)
 	privMux.HandleFuncC(Routes.GetLine, sayCtrl.GetLine)
 	privMux.HandleFuncC(Routes.DeleteLine, sayCtrl.DeleteLine)
+	privMux.HandleFuncC(Routes.UpdateLine, sayCtrl.UpdateLine)
+	privMux.HandleFuncC(Routes.ListLineRevisions, sayCtrl.ListLineRevisions)
+	privMux.HandleFuncC(Routes.MoveLine, sayCtrl.MoveLine)
+	privMux.HandleFuncC(Routes.ListLines, sayCtrl.ListLines)
+	privMux.HandleFuncC(Routes.Search, sayCtrl.Search)
+	privMux.HandleFuncC(Routes.ExportConversation, sayCtrl.ExportConversation)
+	privMux.HandleFuncC(Routes.ImportConversation, sayCtrl.ImportConversation)
+	privMux.HandleFuncC(Routes.GetTranscript, sayCtrl.GetTranscript)
+	privMux.HandleFuncC(Routes.RenderConversation, sayCtrl.RenderConversation)
+	privMux.HandleFuncC(Routes.ImportScript, sayCtrl.ImportScript)
+	privMux.HandleFuncC(Routes.GetScript, sayCtrl.GetScript)
+	privMux.HandleFuncC(Routes.StreamEvents, sayCtrl.StreamEvents)
+	privMux.HandleFuncC(Routes.JoinSession, sayCtrl.JoinSession)
+	privMux.HandleFuncC(Routes.CreateShare, sayCtrl.CreateShare)
+	privMux.HandleFuncC(Routes.ListShares, sayCtrl.ListShares)
+	privMux.HandleFuncC(Routes.RevokeShare, sayCtrl.RevokeShare)
+	privMux.HandleFuncC(Routes.CreateCharacter, sayCtrl.CreateCharacter)
+	privMux.HandleFuncC(Routes.ListCharacters, sayCtrl.ListCharacters)
+	privMux.HandleFuncC(Routes.DeleteCharacter, sayCtrl.DeleteCharacter)
+	privMux.HandleFuncC(Routes.CreateInvite, sayCtrl.CreateInvite)
+	privMux.HandleFuncC(Routes.ListInvites, sayCtrl.ListInvites)
+	privMux.HandleFuncC(Routes.RevokeInvite, sayCtrl.RevokeInvite)
+	privMux.HandleFuncC(Routes.AcceptInvite, sayCtrl.AcceptInvite)
+	privMux.HandleFuncC(Routes.ListMembers, sayCtrl.ListMembers)
+	privMux.HandleFuncC(Routes.UpdateMember, sayCtrl.UpdateMember)
+	privMux.HandleFuncC(Routes.DeleteMember, sayCtrl.DeleteMember)
+
+	privMux.HandleFuncC(Routes.CreateWebhook, sayCtrl.CreateWebhook)
+	privMux.HandleFuncC(Routes.ListWebhooks, sayCtrl.ListWebhooks)
+	privMux.HandleFuncC(Routes.DeleteWebhook, sayCtrl.DeleteWebhook)
+	privMux.HandleFuncC(Routes.ListDeliveries, sayCtrl.ListDeliveries)
 
 	mainMux := goji.NewMux()
 	mainMux.HandleFuncC(Routes.CreateUser, authCtrl.CreateUser)
 	mainMux.HandleFuncC(Routes.GetUser, authCtrl.GetUser)
+	mainMux.HandleC(Routes.GetShared, limitC(shareLimiter, goji.HandlerFunc(sayCtrl.GetShared)))
 	mainMux.HandleC(pat.New("/*"), privMux)
 
 	mainMux.UseC(reqlog.WrapC)
@@ -147,26 +390,43 @@ func buildDB(dsn string, maxIdle, maxOpen int) (*sqlx.DB, error) {
 	return db, nil
 }
 
-func buildLimiter(quota throttled.RateQuota) (*throttled.HTTPRateLimiter, error) {
-	store, err := memstore.New(65536)
+func buildLimiter(quota throttled.RateQuota, varyBy *throttled.VaryBy) (*throttled.HTTPRateLimiter, error) {
+	rateLimiter, err := buildRateLimiter(quota)
 	if err != nil {
 		return nil, err
 	}
 
-	rateLimiter, err := throttled.NewGCRARateLimiter(store, quota)
+	return &throttled.HTTPRateLimiter{
+		RateLimiter: rateLimiter,
+		VaryBy:      varyBy,
+	}, nil
+}
+
+func buildRateLimiter(quota throttled.RateQuota) (throttled.RateLimiter, error) {
+	store, err := memstore.New(65536)
 	if err != nil {
 		return nil, err
 	}
 
-	return &throttled.HTTPRateLimiter{
-		RateLimiter: rateLimiter,
-		VaryBy:      &throttled.VaryBy{RemoteAddr: true},
-	}, nil
+	return throttled.NewGCRARateLimiter(store, quota)
+}
+
+// limitC applies a rate limiter to a single handler rather than to
+// every route of a mux.
+func limitC(limiter *throttled.HTTPRateLimiter, inner goji.Handler) goji.Handler {
+	return goji.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		limiter.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inner.ServeHTTPC(ctx, w, r)
+		})).ServeHTTP(w, r)
+	})
 }
 
+// closeAll closes closers in the reverse of the order they were
+// added so that nothing is closed before what depends on it, such as
+// the database before the background workers of the say controller.
 func closeAll(closers []io.Closer) error {
-	for _, cls := range closers {
-		if err := cls.Close(); err != nil {
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
 			return err
 		}
 	}
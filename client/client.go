@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"strconv"
 
 	"github.com/google/go-querystring/query"
 	"github.com/metcalf/saypi/app"
@@ -127,8 +128,9 @@ func (c *Client) NewRequest(rt Route, rtVars Vars, form *url.Values) (*http.Requ
 
 // Do sends an API request and returns the API response. The API
 // response is JSON-decoded and stored in the value pointed to by
-// v. If a known usererror response is returned, the error will be a
-// UserError with the correct underlying type.
+// v, or stored as is if v is a *[]byte. If a known usererror response
+// is returned, the error will be a UserError with the correct
+// underlying type.
 func (c *Client) Do(req *http.Request, v interface{}) (*http.Response, error) {
 	rv := reflect.ValueOf(v)
 	if !(v == nil || rv.Kind() == reflect.Ptr) {
@@ -141,28 +143,42 @@ func (c *Client) Do(req *http.Request, v interface{}) (*http.Response, error) {
 	}
 	defer resp.Body.Close()
 
+	if err := responseError(resp); err != nil {
+		return resp, err
+	}
+
+	if raw, ok := v.(*[]byte); ok {
+		if *raw, err = ioutil.ReadAll(resp.Body); err != nil {
+			return resp, fmt.Errorf("unable to read response body (%v)", err)
+		}
+	} else if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return resp, fmt.Errorf("unable to parse response body (%v)", err)
+		}
+	}
+
+	return resp, nil
+}
+
+// responseError returns the error described by an unsuccessful
+// response, reading its body if the status code indicates an error.
+func responseError(resp *http.Response) error {
 	if resp.StatusCode > 399 {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return resp, fmt.Errorf("unable to read response body (%v)", err)
+			return fmt.Errorf("unable to read response body (%v)", err)
 		}
 
 		uerr, err := usererrors.UnmarshalJSON(body)
 		if err != nil {
-			return resp, fmt.Errorf("unable to parse error body (%v)", err)
+			return fmt.Errorf("unable to parse error body (%v)", err)
 		}
-		return resp, userError{uerr}
+		return userError{uerr}
 	} else if resp.StatusCode > 299 || resp.StatusCode < 199 {
-		return resp, fmt.Errorf("unexpected status code %d", resp.StatusCode)
-	}
-
-	if v != nil {
-		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
-			return resp, fmt.Errorf("unable to parse response body (%v)", err)
-		}
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
 	}
 
-	return resp, nil
+	return nil
 }
 
 func (c *Client) SetAuthorization(auth string) {
@@ -215,6 +231,18 @@ func (c *Client) UserExists(id string) (bool, error) {
 	return resp.StatusCode == http.StatusNoContent, nil
 }
 
+// GetUsage returns what the user stores against each of their quotas.
+func (c *Client) GetUsage() (*say.Usage, error) {
+	var usage say.Usage
+
+	_, err := c.execute(app.Routes.GetUsage, nil, nil, &usage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &usage, nil
+}
+
 func (c *Client) GetAnimals() ([]string, error) {
 	var animals struct {
 		Animals []string `json:"animals"`
@@ -228,8 +256,10 @@ func (c *Client) GetAnimals() ([]string, error) {
 	return animals.Animals, nil
 }
 
-func (c *Client) ListMoods(params ListParams) *MoodIter {
-	return &MoodIter{c.iter(app.Routes.ListMoods, nil, params, say.Mood{})}
+func (c *Client) ListMoods(params MoodListParams) *MoodIter {
+	it := c.iter(app.Routes.ListMoods, nil, params.ListParams, say.Mood{})
+	it.filters, it.err = query.Values(params)
+	return &MoodIter{it}
 }
 
 func (c *Client) SetMood(mood *say.Mood) error {
@@ -266,6 +296,186 @@ func (c *Client) DeleteMood(name string) error {
 	return nil
 }
 
+func (c *Client) ListMoodSets(params ListParams) *MoodSetIter {
+	return &MoodSetIter{c.iter(app.Routes.ListMoodSets, nil, params, say.MoodSet{})}
+}
+
+func (c *Client) SetMoodSet(set *say.MoodSet) error {
+	form := make(url.Values)
+	for _, entry := range set.Moods {
+		form.Add("moods", fmt.Sprintf("%s:%d", entry.Mood, entry.Weight))
+	}
+
+	_, err := c.execute(app.Routes.SetMoodSet, set, &form, set)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) GetMoodSet(name string) (*say.MoodSet, error) {
+	set := say.MoodSet{Name: name}
+
+	_, err := c.execute(app.Routes.GetMoodSet, &set, nil, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	return &set, nil
+}
+
+func (c *Client) DeleteMoodSet(name string) error {
+	_, err := c.execute(app.Routes.DeleteMoodSet, &say.MoodSet{Name: name}, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) GetSentimentMoods() (*say.SentimentMoods, error) {
+	var moods say.SentimentMoods
+
+	_, err := c.execute(app.Routes.GetSentimentMoods, nil, nil, &moods)
+	if err != nil {
+		return nil, err
+	}
+
+	return &moods, nil
+}
+
+func (c *Client) SetSentimentMoods(ranges []say.SentimentMood) (*say.SentimentMoods, error) {
+	var moods say.SentimentMoods
+
+	form := make(url.Values)
+	for _, rng := range ranges {
+		form.Add("ranges", fmt.Sprintf("%s:%s", rng.Mood, strconv.FormatFloat(rng.MinScore, 'f', -1, 64)))
+	}
+
+	_, err := c.execute(app.Routes.SetSentimentMoods, nil, &form, &moods)
+	if err != nil {
+		return nil, err
+	}
+
+	return &moods, nil
+}
+
+// ResetSentimentMoods restores the default mapping from sentiment
+// scores to moods.
+func (c *Client) ResetSentimentMoods() error {
+	_, err := c.execute(app.Routes.DeleteSentimentMoods, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) GetPublisher() (*say.Publisher, error) {
+	var pub say.Publisher
+
+	_, err := c.execute(app.Routes.GetPublisher, nil, nil, &pub)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pub, nil
+}
+
+func (c *Client) SetPublisher(pub *say.Publisher) error {
+	form, err := query.Values(pub)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.execute(app.Routes.SetPublisher, nil, &form, pub)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) PublishMood(name string) (*say.PublishedMood, error) {
+	var mood say.PublishedMood
+
+	_, err := c.execute(app.Routes.PublishMood, &say.Mood{Name: name}, nil, &mood)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mood, nil
+}
+
+func (c *Client) UnpublishMood(name string) (*say.PublishedMood, error) {
+	var mood say.PublishedMood
+
+	_, err := c.execute(app.Routes.UnpublishMood, &say.Mood{Name: name}, nil, &mood)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mood, nil
+}
+
+func (c *Client) ListGallery(params GalleryListParams) *PublishedMoodIter {
+	it := c.iter(app.Routes.ListGallery, nil, params.ListParams, say.PublishedMood{})
+	it.filters, it.err = query.Values(params)
+	return &PublishedMoodIter{it}
+}
+
+func (c *Client) GetGalleryMood(publisher, name string) (*say.PublishedMood, error) {
+	mood := say.PublishedMood{Publisher: publisher, Name: name}
+
+	_, err := c.execute(app.Routes.GetGalleryMood, &mood, nil, &mood)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mood, nil
+}
+
+// InstallMood installs a published mood so that it can be used in
+// lines as `@<publisher>/<name>`.
+func (c *Client) InstallMood(publisher, name string) (*say.PublishedMood, error) {
+	mood := say.PublishedMood{Publisher: publisher, Name: name}
+
+	_, err := c.execute(app.Routes.InstallMood, &mood, nil, &mood)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mood, nil
+}
+
+func (c *Client) UninstallMood(publisher, name string) error {
+	_, err := c.execute(app.Routes.UninstallMood, &say.PublishedMood{Publisher: publisher, Name: name}, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CopyMood creates a mood named newName with the eyes and tongue of a
+// published mood. An empty newName uses the published mood's name.
+func (c *Client) CopyMood(publisher, name, newName string) (*say.Mood, error) {
+	var mood say.Mood
+
+	form := make(url.Values)
+	if newName != "" {
+		form.Set("name", newName)
+	}
+
+	_, err := c.execute(app.Routes.CopyMood, &say.PublishedMood{Publisher: publisher, Name: name}, &form, &mood)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mood, nil
+}
+
 func (c *Client) ListConversations(params ListParams) *ConversationIter {
 	return &ConversationIter{c.iter(app.Routes.ListConversations, nil, params, say.Conversation{})}
 }
@@ -295,22 +505,29 @@ func (c *Client) GetConversation(id string) (*say.Conversation, error) {
 	return &convo, nil
 }
 
-func (c *Client) DeleteConversation(id string) error {
-	_, err := c.execute(app.Routes.DeleteConversation, &say.Conversation{ID: id}, nil, nil)
+// GetConversationWithLineLimit retrieves a conversation with at most
+// lineLimit of its first lines. HasMoreLines is set if it has more.
+func (c *Client) GetConversationWithLineLimit(id string, lineLimit int) (*say.Conversation, error) {
+	convo := say.Conversation{ID: id}
+	form := url.Values{"line_limit": {strconv.Itoa(lineLimit)}}
+
+	_, err := c.execute(app.Routes.GetConversation, &convo, &form, &convo)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return &convo, nil
 }
 
-func (c *Client) CreateLine(convoID string, line *say.Line) error {
-	form, err := query.Values(line)
+// UpdateConversation changes the heading of a conversation. Its Lines
+// are replaced with the current lines of the conversation.
+func (c *Client) UpdateConversation(convo *say.Conversation) error {
+	form, err := query.Values(convo)
 	if err != nil {
 		return err
 	}
 
-	_, err = c.execute(app.Routes.CreateLine, &say.Conversation{ID: convoID}, &form, line)
+	_, err = c.execute(app.Routes.UpdateConversation, convo, &form, convo)
 	if err != nil {
 		return err
 	}
@@ -318,28 +535,635 @@ func (c *Client) CreateLine(convoID string, line *say.Line) error {
 	return nil
 }
 
-func (c *Client) GetLine(convoID, lineID string) (*say.Line, error) {
-	var line say.Line
+// ForkParams describes how to fork a conversation.
+type ForkParams struct {
+	// Heading replaces the heading of the original if it is not nil.
+	Heading *string `url:"heading,omitempty"`
+	// Through is the ID of the last line to copy. Every line is copied
+	// if it is empty.
+	Through string `url:"through,omitempty"`
+}
 
-	vars := varmap((&say.Conversation{ID: convoID}).Vars())
-	vars["line"] = lineID
+// ForkConversation copies a conversation into a new conversation.
+func (c *Client) ForkConversation(id string, params ForkParams) (*say.Conversation, error) {
+	var convo say.Conversation
 
-	_, err := c.execute(app.Routes.GetLine, vars, nil, &line)
+	form, err := query.Values(params)
 	if err != nil {
 		return nil, err
 	}
 
-	return &line, nil
+	_, err = c.execute(app.Routes.ForkConversation, &say.Conversation{ID: id}, &form, &convo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &convo, nil
 }
 
-func (c *Client) DeleteLine(convoID, lineID string) error {
+// ExportConversation returns a bundle that can be imported to recreate
+// the conversation in another account.
+func (c *Client) ExportConversation(id string) (*say.ConversationBundle, error) {
+	var bundle say.ConversationBundle
+
+	_, err := c.execute(app.Routes.ExportConversation, &say.Conversation{ID: id}, nil, &bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bundle, nil
+}
+
+// ImportConversation creates a conversation from a bundle, creating
+// any moods in the bundle that the user does not have.
+func (c *Client) ImportConversation(bundle *say.ConversationBundle) (*say.Conversation, error) {
+	var convo say.Conversation
+
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{"bundle": {string(data)}}
+
+	_, err = c.execute(app.Routes.ImportConversation, nil, &form, &convo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &convo, nil
+}
+
+// GetTranscript renders every line of a conversation into a single
+// document. The format is "md", "html" or "txt".
+func (c *Client) GetTranscript(id, format string) ([]byte, error) {
+	var transcript []byte
+	form := url.Values{"format": {format}}
+
+	_, err := c.execute(app.Routes.GetTranscript, &say.Conversation{ID: id}, &form, &transcript)
+	if err != nil {
+		return nil, err
+	}
+
+	return transcript, nil
+}
+
+// RenderParams describes how to render a conversation. The zero value
+// renders each line in turn with the server's defaults.
+type RenderParams struct {
+	// Layout is say.LayoutStack or say.LayoutChat.
+	Layout      string `url:"layout,omitempty"`
+	Width       int    `url:"width,omitempty"`
+	Separator   string `url:"separator,omitempty"`
+	LineNumbers bool   `url:"line_numbers,omitempty"`
+	Banner      bool   `url:"banner,omitempty"`
+}
+
+// RenderConversation renders every line of a conversation into a
+// single block of plain text.
+func (c *Client) RenderConversation(id string, params RenderParams) ([]byte, error) {
+	var rendered []byte
+
+	form, err := query.Values(params)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.execute(app.Routes.RenderConversation, &say.Conversation{ID: id}, &form, &rendered)
+	if err != nil {
+		return nil, err
+	}
+
+	return rendered, nil
+}
+
+// ImportScript creates a conversation from a script with one
+// `animal[mood,think]: text` line per line of the conversation.
+func (c *Client) ImportScript(script string) (*say.Conversation, error) {
+	var convo say.Conversation
+	form := url.Values{"script": {script}}
+
+	_, err := c.execute(app.Routes.ImportScript, nil, &form, &convo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &convo, nil
+}
+
+// GetScript emits a conversation in the format accepted by
+// ImportScript.
+func (c *Client) GetScript(id string) (string, error) {
+	var script []byte
+
+	_, err := c.execute(app.Routes.GetScript, &say.Conversation{ID: id}, nil, &script)
+	if err != nil {
+		return "", err
+	}
+
+	return string(script), nil
+}
+
+// CreateShare mints a share token for a conversation. If expiresIn is
+// positive, the share expires after that many seconds.
+func (c *Client) CreateShare(convoID string, expiresIn int) (*say.Share, error) {
+	var share say.Share
+
+	form := url.Values{}
+	if expiresIn > 0 {
+		form.Set("expires_in", strconv.Itoa(expiresIn))
+	}
+
+	_, err := c.execute(app.Routes.CreateShare, &say.Conversation{ID: convoID}, &form, &share)
+	if err != nil {
+		return nil, err
+	}
+
+	return &share, nil
+}
+
+func (c *Client) ListShares(convoID string) ([]say.Share, error) {
+	var res struct {
+		Data []say.Share `json:"data"`
+	}
+
+	_, err := c.execute(app.Routes.ListShares, &say.Conversation{ID: convoID}, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Data, nil
+}
+
+func (c *Client) RevokeShare(convoID, shareID string) error {
 	vars := varmap((&say.Conversation{ID: convoID}).Vars())
-	vars["line"] = lineID
+	vars["share"] = shareID
 
-	_, err := c.execute(app.Routes.DeleteLine, vars, nil, nil)
+	_, err := c.execute(app.Routes.RevokeShare, vars, nil, nil)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// GetShared returns the conversation shared by a share token. It does
+// not require authorization.
+func (c *Client) GetShared(token string) (*say.Conversation, error) {
+	var convo say.Conversation
+
+	_, err := c.execute(app.Routes.GetShared, varmap{"token": token}, nil, &convo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &convo, nil
+}
+
+// CreateCharacter adds a character to a conversation. Empty fields
+// take their defaults.
+func (c *Client) CreateCharacter(convoID string, character *say.Character) error {
+	form, err := query.Values(character)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.execute(app.Routes.CreateCharacter, &say.Conversation{ID: convoID}, &form, character)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) ListCharacters(convoID string) ([]say.Character, error) {
+	var res struct {
+		Data []say.Character `json:"data"`
+	}
+
+	_, err := c.execute(app.Routes.ListCharacters, &say.Conversation{ID: convoID}, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Data, nil
+}
+
+func (c *Client) DeleteCharacter(convoID, characterID string) error {
+	vars := varmap((&say.Conversation{ID: convoID}).Vars())
+	vars["character"] = characterID
+
+	_, err := c.execute(app.Routes.DeleteCharacter, vars, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CreateInvite mints an invite token granting the role in a
+// conversation. An empty role invites a viewer.
+func (c *Client) CreateInvite(convoID, role string) (*say.Invite, error) {
+	var invite say.Invite
+
+	form := url.Values{}
+	if role != "" {
+		form.Set("role", role)
+	}
+
+	_, err := c.execute(app.Routes.CreateInvite, &say.Conversation{ID: convoID}, &form, &invite)
+	if err != nil {
+		return nil, err
+	}
+
+	return &invite, nil
+}
+
+func (c *Client) ListInvites(convoID string) ([]say.Invite, error) {
+	var res struct {
+		Data []say.Invite `json:"data"`
+	}
+
+	_, err := c.execute(app.Routes.ListInvites, &say.Conversation{ID: convoID}, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Data, nil
+}
+
+func (c *Client) RevokeInvite(convoID, inviteID string) error {
+	vars := varmap((&say.Conversation{ID: convoID}).Vars())
+	vars["invite"] = inviteID
+
+	_, err := c.execute(app.Routes.RevokeInvite, vars, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AcceptInvite makes you a member of the conversation of an invite
+// token and returns the conversation without its lines.
+func (c *Client) AcceptInvite(token string) (*say.Conversation, error) {
+	var convo say.Conversation
+
+	_, err := c.execute(app.Routes.AcceptInvite, varmap{"token": token}, nil, &convo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &convo, nil
+}
+
+func (c *Client) ListMembers(convoID string) ([]say.Member, error) {
+	var res struct {
+		Data []say.Member `json:"data"`
+	}
+
+	_, err := c.execute(app.Routes.ListMembers, &say.Conversation{ID: convoID}, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Data, nil
+}
+
+func (c *Client) UpdateMember(convoID, memberID, role string) (*say.Member, error) {
+	var member say.Member
+
+	vars := varmap((&say.Conversation{ID: convoID}).Vars())
+	vars["member"] = memberID
+
+	form := url.Values{"role": {role}}
+	_, err := c.execute(app.Routes.UpdateMember, vars, &form, &member)
+	if err != nil {
+		return nil, err
+	}
+
+	return &member, nil
+}
+
+// DeleteMember removes a member from a conversation. Members other
+// than owners can only remove themselves.
+func (c *Client) DeleteMember(convoID, memberID string) error {
+	vars := varmap((&say.Conversation{ID: convoID}).Vars())
+	vars["member"] = memberID
+
+	_, err := c.execute(app.Routes.DeleteMember, vars, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CreateWebhook registers a URL to receive the events of every
+// conversation you are a member of. The returned webhook includes its signing secret.
+func (c *Client) CreateWebhook(endpoint string) (*say.Webhook, error) {
+	var hook say.Webhook
+
+	form := url.Values{"url": {endpoint}}
+	_, err := c.execute(app.Routes.CreateWebhook, nil, &form, &hook)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
+func (c *Client) ListWebhooks() ([]say.Webhook, error) {
+	var res struct {
+		Data []say.Webhook `json:"data"`
+	}
+
+	_, err := c.execute(app.Routes.ListWebhooks, nil, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Data, nil
+}
+
+func (c *Client) DeleteWebhook(id string) error {
+	_, err := c.execute(app.Routes.DeleteWebhook, &say.Webhook{ID: id}, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ListDeliveries lists the deliveries of events to a webhook, most
+// recent first.
+func (c *Client) ListDeliveries(webhookID string, params ListParams) *WebhookDeliveryIter {
+	return &WebhookDeliveryIter{c.iter(app.Routes.ListDeliveries, &say.Webhook{ID: webhookID}, params, say.WebhookDelivery{})}
+}
+
+func (c *Client) DeleteConversation(id string) error {
+	_, err := c.execute(app.Routes.DeleteConversation, &say.Conversation{ID: id}, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) CreateLine(convoID string, line *say.Line) error {
+	form, err := query.Values(line)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.execute(app.Routes.CreateLine, &say.Conversation{ID: convoID}, &form, line)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CreateCowsayLine appends a line to a conversation from a cowsay or
+// cowthink command such as `cowsay -f tux -d hello`.
+func (c *Client) CreateCowsayLine(convoID, command string) (*say.Line, error) {
+	var line say.Line
+	form := url.Values{"command": {command}}
+
+	_, err := c.execute(app.Routes.CreateCowsayLine, &say.Conversation{ID: convoID}, &form, &line)
+	if err != nil {
+		return nil, err
+	}
+
+	return &line, nil
+}
+
+// ListLines lists the lines of a conversation in order.
+func (c *Client) ListLines(convoID string, params ListParams) *LineIter {
+	return &LineIter{c.iter(app.Routes.ListLines, &say.Conversation{ID: convoID}, params, say.Line{})}
+}
+
+// Search lists the conversations and lines matching a full-text
+// search, best matches first.
+func (c *Client) Search(params SearchParams) *SearchHitIter {
+	it := c.iter(app.Routes.Search, nil, params.ListParams, say.SearchHit{})
+	it.filters, it.err = query.Values(params)
+	return &SearchHitIter{it}
+}
+
+// CreateLines appends lines to a conversation in a single request,
+// setting the ID and Output of each. No lines are created if any line
+// is invalid.
+func (c *Client) CreateLines(convoID string, lines []say.Line) error {
+	batch := make([]say.BatchLine, len(lines))
+	for i := range lines {
+		line := &lines[i]
+		batch[i] = say.BatchLine{
+			Animal:   &line.Animal,
+			Think:    &line.Think,
+			Width:    &line.Width,
+			MoodName: &line.MoodName,
+			Text:     &line.Text,
+		}
+	}
+
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	form := url.Values{"lines": {string(data)}}
+
+	var res struct {
+		Data []say.Line `json:"data"`
+	}
+
+	_, err = c.execute(app.Routes.CreateLines, &say.Conversation{ID: convoID}, &form, &res)
+	if err != nil {
+		return err
+	}
+	copy(lines, res.Data)
+
+	return nil
+}
+
+// InsertLine creates a line immediately before or after another line
+// in the conversation.
+func (c *Client) InsertLine(convoID string, line *say.Line, pos say.LinePosition) error {
+	form, err := query.Values(line)
+	if err != nil {
+		return err
+	}
+
+	posForm, err := query.Values(pos)
+	if err != nil {
+		return err
+	}
+	for k, v := range posForm {
+		form[k] = v
+	}
+
+	_, err = c.execute(app.Routes.CreateLine, &say.Conversation{ID: convoID}, &form, line)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CreateRandomLine creates a line with a `random` or `random:<set>`
+// mood chosen deterministically from the seed. The chosen mood is
+// stored in the line's MoodName.
+func (c *Client) CreateRandomLine(convoID string, line *say.Line, seed int64) error {
+	form, err := query.Values(line)
+	if err != nil {
+		return err
+	}
+	form.Set("seed", strconv.FormatInt(seed, 10))
+
+	_, err = c.execute(app.Routes.CreateLine, &say.Conversation{ID: convoID}, &form, line)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) GetLine(convoID, lineID string) (*say.Line, error) {
+	var line say.Line
+
+	vars := varmap((&say.Conversation{ID: convoID}).Vars())
+	vars["line"] = lineID
+
+	_, err := c.execute(app.Routes.GetLine, vars, nil, &line)
+	if err != nil {
+		return nil, err
+	}
+
+	return &line, nil
+}
+
+// LineUpdateParams describes changes to a Line. Only non-nil fields
+// are changed.
+type LineUpdateParams struct {
+	Animal   *string `url:"animal,omitempty"`
+	Think    *bool   `url:"think,omitempty"`
+	MoodName *string `url:"mood,omitempty"`
+	Text     *string `url:"text,omitempty"`
+}
+
+func (c *Client) UpdateLine(convoID, lineID string, params LineUpdateParams) (*say.Line, error) {
+	var line say.Line
+
+	form, err := query.Values(params)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := varmap((&say.Conversation{ID: convoID}).Vars())
+	vars["line"] = lineID
+
+	_, err = c.execute(app.Routes.UpdateLine, vars, &form, &line)
+	if err != nil {
+		return nil, err
+	}
+
+	return &line, nil
+}
+
+// MoveLine places a line immediately before or after another line in
+// the conversation.
+func (c *Client) MoveLine(convoID, lineID string, pos say.LinePosition) (*say.Line, error) {
+	var line say.Line
+
+	form, err := query.Values(pos)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := varmap((&say.Conversation{ID: convoID}).Vars())
+	vars["line"] = lineID
+
+	_, err = c.execute(app.Routes.MoveLine, vars, &form, &line)
+	if err != nil {
+		return nil, err
+	}
+
+	return &line, nil
+}
+
+// ListConversationRevisions returns the prior headings of a
+// conversation from oldest to newest.
+func (c *Client) ListConversationRevisions(convoID string) ([]say.ConversationRevision, error) {
+	var res struct {
+		Data []say.ConversationRevision `json:"data"`
+	}
+
+	_, err := c.execute(app.Routes.ListConversationRevisions, &say.Conversation{ID: convoID}, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Data, nil
+}
+
+// ListLineRevisions returns the prior versions of a line from oldest
+// to newest.
+func (c *Client) ListLineRevisions(convoID, lineID string) ([]say.LineRevision, error) {
+	var res struct {
+		Data []say.LineRevision `json:"data"`
+	}
+
+	vars := varmap((&say.Conversation{ID: convoID}).Vars())
+	vars["line"] = lineID
+
+	_, err := c.execute(app.Routes.ListLineRevisions, vars, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Data, nil
+}
+
+func (c *Client) DeleteLine(convoID, lineID string) error {
+	vars := varmap((&say.Conversation{ID: convoID}).Vars())
+	vars["line"] = lineID
+
+	_, err := c.execute(app.Routes.DeleteLine, vars, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RestoreLine takes a deleted line out of the trash.
+func (c *Client) RestoreLine(convoID, lineID string) (*say.Line, error) {
+	var line say.Line
+
+	vars := varmap((&say.Conversation{ID: convoID}).Vars())
+	vars["line"] = lineID
+
+	_, err := c.execute(app.Routes.RestoreLine, vars, nil, &line)
+	if err != nil {
+		return nil, err
+	}
+
+	return &line, nil
+}
+
+// RestoreConversation takes a deleted conversation out of the trash.
+func (c *Client) RestoreConversation(id string) (*say.Conversation, error) {
+	convo := say.Conversation{ID: id}
+
+	_, err := c.execute(app.Routes.RestoreConversation, &convo, nil, &convo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &convo, nil
+}
+
+// ListTrash lists deleted conversations and lines, most recently
+// deleted first.
+func (c *Client) ListTrash(params ListParams) *TrashItemIter {
+	return &TrashItemIter{c.iter(app.Routes.ListTrash, nil, params, say.TrashItem{})}
+}
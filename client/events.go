@@ -0,0 +1,97 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/metcalf/saypi/app"
+	"github.com/metcalf/saypi/say"
+)
+
+// EventStream reads the Server-Sent Events of a conversation as they
+// happen.
+type EventStream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+	lastID string
+}
+
+// StreamEvents opens a stream of the changes to a conversation. If
+// lastEventID is not empty, the stream resumes after that event.
+func (c *Client) StreamEvents(convoID, lastEventID string) (*EventStream, error) {
+	req, err := c.NewRequest(app.Routes.StreamEvents, &say.Conversation{ID: convoID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := responseError(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return &EventStream{
+		body:   resp.Body,
+		reader: bufio.NewReader(resp.Body),
+		lastID: lastEventID,
+	}, nil
+}
+
+// Next blocks until the next event arrives. It returns io.EOF once
+// the server ends the stream, after which the stream can be resumed
+// from LastID.
+func (s *EventStream) Next() (*say.Event, error) {
+	var ev say.Event
+	var data []string
+
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		if line == "" {
+			if ev.Type == "" && data == nil {
+				continue
+			}
+			ev.Data = []byte(strings.Join(data, "\n"))
+			if ev.ID != "" {
+				s.lastID = ev.ID
+			}
+			return &ev, nil
+		}
+
+		// Lines starting with a colon are comments
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			ev.ID = value
+		case "event":
+			ev.Type = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
+
+// LastID returns the ID of the last event read from the stream.
+func (s *EventStream) LastID() string {
+	return s.lastID
+}
+
+// Close ends the stream.
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
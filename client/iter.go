@@ -2,6 +2,7 @@ package client
 
 import (
 	"encoding/json"
+	"net/url"
 	"reflect"
 
 	"github.com/google/go-querystring/query"
@@ -9,9 +10,44 @@ import (
 )
 
 type ListParams struct {
-	After  string `url:"ending_after"`
-	Before string `url:"starting_before"`
-	Limit  int
+	After  string `url:"starting_after,omitempty"`
+	Before string `url:"ending_before,omitempty"`
+	Limit  int    `url:"limit,omitempty"`
+}
+
+// MoodListParams filters and orders a list of Moods.
+type MoodListParams struct {
+	ListParams `url:"-"`
+
+	// UserDefined restricts the list to user-defined (true) or
+	// built-in (false) moods when set.
+	UserDefined  *bool  `url:"user_defined,omitempty"`
+	NamePrefix   string `url:"name_prefix,omitempty"`
+	NameContains string `url:"name_contains,omitempty"`
+	// Sort is either "created" (the default) or "name".
+	Sort string `url:"sort,omitempty"`
+}
+
+// GalleryListParams filters and orders a list of PublishedMoods.
+type GalleryListParams struct {
+	ListParams `url:"-"`
+
+	// Query matches part of the mood or publisher name.
+	Query     string `url:"q,omitempty"`
+	Publisher string `url:"publisher,omitempty"`
+	// Installed restricts the list to moods you installed, including
+	// any that have since been unpublished.
+	Installed bool `url:"installed,omitempty"`
+	// Sort is either "created" (the default) or "installs".
+	Sort string `url:"sort,omitempty"`
+}
+
+// SearchParams describes a full-text search of conversations and
+// lines.
+type SearchParams struct {
+	ListParams `url:"-"`
+
+	Query string `url:"q"`
 }
 
 type listResponse struct {
@@ -26,6 +62,7 @@ type Iter struct {
 	route      Route
 	vars       Vars
 	params     ListParams
+	filters    url.Values
 	hasMore    bool
 	values     reflect.Value
 	valuesType reflect.Type
@@ -57,11 +94,61 @@ func (it *ConversationIter) Conversation() say.Conversation {
 	return it.Current().(say.Conversation)
 }
 
+// LineIter is an iterator for lists of Lines. The embedded Iter
+// carries methods with it; see its documentation for details.
+type LineIter struct {
+	*Iter
+}
+
+// Line returns the most recent Line visited by a call to Next.
+func (it *LineIter) Line() say.Line {
+	return it.Current().(say.Line)
+}
+
+// SearchHitIter is an iterator for lists of SearchHits. The embedded
+// Iter carries methods with it; see its documentation for details.
+type SearchHitIter struct {
+	*Iter
+}
+
+// SearchHit returns the most recent SearchHit visited by a call to
+// Next.
+func (it *SearchHitIter) SearchHit() say.SearchHit {
+	return it.Current().(say.SearchHit)
+}
+
+// MoodSetIter is an iterator for lists of MoodSets. The embedded Iter
+// carries methods with it; see its documentation for details.
+type MoodSetIter struct {
+	*Iter
+}
+
+// MoodSet returns the most recent MoodSet visited by a call to Next.
+func (it *MoodSetIter) MoodSet() say.MoodSet {
+	return it.Current().(say.MoodSet)
+}
+
+// PublishedMoodIter is an iterator for lists of PublishedMoods. The
+// embedded Iter carries methods with it; see its documentation for
+// details.
+type PublishedMoodIter struct {
+	*Iter
+}
+
+// PublishedMood returns the most recent PublishedMood visited by a
+// call to Next.
+func (it *PublishedMoodIter) PublishedMood() say.PublishedMood {
+	return it.Current().(say.PublishedMood)
+}
+
 func (it *Iter) getPage() error {
 	form, err := query.Values(it.params)
 	if err != nil {
 		return err
 	}
+	for k, v := range it.filters {
+		form[k] = v
+	}
 
 	var listRes listResponse
 
@@ -71,10 +158,10 @@ func (it *Iter) getPage() error {
 	}
 
 	it.hasMore = listRes.HasMore
-	if it.params.After != "" {
-		it.params.After = listRes.Cursor
-	} else {
+	if it.params.Before != "" {
 		it.params.Before = listRes.Cursor
+	} else {
+		it.params.After = listRes.Cursor
 	}
 
 	// Create a pointer to a slice value and set it to the slice
@@ -137,3 +224,28 @@ func (c *Client) iter(rt Route, rtVars Vars, params ListParams, item interface{}
 		valuesType: tp,
 	}
 }
+
+// TrashItemIter is an iterator for lists of TrashItems. The embedded
+// Iter carries methods with it; see its documentation for details.
+type TrashItemIter struct {
+	*Iter
+}
+
+// TrashItem returns the most recent TrashItem visited by a call to
+// Next.
+func (it *TrashItemIter) TrashItem() say.TrashItem {
+	return it.Current().(say.TrashItem)
+}
+
+// WebhookDeliveryIter is an iterator for lists of WebhookDeliveries.
+// The embedded Iter carries methods with it; see its documentation for
+// details.
+type WebhookDeliveryIter struct {
+	*Iter
+}
+
+// WebhookDelivery returns the most recent WebhookDelivery visited by a
+// call to Next.
+func (it *WebhookDeliveryIter) WebhookDelivery() say.WebhookDelivery {
+	return it.Current().(say.WebhookDelivery)
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"net/url"
+
+	"github.com/metcalf/saypi/app"
+	"github.com/metcalf/saypi/say"
+
+	"golang.org/x/net/websocket"
+)
+
+// Session is a connection to the live session of a conversation.
+type Session struct {
+	ws *websocket.Conn
+}
+
+// JoinSession connects to the live session of a conversation. The
+// name, if not empty, is shown to the other members.
+func (c *Client) JoinSession(convoID, name string) (*Session, error) {
+	var form *url.Values
+	if name != "" {
+		form = &url.Values{"name": {name}}
+	}
+
+	req, err := c.NewRequest(app.Routes.JoinSession, &say.Conversation{ID: convoID}, form)
+	if err != nil {
+		return nil, err
+	}
+
+	loc := *req.URL
+	if loc.Scheme == "https" {
+		loc.Scheme = "wss"
+	} else {
+		loc.Scheme = "ws"
+	}
+
+	cfg, err := websocket.NewConfig(loc.String(), c.baseURL.String())
+	if err != nil {
+		return nil, err
+	}
+	cfg.Header = req.Header
+
+	ws, err := websocket.DialConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{ws}, nil
+}
+
+// CreateLine asks the session to append a line to the conversation.
+// The reply, either the created line or an error, carries the given
+// ref.
+func (s *Session) CreateLine(ref string, line *say.Line) error {
+	return websocket.JSON.Send(s.ws, say.SessionRequest{
+		Type: say.SessionLine,
+		Ref:  ref,
+		Line: &say.BatchLine{
+			Animal:    &line.Animal,
+			Think:     &line.Think,
+			Width:     &line.Width,
+			MoodName:  &line.MoodName,
+			Text:      &line.Text,
+			Character: &line.Character,
+		},
+	})
+}
+
+// SetTyping tells the other members whether you are typing.
+func (s *Session) SetTyping(typing bool) error {
+	return websocket.JSON.Send(s.ws, say.SessionRequest{
+		Type:   say.SessionTyping,
+		Typing: typing,
+	})
+}
+
+// Receive blocks until the next message from the session arrives.
+func (s *Session) Receive() (*say.SessionMessage, error) {
+	var msg say.SessionMessage
+	if err := websocket.JSON.Receive(s.ws, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Close leaves the session.
+func (s *Session) Close() error {
+	return s.ws.Close()
+}
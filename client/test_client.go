@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"time"
 
 	"github.com/metcalf/saypi/app"
 	"github.com/metcalf/saypi/apptest"
@@ -15,6 +17,7 @@ import (
 
 type TestClient struct {
 	Client
+	App     *app.App
 	closers []io.Closer
 }
 
@@ -38,6 +41,64 @@ func NewTestClient(cfg *app.Configuration) (*TestClient, error) {
 	base := url.URL{}
 	cli.baseURL = &base
 
+	if err := cli.initApp(cfg); err != nil {
+		return nil, err
+	}
+
+	cli.do = func(req *http.Request) (*http.Response, error) {
+		rr := httptest.NewRecorder()
+		cli.App.ServeHTTP(rr, req)
+
+		resp := http.Response{
+			Status:        fmt.Sprintf("%d %s", rr.Code, http.StatusText(rr.Code)),
+			StatusCode:    rr.Code,
+			Body:          ioutil.NopCloser(rr.Body),
+			Header:        rr.HeaderMap,
+			ContentLength: int64(rr.Body.Len()),
+			Request:       req,
+		}
+
+		return &resp, nil
+	}
+
+	return &cli, nil
+}
+
+// NewTestServer is like NewTestClient but serves the app over a local
+// HTTP server so that responses such as event streams are delivered
+// as they are written.
+func NewTestServer(cfg *app.Configuration) (*TestClient, error) {
+	var cli TestClient
+
+	if err := cli.initApp(cfg); err != nil {
+		return nil, err
+	}
+
+	srv := httptest.NewServer(cli.App)
+	// Close the server before the app so that it isn't waiting on
+	// requests to a closed app.
+	cli.closers = append([]io.Closer{closerFunc(func() error {
+		cli.App.CloseStreams()
+		srv.Close()
+		return nil
+	})}, cli.closers...)
+
+	base, err := url.Parse(srv.URL)
+	if err != nil {
+		cli.Close()
+		return nil, err
+	}
+	cli.baseURL = base
+	cli.do = http.DefaultClient.Do
+
+	return &cli, nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+func (c *TestClient) initApp(cfg *app.Configuration) error {
 	if cfg == nil {
 		cfg = &app.Configuration{}
 	}
@@ -51,43 +112,58 @@ func NewTestClient(cfg *app.Configuration) (*TestClient, error) {
 	if cfg.IPRateBurst == 0 {
 		cfg.IPRateBurst = 100000
 	}
+	if cfg.SharePerMinute == 0 {
+		cfg.SharePerMinute = 100000
+	}
+	if cfg.ShareRateBurst == 0 {
+		cfg.ShareRateBurst = 100000
+	}
+	if cfg.SessionPerMinute == 0 {
+		cfg.SessionPerMinute = 100000
+	}
+	if cfg.SessionRateBurst == 0 {
+		cfg.SessionRateBurst = 100000
+	}
+	if cfg.WebhookInterval == 0 {
+		cfg.WebhookInterval = 50 * time.Millisecond
+	}
+	if cfg.WebhookRetryDelay == 0 {
+		cfg.WebhookRetryDelay = 10 * time.Millisecond
+	}
+	if cfg.WebhookAllowedNets == nil {
+		// Test receivers listen on loopback addresses
+		var nets []*net.IPNet
+		for _, cidr := range []string{"127.0.0.0/8", "::1/128"} {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return err
+			}
+			nets = append(nets, ipNet)
+		}
+		cfg.WebhookAllowedNets = nets
+	}
 
 	if cfg.DBDSN == "" {
 		tdb, db, err := dbutil.NewTestDB()
 		if err != nil {
-			return nil, err
+			return err
 		}
 		// We don't need the db handle
 		if err := db.Close(); err != nil {
-			return nil, err
+			return err
 		}
-		cli.closers = append(cli.closers, tdb)
+		c.closers = append(c.closers, tdb)
 
 		cfg.DBDSN = dbutil.DefaultDataSource + " dbname=" + tdb.Name()
 	}
 
 	a, err := app.New(cfg)
 	if err != nil {
-		cli.Close()
-		return nil, err
+		c.Close()
+		return err
 	}
-	cli.closers = append(cli.closers, a)
+	c.App = a
+	c.closers = append(c.closers, a)
 
-	cli.do = func(req *http.Request) (*http.Response, error) {
-		rr := httptest.NewRecorder()
-		a.ServeHTTP(rr, req)
-
-		resp := http.Response{
-			Status:        fmt.Sprintf("%d %s", rr.Code, http.StatusText(rr.Code)),
-			StatusCode:    rr.Code,
-			Body:          ioutil.NopCloser(rr.Body),
-			Header:        rr.HeaderMap,
-			ContentLength: int64(rr.Body.Len()),
-			Request:       req,
-		}
-
-		return &resp, nil
-	}
-
-	return &cli, nil
+	return nil
 }
@@ -22,9 +22,19 @@ var DefaultDataSource = testdb.Env("TEST_PG", "sslmode=disable")
 // NewTestDB connects to the default DBMS, creates a new database using testdb,
 // and loads the application's schema.
 func NewTestDB() (*testdb.TestDB, *sqlx.DB, error) {
-	stmts, err := readSQL("../schema.sql")
-	if err != nil {
-		return nil, nil, err
+	return newTestDB("../schema.sql")
+}
+
+// newTestDB creates a new database using testdb and runs the
+// statements of each file in it in order.
+func newTestDB(filenames ...string) (*testdb.TestDB, *sqlx.DB, error) {
+	var stmts []string
+	for _, filename := range filenames {
+		fileStmts, err := readSQL(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		stmts = append(stmts, fileStmts...)
 	}
 
 	tdb, err := testdb.Open(DriverName, DefaultDataSource+" dbname=postgres")
@@ -5,6 +5,8 @@ import (
 	"os"
 	"reflect"
 	"testing"
+
+	"github.com/jmoiron/sqlx"
 )
 
 var testSQL = []string{
@@ -49,3 +51,107 @@ func TestSchemaApplies(t *testing.T) {
 	defer tdb.Close()
 	defer db.Close()
 }
+
+func TestMigrationMatchesSchema(t *testing.T) {
+	tdb, db, err := newTestDB("testdata/original_schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	defer db.Close()
+
+	for _, stmt := range []string{
+		`INSERT INTO conversations (public_id, heading, user_id) VALUES ('cv_1', 'old', 'u')`,
+		`INSERT INTO lines (public_id, animal, text, think, mood_name, conversation_id)
+		 SELECT 'ln_' || n, 'default', 'hello', false, 'default', id
+		 FROM conversations, generate_series(1, 2) n`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Applied the way the migration's instructions say
+	stmts, err := readSQL("../migrations/001_upgrade_original_schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			t.Fatalf("%s\nExecuting: %s", err, stmt)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	freshTDB, fresh, err := NewTestDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer freshTDB.Close()
+	defer fresh.Close()
+
+	migrated, err := describeSchema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect, err := describeSchema(fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(migrated, expect) {
+		t.Errorf("expected the migrated schema\n\t%v\nto match\n\t%v", migrated, expect)
+	}
+
+	var owners int
+	if err := db.Get(&owners, `SELECT count(*) FROM members WHERE user_id = 'u' AND role = 'owner'`); err != nil {
+		t.Fatal(err)
+	}
+	if owners != 1 {
+		t.Errorf("expected the creator to own the conversation but got %d owners", owners)
+	}
+
+	var positions []int
+	if err := db.Select(&positions, `SELECT position FROM lines ORDER BY id`); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(positions, []int{0, 1}) {
+		t.Errorf("expected lines to be positioned in order but got %v", positions)
+	}
+
+	var textBytes int
+	if err := db.Get(&textBytes, `SELECT text_bytes FROM conversations`); err != nil {
+		t.Fatal(err)
+	}
+	if textBytes != 10 {
+		t.Errorf("expected 10 bytes of text but got %d", textBytes)
+	}
+}
+
+// describeSchema lists the columns, indexes and constraints of the
+// database's tables in a comparable form.
+func describeSchema(db *sqlx.DB) ([]string, error) {
+	var desc []string
+	for _, query := range []string{
+		`SELECT concat_ws(' ', table_name, column_name, data_type, is_nullable, column_default)
+		 FROM information_schema.columns WHERE table_schema = 'public'`,
+		`SELECT indexdef FROM pg_indexes WHERE schemaname = 'public'`,
+		`SELECT concat_ws(' ', conrelid::regclass, conname, pg_get_constraintdef(pg_constraint.oid))
+		 FROM pg_constraint
+		 INNER JOIN pg_namespace ON connamespace = pg_namespace.oid
+		 WHERE nspname = 'public'`,
+	} {
+		var rows []string
+		if err := db.Select(&rows, query+" ORDER BY 1"); err != nil {
+			return nil, err
+		}
+		desc = append(desc, rows...)
+	}
+	return desc, nil
+}
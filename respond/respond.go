@@ -84,6 +84,20 @@ func Data(ctx context.Context, w http.ResponseWriter, status int, data interface
 	}
 }
 
+// Raw returns a response with the provided body, content type and
+// HTTP status code.
+func Raw(ctx context.Context, w http.ResponseWriter, status int, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+
+	if _, err := w.Write(body); isBrokenPipe(err) {
+		reqlog.Print(ctx, "unable to respond to client. event=respond_broken_pipe")
+		metrics.Increment("respond_broken_pipe")
+	} else if err != nil {
+		panic(err)
+	}
+}
+
 // UserError returns a JSON response for the provided UserError and
 // HTTP status code.
 func UserError(ctx context.Context, w http.ResponseWriter, status int, uerr usererrors.UserError) {
@@ -0,0 +1,239 @@
+package say
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/sentiment"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	autoMoodName      = "auto"
+	maxSentimentMoods = 20
+	minSentimentScore = -1
+	maxSentimentScore = 1
+)
+
+// SentimentMood chooses Mood for lines created with `mood=auto` whose
+// text has a sentiment score of at least MinScore.
+type SentimentMood struct {
+	MinScore float64 `json:"min_score"`
+	Mood     string  `json:"mood"`
+}
+
+// SentimentMoods maps ranges of sentiment scores to moods. Ranges are
+// ordered by MinScore and scores below the first range use its mood.
+type SentimentMoods struct {
+	Ranges      []SentimentMood `json:"ranges"`
+	UserDefined bool            `json:"user_defined"`
+}
+
+type byMinScore []SentimentMood
+
+func (s byMinScore) Len() int           { return len(s) }
+func (s byMinScore) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byMinScore) Less(i, j int) bool { return s[i].MinScore < s[j].MinScore }
+
+// defaultSentimentMoods is used until a user configures their own,
+// less any ranges whose moods are missing from the built-in catalog.
+var defaultSentimentMoods = []SentimentMood{
+	{MinScore: -1, Mood: "dead"},
+	{MinScore: -0.5, Mood: "tired"},
+	{MinScore: -0.05, Mood: "default"},
+	{MinScore: 0.05, Mood: "young"},
+	{MinScore: 0.5, Mood: "wired"},
+}
+
+// catalogSentimentMoods returns the default sentiment moods whose
+// moods are in the repository's catalog of built-in moods. Scores in
+// the range of a missing mood use the range below it instead. The
+// catalog always defines "default" so at least one range remains.
+func catalogSentimentMoods(repo *repository) []SentimentMood {
+	var ranges []SentimentMood
+	for _, rng := range defaultSentimentMoods {
+		if repo.isBuiltin(rng.Mood) {
+			ranges = append(ranges, rng)
+		}
+	}
+	ranges[0].MinScore = minSentimentScore
+
+	return ranges
+}
+
+// isReservedMoodName reports whether name has a special meaning when
+// creating lines and therefore cannot be used for a mood.
+func isReservedMoodName(name string) bool {
+	_, ok := parseRandomMood(name)
+	return ok || strings.EqualFold(name, autoMoodName) || strings.HasPrefix(name, "@")
+}
+
+// pickSentimentMood returns the name of the mood for score from ranges
+// ordered by MinScore.
+func pickSentimentMood(ranges []SentimentMood, score float64) string {
+	name := ranges[0].Mood
+	for _, rng := range ranges[1:] {
+		if score < rng.MinScore {
+			break
+		}
+		name = rng.Mood
+	}
+	return name
+}
+
+func (c *Controller) getSentimentMoods(userID string) (*SentimentMoods, error) {
+	ranges, err := c.repo.GetSentimentMoods(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		return &SentimentMoods{Ranges: c.sentimentMoods}, nil
+	}
+
+	return &SentimentMoods{Ranges: ranges, UserDefined: true}, nil
+}
+
+// autoMood scores text and finds the mood the user has mapped to the
+// score.
+func (c *Controller) autoMood(userID, text string) (*Mood, float64, usererrors.InvalidParams, error) {
+	score := sentiment.Score(text)
+
+	moods, err := c.getSentimentMoods(userID)
+	if err != nil {
+		return nil, score, nil, err
+	}
+
+	name := pickSentimentMood(moods.Ranges, score)
+	mood, err := c.repo.GetMood(userID, name)
+	if err != nil {
+		return nil, score, nil, err
+	}
+	if mood == nil {
+		return nil, score, usererrors.InvalidParams{{
+			Params:  []string{"mood"},
+			Message: fmt.Sprintf("text has a sentiment score of %g but its mood %q does not exist", score, name),
+		}}, nil
+	}
+
+	return mood, score, nil, nil
+}
+
+func (c *Controller) GetSentimentMoods(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	moods, err := c.getSentimentMoods(userID)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, moods)
+}
+
+// SetSentimentMoods replaces the user's sentiment moods. Each `ranges`
+// parameter has the form `<mood>:<min_score>`.
+func (c *Controller) SetSentimentMoods(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	r.ParseForm()
+	values := r.PostForm["ranges"]
+
+	var uerr usererrors.InvalidParams
+	if len(values) == 0 {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"ranges"},
+			Message: "must include at least one range",
+		})
+	} else if len(values) > maxSentimentMoods {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"ranges"},
+			Message: fmt.Sprintf("must include no more than %d ranges", maxSentimentMoods),
+		})
+	}
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	ranges := make([]SentimentMood, 0, len(values))
+	seen := make(map[float64]bool, len(values))
+	for _, value := range values {
+		value = strings.ToLower(strings.Replace(value, "\x00", "", -1))
+
+		i := strings.LastIndex(value, ":")
+		if i < 0 {
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"ranges"},
+				Message: fmt.Sprintf("%q must have the form <mood>:<min_score>", value),
+			})
+			continue
+		}
+
+		rng := SentimentMood{Mood: value[:i]}
+		var err error
+		rng.MinScore, err = strconv.ParseFloat(value[i+1:], 64)
+		if err != nil || rng.MinScore < minSentimentScore || rng.MinScore > maxSentimentScore {
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"ranges"},
+				Message: fmt.Sprintf("minimum score for %q must be a number from %d to %d", rng.Mood, minSentimentScore, maxSentimentScore),
+			})
+			continue
+		}
+
+		if seen[rng.MinScore] {
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"ranges"},
+				Message: fmt.Sprintf("minimum score %s is included more than once", value[i+1:]),
+			})
+			continue
+		}
+		seen[rng.MinScore] = true
+
+		mood, err := c.repo.GetMood(userID, rng.Mood)
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+		if mood == nil {
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"ranges"},
+				Message: fmt.Sprintf("%q does not exist", rng.Mood),
+			})
+			continue
+		}
+
+		ranges = append(ranges, rng)
+	}
+
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	sort.Sort(byMinScore(ranges))
+
+	if err := c.repo.SetSentimentMoods(userID, ranges); err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, SentimentMoods{Ranges: ranges, UserDefined: true})
+}
+
+// DeleteSentimentMoods restores the default sentiment moods.
+func (c *Controller) DeleteSentimentMoods(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	if err := c.repo.ClearSentimentMoods(userID); err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,50 @@
+package say
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPickSentimentMood(t *testing.T) {
+	cases := []struct {
+		score float64
+		mood  string
+	}{
+		{-1, "dead"},
+		{-0.7, "dead"},
+		{-0.5, "tired"},
+		{0, "default"},
+		{0.05, "young"},
+		{0.49, "young"},
+		{1, "wired"},
+	}
+
+	for i, testcase := range cases {
+		if mood := pickSentimentMood(defaultSentimentMoods, testcase.score); mood != testcase.mood {
+			t.Errorf("%d: expected %q for score %f but got %q", i, testcase.mood, testcase.score, mood)
+		}
+	}
+
+	ranges := []SentimentMood{{MinScore: 0, Mood: "young"}}
+	if mood := pickSentimentMood(ranges, -1); mood != "young" {
+		t.Errorf("expected scores below the first range to use its mood but got %q", mood)
+	}
+}
+
+func TestCatalogSentimentMoods(t *testing.T) {
+	repo := &repository{builtins: []*Mood{
+		{Name: "default", Eyes: "oo"},
+		{Name: "Tired", Eyes: "--"},
+	}}
+
+	expect := []SentimentMood{
+		{MinScore: -1, Mood: "tired"},
+		{MinScore: -0.05, Mood: "default"},
+	}
+	if ranges := catalogSentimentMoods(repo); !reflect.DeepEqual(ranges, expect) {
+		t.Errorf("expected ranges %#v but got %#v", expect, ranges)
+	}
+	if defaultSentimentMoods[1].MinScore != -0.5 {
+		t.Error("expected the default sentiment moods to be unchanged")
+	}
+}
@@ -0,0 +1,150 @@
+package say
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"goji.io/pat"
+
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+const maxBatchLines = 500
+
+// BatchLine holds the parameters of one line created in a batch. Nil
+// fields take the same defaults as when creating a single line.
+type BatchLine struct {
+	Animal   *string `json:"animal,omitempty"`
+	Think    *bool   `json:"think,omitempty"`
+	Width    *int    `json:"width,omitempty"`
+	MoodName *string `json:"mood,omitempty"`
+	Text     *string `json:"text,omitempty"`
+	Seed     *int64  `json:"seed,omitempty"`
+
+	// Character is the name of one of the conversation's characters.
+	Character *string `json:"character,omitempty"`
+}
+
+// form returns the parameters of the line as they would be provided
+// to CreateLine.
+func (bl *BatchLine) form() url.Values {
+	form := make(url.Values)
+	if bl.Animal != nil {
+		form.Set("animal", *bl.Animal)
+	}
+	if bl.Think != nil {
+		form.Set("think", strconv.FormatBool(*bl.Think))
+	}
+	if bl.Width != nil {
+		form.Set("width", strconv.Itoa(*bl.Width))
+	}
+	if bl.MoodName != nil {
+		form.Set("mood", *bl.MoodName)
+	}
+	if bl.Text != nil {
+		form.Set("text", *bl.Text)
+	}
+	if bl.Seed != nil {
+		form.Set("seed", strconv.FormatInt(*bl.Seed, 10))
+	}
+	if bl.Character != nil {
+		form.Set("character", *bl.Character)
+	}
+	return form
+}
+
+// CreateLines appends every line in the `lines` parameter to the
+// conversation or none of them. Errors in a line are reported with
+// parameter names qualified by its index, such as `lines[2].mood`.
+func (c *Controller) CreateLines(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	var batch []BatchLine
+	if err := json.Unmarshal([]byte(r.PostFormValue("lines")), &batch); err != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+			Params:  []string{"lines"},
+			Message: "must be an array of lines in JSON format",
+		}})
+		return
+	}
+	if len(batch) == 0 || len(batch) > maxBatchLines {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+			Params:  []string{"lines"},
+			Message: fmt.Sprintf("must contain between 1 and %d lines", maxBatchLines),
+		}})
+		return
+	}
+
+	var uerr usererrors.InvalidParams
+	lines := make([]Line, len(batch))
+	for i, bl := range batch {
+		line := &lines[i]
+		line.Animal = "default"
+		line.MoodName = "default"
+
+		form := bl.form()
+		lineErr, err := c.setCharacter(userID, convoID, form, line)
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+		lineErr = append(lineErr, c.parseLine(form, line)...)
+
+		moodErr, err := c.resolveMood(userID, line, form.Get("seed"))
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+		lineErr = append(lineErr, moodErr...)
+
+		for _, entry := range lineErr {
+			for j, param := range entry.Params {
+				entry.Params[j] = fmt.Sprintf("lines[%d].%s", i, param)
+			}
+			uerr = append(uerr, entry)
+		}
+	}
+
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	events := make([]*changeEvent, len(lines))
+	for i := range lines {
+		var err error
+		lines[i].Output, err = c.renderLine(&lines[i])
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+		events[i] = &changeEvent{Type: EventLineCreated, Data: &lines[i]}
+	}
+
+	if err := c.repo.InsertLines(userID, convoID, lines, events...); err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleEditor)
+		return
+	} else if uerr, ok := err.(QuotaExceeded); ok {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	for _, event := range events {
+		c.publishEvent(ctx, convoID, event)
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Type: "line",
+		Data: lines,
+	})
+}
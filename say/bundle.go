@@ -0,0 +1,431 @@
+package say
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"goji.io/pat"
+
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	bundleVersion  = 1
+	maxBundleLines = 10000
+)
+
+// ConversationBundle is a self-contained copy of a conversation for
+// importing into another account. Moods contains the definition of
+// every mood used by Lines and Characters.
+type ConversationBundle struct {
+	Version    int               `json:"version"`
+	Heading    string            `json:"heading"`
+	Characters []BundleCharacter `json:"characters"`
+	Lines      []BundleLine      `json:"lines"`
+	Moods      []Mood            `json:"moods"`
+}
+
+// BundleCharacter is a character in a ConversationBundle.
+type BundleCharacter struct {
+	Name     string `json:"name"`
+	Animal   string `json:"animal"`
+	MoodName string `json:"mood"`
+	Facing   string `json:"facing"`
+}
+
+// BundleLine is a line in a ConversationBundle. Character is the name
+// of one of the bundle's characters, if any.
+type BundleLine struct {
+	Animal    string   `json:"animal"`
+	Think     bool     `json:"think"`
+	Width     int      `json:"width,omitempty"`
+	MoodName  string   `json:"mood"`
+	Text      string   `json:"text"`
+	Sentiment *float64 `json:"sentiment,omitempty"`
+	Character string   `json:"character,omitempty"`
+}
+
+func (c *Controller) ExportConversation(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	convo, err := c.repo.GetConversation(userID, convoID, -1)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if convo == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	characters, err := c.repo.ListCharacters(userID, convoID)
+	if err == errRecordNotFound {
+		respond.NotFound(ctx, w, r)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	bundle := ConversationBundle{
+		Version:    bundleVersion,
+		Heading:    convo.Heading,
+		Characters: make([]BundleCharacter, len(characters)),
+		Lines:      make([]BundleLine, len(convo.Lines)),
+		Moods:      make([]Mood, 0),
+	}
+
+	seen := make(map[string]bool)
+	for i, line := range convo.Lines {
+		bundle.Lines[i] = BundleLine{
+			Animal:    line.Animal,
+			Think:     line.Think,
+			Width:     line.Width,
+			MoodName:  line.MoodName,
+			Text:      line.Text,
+			Sentiment: line.Sentiment,
+			Character: line.Character,
+		}
+
+		if key := strings.ToLower(line.mood.Name); !seen[key] {
+			seen[key] = true
+			bundle.Moods = append(bundle.Moods, *line.mood)
+		}
+	}
+
+	for i, character := range characters {
+		bundle.Characters[i] = BundleCharacter{
+			Name:     character.Name,
+			Animal:   character.Animal,
+			MoodName: character.MoodName,
+			Facing:   character.Facing,
+		}
+
+		// Random and automatic moods are chosen again on import
+		key := strings.ToLower(character.MoodName)
+		if seen[key] || isPerLineMood(character.MoodName) {
+			continue
+		}
+		seen[key] = true
+
+		mood, err := c.repo.GetMood(userID, character.MoodName)
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+		if mood != nil {
+			bundle.Moods = append(bundle.Moods, *mood)
+		}
+	}
+
+	respond.Data(ctx, w, http.StatusOK, bundle)
+}
+
+// ImportConversation creates a conversation and its characters from
+// the bundle in the `bundle` parameter. Each mood in the bundle is
+// mapped to the user's mood of the same name, if any, and created
+// otherwise.
+func (c *Controller) ImportConversation(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	var bundle ConversationBundle
+	if err := json.Unmarshal([]byte(r.PostFormValue("bundle")), &bundle); err != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+			Params:  []string{"bundle"},
+			Message: "must be a conversation bundle in JSON format",
+		}})
+		return
+	}
+
+	if uerr := c.validateBundle(&bundle); uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	moods, created, uerr, err := c.mapBundleMoods(userID, &bundle)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	characters := make([]*Character, len(bundle.Characters))
+	byName := make(map[string]*Character, len(bundle.Characters))
+	for i, bc := range bundle.Characters {
+		character := &Character{
+			Name:     bc.Name,
+			Animal:   bc.Animal,
+			MoodName: bc.MoodName,
+			Facing:   bc.Facing,
+		}
+		if mood := moods[strings.ToLower(bc.MoodName)]; mood != nil {
+			character.MoodName = mood.Name
+		}
+		characters[i] = character
+		byName[character.Name] = character
+	}
+
+	lines := make([]Line, len(bundle.Lines))
+	for i, bl := range bundle.Lines {
+		mood := moods[strings.ToLower(bl.MoodName)]
+		lines[i] = Line{
+			Animal:    bl.Animal,
+			Think:     bl.Think,
+			Width:     bl.Width,
+			MoodName:  mood.Name,
+			Text:      bl.Text,
+			Sentiment: bl.Sentiment,
+			mood:      mood,
+		}
+		if character := byName[bl.Character]; character != nil {
+			lines[i].Character = character.Name
+			lines[i].character = character
+		}
+	}
+
+	imported := c.convoCreated()
+	convo, err := c.repo.ImportConversation(userID, bundle.Heading, characters, lines, created, imported)
+	if uerr, ok := err.(QuotaExceeded); ok {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	// The lines were rendered for the event
+	c.publishEvent(ctx, convo.ID, imported)
+
+	respond.Data(ctx, w, http.StatusOK, convo)
+}
+
+// validateBundle applies the same limits as creating a conversation,
+// its characters, its lines and its moods, filling in defaults for
+// empty values.
+func (c *Controller) validateBundle(bundle *ConversationBundle) usererrors.InvalidParams {
+	var uerr usererrors.InvalidParams
+	invalid := func(format string, args ...interface{}) {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"bundle"},
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if bundle.Version != bundleVersion {
+		invalid("version must be %d", bundleVersion)
+		return uerr
+	}
+
+	bundle.Heading = strings.Replace(bundle.Heading, "\x00", "", -1)
+	if utf8.RuneCountInString(bundle.Heading) > maxHeadingLength {
+		invalid("heading must be a string of less than %d characters", maxHeadingLength)
+	}
+
+	if len(bundle.Lines) > maxBundleLines {
+		invalid("must include no more than %d lines", maxBundleLines)
+		return uerr
+	}
+
+	if len(bundle.Characters) > maxCharacters {
+		invalid("must include no more than %d characters", maxCharacters)
+		return uerr
+	}
+
+	characters := make(map[string]*BundleCharacter, len(bundle.Characters))
+	for i := range bundle.Characters {
+		bc := &bundle.Characters[i]
+
+		character := Character{
+			Name:     strings.Replace(bc.Name, "\x00", "", -1),
+			Animal:   bc.Animal,
+			MoodName: strings.Replace(bc.MoodName, "\x00", "", -1),
+			Facing:   bc.Facing,
+		}
+		for _, entry := range c.validateCharacter(&character) {
+			invalid("%s of character %d %s", entry.Params[0], i+1, entry.Message)
+		}
+		bc.Name, bc.Animal, bc.MoodName, bc.Facing = character.Name, character.Animal, character.MoodName, character.Facing
+
+		if _, ok := characters[bc.Name]; ok {
+			invalid("character %q is defined more than once", bc.Name)
+		}
+		characters[bc.Name] = bc
+	}
+
+	for i := range bundle.Lines {
+		line := &bundle.Lines[i]
+
+		line.Character = strings.Replace(line.Character, "\x00", "", -1)
+		if line.Character != "" {
+			// The animal of a character's lines is fixed
+			if character, ok := characters[line.Character]; !ok {
+				invalid("character %q of line %d is not defined in the bundle", line.Character, i+1)
+			} else if line.Animal == "" {
+				line.Animal = character.Animal
+			} else if line.Animal != character.Animal {
+				invalid("animal of line %d must be %q, the animal of character %q", i+1, character.Animal, character.Name)
+			}
+		}
+
+		if line.Animal == "" {
+			line.Animal = "default"
+		}
+		if _, ok := c.cows[line.Animal]; !ok {
+			invalid("animal %q of line %d does not exist", line.Animal, i+1)
+		}
+
+		if line.Width < 0 || line.Width > maxLineWidth {
+			invalid("width of line %d must be an integer between 0 and %d", i+1, maxLineWidth)
+		}
+
+		line.Text = strings.Replace(line.Text, "\x00", "", -1)
+		if utf8.RuneCountInString(line.Text) > maxTextLength {
+			invalid("text of line %d must be a string of less than %d characters", i+1, maxTextLength)
+		}
+
+		line.MoodName = strings.Replace(line.MoodName, "\x00", "", -1)
+		if line.MoodName == "" {
+			line.MoodName = "default"
+		}
+
+		if line.Sentiment != nil && (*line.Sentiment < minSentimentScore || *line.Sentiment > maxSentimentScore) {
+			invalid("sentiment of line %d must be a number from %d to %d", i+1, minSentimentScore, maxSentimentScore)
+		}
+	}
+
+	for i := range bundle.Moods {
+		mood := &bundle.Moods[i]
+		mood.Name = strings.Replace(mood.Name, "\x00", "", -1)
+
+		if mood.Name == "" {
+			invalid("mood %d must have a name", i+1)
+		}
+		for _, entry := range validateMood(mood) {
+			invalid("%s of mood %q %s", entry.Params[0], mood.Name, entry.Message)
+		}
+	}
+
+	return uerr
+}
+
+// mapBundleMoods finds the user's mood for each mood used by the lines
+// and characters of the bundle, keyed by lowercase name. Moods that
+// must be created are also returned separately. Installed gallery moods
+// that are not available to the user are created under their
+// unqualified name. Random and automatic character moods are only
+// checked.
+func (c *Controller) mapBundleMoods(userID string, bundle *ConversationBundle) (map[string]*Mood, []*Mood, usererrors.InvalidParams, error) {
+	defs := make(map[string]Mood, len(bundle.Moods))
+	for _, mood := range bundle.Moods {
+		defs[strings.ToLower(mood.Name)] = mood
+	}
+
+	moods := make(map[string]*Mood)
+	var created []*Mood
+	var uerr usererrors.InvalidParams
+
+	type moodRef struct{ name, user string }
+	refs := make([]moodRef, 0, len(bundle.Lines)+len(bundle.Characters))
+	for i, line := range bundle.Lines {
+		refs = append(refs, moodRef{line.MoodName, fmt.Sprintf("line %d", i+1)})
+	}
+	for _, character := range bundle.Characters {
+		user := fmt.Sprintf("character %q", character.Name)
+		if !isPerLineMood(character.MoodName) {
+			refs = append(refs, moodRef{character.MoodName, user})
+			continue
+		}
+
+		moodErr, err := c.resolveMood(userID, &Line{MoodName: character.MoodName}, "")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, entry := range moodErr {
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"bundle"},
+				Message: fmt.Sprintf("mood of %s %s", user, entry.Message),
+			})
+		}
+	}
+
+	for _, ref := range refs {
+		key := strings.ToLower(ref.name)
+		if _, ok := moods[key]; ok {
+			continue
+		}
+
+		names := []string{ref.name}
+		if _, name, ok := parseMoodReference(ref.name); ok {
+			names = append(names, name)
+		}
+
+		var mood *Mood
+		for _, name := range names {
+			if m := moods[strings.ToLower(name)]; m != nil {
+				mood = m
+				break
+			}
+
+			var err error
+			if mood, err = c.repo.GetMood(userID, name); err != nil {
+				return nil, nil, nil, err
+			} else if mood != nil {
+				break
+			}
+		}
+
+		if mood == nil {
+			// Report each missing mood only once
+			moods[key] = nil
+
+			def, ok := defs[key]
+			name := names[len(names)-1]
+			if !ok {
+				uerr = append(uerr, usererrors.InvalidParamsEntry{
+					Params:  []string{"bundle"},
+					Message: fmt.Sprintf("mood %q of %s does not exist and is not defined in the bundle", ref.name, ref.user),
+				})
+				continue
+			}
+			if isReservedMoodName(name) {
+				uerr = append(uerr, usererrors.InvalidParamsEntry{
+					Params:  []string{"bundle"},
+					Message: fmt.Sprintf("mood %q uses a reserved name", name),
+				})
+				continue
+			}
+
+			mood = &Mood{
+				Name:        strings.ToLower(name),
+				Eyes:        def.Eyes,
+				Tongue:      def.Tongue,
+				UserDefined: true,
+			}
+			created = append(created, mood)
+
+			// Another reference may use the same unqualified name
+			moods[strings.ToLower(name)] = mood
+		}
+
+		moods[key] = mood
+	}
+
+	return moods, created, uerr, nil
+}
+
+// isPerLineMood reports whether a mood name chooses a mood for each
+// line rather than naming one.
+func isPerLineMood(name string) bool {
+	_, ok := parseRandomMood(name)
+	return ok || strings.EqualFold(name, autoMoodName)
+}
@@ -0,0 +1,74 @@
+package say
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type catalogEntry struct {
+	Name   string `json:"name" yaml:"name"`
+	Eyes   string `json:"eyes" yaml:"eyes"`
+	Tongue string `json:"tongue" yaml:"tongue"`
+}
+
+// LoadMoods reads a catalog of built-in moods from a JSON or YAML
+// file, chosen by the file extension. Moods are validated with the
+// same rules as moods set through the API and the catalog must
+// define a "default" mood for lines that don't specify one.
+func LoadMoods(path string) ([]Mood, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading mood catalog: %v", err)
+	}
+
+	var entries []catalogEntry
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		err = json.Unmarshal(data, &entries)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &entries)
+	default:
+		return nil, fmt.Errorf("mood catalog %s must be a .json, .yaml or .yml file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing mood catalog %s: %v", path, err)
+	}
+
+	moods := make([]Mood, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for i, entry := range entries {
+		mood := Mood{
+			Name:   strings.ToLower(strings.TrimSpace(entry.Name)),
+			Eyes:   entry.Eyes,
+			Tongue: entry.Tongue,
+		}
+
+		if mood.Name == "" {
+			return nil, fmt.Errorf("mood %d in catalog %s does not have a name", i, path)
+		}
+		if isReservedMoodName(mood.Name) {
+			return nil, fmt.Errorf("mood %q in catalog %s uses a reserved name", mood.Name, path)
+		}
+		if seen[mood.Name] {
+			return nil, fmt.Errorf("mood %q is defined more than once in catalog %s", mood.Name, path)
+		}
+		seen[mood.Name] = true
+
+		if uerr := validateMood(&mood); uerr != nil {
+			return nil, fmt.Errorf("mood %q in catalog %s is invalid: %s", mood.Name, path, uerr.Message())
+		}
+
+		moods[i] = mood
+	}
+
+	if !seen["default"] {
+		return nil, fmt.Errorf("mood catalog %s does not define a %q mood", path, "default")
+	}
+
+	return moods, nil
+}
@@ -0,0 +1,79 @@
+package say
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadMoods(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saypi-catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expect := []Mood{
+		{Name: "default", Eyes: "oo", Tongue: "  "},
+		{Name: "oncall", Eyes: "@@", Tongue: ""},
+		{Name: "shipit", Eyes: "^^", Tongue: "U "},
+	}
+
+	valid := map[string]string{
+		"catalog.json": `[
+  {"name": "default", "eyes": "oo", "tongue": "  "},
+  {"name": "OnCall", "eyes": "@@"},
+  {"name": "shipit", "eyes": "^^", "tongue": "U "}
+]`,
+		"catalog.yaml": `
+- {name: default, eyes: oo, tongue: "  "}
+- name: oncall
+  eyes: "@@"
+- name: shipit
+  eyes: ^^
+  tongue: "U "
+`,
+	}
+
+	for name, content := range valid {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		moods, err := LoadMoods(path)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(moods, expect) {
+			t.Errorf("%s: expected moods %#v but got %#v", name, expect, moods)
+		}
+	}
+
+	invalid := map[string]struct{ content, errStr string }{
+		"eyes.json":      {`[{"name": "default", "eyes": "ooo"}]`, "eyes"},
+		"tongue.yml":     {`[{name: default, tongue: "U"}]`, "tongue"},
+		"unnamed.json":   {`[{"name": "default"}, {"eyes": "oo"}]`, "name"},
+		"duplicate.json": {`[{"name": "default"}, {"name": "DEFAULT"}]`, "more than once"},
+		"nodefault.json": {`[{"name": "oncall"}]`, "default"},
+		"reserved.json":  {`[{"name": "default"}, {"name": "Random"}]`, "reserved"},
+		"catalog.txt":    {`[{"name": "default"}]`, ".json"},
+		"broken.json":    {`{"name": "default"}`, "parsing"},
+	}
+
+	for name, test := range invalid {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := LoadMoods(path)
+		if err == nil || !strings.Contains(err.Error(), test.errStr) {
+			t.Errorf("%s: expected an error containing %q but got %v", name, test.errStr, err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package say
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"goji.io/pat"
+	"goji.io/pattern"
+
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	maxCharacters          = 20
+	maxCharacterNameLength = 30
+)
+
+// Directions a Character faces
+const (
+	FacingLeft  = "left"
+	FacingRight = "right"
+)
+
+// Character is a named participant in a conversation. Lines created
+// with a character take its animal and, unless they set one, its
+// mood. Characters facing right are drawn mirrored.
+type Character struct {
+	ID       string `json:"id" url:"-"`
+	Name     string `json:"name" url:"name"`
+	Animal   string `json:"animal" url:"animal,omitempty"`
+	MoodName string `json:"mood" url:"mood,omitempty"`
+	Facing   string `json:"facing" url:"facing,omitempty"`
+	Created  int64  `json:"created" url:"-"`
+
+	id int
+}
+
+func (ch *Character) Vars() map[pattern.Variable]string {
+	return map[pattern.Variable]string{
+		"character": ch.ID,
+	}
+}
+
+// CreateCharacter adds a character to the conversation with the
+// `name`, `animal`, `mood` and `facing` parameters. Names are unique
+// within a conversation.
+func (c *Controller) CreateCharacter(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	character := Character{
+		Name:     strings.Replace(r.PostFormValue("name"), "\x00", "", -1),
+		Animal:   r.PostFormValue("animal"),
+		MoodName: strings.Replace(r.PostFormValue("mood"), "\x00", "", -1),
+		Facing:   r.PostFormValue("facing"),
+	}
+
+	uerr := c.validateCharacter(&character)
+
+	// The mood is kept as given so that random and automatic moods are
+	// chosen again for each line, but it must resolve now.
+	moodErr, err := c.resolveMood(userID, &Line{MoodName: character.MoodName}, "")
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	uerr = append(uerr, moodErr...)
+
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	if err := c.repo.InsertCharacter(userID, convoID, &character); err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleEditor)
+		return
+	} else if err == errCharacterExists {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+			Params:  []string{"name"},
+			Message: fmt.Sprintf("%q is already a character in the conversation", character.Name),
+		}})
+		return
+	} else if err == errTooManyCharacters {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
+			Action: fmt.Sprintf("create more than %d characters in a conversation", maxCharacters),
+		})
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, character)
+}
+
+func (c *Controller) ListCharacters(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	characters, err := c.repo.ListCharacters(userID, convoID)
+	if err == errRecordNotFound {
+		respond.NotFound(ctx, w, r)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Type: "character",
+		Data: characters,
+	})
+}
+
+// DeleteCharacter removes a character from the conversation. Its lines
+// keep their animal and mood.
+func (c *Controller) DeleteCharacter(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+	characterID := pat.Param(ctx, "character")
+
+	if err := c.repo.DeleteCharacter(userID, convoID, characterID); err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleEditor)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateCharacter checks the name, animal and facing of a character,
+// filling in defaults for empty values. The mood is not resolved.
+func (c *Controller) validateCharacter(character *Character) usererrors.InvalidParams {
+	var uerr usererrors.InvalidParams
+
+	if cnt := utf8.RuneCountInString(character.Name); cnt == 0 || cnt > maxCharacterNameLength || strings.ContainsAny(character.Name, "\r\n") {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"name"},
+			Message: fmt.Sprintf("must be a single line of between 1 and %d characters", maxCharacterNameLength),
+		})
+	}
+
+	if character.Animal == "" {
+		character.Animal = "default"
+	}
+	if _, ok := c.cows[character.Animal]; !ok {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"animal"},
+			Message: fmt.Sprintf("%q does not exist", character.Animal),
+		})
+	}
+
+	if character.Facing == "" {
+		character.Facing = FacingLeft
+	}
+	if character.Facing != FacingLeft && character.Facing != FacingRight {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"facing"},
+			Message: fmt.Sprintf("must be either '%s' or '%s'", FacingLeft, FacingRight),
+		})
+	}
+
+	if character.MoodName == "" {
+		character.MoodName = "default"
+	}
+
+	return uerr
+}
+
+// setCharacter gives a new line the character named by the `character`
+// parameter, if any, taking the character's animal and mood. It must
+// be called before the other parameters are parsed.
+func (c *Controller) setCharacter(userID, convoID string, form url.Values, line *Line) (usererrors.InvalidParams, error) {
+	name := form.Get("character")
+	if name == "" {
+		return nil, nil
+	}
+
+	character, err := c.repo.GetCharacter(userID, convoID, name)
+	if err != nil {
+		return nil, err
+	}
+	if character == nil {
+		return usererrors.InvalidParams{{
+			Params:  []string{"character"},
+			Message: fmt.Sprintf("%q is not a character in the conversation", name),
+		}}, nil
+	}
+
+	applyCharacter(line, character)
+	return nil, nil
+}
+
+// applyCharacter gives a line the character and its animal and mood.
+func applyCharacter(line *Line, character *Character) {
+	line.Character = character.Name
+	line.Animal = character.Animal
+	line.MoodName = character.MoodName
+	line.character = character
+}
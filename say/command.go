@@ -0,0 +1,389 @@
+package say
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"goji.io/pat"
+
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+// CowsayCommand holds the options of a cowsay or cowthink invocation
+// that correspond to the parameters of a Line.
+type CowsayCommand struct {
+	Animal   string // from -f, empty for the default animal
+	Think    bool   // set when invoked as cowthink
+	MoodName string // from a preset flag such as -d
+	Eyes     string // from -e
+	Tongue   string // from -T
+	Width    int    // from -W, zero for the default width
+	Text     string
+}
+
+// cowsayPresets maps the preset flags of cowsay to mood names. Only -p
+// has no built-in mood and requires a user mood named "paranoid".
+var cowsayPresets = map[rune]string{
+	'b': "borg",
+	'd': "dead",
+	'g': "greedy",
+	'p': "paranoid",
+	's': "stoned",
+	't': "tired",
+	'w': "wired",
+	'y': "young",
+}
+
+// cowsayUnsupported describes the flags of cowsay that have no
+// equivalent for a line.
+var cowsayUnsupported = map[rune]string{
+	'h': "printing help",
+	'l': "listing animals",
+	'n': "disabling word wrapping",
+}
+
+// cowsayParams names the part of a command that sets each line
+// parameter in errors.
+var cowsayParams = map[string]string{
+	"animal": "-f",
+	"mood":   "mood",
+	"text":   "text",
+}
+
+// ParseCowsay parses a shell invocation of cowsay or cowthink such as
+// `cowsay -f tux -e '^^' hello`. Shell features other than quoting and
+// escaping, and flags without an equivalent for a line, are reported
+// as invalid.
+func ParseCowsay(command string) (*CowsayCommand, usererrors.InvalidParams) {
+	var uerr usererrors.InvalidParams
+	invalid := func(format string, args ...interface{}) {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"command"},
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	words, msg := splitShellWords(command)
+	if msg != "" {
+		invalid(msg)
+		return nil, uerr
+	}
+	if len(words) == 0 {
+		invalid("must be a cowsay or cowthink command")
+		return nil, uerr
+	}
+
+	var cmd CowsayCommand
+	switch path.Base(words[0]) {
+	case "cowsay":
+	case "cowthink":
+		cmd.Think = true
+	default:
+		invalid("must run cowsay or cowthink, not %q", words[0])
+		return nil, uerr
+	}
+
+	var preset rune
+	args := words[1:]
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			args = args[1:]
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		args = args[1:]
+
+		if strings.HasPrefix(arg, "--") {
+			invalid("option %q is not supported", arg)
+			continue
+		}
+
+		flags := []rune(arg[1:])
+		for i := 0; i < len(flags); i++ {
+			flag := flags[i]
+
+			if mood, ok := cowsayPresets[flag]; ok {
+				if preset != 0 && preset != flag {
+					invalid("-%c conflicts with -%c", flag, preset)
+				}
+				preset = flag
+				cmd.MoodName = mood
+				continue
+			}
+			if desc, ok := cowsayUnsupported[flag]; ok {
+				invalid("-%c (%s) is not supported", flag, desc)
+				continue
+			}
+			if !strings.ContainsRune("efTW", flag) {
+				invalid("-%c is not a cowsay option", flag)
+				continue
+			}
+
+			// The rest of the word or the next word is the flag's value
+			value := string(flags[i+1:])
+			i = len(flags)
+			if value == "" {
+				if len(args) == 0 {
+					invalid("-%c requires a value", flag)
+					continue
+				}
+				value, args = args[0], args[1:]
+			}
+
+			switch flag {
+			case 'f':
+				cmd.Animal = strings.TrimSuffix(path.Base(value), ".cow")
+			case 'e', 'T':
+				face, ok := cowsayFace(value)
+				if !ok {
+					invalid("-%c must be one or two characters but got %q", flag, value)
+				}
+				if flag == 'e' {
+					cmd.Eyes = face
+				} else {
+					cmd.Tongue = face
+				}
+			case 'W':
+				width, err := strconv.Atoi(value)
+				if err != nil || width < 1 || width > maxLineWidth {
+					invalid("-W must be an integer between 1 and %d but got %q", maxLineWidth, value)
+				}
+				cmd.Width = width
+			}
+		}
+	}
+
+	if preset != 0 && (cmd.Eyes != "" || cmd.Tongue != "") {
+		invalid("-e and -T cannot be combined with -%c", preset)
+	}
+
+	cmd.Text = strings.Join(args, " ")
+	if cmd.Text == "" {
+		invalid("must include the text to say since reading standard input is not supported")
+	}
+
+	if uerr != nil {
+		return nil, uerr
+	}
+	return &cmd, nil
+}
+
+// cowsayFace pads a one character eye or tongue string with a space as
+// cowsay would print it.
+func cowsayFace(value string) (string, bool) {
+	switch utf8.RuneCountInString(value) {
+	case 1:
+		return value + " ", true
+	case 2:
+		return value, true
+	default:
+		return "", false
+	}
+}
+
+// splitShellWords splits a command into words as a POSIX shell would,
+// handling quotes and backslash escapes. If the command uses any other
+// shell syntax, it returns a message describing the problem.
+func splitShellWords(command string) ([]string, string) {
+	var words []string
+	var word []rune
+	inWord := false
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		ch := runes[i]
+
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			if inWord {
+				words = append(words, string(word))
+				word, inWord = nil, false
+			}
+			continue
+		case ch == '\\':
+			i++
+			if i == len(runes) {
+				return nil, "ends with an incomplete escape"
+			}
+			// A backslash before a newline continues the line
+			if runes[i] == '\n' {
+				continue
+			}
+			word = append(word, runes[i])
+		case ch == '\'':
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, "has an unterminated single quote"
+			}
+			word = append(word, runes[i+1:end]...)
+			i = end
+		case ch == '"':
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				switch runes[i] {
+				case '$', '`':
+					return nil, fmt.Sprintf("uses %q, but shell expansion is not supported", runes[i])
+				case '\\':
+					if i+1 < len(runes) && strings.ContainsRune("\"\\\n", runes[i+1]) {
+						i++
+						if runes[i] == '\n' {
+							continue
+						}
+					}
+				}
+				word = append(word, runes[i])
+			}
+			if i == len(runes) {
+				return nil, "has an unterminated double quote"
+			}
+		case strings.ContainsRune("|&;<>()$`", ch):
+			return nil, fmt.Sprintf("uses %q, but only a single command without shell expansion is supported", ch)
+		default:
+			word = append(word, ch)
+		}
+		inWord = true
+	}
+
+	if inWord {
+		words = append(words, string(word))
+	}
+
+	return words, ""
+}
+
+// faceMoodName names the mood created for a face that no mood has. The
+// face is hex encoded since eyes and tongues may contain characters
+// that are awkward in a URL.
+func faceMoodName(eyes, tongue string) string {
+	return fmt.Sprintf("face-%x", eyes+tongue)
+}
+
+func indexRune(runes []rune, start int, r rune) int {
+	for i := start; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// CreateCowsayLine appends a line to the conversation with the animal,
+// mood, think and width options of the cowsay or cowthink invocation
+// in the `command` parameter. Custom eyes and tongues select the
+// built-in or user mood with that face, creating a user mood for the
+// face if there is none.
+func (c *Controller) CreateCowsayLine(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	r.ParseForm()
+	cmd, uerr := ParseCowsay(r.PostFormValue("command"))
+
+	pos, posErr := parseLinePosition(r, false)
+	uerr = append(uerr, posErr...)
+
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	line := Line{
+		Animal:   "default",
+		MoodName: "default",
+		Think:    cmd.Think,
+		Width:    cmd.Width,
+	}
+
+	form := url.Values{"text": {cmd.Text}}
+	if cmd.Animal != "" {
+		form.Set("animal", cmd.Animal)
+	}
+	lineErr := c.parseLine(form, &line)
+
+	if cmd.Eyes != "" || cmd.Tongue != "" {
+		eyes, tongue := cmd.Eyes, cmd.Tongue
+		if eyes == "" {
+			eyes = "oo"
+		}
+		if tongue == "" {
+			tongue = "  "
+		}
+
+		mood, err := c.repo.FindMoodByFace(userID, eyes, tongue)
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+		if mood == nil {
+			// Created along with the line
+			mood = &Mood{
+				Name:        faceMoodName(eyes, tongue),
+				Eyes:        eyes,
+				Tongue:      tongue,
+				UserDefined: true,
+			}
+		}
+		line.MoodName = mood.Name
+		line.mood = mood
+	} else {
+		if cmd.MoodName != "" {
+			line.MoodName = cmd.MoodName
+		}
+
+		moodErr, err := c.resolveMood(userID, &line, "")
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+		lineErr = append(lineErr, moodErr...)
+	}
+
+	for _, entry := range lineErr {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"command"},
+			Message: fmt.Sprintf("%s %s", cowsayParams[entry.Params[0]], entry.Message),
+		})
+	}
+
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	var err error
+	line.Output, err = c.renderLine(&line)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	created := &changeEvent{Type: EventLineCreated, Data: &line}
+	if err := c.repo.InsertLine(userID, convoID, &line, pos, created); err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleEditor)
+		return
+	} else if err == errAnchorNotFound {
+		respondAnchorNotFound(ctx, w, pos)
+		return
+	} else if uerr, ok := err.(QuotaExceeded); ok {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	c.publishEvent(ctx, convoID, created)
+
+	respond.Data(ctx, w, http.StatusOK, line)
+}
@@ -0,0 +1,80 @@
+package say
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCowsay(t *testing.T) {
+	cases := []struct {
+		command string
+		expect  CowsayCommand
+	}{
+		{
+			`cowsay -f tux -e '^^' -T 'U ' -W 30 hello`,
+			CowsayCommand{Animal: "tux", Eyes: "^^", Tongue: "U ", Width: 30, Text: "hello"},
+		},
+		{
+			`/usr/games/cowthink -d -f /usr/share/cows/dragon.cow "I have \"seen\" things"`,
+			CowsayCommand{Animal: "dragon", Think: true, MoodName: "dead", Text: `I have "seen" things`},
+		},
+		{
+			`cowsay -bW20 -- -not a flag`,
+			CowsayCommand{MoodName: "borg", Width: 20, Text: "-not a flag"},
+		},
+		{
+			"cowsay -TU  two\\ \\ spaces \\\n  continued",
+			CowsayCommand{Tongue: "U ", Text: "two  spaces continued"},
+		},
+		{
+			`cowsay -y -y it''s "fine"`,
+			CowsayCommand{MoodName: "young", Text: "its fine"},
+		},
+	}
+
+	for i, testcase := range cases {
+		cmd, uerr := ParseCowsay(testcase.command)
+		if uerr != nil {
+			t.Errorf("%d: unexpected error parsing %q: %v", i, testcase.command, uerr)
+			continue
+		}
+		if !reflect.DeepEqual(*cmd, testcase.expect) {
+			t.Errorf("%d: got %#v but expected %#v", i, *cmd, testcase.expect)
+		}
+	}
+
+	invalid := []struct {
+		command string
+		message string
+	}{
+		{"", "cowsay or cowthink"},
+		{"echo hello", `not "echo"`},
+		{"cowsay -n hello", "-n (disabling word wrapping)"},
+		{"cowsay -x hello", "-x is not a cowsay option"},
+		{"cowsay --help", `"--help"`},
+		{"cowsay -d -s hello", "-s conflicts with -d"},
+		{"cowsay -d -e xx hello", "cannot be combined with -d"},
+		{"cowsay -e abc hello", "-e must be one or two characters"},
+		{"cowsay -W wide hello", "-W must be an integer"},
+		{"cowsay -W 1000 hello", "-W must be an integer"},
+		{"cowsay -f", "-f requires a value"},
+		{"cowsay -f tux", "standard input"},
+		{"cowsay 'unterminated", "single quote"},
+		{`cowsay "$HOME"`, "shell expansion"},
+		{"fortune | cowsay", "single command"},
+		{"cowsay hello > out", "single command"},
+	}
+
+	for i, testcase := range invalid {
+		_, uerr := ParseCowsay(testcase.command)
+
+		found := false
+		for _, entry := range uerr {
+			found = found || strings.Contains(entry.Message, testcase.message)
+		}
+		if !found {
+			t.Errorf("%d: expected an error parsing %q that mentions %q but got %v", i, testcase.command, testcase.message, uerr)
+		}
+	}
+}
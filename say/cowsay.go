@@ -42,7 +42,23 @@ func listAnimals() []string {
 	return assets
 }
 
-func (c *cow) Say(text, eyes, tongue string, think bool) (string, error) {
+// Say renders the cow speaking or thinking text, wrapped at width
+// columns or the cow's default width if width is zero.
+func (c *cow) Say(text, eyes, tongue string, think bool, width int) (string, error) {
+	return c.say(text, eyes, tongue, think, width, false)
+}
+
+// SayMirrored renders like Say but with the cow facing the other way
+// and the balloon over its right side.
+func (c *cow) SayMirrored(text, eyes, tongue string, think bool, width int) (string, error) {
+	return c.say(text, eyes, tongue, think, width, true)
+}
+
+func (c *cow) say(text, eyes, tongue string, think bool, width int, mirrored bool) (string, error) {
+	if width == 0 {
+		width = c.maxWidth
+	}
+
 	if eyes == "" {
 		eyes = "oo"
 	}
@@ -59,8 +75,74 @@ func (c *cow) Say(text, eyes, tongue string, think bool) (string, error) {
 		return "", errors.New("Tongue string must be exactly two characters or empty")
 	}
 
-	txt := c.balloonText(text, think, c.maxWidth) + "\n" + c.cowText(eyes, tongue, think)
-	return txt, nil
+	balloon := c.balloonText(text, think, width)
+	if !mirrored {
+		return balloon + "\n" + c.cowText(eyes, tongue, think), nil
+	}
+
+	// Mirroring the eyes and tongue first keeps them as given once the
+	// whole cow is flipped.
+	art := mirror(c.cowText(flip(eyes, 2), flip(tongue, 2), think))
+
+	// Align the right edges of the balloon and the cow
+	cowWidth := 0
+	for _, line := range strings.Split(art, "\n") {
+		if n := utf8.RuneCountInString(line); n > cowWidth {
+			cowWidth = n
+		}
+	}
+	balloonWidth := utf8.RuneCountInString(strings.SplitN(balloon, "\n", 2)[0])
+	if indent := cowWidth - balloonWidth; indent > 0 {
+		pad := strings.Repeat(" ", indent)
+		balloon = pad + strings.Replace(balloon, "\n", "\n"+pad, -1)
+	}
+
+	return balloon + "\n" + art, nil
+}
+
+var mirroredRunes = map[rune]rune{
+	'(': ')', ')': '(',
+	'[': ']', ']': '[',
+	'{': '}', '}': '{',
+	'<': '>', '>': '<',
+	'/': '\\', '\\': '/',
+}
+
+// mirror flips each line of art horizontally, swapping characters such
+// as brackets and slashes for their mirror images. Lines are padded to
+// the width of the widest line before they are flipped and trailing
+// spaces are removed afterwards.
+func mirror(art string) string {
+	lines := strings.Split(art, "\n")
+
+	width := 0
+	for _, line := range lines {
+		if n := utf8.RuneCountInString(line); n > width {
+			width = n
+		}
+	}
+
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(flip(line, width), " ")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// flip pads s with spaces to width characters and reverses it,
+// swapping characters for their mirror images.
+func flip(s string, width int) string {
+	flipped := make([]rune, width)
+	for i := range flipped {
+		flipped[i] = ' '
+	}
+	for i, r := range []rune(s) {
+		if m, ok := mirroredRunes[r]; ok {
+			r = m
+		}
+		flipped[width-1-i] = r
+	}
+	return string(flipped)
 }
 
 // Adapted from https://github.com/marmelab/gosay
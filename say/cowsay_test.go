@@ -73,7 +73,7 @@ func TestSay(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		said, err := cow.Say(testcase.text, testcase.eyes, testcase.tongue, testcase.think)
+		said, err := cow.Say(testcase.text, testcase.eyes, testcase.tongue, testcase.think, 0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -85,6 +85,25 @@ func TestSay(t *testing.T) {
 	}
 }
 
+func TestSayMirrored(t *testing.T) {
+	cow, err := newCow("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The eyes and tongue read the same way as in TestSay
+	said, err := cow.SayMirrored("This is my cow", "xo", "T ", true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "   ________________ \n  ( This is my cow )\n   ---------------- \n" +
+		"            ^__^   o\n    _______/(xo)  o\n/\\/(       /(__)\n   | w----|| T\n   ||     ||\n"
+	if said != expect {
+		t.Errorf("Expected\n\n%s\n\nbut got\n\n%s\n\n%s", expect, said, diffCows(expect, said))
+	}
+}
+
 func diffCows(haveStr, wantStr string) string {
 	haveLines := strings.Split(haveStr, "\n")
 	wantLines := strings.Split(wantStr, "\n")
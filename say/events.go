@@ -0,0 +1,340 @@
+package say
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goji.io/pat"
+
+	"github.com/metcalf/saypi/reqlog"
+	"github.com/metcalf/saypi/respond"
+
+	"golang.org/x/net/context"
+)
+
+// Types of Event
+const (
+	EventLineCreated  = "line.created"
+	EventLineDeleted  = "line.deleted"
+	EventConvoCreated = "conversation.created"
+	EventConvoUpdated = "conversation.updated"
+	EventConvoDeleted = "conversation.deleted"
+
+	// EventStreamReset is sent in place of missed events when a stream
+	// cannot be resumed from its Last-Event-ID. Clients should fetch
+	// the conversation again.
+	EventStreamReset = "stream.reset"
+)
+
+const (
+	eventHistory   = 100              // events kept per conversation for resuming
+	eventBuffer    = 64               // events queued per stream before it is dropped
+	eventRetention = 5 * time.Minute  // how long to keep history without streams
+	eventKeepAlive = 15 * time.Second // interval between comments on idle streams
+)
+
+// Event is a change to a conversation sent to its event streams.
+type Event struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+
+	seq uint64
+}
+
+// eventBroker fans out the events of each conversation to its
+// streams. Events are only recorded for conversations that have had a
+// stream within eventRetention so that other changes cost nothing.
+type eventBroker struct {
+	mu     sync.Mutex
+	epoch  string // distinguishes event IDs from those of other processes
+	seq    uint64
+	topics map[string]*eventTopic
+	closed bool
+}
+
+type eventTopic struct {
+	history []Event
+	dropped uint64 // events up to this sequence number are unavailable
+	subs    map[*eventSub]struct{}
+	idle    time.Time // when the last stream ended
+}
+
+type eventSub struct {
+	topic  string
+	events chan Event
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		topics: make(map[string]*eventTopic),
+	}
+}
+
+// publish records an event for the conversation and sends it to every
+// stream of the conversation. Streams that are not keeping up are
+// closed so that they reconnect and resume from their last event.
+func (b *eventBroker) publish(convoID, typ string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("encoding %s event: %v", typ, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	topic, ok := b.topics[convoID]
+	if !ok || b.closed {
+		return nil
+	}
+
+	ev := Event{ID: b.eventID(b.seq), Type: typ, Data: raw, seq: b.seq}
+
+	topic.history = append(topic.history, ev)
+	if over := len(topic.history) - eventHistory; over > 0 {
+		topic.dropped = topic.history[over-1].seq
+		topic.history = append([]Event(nil), topic.history[over:]...)
+	}
+
+	for sub := range topic.subs {
+		select {
+		case sub.events <- ev:
+		default:
+			delete(topic.subs, sub)
+			close(sub.events)
+		}
+	}
+
+	return nil
+}
+
+// subscribe starts a stream of the conversation's events. The events
+// after lastID are returned to be sent first, or a reset event if they
+// are no longer available. It returns nil once the broker is closed.
+func (b *eventBroker) subscribe(convoID, lastID string) (*eventSub, []Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, nil
+	}
+
+	now := time.Now()
+	for id, topic := range b.topics {
+		if len(topic.subs) == 0 && now.Sub(topic.idle) > eventRetention {
+			delete(b.topics, id)
+		}
+	}
+
+	topic, ok := b.topics[convoID]
+	if !ok {
+		topic = &eventTopic{
+			dropped: b.seq,
+			subs:    make(map[*eventSub]struct{}),
+		}
+		b.topics[convoID] = topic
+	}
+
+	sub := &eventSub{topic: convoID, events: make(chan Event, eventBuffer)}
+	topic.subs[sub] = struct{}{}
+
+	if lastID == "" {
+		return sub, nil
+	}
+
+	lastSeq, ok := b.parseEventID(lastID)
+	if !ok || lastSeq < topic.dropped || lastSeq > b.seq {
+		return sub, []Event{{ID: b.eventID(b.seq), Type: EventStreamReset, Data: json.RawMessage("{}")}}
+	}
+
+	var backlog []Event
+	for _, ev := range topic.history {
+		if ev.seq > lastSeq {
+			backlog = append(backlog, ev)
+		}
+	}
+
+	return sub, backlog
+}
+
+func (b *eventBroker) unsubscribe(sub *eventSub) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topic, ok := b.topics[sub.topic]
+	if !ok {
+		return
+	}
+	if _, ok := topic.subs[sub]; ok {
+		delete(topic.subs, sub)
+		close(sub.events)
+	}
+	if len(topic.subs) == 0 {
+		topic.idle = time.Now()
+	}
+}
+
+// close ends every stream and rejects new ones.
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	for _, topic := range b.topics {
+		for sub := range topic.subs {
+			close(sub.events)
+		}
+		topic.subs = nil
+	}
+}
+
+func (b *eventBroker) eventID(seq uint64) string {
+	return fmt.Sprintf("%s-%d", b.epoch, seq)
+}
+
+func (b *eventBroker) parseEventID(id string) (uint64, bool) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 || parts[0] != b.epoch {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	return seq, err == nil
+}
+
+// changeEvent is an event caused by a change to a conversation. It is
+// passed to the repository method that makes the change, which queues
+// its webhook deliveries in the same transaction, and is published to
+// the conversation's streams once the change is committed.
+type changeEvent struct {
+	Type string
+	Data interface{}
+
+	// build, if set, sets Data from the conversation once the change
+	// has been made, for changes that create the conversation.
+	build func(convo *Conversation) (interface{}, error)
+}
+
+// convoCreated returns the event of a change that creates a
+// conversation. Its data is the conversation, whose lines are rendered
+// when it is built.
+func (c *Controller) convoCreated() *changeEvent {
+	return &changeEvent{
+		Type: EventConvoCreated,
+		build: func(convo *Conversation) (interface{}, error) {
+			for i := range convo.Lines {
+				var err error
+				convo.Lines[i].Output, err = c.renderLine(&convo.Lines[i])
+				if err != nil {
+					return nil, err
+				}
+			}
+			return convo, nil
+		},
+	}
+}
+
+// publishEvent publishes an event to the conversation's streams after
+// its change has been committed and sends the webhook deliveries it
+// queued. Failures are logged rather than failing a request that
+// succeeded.
+func (c *Controller) publishEvent(ctx context.Context, convoID string, event *changeEvent) {
+	if err := c.events.publish(convoID, event.Type, event.Data); err != nil {
+		reqlog.Printf(ctx, "Error publishing event. event=publish_error error=%q", err)
+	}
+	c.wakeWebhooks()
+}
+
+// CloseStreams ends every event stream and session so that a graceful
+// shutdown does not wait for them. Clients are expected to reconnect.
+func (c *Controller) CloseStreams() {
+	c.events.close()
+	c.sessions.close()
+}
+
+// StreamEvents sends the changes to a conversation as Server-Sent
+// Events until the client disconnects. A client that reconnects with
+// the `Last-Event-ID` header receives the events it missed.
+func (c *Controller) StreamEvents(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	convo, err := c.repo.GetConversation(userID, convoID, 0)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if convo == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respond.InternalError(ctx, w, errors.New("response writer does not support flushing"))
+		return
+	}
+
+	// Nil if the client's disconnection can't be detected
+	var gone <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+
+	sub, backlog := c.events.subscribe(convoID, r.Header.Get("Last-Event-ID"))
+	if sub == nil {
+		respond.InternalError(ctx, w, errors.New("event streams are closed"))
+		return
+	}
+	defer c.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, ev := range backlog {
+		writeEvent(w, ev)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	sent := len(backlog)
+	defer func() {
+		reqlog.SetContext(ctx, "events_sent", strconv.Itoa(sent))
+	}()
+
+	for {
+		select {
+		case ev, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			writeEvent(w, ev)
+			sent++
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-gone:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev Event) {
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, ev.Data)
+}
@@ -0,0 +1,77 @@
+package say
+
+import (
+	"testing"
+)
+
+func TestEventBroker(t *testing.T) {
+	b := newEventBroker()
+
+	// Events for conversations without streams are not recorded
+	b.publish("cv_1", EventLineCreated, nil)
+
+	sub, backlog := b.subscribe("cv_1", "")
+	if backlog != nil {
+		t.Errorf("expected no backlog for a new stream but got %v", backlog)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := b.publish("cv_1", EventLineCreated, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.publish("cv_2", EventLineCreated, nil)
+
+	var received []Event
+	for len(sub.events) > 0 {
+		received = append(received, <-sub.events)
+	}
+	if len(received) != 3 || string(received[2].Data) != "2" {
+		t.Fatalf("expected the three events of cv_1 but got %v", received)
+	}
+	b.unsubscribe(sub)
+
+	sub, backlog = b.subscribe("cv_1", received[0].ID)
+	if len(backlog) != 2 || backlog[0].ID != received[1].ID || backlog[1].ID != received[2].ID {
+		t.Errorf("expected to resume with the last two events but got %v", backlog)
+	}
+	b.unsubscribe(sub)
+
+	for _, lastID := range []string{"unknown-1", b.eventID(0), b.eventID(b.seq + 1)} {
+		sub, backlog = b.subscribe("cv_1", lastID)
+		if len(backlog) != 1 || backlog[0].Type != EventStreamReset {
+			t.Errorf("expected a reset resuming from %q but got %v", lastID, backlog)
+		}
+		b.unsubscribe(sub)
+	}
+
+	// Streams that fall behind are closed
+	sub, _ = b.subscribe("cv_1", "")
+	for i := 0; i < eventHistory; i++ {
+		b.publish("cv_1", EventLineCreated, i)
+	}
+	for range sub.events {
+	}
+	b.unsubscribe(sub)
+
+	// The received events have dropped out of the history, but nothing
+	// after the last of them has
+	sub, backlog = b.subscribe("cv_1", received[2].ID)
+	if len(backlog) != eventHistory {
+		t.Errorf("expected to resume with %d events but got %d", eventHistory, len(backlog))
+	}
+	b.unsubscribe(sub)
+
+	sub, backlog = b.subscribe("cv_1", received[1].ID)
+	if len(backlog) != 1 || backlog[0].Type != EventStreamReset {
+		t.Errorf("expected a reset resuming from before the history but got %v", backlog)
+	}
+
+	b.close()
+	if _, ok := <-sub.events; ok {
+		t.Error("expected closing the broker to end streams")
+	}
+	if sub, _ := b.subscribe("cv_1", ""); sub != nil {
+		t.Error("expected no streams after closing the broker")
+	}
+}
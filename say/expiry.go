@@ -0,0 +1,120 @@
+package say
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/metcalf/saypi/metrics"
+	"github.com/metcalf/saypi/reqlog"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+const maxExpirySeconds = 365 * 24 * 60 * 60
+
+// parseExpiry returns the number of seconds until a new conversation
+// expires from either the `expires_at` parameter, a Unix time, or the
+// `ttl` parameter. It is not valid if neither is provided.
+func parseExpiry(r *http.Request) (sql.NullInt64, usererrors.UserError) {
+	expiresAt, ttl := r.PostFormValue("expires_at"), r.PostFormValue("ttl")
+
+	var secs int64
+	var err error
+	switch {
+	case expiresAt != "" && ttl != "":
+		return sql.NullInt64{}, usererrors.InvalidParams{{
+			Params:  []string{"expires_at", "ttl"},
+			Message: "cannot both be provided",
+		}}
+	case expiresAt != "":
+		secs, err = strconv.ParseInt(expiresAt, 10, 64)
+		secs -= time.Now().Unix()
+		if err != nil || secs <= 0 || secs > maxExpirySeconds {
+			return sql.NullInt64{}, usererrors.InvalidParams{{
+				Params:  []string{"expires_at"},
+				Message: fmt.Sprintf("must be a Unix time in the future and no more than %d seconds away", maxExpirySeconds),
+			}}
+		}
+	case ttl != "":
+		secs, err = strconv.ParseInt(ttl, 10, 64)
+		if err != nil || secs <= 0 || secs > maxExpirySeconds {
+			return sql.NullInt64{}, usererrors.InvalidParams{{
+				Params:  []string{"ttl"},
+				Message: fmt.Sprintf("must be a number of seconds from 1 to %d", maxExpirySeconds),
+			}}
+		}
+	default:
+		return sql.NullInt64{}, nil
+	}
+
+	return sql.NullInt64{Int64: secs, Valid: true}, nil
+}
+
+// StartReaper permanently deletes conversations that have expired,
+// up to batchSize at a time, checking every interval until the
+// Controller is closed. Only one process sharing the database reaps at
+// a time.
+func (c *Controller) StartReaper(interval time.Duration, batchSize int) {
+	c.stopReaper = make(chan struct{})
+	c.reaperDone = make(chan struct{})
+
+	go func() {
+		defer close(c.reaperDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.reapConversations(batchSize)
+			case <-c.stopReaper:
+				return
+			}
+		}
+	}()
+}
+
+func (c *Controller) reapConversations(batchSize int) {
+	ctx := context.Background()
+
+	for {
+		ids, err := c.repo.ReapConversations(batchSize)
+		if err == errReaperLocked {
+			metrics.Increment("reaper.skipped")
+			return
+		} else if err != nil {
+			metrics.Increment("reaper.error")
+			reqlog.Printf(ctx, "Error reaping conversations. event=reap_error error=%q", err)
+			return
+		}
+
+		// Members' webhooks aren't notified since the members were
+		// deleted along with the conversation
+		for _, id := range ids {
+			metrics.Increment("reaper.conversation_deleted")
+			if err := c.events.publish(id, EventConvoDeleted, struct {
+				ID string `json:"id"`
+			}{id}); err != nil {
+				reqlog.Printf(ctx, "Error publishing event. event=publish_error error=%q", err)
+			}
+		}
+
+		if len(ids) > 0 {
+			reqlog.Printf(ctx, "Reaped expired conversations. event=conversations_reaped conversations=%d", len(ids))
+		}
+
+		if len(ids) < batchSize {
+			return
+		}
+		select {
+		case <-c.stopReaper:
+			return
+		default:
+		}
+	}
+}
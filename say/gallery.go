@@ -0,0 +1,402 @@
+package say
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"goji.io/pat"
+	"goji.io/pattern"
+
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	maxPublisherLength = 30
+
+	gallerySortCreated  = "created"
+	gallerySortInstalls = "installs"
+)
+
+// Publisher is the public name under which a user shares moods.
+type Publisher struct {
+	Name string `json:"name" url:"name"`
+}
+
+// PublishedMood is a mood shared in the public gallery. Other users
+// may install it to use as `mood=@<publisher>/<name>` or copy it into
+// their own moods.
+type PublishedMood struct {
+	Publisher string `json:"publisher"`
+	Name      string `json:"name"`
+	Reference string `json:"reference"`
+	Eyes      string `json:"eyes"`
+	Tongue    string `json:"tongue"`
+	Installs  int    `json:"installs"`
+	Published bool   `json:"published"`
+	Installed bool   `json:"installed"`
+
+	id    int
+	owned bool
+}
+
+func (m *PublishedMood) Vars() map[pattern.Variable]string {
+	return map[pattern.Variable]string{
+		"publisher": m.Publisher,
+		"mood":      m.Name,
+	}
+}
+
+// galleryFilter narrows and orders a listing of published moods.
+type galleryFilter struct {
+	Query     string // matches part of the mood or publisher name
+	Publisher string
+	Installed bool // only list moods the user installed
+	Sort      string
+}
+
+// moodReference returns the name used to refer to a published mood.
+func moodReference(publisher, name string) string {
+	return "@" + publisher + "/" + name
+}
+
+// parseMoodReference splits a reference of the form
+// `@<publisher>/<name>` into its parts.
+func parseMoodReference(ref string) (string, string, bool) {
+	if !strings.HasPrefix(ref, "@") {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(ref[1:], "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+func validPublisherName(name string) bool {
+	if name == "" || len(name) > maxPublisherLength {
+		return false
+	}
+
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *Controller) GetPublisher(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	pub, err := c.repo.GetPublisher(userID)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if pub == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, pub)
+}
+
+// SetPublisher claims the public name used to refer to the user's
+// published moods.
+func (c *Controller) SetPublisher(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	pub := Publisher{Name: strings.ToLower(r.PostFormValue("name"))}
+	if !validPublisherName(pub.Name) {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+			Params:  []string{"name"},
+			Message: fmt.Sprintf("must be between 1 and %d letters, numbers, dashes or underscores", maxPublisherLength),
+		}})
+		return
+	}
+
+	if err := c.repo.SetPublisher(userID, &pub); err == errPublisherExists {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
+			Action: "change your publisher name",
+		})
+	} else if err == errPublisherTaken {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+			Params:  []string{"name"},
+			Message: fmt.Sprintf("%q is already taken", pub.Name),
+		}})
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+	} else {
+		respond.Data(ctx, w, http.StatusOK, pub)
+	}
+}
+
+func (c *Controller) PublishMood(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	c.setPublished(ctx, w, r, true)
+}
+
+func (c *Controller) UnpublishMood(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	c.setPublished(ctx, w, r, false)
+}
+
+func (c *Controller) setPublished(ctx context.Context, w http.ResponseWriter, r *http.Request, publish bool) {
+	userID := mustUserID(ctx)
+	name := pat.Param(ctx, "mood")
+
+	action := "publish"
+	update := c.repo.PublishMood
+	if !publish {
+		action = "unpublish"
+		update = c.repo.UnpublishMood
+	}
+
+	pub, err := c.repo.GetPublisher(userID)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	if pub == nil {
+		err = errNoPublisher
+	} else {
+		err = update(userID, name)
+	}
+
+	if err == errBuiltinMood {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
+			Action: fmt.Sprintf("%s built-in mood %s", action, name),
+		})
+		return
+	} else if err == errNoPublisher {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
+			Action: fmt.Sprintf("%s a mood without choosing a publisher name", action),
+		})
+		return
+	} else if err == errRecordNotFound {
+		respond.NotFound(ctx, w, r)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	mood, err := c.repo.GetPublishedMood(userID, pub.Name, name)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if mood == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, mood)
+}
+
+func (c *Controller) ListGallery(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	lArgs, uerr := getListArgs(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	filter, uerr := getGalleryFilter(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	moods, hasMore, err := c.repo.ListGallery(userID, lArgs, filter)
+	if err == errCursorNotFound {
+		respondCursorNotFound(ctx, w, lArgs)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	var cursor string
+	if len(moods) > 0 {
+		cursor = moods[len(moods)-1].Reference
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Cursor:  cursor,
+		Type:    "published_mood",
+		HasMore: hasMore,
+		Data:    moods,
+	})
+}
+
+func (c *Controller) GetGalleryMood(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	mood, ok := c.findGalleryMood(ctx, w, r, userID)
+	if !ok {
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, mood)
+}
+
+// InstallMood lets the user refer to a published mood as
+// `@<publisher>/<name>`.
+func (c *Controller) InstallMood(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	mood, ok := c.findGalleryMood(ctx, w, r, userID)
+	if !ok {
+		return
+	}
+
+	if err := c.repo.InstallMood(userID, mood); err == errOwnMood {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
+			Action: fmt.Sprintf("install your own mood %s", mood.Reference),
+		})
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	mood, ok = c.findGalleryMood(ctx, w, r, userID)
+	if !ok {
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, mood)
+}
+
+// UninstallMood removes an installed mood. Existing lines that use the
+// mood are unaffected.
+func (c *Controller) UninstallMood(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	mood, ok := c.findGalleryMood(ctx, w, r, userID)
+	if !ok {
+		return
+	}
+
+	if err := c.repo.UninstallMood(userID, mood); err == errRecordNotFound {
+		respond.NotFound(ctx, w, r)
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// CopyMood creates a mood for the user with the eyes and tongue of a
+// published mood. The `name` parameter defaults to the name of the
+// published mood.
+func (c *Controller) CopyMood(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	published, ok := c.findGalleryMood(ctx, w, r, userID)
+	if !ok {
+		return
+	}
+
+	name := strings.Replace(r.PostFormValue("name"), "\x00", "", -1)
+	if name == "" {
+		name = published.Name
+	}
+	if isReservedMoodName(name) {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
+			Action: fmt.Sprintf("use reserved mood name %s", name),
+		})
+		return
+	}
+
+	existing, err := c.repo.GetMood(userID, name)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if existing != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
+			Action: fmt.Sprintf("copy over existing mood %s", name),
+		})
+		return
+	}
+
+	mood := Mood{
+		Name:        strings.ToLower(name),
+		Eyes:        published.Eyes,
+		Tongue:      published.Tongue,
+		UserDefined: true,
+	}
+
+	err = c.repo.SetMood(userID, &mood)
+	if uerr, ok := err.(QuotaExceeded); ok {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, mood)
+}
+
+// findGalleryMood responds with NotFound and returns false if the mood
+// in the request path is not visible to the user.
+func (c *Controller) findGalleryMood(ctx context.Context, w http.ResponseWriter, r *http.Request, userID string) (*PublishedMood, bool) {
+	mood, err := c.repo.GetPublishedMood(userID, pat.Param(ctx, "publisher"), pat.Param(ctx, "mood"))
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return nil, false
+	}
+	if mood == nil {
+		respond.NotFound(ctx, w, r)
+		return nil, false
+	}
+
+	return mood, true
+}
+
+func getGalleryFilter(r *http.Request) (galleryFilter, usererrors.UserError) {
+	var uerr usererrors.InvalidParams
+
+	res := galleryFilter{
+		Query:     r.FormValue("q"),
+		Publisher: r.FormValue("publisher"),
+		Sort:      r.FormValue("sort"),
+	}
+
+	switch r.FormValue("installed") {
+	case "", "false":
+	case "true":
+		res.Installed = true
+	default:
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"installed"},
+			Message: "must be either 'true' or 'false'",
+		})
+	}
+
+	switch res.Sort {
+	case "":
+		res.Sort = gallerySortCreated
+	case gallerySortCreated, gallerySortInstalls:
+	default:
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"sort"},
+			Message: fmt.Sprintf("must be either '%s' or '%s'", gallerySortCreated, gallerySortInstalls),
+		})
+	}
+
+	if uerr != nil {
+		return galleryFilter{}, uerr
+	}
+	return res, nil
+}
@@ -0,0 +1,39 @@
+package say
+
+import "testing"
+
+func TestParseMoodReference(t *testing.T) {
+	cases := []struct {
+		ref, publisher, name string
+		ok                   bool
+	}{
+		{"@alice/happy", "alice", "happy", true},
+		{"@alice/a/b", "alice", "a/b", true},
+		{"alice/happy", "", "", false},
+		{"@alice", "", "", false},
+		{"@/happy", "", "", false},
+		{"@alice/", "", "", false},
+		{"happy", "", "", false},
+	}
+
+	for i, testcase := range cases {
+		publisher, name, ok := parseMoodReference(testcase.ref)
+		if ok != testcase.ok || publisher != testcase.publisher || name != testcase.name {
+			t.Errorf("%d: parseMoodReference(%q)=%q, %q, %t", i, testcase.ref, publisher, name, ok)
+		}
+	}
+}
+
+func TestValidPublisherName(t *testing.T) {
+	for _, name := range []string{"alice", "cow_fan-99"} {
+		if !validPublisherName(name) {
+			t.Errorf("expected %q to be valid", name)
+		}
+	}
+
+	for _, name := range []string{"", "Alice", "a/b", "@alice", "this_name_is_much_too_long_to_be_valid"} {
+		if validPublisherName(name) {
+			t.Errorf("expected %q to be invalid", name)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package say
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"goji.io/pat"
+	"goji.io/pattern"
+
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	maxMembers     = 50
+	inviteDuration = 7 * 24 * time.Hour
+)
+
+// Roles of the members of a conversation. Viewers can read the
+// conversation, editors can also change its lines and characters, and
+// owners can also change the conversation itself and manage its
+// shares, invites and members.
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+// Member is a user with a role in a conversation. Members are never
+// identified by their user since user IDs are also their credentials.
+type Member struct {
+	ID      string `json:"id"`
+	Role    string `json:"role"`
+	Self    bool   `json:"self"`
+	Created int64  `json:"created"`
+}
+
+func (m *Member) Vars() map[pattern.Variable]string {
+	return map[pattern.Variable]string{
+		"member": m.ID,
+	}
+}
+
+// Invite grants a role in a conversation to the first user to accept
+// its token before it expires.
+type Invite struct {
+	ID      string `json:"id"`
+	Token   string `json:"token"`
+	Role    string `json:"role"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires"`
+}
+
+func (inv *Invite) Vars() map[pattern.Variable]string {
+	return map[pattern.Variable]string{
+		"invite": inv.ID,
+	}
+}
+
+// CreateInvite mints an invite token for the role in the `role`
+// parameter, which defaults to viewer.
+func (c *Controller) CreateInvite(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	role := r.PostFormValue("role")
+	if role == "" {
+		role = RoleViewer
+	}
+	if uerr := validateRole(role); uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	id := make([]byte, tokenIDLen)
+	if _, err := rand.Read(id); err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	tokenID := base64.URLEncoding.EncodeToString(id)
+
+	invite, err := c.repo.InsertInvite(userID, convoID, tokenID, role, inviteDuration)
+	if err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleOwner)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	invite.Token = c.signToken(inviteTokenContext, id)
+
+	respond.Data(ctx, w, http.StatusOK, invite)
+}
+
+// ListInvites lists the invites to a conversation that have been
+// neither accepted nor revoked and have not expired.
+func (c *Controller) ListInvites(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	recs, err := c.repo.ListInvites(userID, convoID)
+	if err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleOwner)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	invites := make([]Invite, len(recs))
+	for i, rec := range recs {
+		id, err := base64.URLEncoding.DecodeString(rec.TokenID)
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+
+		invites[i] = rec.Invite
+		invites[i].Token = c.signToken(inviteTokenContext, id)
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Type: "invite",
+		Data: invites,
+	})
+}
+
+// RevokeInvite deletes an invite so that its token can no longer be
+// accepted.
+func (c *Controller) RevokeInvite(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+	inviteID := pat.Param(ctx, "invite")
+
+	if err := c.repo.DeleteInvite(userID, convoID, inviteID); err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleOwner)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AcceptInvite makes the user a member of the conversation of the
+// invite token in the URL and responds with the conversation. Tokens
+// that are malformed, forged, used, revoked or expired are all
+// reported as not found.
+func (c *Controller) AcceptInvite(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	tokenID, ok := c.verifyToken(inviteTokenContext, pat.Param(ctx, "token"))
+	if !ok {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	convoID, err := c.repo.AcceptInvite(userID, tokenID)
+	if err == errRecordNotFound {
+		respond.NotFound(ctx, w, r)
+		return
+	} else if err == errAlreadyMember {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
+			Action: "accept an invite to a conversation you are already a member of",
+		})
+		return
+	} else if err == errTooManyMembers {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
+			Action: fmt.Sprintf("add more than %d members to a conversation", maxMembers),
+		})
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	convo, err := c.repo.GetConversation(userID, convoID, 0)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if convo == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, convo)
+}
+
+func (c *Controller) ListMembers(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	members, err := c.repo.ListMembers(userID, convoID)
+	if err == errRecordNotFound {
+		respond.NotFound(ctx, w, r)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Type: "member",
+		Data: members,
+	})
+}
+
+// UpdateMember changes the role of a member to the `role` parameter.
+// A conversation always keeps at least one owner.
+func (c *Controller) UpdateMember(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+	memberID := pat.Param(ctx, "member")
+
+	role := r.PostFormValue("role")
+	if uerr := validateRole(role); uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	member, err := c.repo.UpdateMember(userID, convoID, memberID, role)
+	if err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleOwner)
+		return
+	} else if err == errLastOwner {
+		respondLastOwner(ctx, w)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, member)
+}
+
+// DeleteMember removes a member from a conversation. Owners can remove
+// anyone and other members can remove themselves.
+func (c *Controller) DeleteMember(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+	memberID := pat.Param(ctx, "member")
+
+	if err := c.repo.DeleteMember(userID, convoID, memberID); err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleOwner)
+		return
+	} else if err == errLastOwner {
+		respondLastOwner(ctx, w)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// missingRole returns the error for a change to a conversation that
+// found nothing to change. Members who can see the conversation but
+// whose role is below role are told so, while to everyone else the
+// conversation doesn't exist.
+func (c *Controller) missingRole(userID, convoID, role string) (usererrors.UserError, error) {
+	current, err := c.repo.GetRole(userID, convoID)
+	if err != nil {
+		return nil, err
+	}
+
+	if current != "" && roleRanks[current] < roleRanks[role] {
+		return RoleRequired{Role: role}, nil
+	}
+	return usererrors.NotFound{}, nil
+}
+
+func (c *Controller) respondMissingRole(ctx context.Context, w http.ResponseWriter, r *http.Request, convoID, role string) {
+	uerr, err := c.missingRole(mustUserID(ctx), convoID, role)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	if _, ok := uerr.(RoleRequired); ok {
+		respond.UserError(ctx, w, http.StatusForbidden, uerr)
+		return
+	}
+	respond.NotFound(ctx, w, r)
+}
+
+func respondLastOwner(ctx context.Context, w http.ResponseWriter) {
+	respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
+		Action: "remove the last owner of a conversation",
+	})
+}
+
+func validateRole(role string) usererrors.UserError {
+	if _, ok := roleRanks[role]; !ok {
+		return usererrors.InvalidParams{{
+			Params:  []string{"role"},
+			Message: fmt.Sprintf("must be one of '%s', '%s' or '%s'", RoleOwner, RoleEditor, RoleViewer),
+		}}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package say
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"goji.io/pat"
+	"goji.io/pattern"
+
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	randomMoodName   = "random"
+	maxMoodSetSize   = 100
+	maxMoodSetWeight = 1000
+)
+
+// MoodSetEntry is a mood within a MoodSet and its relative likelihood
+// of being chosen.
+type MoodSetEntry struct {
+	Mood   string `json:"mood"`
+	Weight int    `json:"weight"`
+}
+
+// MoodSet is a named, weighted collection of moods used to choose a
+// mood for lines created with `mood=random:<set>`.
+type MoodSet struct {
+	Name  string         `json:"name"`
+	Moods []MoodSetEntry `json:"moods"`
+
+	id int
+}
+
+func (s *MoodSet) Vars() map[pattern.Variable]string {
+	return map[pattern.Variable]string{
+		"set": s.Name,
+	}
+}
+
+// parseRandomMood reports whether name requests a random mood and
+// returns the name of the set to choose from, if any.
+func parseRandomMood(name string) (string, bool) {
+	if strings.EqualFold(name, randomMoodName) {
+		return "", true
+	}
+
+	prefix := randomMoodName + ":"
+	if len(name) > len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+		return name[len(prefix):], true
+	}
+
+	return "", false
+}
+
+// newRand returns a source of randomness for choosing moods. Selection
+// is deterministic if a seed is provided.
+func newRand(seedStr string) (*rand.Rand, error) {
+	var seed int64
+	if seedStr != "" {
+		var err error
+		seed, err = strconv.ParseInt(seedStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		rv, err := crand.Int(crand.Reader, big.NewInt(math.MaxInt64))
+		if err != nil {
+			return nil, fmt.Errorf("generating random seed: %v", err)
+		}
+		seed = rv.Int64()
+	}
+
+	return rand.New(rand.NewSource(seed)), nil
+}
+
+func (c *Controller) ListMoodSets(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	lArgs, uerr := getListArgs(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	sets, hasMore, err := c.repo.ListMoodSets(userID, lArgs)
+	if err == errCursorNotFound {
+		respondCursorNotFound(ctx, w, lArgs)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	var cursor string
+	if len(sets) > 0 {
+		cursor = sets[len(sets)-1].Name
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Cursor:  cursor,
+		Type:    "mood_set",
+		HasMore: hasMore,
+		Data:    sets,
+	})
+}
+
+func (c *Controller) GetMoodSet(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	name := pat.Param(ctx, "set")
+
+	set, err := c.repo.GetMoodSet(userID, name)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if set == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, set)
+}
+
+// SetMoodSet creates or replaces a mood set. Each `moods` parameter
+// names a mood with an optional weight in the form `<mood>:<weight>`.
+func (c *Controller) SetMoodSet(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	name := strings.Replace(pat.Param(ctx, "set"), "\x00", "", -1)
+
+	r.ParseForm()
+	values := r.PostForm["moods"]
+
+	var uerr usererrors.InvalidParams
+	if len(values) == 0 {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"moods"},
+			Message: "must include at least one mood",
+		})
+	} else if len(values) > maxMoodSetSize {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"moods"},
+			Message: fmt.Sprintf("must include no more than %d moods", maxMoodSetSize),
+		})
+	}
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	set := MoodSet{Name: strings.ToLower(name)}
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		entry := MoodSetEntry{
+			Mood:   strings.ToLower(strings.Replace(value, "\x00", "", -1)),
+			Weight: 1,
+		}
+
+		if i := strings.LastIndex(entry.Mood, ":"); i >= 0 {
+			weight, err := strconv.Atoi(entry.Mood[i+1:])
+			if err != nil || weight < 1 || weight > maxMoodSetWeight {
+				uerr = append(uerr, usererrors.InvalidParamsEntry{
+					Params:  []string{"moods"},
+					Message: fmt.Sprintf("weight for %q must be a positive integer no greater than %d", entry.Mood[:i], maxMoodSetWeight),
+				})
+				continue
+			}
+			entry.Mood = entry.Mood[:i]
+			entry.Weight = weight
+		}
+
+		if seen[entry.Mood] {
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"moods"},
+				Message: fmt.Sprintf("%q is included more than once", entry.Mood),
+			})
+			continue
+		}
+		seen[entry.Mood] = true
+
+		mood, err := c.repo.GetMood(userID, entry.Mood)
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+		if mood == nil {
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"moods"},
+				Message: fmt.Sprintf("%q does not exist", entry.Mood),
+			})
+			continue
+		}
+
+		set.Moods = append(set.Moods, entry)
+	}
+
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	if err := c.repo.SetMoodSet(userID, &set); err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, set)
+}
+
+func (c *Controller) DeleteMoodSet(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	name := pat.Param(ctx, "set")
+
+	if err := c.repo.DeleteMoodSet(userID, name); err == errRecordNotFound {
+		respond.NotFound(ctx, w, r)
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,98 @@
+package say
+
+import (
+	"net/http"
+
+	"github.com/metcalf/saypi/respond"
+
+	"golang.org/x/net/context"
+)
+
+// Quotas reported by QuotaExceeded and Usage
+const (
+	QuotaConversations        = "conversations"
+	QuotaLinesPerConversation = "lines_per_conversation"
+	QuotaMoods                = "moods"
+	QuotaTextBytes            = "text_bytes"
+)
+
+var quotaUnits = map[string]string{
+	QuotaConversations:        "conversations",
+	QuotaLinesPerConversation: "lines in a conversation",
+	QuotaMoods:                "moods",
+	QuotaTextBytes:            "bytes of text",
+}
+
+// Quotas limit what each user can store. A conversation counts against
+// the user who created it, as do its lines and the text of its lines
+// and their revisions, whichever member wrote them. Conversations and
+// lines in the trash count until they are purged. Zero fields are
+// unlimited.
+type Quotas struct {
+	Conversations        int64
+	LinesPerConversation int64
+	Moods                int64 // user-defined moods
+	TextBytes            int64
+}
+
+// Usage is what a user stores against each of their quotas.
+// LinesPerConversation is used by the conversation with the most
+// lines.
+type Usage struct {
+	Conversations        UsageEntry `json:"conversations"`
+	LinesPerConversation UsageEntry `json:"lines_per_conversation"`
+	Moods                UsageEntry `json:"moods"`
+	TextBytes            UsageEntry `json:"text_bytes"`
+}
+
+// UsageEntry is the usage of a quota. Limit is nil if the quota is
+// unlimited.
+type UsageEntry struct {
+	Used  int64  `json:"used"`
+	Limit *int64 `json:"limit"`
+}
+
+// usageDelta is what a change adds to the usage of a user.
+type usageDelta struct {
+	conversations, lines, moods, textBytes int64
+}
+
+// SetQuotas limits what each user can store. Users are not limited if
+// it is never called.
+func (c *Controller) SetQuotas(quotas Quotas) {
+	c.repo.quotas = quotas
+}
+
+func (c *Controller) GetUsage(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	usage, err := c.repo.GetUsage(userID)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, Usage{
+		Conversations:        usageEntry(usage.Conversations, c.repo.quotas.Conversations),
+		LinesPerConversation: usageEntry(usage.LinesPerConversation, c.repo.quotas.LinesPerConversation),
+		Moods:                usageEntry(usage.Moods, c.repo.quotas.Moods),
+		TextBytes:            usageEntry(usage.TextBytes, c.repo.quotas.TextBytes),
+	})
+}
+
+func usageEntry(used, limit int64) UsageEntry {
+	entry := UsageEntry{Used: used}
+	if limit > 0 {
+		entry.Limit = &limit
+	}
+	return entry
+}
+
+// linesUsage is the usage added by inserting lines.
+func linesUsage(lines ...Line) usageDelta {
+	d := usageDelta{lines: int64(len(lines))}
+	for _, line := range lines {
+		d.textBytes += int64(len(line.Text))
+	}
+	return d
+}
@@ -0,0 +1,267 @@
+package say
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"goji.io/pat"
+
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+// Layouts of a rendered conversation
+const (
+	LayoutStack = "stack"
+	LayoutChat  = "chat"
+)
+
+const (
+	defaultRenderWidth = 80
+	minRenderWidth     = 20
+	maxRenderWidth     = 2 * maxLineWidth
+	balloonPadding     = 4 // columns a balloon's border adds around its text
+)
+
+// renderOptions controls how renderConversation lays out the lines of
+// a conversation.
+type renderOptions struct {
+	layout      string
+	width       int
+	separator   string // drawn across the width between lines if not empty
+	lineNumbers bool
+	banner      bool
+}
+
+// speaker identifies who says a line for the chat layout.
+type speaker struct {
+	character, animal string
+}
+
+// RenderConversation renders every line of a conversation into a
+// single block of plain text. In the `chat` layout, lines are aligned
+// left or right within the `width` parameter, switching sides whenever
+// the speaker changes, and their text is wrapped to fit.
+// The `separator`, `line_numbers` and `banner` parameters add a
+// separator between lines, a number above each line and a box around
+// the heading.
+func (c *Controller) RenderConversation(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	opts, uerr := parseRenderOptions(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	convo, err := c.repo.GetConversation(userID, convoID, -1)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if convo == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	for i := range convo.Lines {
+		line := &convo.Lines[i]
+		if cow, ok := c.cows[line.Animal]; ok && opts.layout == LayoutChat {
+			line.Width = fitBalloon(line.Width, cow.maxWidth, opts.width)
+		}
+
+		line.Output, err = c.renderLine(line)
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+	}
+
+	respond.Raw(ctx, w, http.StatusOK, "text/plain; charset=utf-8", renderConversation(convo.Heading, convo.Lines, opts))
+}
+
+func parseRenderOptions(r *http.Request) (renderOptions, usererrors.UserError) {
+	var uerr usererrors.InvalidParams
+
+	opts := renderOptions{
+		layout:    r.FormValue("layout"),
+		width:     defaultRenderWidth,
+		separator: r.FormValue("separator"),
+	}
+
+	switch opts.layout {
+	case "":
+		opts.layout = LayoutStack
+	case LayoutStack, LayoutChat:
+	default:
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"layout"},
+			Message: fmt.Sprintf("must be either '%s' or '%s'", LayoutStack, LayoutChat),
+		})
+	}
+
+	if value := r.FormValue("width"); value != "" {
+		width, err := strconv.Atoi(value)
+		if err != nil || width < minRenderWidth || width > maxRenderWidth {
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"width"},
+				Message: fmt.Sprintf("must be an integer from %d to %d", minRenderWidth, maxRenderWidth),
+			})
+		}
+		opts.width = width
+	}
+
+	if opts.separator != "" {
+		sep, size := utf8.DecodeRuneInString(opts.separator)
+		if size != len(opts.separator) || !unicode.IsGraphic(sep) || unicode.IsSpace(sep) {
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"separator"},
+				Message: "must be a single visible character",
+			})
+		}
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *bool
+	}{
+		{"line_numbers", &opts.lineNumbers},
+		{"banner", &opts.banner},
+	} {
+		switch r.FormValue(param.name) {
+		case "", "false":
+		case "true":
+			*param.value = true
+		default:
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{param.name},
+				Message: "must be either 'true' or 'false'",
+			})
+		}
+	}
+
+	if uerr != nil {
+		return opts, uerr
+	}
+	return opts, nil
+}
+
+// renderConversation joins the rendered output of each line into a
+// single block of text. Lines are separated by a blank line unless
+// there is a separator. In the chat layout, lines are aligned left
+// until the speaker changes, then right until it changes again and so
+// on, keeping each line's art intact.
+func renderConversation(heading string, lines []Line, opts renderOptions) []byte {
+	var blocks [][]string
+
+	if opts.banner && heading != "" {
+		blocks = append(blocks, renderBanner(heading, opts.width))
+	}
+
+	var (
+		right bool
+		prev  speaker
+	)
+	for i, line := range lines {
+		block := strings.Split(strings.TrimRight(line.Output, "\n"), "\n")
+		if opts.lineNumbers {
+			block = append([]string{fmt.Sprintf("%d.", i+1)}, block...)
+		}
+
+		if opts.layout == LayoutChat {
+			key := speaker{line.Character, line.Animal}
+			if i > 0 && key != prev {
+				right = !right
+			}
+			prev = key
+			if right {
+				block = alignRight(block, opts.width)
+			}
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	var separator string
+	if opts.separator != "" {
+		separator = strings.Repeat(opts.separator, opts.width)
+	}
+
+	var buf bytes.Buffer
+	for i, block := range blocks {
+		if i > 0 {
+			buf.WriteString(separator + "\n")
+		}
+		for _, text := range block {
+			buf.WriteString(text + "\n")
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// renderBanner draws a box around the heading, centered within width
+// unless the heading is too long to fit.
+func renderBanner(heading string, width int) []string {
+	heading = strings.Join(strings.Fields(heading), " ")
+
+	n := utf8.RuneCountInString(heading)
+	inner := width - 2
+	if inner < n+2 {
+		inner = n + 2
+	}
+	left := (inner - n) / 2
+
+	border := "+" + strings.Repeat("-", inner) + "+"
+	return []string{
+		border,
+		"|" + strings.Repeat(" ", left) + heading + strings.Repeat(" ", inner-n-left) + "|",
+		border,
+	}
+}
+
+// fitBalloon returns the column at which to wrap the text of a line so
+// that its balloon fits within width, given the line's own wrap column
+// and the animal's default.
+func fitBalloon(wrap, defaultWrap, width int) int {
+	if wrap == 0 {
+		wrap = defaultWrap
+	}
+	if max := width - balloonPadding; wrap > max {
+		return max
+	}
+	return wrap
+}
+
+// alignRight indents every line of a block by the same amount so that
+// its widest line ends at width.
+func alignRight(block []string, width int) []string {
+	var max int
+	for _, text := range block {
+		if n := utf8.RuneCountInString(text); n > max {
+			max = n
+		}
+	}
+	if max >= width {
+		return block
+	}
+
+	indent := strings.Repeat(" ", width-max)
+	aligned := make([]string, len(block))
+	for i, text := range block {
+		aligned[i] = indent + text
+	}
+	return aligned
+}
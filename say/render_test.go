@@ -0,0 +1,120 @@
+package say
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/metcalf/saypi/usererrors"
+)
+
+func TestRenderConversation(t *testing.T) {
+	lines := []Line{
+		{Animal: "cow", Output: "A1\n"},
+		{Animal: "tux", Output: "B1\n"},
+		{Animal: "cow", Output: "A2\n"},
+		{Animal: "cow", Character: "Al", Output: "C1\n"},
+		{Animal: "cow", Character: "Al", Output: "C2\n"},
+		{Animal: "tux", Output: "B2\n"},
+	}
+	wide := []Line{lines[0], {Animal: "tux", Output: "0123456789AB\n"}}
+
+	cases := []struct {
+		heading string
+		lines   []Line
+		opts    renderOptions
+		expect  string
+	}{
+		{"Hi", lines[:4], renderOptions{layout: LayoutStack, width: 10}, "A1\n\nB1\n\nA2\n\nC1\n"},
+		{"", nil, renderOptions{layout: LayoutStack, width: 10}, ""},
+		// Sides switch with each change of speaker, and characters are
+		// distinct speakers from their animal
+		{
+			"", lines, renderOptions{layout: LayoutChat, width: 10},
+			"A1\n\n        B1\n\nA2\n\n        C1\n\n        C2\n\nB2\n",
+		},
+		{
+			"", lines[:2], renderOptions{layout: LayoutChat, width: 10, separator: "-", lineNumbers: true},
+			"1.\nA1\n----------\n        2.\n        B1\n",
+		},
+		// Blocks wider than the layout are left as they are
+		{"", wide, renderOptions{layout: LayoutChat, width: 10}, "A1\n\n0123456789AB\n"},
+		{"Hi", nil, renderOptions{layout: LayoutStack, width: 10, banner: true}, "+--------+\n|   Hi   |\n+--------+\n"},
+		{
+			"A long\nheading", lines[:1], renderOptions{layout: LayoutStack, width: 10, banner: true, separator: "="},
+			"+----------------+\n| A long heading |\n+----------------+\n==========\nA1\n",
+		},
+	}
+
+	for i, testcase := range cases {
+		got := string(renderConversation(testcase.heading, testcase.lines, testcase.opts))
+		if got != testcase.expect {
+			t.Errorf("%d: renderConversation(%#v) = %q but expected %q", i, testcase.opts, got, testcase.expect)
+		}
+	}
+}
+
+func TestFitBalloon(t *testing.T) {
+	cases := []struct {
+		wrap, defaultWrap, width, expect int
+	}{
+		{0, 40, 80, 40},
+		{0, 40, 30, 26},
+		{10, 40, 30, 10},
+		{60, 40, 80, 60},
+		{60, 40, 50, 46},
+	}
+
+	for i, testcase := range cases {
+		if got := fitBalloon(testcase.wrap, testcase.defaultWrap, testcase.width); got != testcase.expect {
+			t.Errorf("%d: fitBalloon(%d, %d, %d) = %d but expected %d", i,
+				testcase.wrap, testcase.defaultWrap, testcase.width, got, testcase.expect)
+		}
+	}
+}
+
+func TestParseRenderOptions(t *testing.T) {
+	cases := []struct {
+		query   string
+		expect  renderOptions
+		invalid []string
+	}{
+		{"", renderOptions{layout: LayoutStack, width: defaultRenderWidth}, nil},
+		{
+			"layout=chat&width=40&separator=%E2%94%80&line_numbers=true&banner=false",
+			renderOptions{layout: LayoutChat, width: 40, separator: "─", lineNumbers: true},
+			nil,
+		},
+		{"layout=grid&width=10", renderOptions{}, []string{"layout", "width"}},
+		{"separator=ab&banner=yes", renderOptions{}, []string{"separator", "banner"}},
+		// Spaces aren't visible
+		{"separator=+", renderOptions{}, []string{"separator"}},
+	}
+
+	for i, testcase := range cases {
+		r, err := http.NewRequest("GET", "/render?"+testcase.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts, uerr := parseRenderOptions(r)
+		if testcase.invalid == nil {
+			if uerr != nil {
+				t.Errorf("%d: unexpected error %s", i, uerr.Message())
+			} else if opts != testcase.expect {
+				t.Errorf("%d: got %#v but expected %#v", i, opts, testcase.expect)
+			}
+			continue
+		}
+
+		var params []string
+		if invalid, ok := uerr.(usererrors.InvalidParams); ok {
+			for _, entry := range invalid {
+				params = append(params, entry.Params...)
+			}
+		}
+		if !reflect.DeepEqual(params, testcase.invalid) {
+			t.Errorf("%d: expected invalid params %v but got %v", i, testcase.invalid, uerr)
+		}
+	}
+}
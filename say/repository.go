@@ -3,32 +3,55 @@ package say
 import (
 	"crypto/rand"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"math/big"
+	mrand "math/rand"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 )
 
 const (
-	maxInsertRetries = 16
-	convoIDPrefix    = "cv_"
-	lineIDPrefix     = "ln_"
-	dbErrDupUnique   = "23505"
-	dbErrFKViolation = "23503"
+	maxInsertRetries  = 16
+	convoIDPrefix     = "cv_"
+	lineIDPrefix      = "ln_"
+	shareIDPrefix     = "sh_"
+	memberIDPrefix    = "mb_"
+	inviteIDPrefix    = "in_"
+	characterIDPrefix = "ch_"
+	webhookIDPrefix   = "wh_"
+	deliveryIDPrefix  = "dl_"
+	dbErrDupUnique    = "23505"
+	dbErrFKViolation  = "23503"
+	reaperLockKey     = 0x73617970 // advisory lock held while reaping
+	webhookLockKey    = 0x77656268 // advisory lock held with a user while adding their webhooks
+	quotaLockKey      = 0x71756f74 // advisory lock held with a user while checking their quotas
 
 	listMoods = `
 SELECT id as int_id, name, eyes, tongue
 FROM moods
 WHERE user_id = :user_id AND
-  (:cursor_id < 0 OR id %s :cursor_id)
-ORDER BY 1 %s
-LIMIT :limit + 1
+  (:cursor_id < 0 OR id %s :cursor_id) AND
+  name LIKE :prefix_pattern AND name LIKE :contains_pattern
+ORDER BY id %s
+LIMIT :limit
+`
+	listMoodsByName = `
+SELECT id as int_id, name, eyes, tongue
+FROM moods
+WHERE user_id = :user_id AND
+  (:cursor_name = '' OR name COLLATE "C" %s :cursor_name) AND
+  name LIKE :prefix_pattern AND name LIKE :contains_pattern
+ORDER BY name COLLATE "C" %s
+LIMIT :limit
 `
 	findMood = `
 SELECT id as int_id, eyes, tongue, name
@@ -53,37 +76,247 @@ inserted as (
   WHERE NOT EXISTS (SELECT * FROM updated)
   RETURNING id
 )
-SELECT id FROM updated UNION ALL SELECT id FROM inserted
+SELECT id, false as inserted FROM updated UNION ALL SELECT id, true FROM inserted
+`
+
+	// Returns no rows if the user already has a mood with the name
+	insertMood = `
+INSERT INTO moods (user_id, name, eyes, tongue)
+VALUES (:user_id, lower(:name), :eyes, :tongue)
+ON CONFLICT (user_id, lower(name)) DO NOTHING
+RETURNING id
+`
+	countMoods = `
+SELECT count(*) FROM moods WHERE user_id = :user_id
+`
+	// Finds the user's moods named like built-in moods, which can only
+	// happen if the mood was added to the catalog after the user
+	// defined it
+	findShadowedBuiltins = `
+SELECT lower(name)
+FROM moods
+WHERE user_id = :user_id AND lower(name) = ANY(:names)
+`
+	nthMood = `
+SELECT id as int_id, name, eyes, tongue
+FROM moods
+WHERE user_id = :user_id
+ORDER BY id ASC
+OFFSET :offset
+LIMIT 1
+`
+
+	listMoodSets = `
+SELECT id as int_id, name
+FROM mood_sets
+WHERE user_id = :user_id AND
+  (:cursor_id < 0 OR id %s :cursor_id)
+ORDER BY 1 %s
+LIMIT :limit
+`
+	findMoodSet = `
+SELECT id as int_id, name
+FROM mood_sets
+WHERE user_id = :user_id AND lower(name) = lower(:name)
+`
+	findMoodSetEntries = `
+SELECT mood_set_id, mood_name as mood, weight
+FROM mood_set_entries
+WHERE mood_set_id = ANY(:sets)
+ORDER BY mood_set_id, mood_name
+`
+	deleteMoodSet = `
+DELETE FROM mood_sets
+WHERE user_id = :user_id AND lower(name) = lower(:name)
+`
+	// Updating the name of an existing set locks it until its entries
+	// are replaced.
+	setMoodSet = `
+INSERT INTO mood_sets (user_id, name)
+VALUES (:user_id, lower(:name))
+ON CONFLICT (user_id, lower(name)) DO UPDATE SET name = EXCLUDED.name
+RETURNING id
+`
+	clearMoodSet = `
+DELETE FROM mood_set_entries WHERE mood_set_id = :id
+`
+	insertMoodSetEntry = `
+INSERT INTO mood_set_entries (mood_set_id, mood_name, weight)
+SELECT :id, lower(:mood), :weight
+`
+
+	findSentimentMoods = `
+SELECT min_score, mood_name as mood
+FROM sentiment_moods
+WHERE user_id = :user_id
+ORDER BY min_score ASC
+`
+	clearSentimentMoods = `
+DELETE FROM sentiment_moods WHERE user_id = :user_id
+`
+	insertSentimentMood = `
+INSERT INTO sentiment_moods (user_id, min_score, mood_name)
+SELECT :user_id, :min_score, lower(:mood)
+`
+
+	findPublisher = `
+SELECT name FROM publishers WHERE user_id = :user_id
+`
+	insertPublisher = `
+INSERT INTO publishers (user_id, name)
+SELECT :user_id, lower(:name)
+`
+	publishMood = `
+UPDATE moods SET published_at = COALESCE(published_at, NOW())
+WHERE user_id = :user_id AND lower(name) = lower(:name)
+RETURNING id
+`
+	unpublishMood = `
+UPDATE moods SET published_at = NULL
+WHERE user_id = :user_id AND lower(name) = lower(:name)
+RETURNING id
+`
+	galleryMoods = `
+SELECT moods.id as int_id, moods.user_id, moods.name, eyes, tongue,
+  publishers.name as publisher, install_count as installs,
+  published_at IS NOT NULL as published,
+  EXISTS (
+    SELECT * FROM mood_installs
+    WHERE mood_id = moods.id AND mood_installs.user_id = :user_id
+  ) as installed
+FROM moods
+INNER JOIN publishers ON moods.user_id = publishers.user_id
+`
+	findGalleryMood = galleryMoods + `
+WHERE lower(publishers.name) = lower(:publisher) AND lower(moods.name) = lower(:name)
+`
+	// Filled with a cursor condition and an ordering
+	listGallery = galleryMoods + `
+WHERE
+  ((NOT :installed AND published_at IS NOT NULL) OR
+   (:installed AND EXISTS (
+     SELECT * FROM mood_installs
+     WHERE mood_id = moods.id AND mood_installs.user_id = :user_id
+   ))) AND
+  (:publisher = '' OR lower(publishers.name) = lower(:publisher)) AND
+  (moods.name LIKE :pattern OR publishers.name LIKE :pattern) AND
+  (:cursor_id < 0 OR %s)
+ORDER BY %s
+LIMIT :limit
+`
+	findMoodReference = `
+SELECT moods.id as int_id, eyes, tongue
+FROM moods
+INNER JOIN publishers ON moods.user_id = publishers.user_id
+WHERE lower(publishers.name) = lower(:publisher) AND lower(moods.name) = lower(:name) AND
+  (moods.user_id = :user_id OR EXISTS (
+    SELECT * FROM mood_installs
+    WHERE mood_id = moods.id AND mood_installs.user_id = :user_id
+  ))
+`
+	installMood = `
+WITH inserted as (
+  INSERT INTO mood_installs (mood_id, user_id)
+  SELECT :mood_id, :user_id
+  WHERE NOT EXISTS (
+    SELECT * FROM mood_installs WHERE mood_id = :mood_id AND user_id = :user_id
+  )
+  RETURNING mood_id
+)
+UPDATE moods SET install_count = install_count + 1
+WHERE id IN (SELECT mood_id FROM inserted)
+`
+	uninstallMood = `
+WITH deleted as (
+  DELETE FROM mood_installs WHERE mood_id = :mood_id AND user_id = :user_id
+  RETURNING mood_id
+)
+UPDATE moods SET install_count = install_count - 1
+WHERE id IN (SELECT mood_id FROM deleted)
 `
 
+	// Matches conversations in which the user has one of :roles
+	hasRole = `EXISTS (
+  SELECT 1 FROM members
+  WHERE
+    members.conversation_id = conversations.id AND members.user_id = :user_id AND
+    members.role = ANY(CAST(:roles AS TEXT[]))
+)`
+	// Selects the role of the user in the conversation
+	selectRole = `(
+  SELECT role FROM members
+  WHERE members.conversation_id = conversations.id AND members.user_id = :user_id
+) as role`
+	// Matches conversations that are neither deleted nor expired, as
+	// expired ones are only deleted once the reaper gets to them
+	isLive = `conversations.deleted_at IS NULL AND
+  (conversations.expires_at IS NULL OR conversations.expires_at > NOW())`
+
 	listConvos = `
-SELECT id as int_id, public_id as id, heading
+SELECT id as int_id, public_id as id, heading,
+  coalesce((
+    SELECT public_id FROM conversations parent
+    WHERE parent.id = conversations.parent_id AND parent.deleted_at IS NULL
+  ), '') as parent_id,
+  CAST(extract(epoch from expires_at) AS BIGINT) as expires,
+  ` + selectRole + `
 FROM conversations
-WHERE user_id = :user_id AND
+WHERE ` + hasRole + ` AND ` + isLive + ` AND
   (:cursor_id < 0 OR id %s :cursor_id)
 ORDER BY 1 %s
 LIMIT :limit
 `
 	insertConvo = `
-INSERT INTO conversations (public_id, user_id, heading)
-SELECT :public_id, :user_id, :heading
-RETURNING id
+INSERT INTO conversations (public_id, user_id, heading, search, expires_at)
+SELECT
+  :public_id, :user_id, :heading, to_tsvector('english', :heading),
+  NOW() + CAST(:expires_in AS DOUBLE PRECISION) * interval '1 second'
+RETURNING id, CAST(extract(epoch from expires_at) AS BIGINT) as expires
 `
 	getConvo = `
-SELECT id as int_id, public_id as id, heading FROM conversations
-WHERE user_id = :user_id AND public_id = :public_id
+SELECT id as int_id, public_id as id, heading,
+  coalesce((
+    SELECT public_id FROM conversations parent
+    WHERE parent.id = conversations.parent_id AND parent.deleted_at IS NULL
+  ), '') as parent_id,
+  CAST(extract(epoch from expires_at) AS BIGINT) as expires,
+  ` + selectRole + `
+FROM conversations
+WHERE public_id = :public_id AND ` + isLive + ` AND ` + hasRole + `
 `
 	deleteConvo = `
-DELETE FROM conversations
-WHERE user_id = :user_id AND public_id = :public_id
+UPDATE conversations SET deleted_at = NOW()
+WHERE public_id = :public_id AND ` + isLive + ` AND ` + hasRole + `
+`
+	restoreConvo = `
+UPDATE conversations SET deleted_at = NULL
+WHERE public_id = :public_id AND deleted_at IS NOT NULL AND ` + hasRole + `
 `
 
 	findConvoLines = `
-SELECT public_id as id, animal, think, text, mood_name, eyes, tongue
+SELECT
+  lines.public_id as id, lines.animal, think, width, text, lines.mood_name, lines.mood_id, sentiment, eyes, tongue,
+  lines.character_id, coalesce(characters.name, '') as character,
+  characters.mood_name as character_mood, characters.facing
 FROM lines
 LEFT JOIN moods ON lines.mood_id = moods.id
-WHERE conversation_id = :id
-ORDER BY lines.id ASC
+LEFT JOIN characters ON lines.character_id = characters.id
+WHERE lines.conversation_id = :id AND lines.deleted_at IS NULL
+ORDER BY lines.position ASC
+LIMIT :limit
+`
+	listLines = `
+SELECT
+  lines.public_id as id, lines.animal, think, width, text, lines.mood_name, lines.mood_id, sentiment, eyes, tongue,
+  lines.character_id, coalesce(characters.name, '') as character,
+  characters.mood_name as character_mood, characters.facing
+FROM lines
+LEFT JOIN moods ON lines.mood_id = moods.id
+LEFT JOIN characters ON lines.character_id = characters.id
+WHERE lines.conversation_id = :conversation_id AND lines.deleted_at IS NULL AND
+  (:cursor_position < 0 OR position %s :cursor_position)
+ORDER BY position %s
+LIMIT :limit
 `
 	findMoodLines = `
 SELECT public_id as id
@@ -93,33 +326,697 @@ WHERE user_id = :user_id AND mood_name = :name
 ORDER BY lines.id ASC
 `
 	insertLine = `
-INSERT INTO LINES (public_id, animal, think, text, mood_name, mood_id, conversation_id)
-SELECT :public_id, :animal, :think, :text, :mood_name, :mood_id, :conversation_id
+INSERT INTO LINES (public_id, animal, think, width, text, mood_name, mood_id, sentiment, character_id, conversation_id, position, search)
+SELECT :public_id, :animal, :think, :width, :text, :mood_name, :mood_id, :sentiment, :character_id, :conversation_id, :position,
+  to_tsvector('english', :text)
 `
 	getLine = `
-SELECT lines.public_id as id, animal, think, text, mood_name, eyes, tongue
+SELECT
+  lines.public_id as id, lines.animal, think, width, text, lines.mood_name, lines.mood_id, sentiment, eyes, tongue,
+  lines.character_id, coalesce(characters.name, '') as character,
+  characters.mood_name as character_mood, characters.facing
 FROM lines
 LEFT JOIN moods ON lines.mood_id = moods.id
+LEFT JOIN characters ON lines.character_id = characters.id
 INNER JOIN conversations ON lines.conversation_id = conversations.id
 WHERE
   conversations.public_id = :convo_id AND
-  conversations.user_id = :user_id AND
-  lines.public_id = :line_id
+  ` + hasRole + ` AND
+  ` + isLive + ` AND
+  lines.public_id = :line_id AND
+  lines.deleted_at IS NULL
 `
-	deleteLine = `
-DELETE FROM lines
+	lockConvo = `
+SELECT id as int_id, public_id as id, heading, user_id as creator, ` + selectRole + `
+FROM conversations
+WHERE public_id = :public_id AND ` + isLive + ` AND ` + hasRole + `
+FOR UPDATE
+`
+	insertConvoRevision = `
+INSERT INTO conversation_revisions (conversation_id, user_id, heading)
+SELECT id, :user_id, heading FROM conversations WHERE id = :id
+`
+	findConvoRevisions = `
+SELECT
+  CAST(row_number() OVER (ORDER BY conversation_revisions.id) AS INTEGER) as revision,
+  conversation_revisions.heading,
+  CAST(extract(epoch from conversation_revisions.created_at) AS BIGINT) as edited,
+  coalesce(editors.public_id, '') as edited_by,
+  conversation_revisions.user_id = :user_id as self
+FROM conversation_revisions
+INNER JOIN conversations ON conversation_revisions.conversation_id = conversations.id
+LEFT JOIN members editors ON
+  editors.conversation_id = conversations.id AND editors.user_id = conversation_revisions.user_id
+WHERE
+  conversations.public_id = :convo_id AND
+  ` + hasRole + ` AND
+  ` + isLive + `
+ORDER BY conversation_revisions.id ASC
+`
+	updateConvo = `
+UPDATE conversations SET
+  heading = :heading, search = to_tsvector('english', :heading)
+WHERE id = :id
+`
+	lockLine = `
+SELECT lines.id, conversations.id as conversation_id, conversations.user_id as creator
+FROM lines
+INNER JOIN conversations ON lines.conversation_id = conversations.id
+WHERE
+  conversations.public_id = :convo_id AND
+  ` + hasRole + ` AND
+  ` + isLive + ` AND
+  lines.public_id = :line_id AND
+  lines.deleted_at IS NULL
+FOR UPDATE OF lines
+`
+	// Called with the line locked so the revision number is safe. Skips
+	// lines that the update would leave unchanged.
+	insertLineRevision = `
+INSERT INTO line_revisions
+  (line_id, revision, user_id, animal, think, width, text, mood_name, mood_id, sentiment)
+SELECT
+  id, (SELECT count(*) + 1 FROM line_revisions WHERE line_id = :id),
+  :user_id, animal, think, width, text, mood_name, mood_id, sentiment
+FROM lines
+WHERE id = :id AND
+  (animal, think, width, text, mood_name, mood_id, sentiment) IS DISTINCT FROM (
+    CAST(:animal AS TEXT), CAST(:think AS BOOLEAN), CAST(:width AS INTEGER),
+    CAST(:text AS TEXT), CAST(:mood_name AS TEXT), CAST(:mood_id AS INTEGER),
+    CAST(:sentiment AS DOUBLE PRECISION)
+  )
+`
+	updateLine = `
+UPDATE lines SET
+  animal = :animal, think = :think, width = :width, text = :text,
+  mood_name = :mood_name, mood_id = :mood_id, sentiment = :sentiment,
+  search = to_tsvector('english', :text)
+WHERE id = :id
+`
+	findLineRevisions = `
+SELECT
+  revision, animal, think, width, text, mood_name, sentiment,
+  CAST(extract(epoch from line_revisions.created_at) AS BIGINT) as edited,
+  coalesce(editors.public_id, '') as edited_by,
+  line_revisions.user_id = :user_id as self
+FROM line_revisions
+INNER JOIN lines ON line_revisions.line_id = lines.id
+INNER JOIN conversations ON lines.conversation_id = conversations.id
+LEFT JOIN members editors ON
+  editors.conversation_id = conversations.id AND editors.user_id = line_revisions.user_id
+WHERE
+  conversations.public_id = :convo_id AND
+  ` + hasRole + ` AND
+  ` + isLive + ` AND
+  lines.public_id = :line_id AND
+  lines.deleted_at IS NULL
+ORDER BY revision ASC
+`
+	findLinePosition = `
+SELECT id, position FROM lines
+WHERE conversation_id = :conversation_id AND public_id = :line_id AND deleted_at IS NULL
+`
+	// Positions include deleted lines so that they can be restored
+	nextLinePosition = `
+SELECT coalesce(max(position) + 1, 0) FROM lines
+WHERE conversation_id = :conversation_id
+`
+	// Called with the conversation locked so that positions are stable
+	shiftLines = `
+UPDATE lines SET position = position + 1
+WHERE conversation_id = :conversation_id AND position >= :position AND id <> :id
+`
+	moveLine = `
+UPDATE lines SET position = :position WHERE id = :id
+`
+	// Snippets mark matches with control characters, stripped from the
+	// text itself, so that the rest of the text can be escaped.
+	searchHits = `
+WITH query AS (SELECT plainto_tsquery('english', :query) AS q),
+hits AS (
+  SELECT
+    conversations.public_id AS id, 'conversation' AS type,
+    conversations.public_id AS conversation_id, '' AS line_id, heading,
+    ts_headline(
+      'english', translate(heading, chr(1) || chr(2), ''), q,
+      'HighlightAll=true, StartSel=' || chr(1) || ', StopSel=' || chr(2)
+    ) AS snippet,
+    ts_rank(search, q) AS rank
+  FROM conversations, query
+  WHERE ` + hasRole + ` AND ` + isLive + ` AND search @@ q
+  UNION ALL
+  SELECT
+    lines.public_id, 'line',
+    conversations.public_id, lines.public_id, heading,
+    ts_headline(
+      'english', translate(text, chr(1) || chr(2), ''), q,
+      'MinWords=5, MaxWords=20, StartSel=' || chr(1) || ', StopSel=' || chr(2)
+    ),
+    ts_rank(lines.search, q)
+  FROM lines
+  INNER JOIN conversations ON lines.conversation_id = conversations.id, query
+  WHERE
+    ` + hasRole + ` AND ` + isLive + ` AND
+    lines.deleted_at IS NULL AND lines.search @@ q
+)
+`
+	countSearchCursor = searchHits + `
+SELECT count(*) FROM hits WHERE id = :cursor_id
+`
+	// Filled with the direction of the cursor and ordering. The best
+	// hits come first.
+	listSearchHits = searchHits + `
+SELECT id, type, conversation_id, line_id, heading, snippet
+FROM hits
+WHERE :cursor_id = '' OR (rank, id) %s (SELECT rank, id FROM hits WHERE id = :cursor_id)
+ORDER BY rank %s, id %s
+LIMIT :limit
+`
+	forkConvo = `
+INSERT INTO conversations (public_id, user_id, heading, search, parent_id)
+SELECT :public_id, :user_id, :heading, to_tsvector('english', :heading), :parent_id
+RETURNING id
+`
+	countForkLines = `
+SELECT count(*) FROM lines
+WHERE conversation_id = :parent_id AND deleted_at IS NULL AND (:through < 0 OR position <= :through)
+`
+	// Copies the moods of other users used by the lines being forked to
+	// the user, keeping any mood the user already has with the name
+	forkMoods = `
+INSERT INTO moods (user_id, name, eyes, tongue)
+SELECT DISTINCT ON (lower(moods.name)) :user_id, lower(moods.name), moods.eyes, moods.tongue
+FROM lines
+INNER JOIN moods ON lines.mood_id = moods.id
+WHERE
+  lines.conversation_id = :parent_id AND lines.deleted_at IS NULL AND
+  (:through < 0 OR lines.position <= :through) AND moods.user_id <> :user_id
+ORDER BY lower(moods.name), moods.id
+ON CONFLICT (user_id, lower(name)) DO NOTHING
+`
+	// Copies characters in order, pairing each with one of the new
+	// public IDs
+	forkCharacters = `
+INSERT INTO characters (public_id, conversation_id, name, animal, mood_name, facing)
+SELECT ids.public_id, :id, name, animal, mood_name, facing
+FROM (
+  SELECT *, row_number() OVER (ORDER BY id) AS n
+  FROM characters
+  WHERE conversation_id = :parent_id
+) AS source
+INNER JOIN unnest(CAST(:public_ids AS TEXT[])) WITH ORDINALITY AS ids(public_id, n) ON source.n = ids.n
+`
+	// Copies lines in order, pairing each with one of the new public
+	// IDs, with the user's mood of the same name as its mood and with
+	// the copy of its character
+	forkLines = `
+INSERT INTO lines (public_id, animal, think, width, text, mood_name, mood_id, sentiment, character_id, conversation_id, position, search)
+SELECT
+  ids.public_id, animal, think, width, text, mood_name,
+  (
+    SELECT own.id FROM moods own
+    INNER JOIN moods original ON lower(own.name) = lower(original.name)
+    WHERE original.id = source.mood_id AND own.user_id = :user_id
+  ),
+  sentiment,
+  (
+    SELECT forked.id FROM characters forked
+    INNER JOIN characters original ON forked.name = original.name
+    WHERE original.id = source.character_id AND forked.conversation_id = :id
+  ),
+  :id, position, search
+FROM (
+  SELECT *, row_number() OVER (ORDER BY position) AS n
+  FROM lines
+  WHERE conversation_id = :parent_id AND deleted_at IS NULL AND (:through < 0 OR position <= :through)
+) AS source
+INNER JOIN unnest(CAST(:public_ids AS TEXT[])) WITH ORDINALITY AS ids(public_id, n) ON source.n = ids.n
+`
+	insertShare = `
+INSERT INTO shares (public_id, token_id, conversation_id, expires_at)
+SELECT :public_id, :token_id, id, NOW() + CAST(:expires_in AS INTEGER) * interval '1 second'
+FROM conversations
+WHERE public_id = :convo_id AND ` + isLive + ` AND ` + hasRole + `
+RETURNING
+  CAST(extract(epoch from created_at) AS BIGINT) as created,
+  CAST(extract(epoch from expires_at) AS BIGINT) as expires
+`
+	listShares = `
+SELECT
+  shares.public_id as id, token_id,
+  CAST(extract(epoch from shares.created_at) AS BIGINT) as created,
+  CAST(extract(epoch from expires_at) AS BIGINT) as expires
+FROM shares
+WHERE conversation_id = :conversation_id
+ORDER BY id ASC
+`
+	// Finds the share along with one of the owners of the conversation
+	// to read it as
+	findShare = `
+SELECT
+  shares.public_id as id, conversations.public_id as conversation_id,
+  (
+    SELECT user_id FROM members
+    WHERE members.conversation_id = conversations.id AND members.role = 'owner'
+    ORDER BY members.id ASC
+    LIMIT 1
+  ) as user_id
+FROM shares
+INNER JOIN conversations ON shares.conversation_id = conversations.id
+WHERE
+  token_id = :token_id AND (shares.expires_at IS NULL OR shares.expires_at > NOW()) AND
+  ` + isLive + `
+`
+	deleteShare = `
+DELETE FROM shares
 USING conversations
+WHERE
+  shares.conversation_id = conversations.id AND
+  conversations.public_id = :convo_id AND
+  ` + hasRole + ` AND
+  shares.public_id = :share_id
+`
+	deleteLine = `
+UPDATE lines SET deleted_at = NOW()
+FROM conversations
+WHERE
+  lines.conversation_id = conversations.id AND
+  conversations.public_id = :convo_id AND
+  ` + hasRole + ` AND
+  ` + isLive + ` AND
+  lines.public_id = :line_id AND
+  lines.deleted_at IS NULL
+`
+	restoreLine = `
+UPDATE lines SET deleted_at = NULL
+FROM conversations
 WHERE
   lines.conversation_id = conversations.id AND
   conversations.public_id = :convo_id AND
-  conversations.user_id = :user_id AND
-  lines.public_id = :line_id
+  ` + hasRole + ` AND
+  ` + isLive + ` AND
+  lines.public_id = :line_id AND
+  lines.deleted_at IS NOT NULL
+`
+	// Lines of deleted conversations are restored with the
+	// conversation so only lines deleted on their own are listed.
+	// Conversations are only listed for their owners and lines for
+	// those with one of :roles.
+	trashItems = `
+WITH items AS (
+  SELECT
+    public_id AS id, 'conversation' AS type, public_id AS conversation_id,
+    heading, '' AS text, deleted_at
+  FROM conversations
+  WHERE deleted_at IS NOT NULL AND EXISTS (
+    SELECT 1 FROM members
+    WHERE
+      members.conversation_id = conversations.id AND members.user_id = :user_id AND
+      members.role = 'owner'
+  )
+  UNION ALL
+  SELECT
+    lines.public_id, 'line', conversations.public_id,
+    heading, text, lines.deleted_at
+  FROM lines
+  INNER JOIN conversations ON lines.conversation_id = conversations.id
+  WHERE
+    ` + hasRole + ` AND ` + isLive + ` AND
+    lines.deleted_at IS NOT NULL
+)
+`
+	countTrashCursor = trashItems + `
+SELECT count(*) FROM items WHERE id = :cursor_id
+`
+	// Filled with the direction of the cursor and ordering. The most
+	// recently deleted items come first.
+	listTrash = trashItems + `
+SELECT id, type, conversation_id, heading, text, CAST(extract(epoch from deleted_at) AS BIGINT) as deleted
+FROM items
+WHERE :cursor_id = '' OR (deleted_at, id) %s (SELECT deleted_at, id FROM items WHERE id = :cursor_id)
+ORDER BY deleted_at %s, id %s
+LIMIT :limit
+`
+	purgeConvos = `
+DELETE FROM conversations
+WHERE deleted_at < NOW() - CAST(:retention AS DOUBLE PRECISION) * interval '1 second'
+`
+	// Takes the text of the purged lines and their revisions off the
+	// text_bytes of their conversations and counts the purged lines
+	purgeLines = `
+WITH
+purged AS (
+  DELETE FROM lines
+  WHERE deleted_at < NOW() - CAST(:retention AS DOUBLE PRECISION) * interval '1 second'
+  RETURNING id, conversation_id, octet_length(text) as bytes
+),
+freed AS (
+  SELECT conversation_id, CAST(sum(bytes) AS BIGINT) as bytes FROM (
+    SELECT conversation_id, bytes FROM purged
+    UNION ALL
+    SELECT purged.conversation_id, octet_length(line_revisions.text)
+    FROM line_revisions
+    INNER JOIN purged ON line_revisions.line_id = purged.id
+  ) AS texts
+  GROUP BY conversation_id
+),
+updated AS (
+  UPDATE conversations SET text_bytes = conversations.text_bytes - freed.bytes
+  FROM freed
+  WHERE conversations.id = freed.conversation_id
+)
+SELECT count(*) FROM purged
+`
+	// Fails rather than waiting if another process holds the lock
+	lockReaper = `
+SELECT pg_try_advisory_xact_lock(CAST(:key AS BIGINT))
+`
+	// Deletes a batch of the conversations that expired first,
+	// whether or not they are in the trash
+	reapConvos = `
+DELETE FROM conversations
+WHERE id IN (
+  SELECT id FROM conversations
+  WHERE expires_at <= NOW()
+  ORDER BY expires_at ASC
+  LIMIT :limit
+)
+RETURNING public_id
+`
+	findMoodByFace = `
+SELECT id as int_id, eyes, tongue, name
+FROM moods
+WHERE user_id = :user_id AND eyes = :eyes AND tongue = :tongue
+ORDER BY lower(name) ASC
+LIMIT 1
+`
+	insertCharacter = `
+INSERT INTO characters (public_id, conversation_id, name, animal, mood_name, facing)
+VALUES (:public_id, :conversation_id, :name, :animal, :mood_name, :facing)
+RETURNING id as int_id, CAST(extract(epoch from created_at) AS BIGINT) as created
+`
+	// Counts every character of the conversation and those with the name
+	countCharacters = `
+SELECT count(*) as total, coalesce(sum(CASE WHEN name = :name THEN 1 ELSE 0 END), 0) as named
+FROM characters
+WHERE conversation_id = :conversation_id
+`
+	listCharacters = `
+SELECT
+  id as int_id, public_id as id, name, animal, mood_name, facing,
+  CAST(extract(epoch from created_at) AS BIGINT) as created
+FROM characters
+WHERE conversation_id = :conversation_id
+ORDER BY id ASC
+`
+	findCharacter = `
+SELECT
+  characters.id as int_id, characters.public_id as id, name, animal, mood_name, facing,
+  CAST(extract(epoch from characters.created_at) AS BIGINT) as created
+FROM characters
+INNER JOIN conversations ON characters.conversation_id = conversations.id
+WHERE
+  conversations.public_id = :convo_id AND
+  ` + hasRole + ` AND
+  ` + isLive + ` AND
+  characters.name = :name
+`
+	deleteCharacter = `
+DELETE FROM characters
+USING conversations
+WHERE
+  characters.conversation_id = conversations.id AND
+  conversations.public_id = :convo_id AND
+  ` + hasRole + ` AND
+  ` + isLive + ` AND
+  characters.public_id = :character_id
+`
+	insertMember = `
+INSERT INTO members (public_id, conversation_id, user_id, role)
+VALUES (:public_id, :conversation_id, :user_id, :role)
+`
+	getRole = `
+SELECT role
+FROM members
+INNER JOIN conversations ON members.conversation_id = conversations.id
+WHERE
+  conversations.public_id = :convo_id AND
+  ` + isLive + ` AND
+  members.user_id = :user_id
+`
+	// Counts every member of the conversation, its owners and the user
+	countMembers = `
+SELECT
+  count(*) as total,
+  coalesce(sum(CASE WHEN role = 'owner' THEN 1 ELSE 0 END), 0) as owners,
+  coalesce(sum(CASE WHEN user_id = :user_id THEN 1 ELSE 0 END), 0) as self
+FROM members
+WHERE conversation_id = :conversation_id
+`
+	listMembers = `
+SELECT
+  public_id as id, role, user_id = :user_id as self,
+  CAST(extract(epoch from created_at) AS BIGINT) as created
+FROM members
+WHERE conversation_id = :conversation_id
+ORDER BY id ASC
+`
+	findMember = `
+SELECT
+  id as int_id, public_id as id, user_id, role, user_id = :user_id as self,
+  CAST(extract(epoch from created_at) AS BIGINT) as created
+FROM members
+WHERE conversation_id = :conversation_id AND public_id = :member_id
+`
+	updateMember = `
+UPDATE members SET role = :role WHERE id = :id
+`
+	deleteMember = `
+DELETE FROM members WHERE id = :id
+`
+	insertInvite = `
+INSERT INTO invites (public_id, token_id, conversation_id, role, expires_at)
+SELECT :public_id, :token_id, id, :role, NOW() + CAST(:expires_in AS DOUBLE PRECISION) * interval '1 second'
+FROM conversations
+WHERE public_id = :convo_id AND ` + isLive + ` AND ` + hasRole + `
+RETURNING
+  CAST(extract(epoch from created_at) AS BIGINT) as created,
+  CAST(extract(epoch from expires_at) AS BIGINT) as expires
+`
+	listInvites = `
+SELECT
+  public_id as id, token_id, role,
+  CAST(extract(epoch from created_at) AS BIGINT) as created,
+  CAST(extract(epoch from expires_at) AS BIGINT) as expires
+FROM invites
+WHERE conversation_id = :conversation_id AND expires_at > NOW()
+ORDER BY id ASC
+`
+	// Locks the conversation along with the invite so that members
+	// are added one at a time
+	lockInvite = `
+SELECT invites.id, conversations.id as conversation_id, conversations.public_id as convo_id, role
+FROM invites
+INNER JOIN conversations ON invites.conversation_id = conversations.id
+WHERE token_id = :token_id AND invites.expires_at > NOW() AND ` + isLive + `
+FOR UPDATE
+`
+	useInvite = `
+DELETE FROM invites WHERE id = :id
+`
+	deleteInvite = `
+DELETE FROM invites
+USING conversations
+WHERE
+  invites.conversation_id = conversations.id AND
+  conversations.public_id = :convo_id AND
+  ` + hasRole + ` AND
+  invites.public_id = :invite_id
+`
+	// Sums what the user stores against their quotas. Conversations
+	// and lines in the trash count until they are purged.
+	getUsage = `
+SELECT
+  (SELECT count(*) FROM conversations WHERE user_id = :user_id) as conversations,
+  (SELECT count(*) FROM moods WHERE user_id = :user_id) as moods,
+  coalesce((
+    SELECT max(counts.lines) FROM (
+      SELECT count(*) as lines FROM lines
+      INNER JOIN conversations ON lines.conversation_id = conversations.id
+      WHERE conversations.user_id = :user_id
+      GROUP BY lines.conversation_id
+    ) counts
+  ), 0) as lines_per_conversation,
+  (
+    SELECT coalesce(CAST(sum(text_bytes) AS BIGINT), 0) FROM conversations
+    WHERE user_id = :user_id
+  ) as text_bytes
+`
+	// Finds the usage that a change checks against the quotas: the
+	// conversations and moods of the user and the lines of the
+	// conversation and text of the conversations of its creator
+	findQuotaUsage = `
+SELECT
+  (SELECT count(*) FROM conversations WHERE user_id = :user_id) as conversations,
+  (SELECT count(*) FROM moods WHERE user_id = :user_id) as moods,
+  (SELECT count(*) FROM lines WHERE conversation_id = :conversation_id) as lines_per_conversation,
+  (
+    SELECT coalesce(CAST(sum(text_bytes) AS BIGINT), 0) FROM conversations
+    WHERE user_id = :creator
+  ) as text_bytes
+`
+	addTextBytes = `
+UPDATE conversations SET text_bytes = text_bytes + :bytes WHERE id = :id
+`
+	// Sets the text_bytes of a fork to the text of the lines it copied
+	countTextBytes = `
+UPDATE conversations SET text_bytes = (
+  SELECT coalesce(sum(octet_length(text)), 0) FROM lines WHERE conversation_id = :id
+)
+WHERE id = :id
+RETURNING text_bytes
+`
+	// Serializes the changes of a user's webhooks or quotas, depending
+	// on the key, so that each one counts those committed before it
+	lockUser = `
+SELECT pg_advisory_xact_lock(CAST(:key AS INTEGER), hashtext(:user_id))
+`
+	insertWebhook = `
+INSERT INTO webhooks (public_id, user_id, url, secret)
+SELECT :public_id, :user_id, :url, :secret
+WHERE (SELECT count(*) FROM webhooks WHERE user_id = :user_id) < :max_webhooks
+RETURNING CAST(extract(epoch from created_at) AS BIGINT) as created
+`
+	listWebhooks = `
+SELECT public_id as id, url, CAST(extract(epoch from created_at) AS BIGINT) as created
+FROM webhooks
+WHERE user_id = :user_id
+ORDER BY id ASC
+`
+	findWebhook = `
+SELECT public_id as id, url, CAST(extract(epoch from created_at) AS BIGINT) as created
+FROM webhooks
+WHERE user_id = :user_id AND public_id = :webhook_id
+`
+	// Finds the webhooks of the conversation's owners and editors, keeping
+	// them from being deleted until the deliveries are queued
+	lockConvoWebhooks = `
+SELECT webhooks.id
+FROM webhooks
+INNER JOIN members ON webhooks.user_id = members.user_id
+WHERE members.conversation_id = :conversation_id
+AND members.role IN ('owner', 'editor')
+ORDER BY webhooks.id
+FOR SHARE OF webhooks
+`
+	deleteWebhook = `
+DELETE FROM webhooks WHERE user_id = :user_id AND public_id = :webhook_id
+`
+	// Queues a delivery of the payload to each webhook, pairing the
+	// webhooks with the public IDs in order
+	queueDeliveries = `
+INSERT INTO webhook_deliveries (public_id, webhook_id, event_type, payload, next_attempt_at)
+SELECT ids.public_id, ids.webhook_id, :event_type, :payload, NOW()
+FROM unnest(CAST(:public_ids AS TEXT[]), CAST(:webhook_ids AS INTEGER[])) AS ids(public_id, webhook_id)
+`
+	// Deletes a batch of the deliveries queued before the retention
+	// period that have been delivered or abandoned
+	pruneDeliveries = `
+DELETE FROM webhook_deliveries
+WHERE id IN (
+  SELECT id FROM webhook_deliveries
+  WHERE
+    next_attempt_at IS NULL AND
+    created_at < NOW() - CAST(:retention AS DOUBLE PRECISION) * interval '1 second'
+  LIMIT :limit
+)
+`
+	// Postpones the due deliveries by the lease so that other workers
+	// skip them while they are being sent
+	claimDeliveries = `
+UPDATE webhook_deliveries
+SET next_attempt_at = NOW() + CAST(:lease AS DOUBLE PRECISION) * interval '1 second'
+FROM webhooks
+WHERE webhook_deliveries.webhook_id = webhooks.id AND webhook_deliveries.id IN (
+  SELECT id FROM webhook_deliveries
+  WHERE next_attempt_at <= NOW()
+  ORDER BY next_attempt_at
+  LIMIT :limit
+  FOR UPDATE SKIP LOCKED
+)
+RETURNING
+  webhook_deliveries.id as int_id, webhook_deliveries.public_id as id,
+  event_type as type, payload as body, attempts, url, secret
+`
+	recordDelivery = `
+UPDATE webhook_deliveries SET
+  attempts = attempts + 1,
+  response_code = :response_code,
+  error = :error,
+  last_attempt_at = NOW(),
+  delivered_at = CASE WHEN :delivered THEN NOW() END,
+  next_attempt_at = CASE WHEN :retry THEN NOW() + CAST(:retry_delay AS DOUBLE PRECISION) * interval '1 second' END
+WHERE id = :int_id
+`
+	countDeliveryCursor = `
+SELECT count(*)
+FROM webhook_deliveries
+INNER JOIN webhooks ON webhook_deliveries.webhook_id = webhooks.id
+WHERE
+  webhooks.user_id = :user_id AND webhooks.public_id = :webhook_id AND
+  webhook_deliveries.public_id = :cursor_id
+`
+	// Filled with the direction of the cursor and ordering. The most
+	// recent deliveries come first.
+	listDeliveries = `
+SELECT
+  webhook_deliveries.public_id as id, event_type as type, payload as body,
+  attempts, response_code, error,
+  CASE
+    WHEN delivered_at IS NOT NULL THEN 'delivered'
+    WHEN next_attempt_at IS NOT NULL THEN 'pending'
+    ELSE 'failed'
+  END as status,
+  CAST(extract(epoch from webhook_deliveries.created_at) AS BIGINT) as created,
+  CAST(extract(epoch from last_attempt_at) AS BIGINT) as last_attempt,
+  CAST(extract(epoch from next_attempt_at) AS BIGINT) as next_attempt
+FROM webhook_deliveries
+INNER JOIN webhooks ON webhook_deliveries.webhook_id = webhooks.id
+WHERE
+  webhooks.user_id = :user_id AND webhooks.public_id = :webhook_id AND
+  (:cursor_id = '' OR webhook_deliveries.id %s (
+    SELECT id FROM webhook_deliveries WHERE public_id = :cursor_id
+  ))
+ORDER BY webhook_deliveries.id %s
+LIMIT :limit
 `
 )
 
 var errCursorNotFound = errors.New("Invalid cursor")
 var errBuiltinMood = errors.New("Cannot modify built-in moods")
 var errRecordNotFound = errors.New("Requested record was not found")
+var errMoodSetNotFound = errors.New("Mood set was not found")
+var errNoMoods = errors.New("No moods are available to choose from")
+var errMoodInUse = errors.New("Mood is used by other users")
+var errNoPublisher = errors.New("User does not have a publisher name")
+var errPublisherExists = errors.New("User already has a different publisher name")
+var errPublisherTaken = errors.New("Publisher name is already taken")
+var errOwnMood = errors.New("Cannot install your own mood")
+var errAnchorNotFound = errors.New("Line to position relative to was not found")
+var errReaperLocked = errors.New("Another process is reaping expired conversations")
+var errTooManyWebhooks = errors.New("User has the maximum number of webhooks")
+var errTooManyCharacters = errors.New("Conversation has the maximum number of characters")
+var errCharacterExists = errors.New("Conversation already has a character with the name")
+var errTooManyMembers = errors.New("Conversation has the maximum number of members")
+var errAlreadyMember = errors.New("User is already a member of the conversation")
+var errLastOwner = errors.New("Conversation must have an owner")
+
+// Roles that may view, edit and manage a conversation, passed as :roles
+var (
+	viewerRoles = pq.StringArray{RoleOwner, RoleEditor, RoleViewer}
+	editorRoles = pq.StringArray{RoleOwner, RoleEditor}
+	ownerRoles  = pq.StringArray{RoleOwner}
+)
 
 type conflictErr struct {
 	IDs []string
@@ -130,12 +1027,60 @@ func (e conflictErr) Error() string {
 }
 
 type repository struct {
-	db      *sqlx.DB
-	closers []io.Closer
+	db       *sqlx.DB
+	closers  []io.Closer
+	builtins []*Mood
+	quotas   Quotas
 
 	listMoodsAsc, listMoodsDesc, findMood, deleteMood, setMood        *sqlx.NamedStmt
+	insertMood                                                        *sqlx.NamedStmt
 	listConvosAsc, listConvosDesc, insertConvo, getConvo, deleteConvo *sqlx.NamedStmt
 	findConvoLines, findMoodLines, insertLine, getLine, deleteLine    *sqlx.NamedStmt
+
+	listMoodsByNameAsc, listMoodsByNameDesc, countMoods, nthMood       *sqlx.NamedStmt
+	findShadowedBuiltins                                               *sqlx.NamedStmt
+	listMoodSetsAsc, listMoodSetsDesc, findMoodSet, findMoodSetEntries *sqlx.NamedStmt
+	deleteMoodSet, setMoodSet, clearMoodSet, insertMoodSetEntry        *sqlx.NamedStmt
+	findSentimentMoods, clearSentimentMoods, insertSentimentMood       *sqlx.NamedStmt
+
+	findPublisher, insertPublisher, publishMood, unpublishMood *sqlx.NamedStmt
+	listGalleryAsc, listGalleryDesc, findGalleryMood           *sqlx.NamedStmt
+	listGalleryByInstallsAsc, listGalleryByInstallsDesc        *sqlx.NamedStmt
+	findMoodReference, installMood, uninstallMood              *sqlx.NamedStmt
+
+	lockConvo, insertConvoRevision, updateConvo, findConvoRevisions *sqlx.NamedStmt
+	lockLine, insertLineRevision, updateLine, findLineRevisions     *sqlx.NamedStmt
+
+	findLinePosition, nextLinePosition, shiftLines, moveLine *sqlx.NamedStmt
+	listLinesAsc, listLinesDesc                              *sqlx.NamedStmt
+
+	countSearchCursor, listSearchHitsAfter, listSearchHitsBefore *sqlx.NamedStmt
+
+	insertShare, listShares, findShare, deleteShare *sqlx.NamedStmt
+
+	forkConvo, countForkLines, forkMoods, forkLines, forkCharacters *sqlx.NamedStmt
+
+	restoreConvo, restoreLine, purgeConvos, purgeLines *sqlx.NamedStmt
+	lockReaper, reapConvos                             *sqlx.NamedStmt
+	countTrashCursor, listTrashAfter, listTrashBefore  *sqlx.NamedStmt
+
+	findMoodByFace *sqlx.NamedStmt
+
+	insertCharacter, countCharacters, listCharacters *sqlx.NamedStmt
+	findCharacter, deleteCharacter                   *sqlx.NamedStmt
+
+	insertMember, getRole, countMembers, listMembers *sqlx.NamedStmt
+	findMember, updateMember, deleteMember           *sqlx.NamedStmt
+	insertInvite, listInvites, lockInvite, useInvite *sqlx.NamedStmt
+	deleteInvite                                     *sqlx.NamedStmt
+
+	getUsage, findQuotaUsage, addTextBytes, countTextBytes *sqlx.NamedStmt
+
+	insertWebhook, listWebhooks, findWebhook                       *sqlx.NamedStmt
+	lockUser, lockConvoWebhooks, deleteWebhook                     *sqlx.NamedStmt
+	queueDeliveries, claimDeliveries, recordDelivery               *sqlx.NamedStmt
+	pruneDeliveries                                                *sqlx.NamedStmt
+	countDeliveryCursor, listDeliveriesAfter, listDeliveriesBefore *sqlx.NamedStmt
 }
 
 type listArgs struct {
@@ -143,6 +1088,21 @@ type listArgs struct {
 	Limit         int
 }
 
+const (
+	moodSortCreated = "created"
+	moodSortName    = "name"
+)
+
+// moodFilter narrows and orders a mood listing. Under moodSortCreated,
+// user moods are listed in creation order followed by built-in moods
+// in catalog order. Under moodSortName, both are merged by name.
+type moodFilter struct {
+	UserDefined              *bool // nil lists both user and built-in moods
+	NamePrefix, NameContains string
+	Sort                     string
+}
+
+// builtinMoods is the default catalog of moods available to every user.
 var builtinMoods = []*Mood{
 	{"default", "oo", "  ", false, 0},
 	{"borg", "==", "  ", false, 0},
@@ -160,18 +1120,100 @@ type moodRec struct {
 }
 
 type lineRec struct {
-	Eyes, Tongue sql.NullString
+	Eyes, Tongue  sql.NullString
+	MoodID        sql.NullInt64
+	CharacterID   sql.NullInt64
+	CharacterMood sql.NullString
+	Facing        sql.NullString
 	Line
 }
 
-type convoRec struct {
+type linePositionRec struct {
+	ID, Position int
+}
+
+type shareRec struct {
+	TokenID string
+	Share
+}
+
+// sharedConvoRec identifies the conversation a share token grants
+// access to.
+type sharedConvoRec struct {
+	ID, UserID, ConversationID string
+}
+
+type moodSetRec struct {
+	IntID int
+	MoodSet
+}
+
+type moodSetEntryRec struct {
+	MoodSetID int
+	MoodSetEntry
+}
+
+type publishedMoodRec struct {
+	IntID  int
+	UserID string
+	PublishedMood
+}
+
+// deliveryRec is a webhook delivery with the raw payload and the
+// endpoint it is sent to.
+type deliveryRec struct {
+	IntID       int
+	Body        string
+	URL, Secret string
+	WebhookDelivery
+}
+
+type characterRec struct {
 	IntID int
+	Character
+}
+
+type memberRec struct {
+	IntID  int
+	UserID string
+	Member
+}
+
+type inviteRec struct {
+	TokenID string
+	Invite
+}
+
+// inviteConvoRec identifies the conversation an invite is for.
+type inviteConvoRec struct {
+	ID, ConversationID int
+	ConvoID, Role      string
+}
+
+// usageRec is what a user stores against their quotas.
+type usageRec struct {
+	Conversations, LinesPerConversation, Moods, TextBytes int64
+}
+
+type convoRec struct {
+	IntID   int
+	Creator string
 
 	Conversation
 }
 
-func newRepository(db *sqlx.DB) (*repository, error) {
-	r := repository{db: db}
+// newRepository prepares a repository for the given database. If
+// builtins is nil, the default catalog of built-in moods is used.
+func newRepository(db *sqlx.DB, builtins []Mood) (*repository, error) {
+	r := repository{db: db, builtins: builtinMoods}
+	if builtins != nil {
+		r.builtins = make([]*Mood, len(builtins))
+		for i := range builtins {
+			mood := builtins[i]
+			mood.UserDefined = false
+			r.builtins[i] = &mood
+		}
+	}
 
 	stmts := map[string]**sqlx.NamedStmt{
 		findMood:       &r.findMood,
@@ -186,13 +1228,137 @@ func newRepository(db *sqlx.DB) (*repository, error) {
 		getLine:        &r.getLine,
 		deleteLine:     &r.deleteLine,
 
+		insertMood:           &r.insertMood,
+		countMoods:           &r.countMoods,
+		findShadowedBuiltins: &r.findShadowedBuiltins,
+		nthMood:              &r.nthMood,
+		findMoodSet:          &r.findMoodSet,
+		findMoodSetEntries:   &r.findMoodSetEntries,
+		deleteMoodSet:        &r.deleteMoodSet,
+		setMoodSet:           &r.setMoodSet,
+		clearMoodSet:         &r.clearMoodSet,
+		insertMoodSetEntry:   &r.insertMoodSetEntry,
+
+		findSentimentMoods:  &r.findSentimentMoods,
+		clearSentimentMoods: &r.clearSentimentMoods,
+		insertSentimentMood: &r.insertSentimentMood,
+
+		findPublisher:     &r.findPublisher,
+		insertPublisher:   &r.insertPublisher,
+		publishMood:       &r.publishMood,
+		unpublishMood:     &r.unpublishMood,
+		findGalleryMood:   &r.findGalleryMood,
+		findMoodReference: &r.findMoodReference,
+		installMood:       &r.installMood,
+		uninstallMood:     &r.uninstallMood,
+
+		lockConvo:           &r.lockConvo,
+		insertConvoRevision: &r.insertConvoRevision,
+		findConvoRevisions:  &r.findConvoRevisions,
+		updateConvo:         &r.updateConvo,
+		lockLine:            &r.lockLine,
+		insertLineRevision:  &r.insertLineRevision,
+		updateLine:          &r.updateLine,
+		findLineRevisions:   &r.findLineRevisions,
+
+		findLinePosition: &r.findLinePosition,
+		nextLinePosition: &r.nextLinePosition,
+		shiftLines:       &r.shiftLines,
+		moveLine:         &r.moveLine,
+
+		countSearchCursor: &r.countSearchCursor,
+
+		insertShare: &r.insertShare,
+		listShares:  &r.listShares,
+		findShare:   &r.findShare,
+		deleteShare: &r.deleteShare,
+
+		forkConvo:      &r.forkConvo,
+		countForkLines: &r.countForkLines,
+		forkMoods:      &r.forkMoods,
+		forkLines:      &r.forkLines,
+		forkCharacters: &r.forkCharacters,
+
+		restoreConvo:     &r.restoreConvo,
+		restoreLine:      &r.restoreLine,
+		purgeConvos:      &r.purgeConvos,
+		purgeLines:       &r.purgeLines,
+		lockReaper:       &r.lockReaper,
+		reapConvos:       &r.reapConvos,
+		countTrashCursor: &r.countTrashCursor,
+
+		findMoodByFace: &r.findMoodByFace,
+
+		insertCharacter: &r.insertCharacter,
+		countCharacters: &r.countCharacters,
+		listCharacters:  &r.listCharacters,
+		findCharacter:   &r.findCharacter,
+		deleteCharacter: &r.deleteCharacter,
+
+		insertMember: &r.insertMember,
+		getRole:      &r.getRole,
+		countMembers: &r.countMembers,
+		listMembers:  &r.listMembers,
+		findMember:   &r.findMember,
+		updateMember: &r.updateMember,
+		deleteMember: &r.deleteMember,
+		insertInvite: &r.insertInvite,
+		listInvites:  &r.listInvites,
+		lockInvite:   &r.lockInvite,
+		useInvite:    &r.useInvite,
+		deleteInvite: &r.deleteInvite,
+
+		getUsage:       &r.getUsage,
+		findQuotaUsage: &r.findQuotaUsage,
+		addTextBytes:   &r.addTextBytes,
+		countTextBytes: &r.countTextBytes,
+
+		insertWebhook:       &r.insertWebhook,
+		listWebhooks:        &r.listWebhooks,
+		findWebhook:         &r.findWebhook,
+		lockUser:            &r.lockUser,
+		lockConvoWebhooks:   &r.lockConvoWebhooks,
+		deleteWebhook:       &r.deleteWebhook,
+		queueDeliveries:     &r.queueDeliveries,
+		claimDeliveries:     &r.claimDeliveries,
+		recordDelivery:      &r.recordDelivery,
+		pruneDeliveries:     &r.pruneDeliveries,
+		countDeliveryCursor: &r.countDeliveryCursor,
+
+		fmt.Sprintf(listGallery, "moods.id > :cursor_id", "moods.id ASC"):  &r.listGalleryAsc,
+		fmt.Sprintf(listGallery, "moods.id < :cursor_id", "moods.id DESC"): &r.listGalleryDesc,
+		fmt.Sprintf(listGallery,
+			"(install_count, moods.id) < (:cursor_installs, :cursor_id)",
+			"install_count DESC, moods.id DESC",
+		): &r.listGalleryByInstallsAsc,
+		fmt.Sprintf(listGallery,
+			"(install_count, moods.id) > (:cursor_installs, :cursor_id)",
+			"install_count ASC, moods.id ASC",
+		): &r.listGalleryByInstallsDesc,
+
 		fmt.Sprintf(listConvos, ">", "ASC"):  &r.listConvosAsc,
 		fmt.Sprintf(listConvos, "<", "DESC"): &r.listConvosDesc,
 		fmt.Sprintf(listMoods, ">", "ASC"):   &r.listMoodsAsc,
 		fmt.Sprintf(listMoods, "<", "DESC"):  &r.listMoodsDesc,
-	}
 
-	for sqlStr, stmt := range stmts {
+		fmt.Sprintf(listMoodsByName, ">", "ASC"):  &r.listMoodsByNameAsc,
+		fmt.Sprintf(listMoodsByName, "<", "DESC"): &r.listMoodsByNameDesc,
+		fmt.Sprintf(listMoodSets, ">", "ASC"):     &r.listMoodSetsAsc,
+		fmt.Sprintf(listMoodSets, "<", "DESC"):    &r.listMoodSetsDesc,
+		fmt.Sprintf(listLines, ">", "ASC"):        &r.listLinesAsc,
+		fmt.Sprintf(listLines, "<", "DESC"):       &r.listLinesDesc,
+
+		fmt.Sprintf(listSearchHits, "<", "DESC", "DESC"): &r.listSearchHitsAfter,
+		fmt.Sprintf(listSearchHits, ">", "ASC", "ASC"):   &r.listSearchHitsBefore,
+
+		fmt.Sprintf(listTrash, "<", "DESC", "DESC"): &r.listTrashAfter,
+		fmt.Sprintf(listTrash, ">", "ASC", "ASC"):   &r.listTrashBefore,
+
+		fmt.Sprintf(listDeliveries, "<", "DESC"): &r.listDeliveriesAfter,
+		fmt.Sprintf(listDeliveries, ">", "ASC"):  &r.listDeliveriesBefore,
+	}
+
+	for sqlStr, stmt := range stmts {
 		prepped, err := db.PrepareNamed(sqlStr)
 		*stmt = prepped
 		if err != nil {
@@ -204,6 +1370,29 @@ func newRepository(db *sqlx.DB) (*repository, error) {
 	return &r, nil
 }
 
+// shadowedBuiltins returns the lowercased names of the built-in moods
+// that the user's own moods of the same name take the place of.
+func (r *repository) shadowedBuiltins(userID string) (map[string]bool, error) {
+	names := make(pq.StringArray, len(r.builtins))
+	for i, builtin := range r.builtins {
+		names[i] = strings.ToLower(builtin.Name)
+	}
+
+	var shadowed []string
+	if err := r.findShadowedBuiltins.Select(&shadowed, struct {
+		UserID string
+		Names  pq.StringArray
+	}{userID, names}); err != nil {
+		return nil, fmt.Errorf("finding built-in moods shadowed for user %q: %v", userID, err)
+	}
+
+	byName := make(map[string]bool, len(shadowed))
+	for _, name := range shadowed {
+		byName[name] = true
+	}
+	return byName, nil
+}
+
 func (r *repository) Close() error {
 	for _, closer := range r.closers {
 		if err := closer.Close(); err != nil {
@@ -214,88 +1403,73 @@ func (r *repository) Close() error {
 	return nil
 }
 
-func (r *repository) ListMoods(userID string, args listArgs) ([]Mood, bool, error) {
-	sources := make([]func(bool, listArgs) ([]Mood, bool, error), 2)
-	var sourceNames []string
-
-	userSrc := func(asc bool, args listArgs) ([]Mood, bool, error) {
-		return r.listUserMoods(userID, asc, args)
-	}
-
-	var asc bool
-	if sortAsc(args) {
-		asc = true
-		sources[0] = userSrc
-		sources[1] = r.listBuiltinMoods
-		sourceNames = []string{"user", "built-in"}
-	} else {
-		asc = false
-		sources[1] = userSrc
-		sources[0] = r.listBuiltinMoods
-		sourceNames = []string{"built-in", "user"}
+func (r *repository) ListMoods(userID string, args listArgs, filter moodFilter) ([]Mood, bool, error) {
+	asc := sortAsc(args)
+	cursor := args.After
+	if !asc {
+		cursor = args.Before
 	}
 
-	moods, _, err := sources[0](asc, args)
-	if err != nil {
-		if err != errCursorNotFound {
-			return nil, false, fmt.Errorf("listing %s moods %v", sourceNames[0], err)
-		}
-	} else {
-		args.Limit = args.Limit - len(moods)
-		args.Before = ""
-		args.After = ""
-
-		if len(moods) == args.Limit {
-			return moods, true, nil
+	var cursorMood *Mood
+	if cursor != "" {
+		var err error
+		cursorMood, err = r.GetMood(userID, cursor)
+		if err != nil {
+			return nil, false, fmt.Errorf("finding mood cursor %q for user %q: %v", cursor, userID, err)
 		}
-	}
-
-	moreMoods, hasMore, err := sources[1](asc, args)
-	if err != nil {
-		if err != errCursorNotFound {
-			err = fmt.Errorf("listing %s moods %v", sourceNames[1], err)
+		if cursorMood == nil {
+			return nil, false, errCursorNotFound
 		}
-		return nil, false, err
 	}
 
-	for _, mood := range moreMoods {
-		moods = append(moods, mood)
-	}
-
-	return moods, hasMore, nil
-}
-
-func (r *repository) listBuiltinMoods(asc bool, args listArgs) ([]Mood, bool, error) {
-	var moods []Mood
-
-	cursor := args.After
+	less := func(a, b *Mood) bool { return r.moodLess(a, b, filter.Sort) }
 	if !asc {
-		cursor = args.Before
+		less = func(a, b *Mood) bool { return r.moodLess(b, a, filter.Sort) }
 	}
 
-	limit := args.Limit + 1
-
-	found := args.After == "" && args.Before == ""
-	for i := 0; i < len(builtinMoods); i++ {
-		var mood *Mood
-		if asc {
-			mood = builtinMoods[i]
-		} else {
-			mood = builtinMoods[len(builtinMoods)-1-i]
+	var userMoods, builtins []Mood
+	if filter.UserDefined == nil || *filter.UserDefined {
+		var err error
+		userMoods, err = r.listUserMoods(userID, asc, cursorMood, filter, args.Limit+1)
+		if err != nil {
+			return nil, false, fmt.Errorf("listing user moods %v", err)
+		}
+	}
+	if filter.UserDefined == nil || !*filter.UserDefined {
+		shadowed, err := r.shadowedBuiltins(userID)
+		if err != nil {
+			return nil, false, err
 		}
 
-		if found {
-			moods = append(moods, *mood)
-			if len(moods) == limit {
-				break
+		for i := range r.builtins {
+			mood := r.builtins[i]
+			if !asc {
+				mood = r.builtins[len(r.builtins)-1-i]
+			}
+			if shadowed[strings.ToLower(mood.Name)] || (cursorMood != nil && !less(cursorMood, mood)) {
+				continue
 			}
-		} else if mood.Name == cursor {
-			found = true
+			if filter.matches(mood.Name) {
+				builtins = append(builtins, *mood)
+			}
+		}
+		// The catalog is in created order rather than by name
+		if filter.Sort == moodSortName {
+			sort.Slice(builtins, func(i, j int) bool { return less(&builtins[i], &builtins[j]) })
 		}
 	}
 
-	if !found {
-		return nil, false, errCursorNotFound
+	// Both sources are already in listing order so we only need to
+	// merge them up to one past the limit to determine hasMore.
+	var moods []Mood
+	for len(moods) <= args.Limit && (len(userMoods) > 0 || len(builtins) > 0) {
+		if len(builtins) == 0 || (len(userMoods) > 0 && less(&userMoods[0], &builtins[0])) {
+			moods = append(moods, userMoods[0])
+			userMoods = userMoods[1:]
+		} else {
+			moods = append(moods, builtins[0])
+			builtins = builtins[1:]
+		}
 	}
 
 	hasMore := len(moods) > args.Limit
@@ -306,43 +1480,54 @@ func (r *repository) listBuiltinMoods(asc bool, args listArgs) ([]Mood, bool, er
 	return moods, hasMore, nil
 }
 
-func (r *repository) listUserMoods(userID string, asc bool, args listArgs) ([]Mood, bool, error) {
+func (r *repository) listUserMoods(userID string, asc bool, cursor *Mood, filter moodFilter, limit int) ([]Mood, error) {
 	var moods []Mood
+	var rows *sqlx.Rows
+	var err error
 
-	cursor := args.After
-	query := r.listMoodsAsc
-	if !asc {
-		cursor = args.Before
-		query = r.listMoodsDesc
+	queryArgs := struct {
+		UserID, CursorName             string
+		PrefixPattern, ContainsPattern string
+		CursorID, Limit                int
+	}{
+		UserID:          userID,
+		PrefixPattern:   escapeLike(strings.ToLower(filter.NamePrefix)) + "%",
+		ContainsPattern: "%" + escapeLike(strings.ToLower(filter.NameContains)) + "%",
+		CursorID:        -1,
+		Limit:           limit,
 	}
 
-	cursorID := -1
-	if cursor != "" {
-		var mood moodRec
-
-		err := r.findMood.Get(&mood, struct{ UserID, Name string }{userID, cursor})
-		if err == sql.ErrNoRows {
-			return nil, false, errCursorNotFound
-		} else if err != nil {
-			return nil, false, fmt.Errorf("finding mood cursor %q for user %q: %v", cursor, userID, err)
-		} else {
-			cursorID = mood.IntID
+	if filter.Sort == moodSortName {
+		query := r.listMoodsByNameAsc
+		if !asc {
+			query = r.listMoodsByNameDesc
+		}
+		if cursor != nil {
+			queryArgs.CursorName = cursor.Name
+		}
+		rows, err = query.Queryx(queryArgs)
+	} else {
+		query := r.listMoodsAsc
+		if !asc {
+			query = r.listMoodsDesc
 		}
+		if cursor != nil && cursor.UserDefined {
+			queryArgs.CursorID = cursor.id
+		} else if cursor != nil && asc {
+			// Every user mood sorts before the built-in cursor
+			return nil, nil
+		}
+		rows, err = query.Queryx(queryArgs)
 	}
-
-	rows, err := query.Queryx(struct {
-		UserID          string
-		CursorID, Limit int
-	}{userID, cursorID, args.Limit + 1})
 	if err != nil {
-		return nil, false, fmt.Errorf("listing user moods: %v", err)
+		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var rec moodRec
 		if err := rows.StructScan(&rec); err != nil {
-			return nil, false, fmt.Errorf("scanning user mood: %v", err)
+			return nil, fmt.Errorf("scanning user mood: %v", err)
 		}
 
 		rec.UserDefined = true
@@ -350,17 +1535,64 @@ func (r *repository) listUserMoods(userID string, asc bool, args listArgs) ([]Mo
 		moods = append(moods, rec.Mood)
 	}
 
-	hasMore := len(moods) > args.Limit
-	if hasMore {
-		moods = moods[:args.Limit]
+	return moods, rows.Err()
+}
+
+// GetMood returns the user's mood or the built-in mood with the name,
+// or nil if there is neither. A user's mood takes the place of a
+// built-in mood of the same name added to the catalog after it.
+func (r *repository) GetMood(userID, name string) (*Mood, error) {
+	if publisher, moodName, ok := parseMoodReference(name); ok {
+		return r.getMoodReference(userID, publisher, moodName)
 	}
 
-	return moods, hasMore, nil
+	var rec moodRec
+	err := r.findMood.Get(&rec, struct{ UserID, Name string }{userID, name})
+	if err == sql.ErrNoRows {
+		for _, builtin := range r.builtins {
+			if strings.EqualFold(builtin.Name, name) {
+				// Copy to prevent modifying builtins by the caller
+				mood := *builtin
+				return &mood, nil
+			}
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("getting user mood: %v", err)
+	}
+	rec.UserDefined = true
+	rec.id = rec.IntID
+
+	return &rec.Mood, nil
 }
 
-func (r *repository) GetMood(userID, name string) (*Mood, error) {
-	for _, builtin := range builtinMoods {
-		if builtin.Name == name {
+// insertMoodTx creates a mood for the user, setting its ID. If the
+// user already has a mood with the name, mood is replaced with it.
+func (r *repository) insertMoodTx(tx *sqlx.Tx, userID string, mood *Mood) error {
+	err := tx.NamedStmt(r.insertMood).QueryRow(struct {
+		UserID, Name, Eyes, Tongue string
+	}{
+		userID, mood.Name, mood.Eyes, mood.Tongue,
+	}).Scan(&mood.id)
+	if err == sql.ErrNoRows {
+		var rec moodRec
+		err = tx.NamedStmt(r.findMood).Get(&rec, struct{ UserID, Name string }{userID, mood.Name})
+		rec.UserDefined = true
+		rec.id = rec.IntID
+		*mood = rec.Mood
+	}
+	if err != nil {
+		return fmt.Errorf("inserting mood %q: %v", mood.Name, err)
+	}
+	return nil
+}
+
+// FindMoodByFace returns a built-in mood or one of the user's moods
+// with the given eyes and tongue, preferring built-in moods. It returns
+// nil if there is no such mood.
+func (r *repository) FindMoodByFace(userID, eyes, tongue string) (*Mood, error) {
+	for _, builtin := range r.builtins {
+		if builtin.Eyes == eyes && builtin.Tongue == tongue {
 			// Copy to prevent modifying builtins by the caller
 			mood := *builtin
 			return &mood, nil
@@ -368,11 +1600,11 @@ func (r *repository) GetMood(userID, name string) (*Mood, error) {
 	}
 
 	var rec moodRec
-	err := r.findMood.Get(&rec, struct{ UserID, Name string }{userID, name})
+	err := r.findMoodByFace.Get(&rec, struct{ UserID, Eyes, Tongue string }{userID, eyes, tongue})
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
-		return nil, fmt.Errorf("getting user mood: %v", err)
+		return nil, fmt.Errorf("finding mood by face: %v", err)
 	}
 	rec.UserDefined = true
 	rec.id = rec.IntID
@@ -380,36 +1612,58 @@ func (r *repository) GetMood(userID, name string) (*Mood, error) {
 	return &rec.Mood, nil
 }
 
+// SetMood creates or replaces one of the user's moods. It returns
+// QuotaExceeded if creating it would exceed the user's quota.
 func (r *repository) SetMood(userID string, mood *Mood) error {
-	if isBuiltin(mood.Name) {
+	if r.isBuiltin(mood.Name) {
 		return errBuiltinMood
 	}
 
-	var id int
-	err := r.setMood.QueryRow(struct {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var rec struct {
+		ID       int
+		Inserted bool
+	}
+	err = tx.NamedStmt(r.setMood).Get(&rec, struct {
 		UserID, Name, Eyes, Tongue string
 	}{
 		userID, mood.Name, mood.Eyes, mood.Tongue,
-	}).Scan(&id)
+	})
 	if err != nil {
 		return fmt.Errorf("upserting user mood: %v", err)
 	}
-	if id == 0 {
+	if rec.ID == 0 {
 		return fmt.Errorf("unable to update mood %q", mood.Name)
 	}
 
-	mood.id = id
+	if rec.Inserted {
+		if err := r.enforceQuotasTx(tx, userID, userID, 0, usageDelta{moods: 1}); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing mood %q: %v", mood.Name, err)
+	}
+
+	mood.id = rec.ID
 
 	return nil
 }
 
 func (r *repository) DeleteMood(userID, name string) error {
-	if isBuiltin(name) {
+	// Deleting by a built-in name only removes a mood shadowing it
+	queryArgs := struct{ UserID, Name string }{userID, name}
+	err := doDelete(r.deleteMood, queryArgs)
+	if err == errRecordNotFound && r.isBuiltin(name) {
 		return errBuiltinMood
 	}
-
-	queryArgs := struct{ UserID, Name string }{userID, name}
-	if err := doDelete(r.deleteMood, queryArgs); err != nil {
+	if err != nil {
 		if dbErr, ok := err.(*pq.Error); !ok || dbErr.Code != dbErrFKViolation {
 			return err
 		}
@@ -422,6 +1676,10 @@ func (r *repository) DeleteMood(userID, name string) error {
 		if err := r.findMoodLines.Select(&lineIDs, queryArgs); err != nil {
 			return fmt.Errorf("listing lines for mood %q and user %q: %v", name, userID, err)
 		}
+		if len(lineIDs) == 0 {
+			// Only lines belonging to users who installed the mood
+			return errMoodInUse
+		}
 
 		return conflictErr{lineIDs}
 	}
@@ -429,27 +1687,106 @@ func (r *repository) DeleteMood(userID, name string) error {
 	return nil
 }
 
-func (r *repository) ListConversations(userID string, args listArgs) ([]Conversation, bool, error) {
-	var convos []Conversation
+// PickMood chooses a mood for userID using rng. With an empty setName,
+// every built-in and user mood is equally likely. Otherwise the mood
+// is drawn from the named set according to the weight of each entry.
+func (r *repository) PickMood(userID, setName string, rng *mrand.Rand) (*Mood, error) {
+	if setName == "" {
+		return r.pickAnyMood(userID, rng)
+	}
+
+	set, err := r.GetMoodSet(userID, setName)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		return nil, errMoodSetNotFound
+	}
+
+	// Moods may have been deleted since the set was saved so we skip
+	// over any entries that no longer resolve.
+	entries := set.Moods
+	for len(entries) > 0 {
+		var total int
+		for _, entry := range entries {
+			total += entry.Weight
+		}
+
+		n := rng.Intn(total)
+		i := 0
+		for ; n >= entries[i].Weight; i++ {
+			n -= entries[i].Weight
+		}
+
+		mood, err := r.GetMood(userID, entries[i].Mood)
+		if err != nil {
+			return nil, err
+		}
+		if mood != nil {
+			return mood, nil
+		}
+
+		entries = append(entries[:i:i], entries[i+1:]...)
+	}
+
+	return nil, errNoMoods
+}
+
+// pickAnyMood chooses one of the built-in and user moods with equal
+// probability.
+func (r *repository) pickAnyMood(userID string, rng *mrand.Rand) (*Mood, error) {
+	// The user may delete moods between counting them and getting the
+	// one drawn, so draw again until the mood exists.
+	for {
+		var count int
+		if err := r.countMoods.Get(&count, struct{ UserID string }{userID}); err != nil {
+			return nil, fmt.Errorf("counting moods for user %q: %v", userID, err)
+		}
+
+		n := rng.Intn(len(r.builtins) + count)
+		if n < len(r.builtins) {
+			mood := *r.builtins[n]
+			return &mood, nil
+		}
+
+		var rec moodRec
+		err := r.nthMood.Get(&rec, struct {
+			UserID string
+			Offset int
+		}{userID, n - len(r.builtins)})
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("getting mood %d for user %q: %v", n, userID, err)
+		}
+		rec.UserDefined = true
+		rec.id = rec.IntID
+
+		return &rec.Mood, nil
+	}
+}
+
+func (r *repository) ListMoodSets(userID string, args listArgs) ([]MoodSet, bool, error) {
+	var sets []MoodSet
 
 	cursor := args.After
-	query := r.listConvosAsc
+	query := r.listMoodSetsAsc
 	if !sortAsc(args) {
 		cursor = args.Before
-		query = r.listConvosDesc
+		query = r.listMoodSetsDesc
 	}
 
 	cursorID := -1
 	if cursor != "" {
-		var convo convoRec
+		var set moodSetRec
 
-		err := r.getConvo.Get(&convo, struct{ UserID, PublicID string }{userID, cursor})
+		err := r.findMoodSet.Get(&set, struct{ UserID, Name string }{userID, cursor})
 		if err == sql.ErrNoRows {
 			return nil, false, errCursorNotFound
 		} else if err != nil {
-			return nil, false, fmt.Errorf("finding conversation cursor %q for user %q: %v", cursor, userID, err)
+			return nil, false, fmt.Errorf("finding mood set cursor %q for user %q: %v", cursor, userID, err)
 		} else {
-			cursorID = convo.IntID
+			cursorID = set.IntID
 		}
 	}
 
@@ -458,198 +1795,2119 @@ func (r *repository) ListConversations(userID string, args listArgs) ([]Conversa
 		CursorID, Limit int
 	}{userID, cursorID, args.Limit + 1})
 	if err != nil {
-		return nil, false, fmt.Errorf("listing conversations for user %s: %v", userID, err)
+		return nil, false, fmt.Errorf("listing mood sets for user %s: %v", userID, err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var rec convoRec
+		var rec moodSetRec
 		if err := rows.StructScan(&rec); err != nil {
-			return nil, false, fmt.Errorf("scanning conversation: %v", err)
+			return nil, false, fmt.Errorf("scanning mood set: %v", err)
 		}
 
 		rec.id = rec.IntID
-		convos = append(convos, rec.Conversation)
+		sets = append(sets, rec.MoodSet)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("listing mood sets for user %s: %v", userID, err)
 	}
 
-	hasMore := len(convos) > args.Limit
+	hasMore := len(sets) > args.Limit
 	if hasMore {
-		convos = convos[:args.Limit]
+		sets = sets[:args.Limit]
 	}
 
-	return convos, hasMore, nil
+	if err := r.loadMoodSetEntries(sets); err != nil {
+		return nil, false, err
+	}
+
+	return sets, hasMore, nil
 }
 
-func (r *repository) NewConversation(userID, heading string) (*Conversation, error) {
-	var publicID string
+func (r *repository) GetMoodSet(userID, name string) (*MoodSet, error) {
+	var rec moodSetRec
+	err := r.findMoodSet.Get(&rec, struct{ UserID, Name string }{userID, name})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("getting mood set: %v", err)
+	}
+	rec.id = rec.IntID
 
-	for i := 0; i < maxInsertRetries; i++ {
-		rv, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
-		if err != nil {
-			return nil, fmt.Errorf("generating random ID: %v", err)
-		}
-		publicID = convoIDPrefix + strconv.FormatUint(rv.Uint64(), 36)
+	sets := []MoodSet{rec.MoodSet}
+	if err := r.loadMoodSetEntries(sets); err != nil {
+		return nil, err
+	}
 
-		var id int
-		err = r.insertConvo.QueryRow(struct {
-			PublicID, UserID, Heading string
-		}{publicID, userID, heading}).Scan(&id)
-		if err == nil {
-			return &Conversation{
-				ID:      publicID,
-				Heading: heading,
-				id:      id,
-			}, nil
-		}
+	return &sets[0], nil
+}
 
-		dbErr, ok := err.(*pq.Error)
-		if !ok || dbErr.Code != dbErrDupUnique {
-			return nil, fmt.Errorf("inserting conversation: %v", err)
+// SetMoodSet creates or replaces the named mood set and all of its
+// entries in a single transaction.
+func (r *repository) SetMoodSet(userID string, set *MoodSet) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.NamedStmt(r.setMoodSet).QueryRow(struct {
+		UserID, Name string
+	}{userID, set.Name}).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("upserting mood set: %v", err)
+	}
+
+	if _, err := tx.NamedStmt(r.clearMoodSet).Exec(struct{ ID int }{id}); err != nil {
+		return fmt.Errorf("clearing mood set %q: %v", set.Name, err)
+	}
+
+	insert := tx.NamedStmt(r.insertMoodSetEntry)
+	for _, entry := range set.Moods {
+		_, err := insert.Exec(struct {
+			ID     int
+			Mood   string
+			Weight int
+		}{id, entry.Mood, entry.Weight})
+		if err != nil {
+			return fmt.Errorf("inserting mood set entry %q: %v", entry.Mood, err)
 		}
 	}
 
-	return nil, errors.New("Unable to insert a new, unique conversation")
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing mood set %q: %v", set.Name, err)
+	}
+
+	set.id = id
+
+	return nil
 }
 
-func (r *repository) GetConversation(userID, convoID string) (*Conversation, error) {
-	var convo convoRec
+func (r *repository) DeleteMoodSet(userID, name string) error {
+	return doDelete(r.deleteMoodSet, struct{ UserID, Name string }{userID, name})
+}
 
-	err := r.getConvo.Get(&convo, struct{ UserID, PublicID string }{userID, convoID})
-	if err == sql.ErrNoRows {
-		return nil, nil
-	} else if err != nil {
-		return nil, fmt.Errorf("finding conversation %q for user %q: %v", convoID, userID, err)
+func (r *repository) loadMoodSetEntries(sets []MoodSet) error {
+	if len(sets) == 0 {
+		return nil
 	}
 
-	rows, err := r.findConvoLines.Queryx(struct{ ID int }{convo.IntID})
+	ids := make([]int64, len(sets))
+	byID := make(map[int]*MoodSet, len(sets))
+	for i := range sets {
+		ids[i] = int64(sets[i].id)
+		byID[sets[i].id] = &sets[i]
+		sets[i].Moods = make([]MoodSetEntry, 0)
+	}
+
+	rows, err := r.findMoodSetEntries.Queryx(struct{ Sets interface{} }{pq.Array(ids)})
 	if err != nil {
-		return nil, fmt.Errorf("retrieving lines for %q: %v", convoID, err)
+		return fmt.Errorf("listing mood set entries: %v", err)
 	}
 	defer rows.Close()
 
-	convo.Lines = make([]Line, 0)
 	for rows.Next() {
-		var rec lineRec
+		var rec moodSetEntryRec
 		if err := rows.StructScan(&rec); err != nil {
-			return nil, fmt.Errorf("scanning line for %q: %v", convoID, err)
-		}
-
-		setLineMood(&rec)
-		if rec.mood == nil {
-			return nil, fmt.Errorf("line %s does not have a valid mood", rec.ID)
+			return fmt.Errorf("scanning mood set entry: %v", err)
 		}
 
-		convo.Lines = append(convo.Lines, rec.Line)
+		set := byID[rec.MoodSetID]
+		set.Moods = append(set.Moods, rec.MoodSetEntry)
 	}
 
-	convo.Conversation.id = convo.IntID
-
-	return &convo.Conversation, nil
+	return rows.Err()
 }
 
-func (r *repository) DeleteConversation(userID, convoID string) error {
-	if err := doDelete(r.deleteConvo, struct{ UserID, PublicID string }{userID, convoID}); err != nil {
-		return err
+// GetSentimentMoods returns the user's sentiment moods ordered by
+// minimum score or nil if they have not configured any.
+func (r *repository) GetSentimentMoods(userID string) ([]SentimentMood, error) {
+	var ranges []SentimentMood
+	if err := r.findSentimentMoods.Select(&ranges, struct{ UserID string }{userID}); err != nil {
+		return nil, fmt.Errorf("listing sentiment moods for user %q: %v", userID, err)
 	}
 
-	return nil
+	return ranges, nil
 }
 
-func (r *repository) InsertLine(userID, convoID string, line *Line) error {
-	var publicID string
-
-	var convo convoRec
-	err := r.getConvo.Get(&convo, struct{ UserID, PublicID string }{userID, convoID})
+// SetSentimentMoods replaces all of the user's sentiment moods in a
+// single transaction.
+func (r *repository) SetSentimentMoods(userID string, ranges []SentimentMood) error {
+	tx, err := r.db.Beginx()
 	if err != nil {
-		return fmt.Errorf("finding conversation %s for user %s: %v", convoID, userID, err)
+		return fmt.Errorf("beginning transaction: %v", err)
 	}
+	defer tx.Rollback()
 
-	for i := 0; i < maxInsertRetries; i++ {
-		rv, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if _, err := tx.NamedStmt(r.clearSentimentMoods).Exec(struct{ UserID string }{userID}); err != nil {
+		return fmt.Errorf("clearing sentiment moods for user %q: %v", userID, err)
+	}
+
+	insert := tx.NamedStmt(r.insertSentimentMood)
+	for _, rng := range ranges {
+		_, err := insert.Exec(struct {
+			UserID   string
+			MinScore float64
+			Mood     string
+		}{userID, rng.MinScore, rng.Mood})
 		if err != nil {
-			return fmt.Errorf("generating random ID: %v", err)
+			return fmt.Errorf("inserting sentiment mood %q: %v", rng.Mood, err)
 		}
-		publicID = lineIDPrefix + strconv.FormatUint(rv.Uint64(), 36)
+	}
 
-		var moodID sql.NullInt64
-		if line.mood.id != 0 {
-			moodID.Int64 = int64(line.mood.id)
-			moodID.Valid = true
-		}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing sentiment moods for user %q: %v", userID, err)
+	}
 
-		_, err = r.insertLine.Exec(struct {
-			PublicID, Animal, Text, MoodName string
-			Think                            bool
-			MoodID                           sql.NullInt64
-			ConversationID                   int
-		}{
-			publicID, line.Animal, line.Text, line.MoodName,
-			line.Think,
-			moodID,
-			convo.IntID,
-		})
-		if err == nil {
-			line.ID = publicID
-			return nil
-		}
+	return nil
+}
 
-		dbErr, ok := err.(*pq.Error)
-		if !ok || dbErr.Code != dbErrDupUnique {
-			return fmt.Errorf("inserting line: %v", err)
-		}
+func (r *repository) ClearSentimentMoods(userID string) error {
+	if _, err := r.clearSentimentMoods.Exec(struct{ UserID string }{userID}); err != nil {
+		return fmt.Errorf("clearing sentiment moods for user %q: %v", userID, err)
 	}
 
-	return errors.New("unable to insert a new, unique line")
+	return nil
 }
 
-func (r *repository) GetLine(userID, convoID, lineID string) (*Line, error) {
-	var rec lineRec
-
-	err := r.getLine.Get(&rec, struct{ UserID, ConvoID, LineID string }{userID, convoID, lineID})
+// getMoodReference finds a published mood that the user installed or
+// published themselves.
+func (r *repository) getMoodReference(userID, publisher, name string) (*Mood, error) {
+	var rec moodRec
+	err := r.findMoodReference.Get(&rec, struct {
+		UserID, Publisher, Name string
+	}{userID, publisher, name})
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
-		return nil, fmt.Errorf("getting line: %v", err)
+		return nil, fmt.Errorf("getting mood reference: %v", err)
 	}
+	rec.Name = moodReference(publisher, name)
+	rec.id = rec.IntID
 
-	setLineMood(&rec)
-	if rec.mood == nil {
-		return nil, fmt.Errorf("Line %s does not have a valid mood", rec.ID)
-	}
+	return &rec.Mood, nil
+}
+
+func (r *repository) GetPublisher(userID string) (*Publisher, error) {
+	var pub Publisher
+	err := r.findPublisher.Get(&pub, struct{ UserID string }{userID})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("getting publisher for user %q: %v", userID, err)
+	}
+
+	return &pub, nil
+}
+
+// SetPublisher claims a publisher name for the user. Setting the same
+// name again has no effect but a user may not change their name once
+// other users may be referring to it.
+func (r *repository) SetPublisher(userID string, pub *Publisher) error {
+	existing, err := r.GetPublisher(userID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if !strings.EqualFold(existing.Name, pub.Name) {
+			return errPublisherExists
+		}
+		pub.Name = existing.Name
+		return nil
+	}
+
+	_, err = r.insertPublisher.Exec(struct{ UserID, Name string }{userID, pub.Name})
+	if dbErr, ok := err.(*pq.Error); ok && dbErr.Code == dbErrDupUnique {
+		return errPublisherTaken
+	} else if err != nil {
+		return fmt.Errorf("inserting publisher %q: %v", pub.Name, err)
+	}
+
+	pub.Name = strings.ToLower(pub.Name)
+
+	return nil
+}
+
+// PublishMood lists one of the user's moods in the gallery.
+func (r *repository) PublishMood(userID, name string) error {
+	if r.isBuiltin(name) {
+		return errBuiltinMood
+	}
+
+	pub, err := r.GetPublisher(userID)
+	if err != nil {
+		return err
+	}
+	if pub == nil {
+		return errNoPublisher
+	}
+
+	return r.setPublished(r.publishMood, userID, name)
+}
+
+// UnpublishMood removes one of the user's moods from the gallery. Users
+// who already installed the mood may continue to use it.
+func (r *repository) UnpublishMood(userID, name string) error {
+	if r.isBuiltin(name) {
+		return errBuiltinMood
+	}
+
+	return r.setPublished(r.unpublishMood, userID, name)
+}
+
+func (r *repository) setPublished(stmt *sqlx.NamedStmt, userID, name string) error {
+	var id int
+	err := stmt.Get(&id, struct{ UserID, Name string }{userID, name})
+	if err == sql.ErrNoRows {
+		return errRecordNotFound
+	} else if err != nil {
+		return fmt.Errorf("publishing mood %q for user %q: %v", name, userID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) ListGallery(userID string, args listArgs, filter galleryFilter) ([]PublishedMood, bool, error) {
+	var moods []PublishedMood
+
+	asc := sortAsc(args)
+	cursor := args.After
+	if !asc {
+		cursor = args.Before
+	}
+
+	var query *sqlx.NamedStmt
+	switch {
+	case filter.Sort == gallerySortInstalls && asc:
+		query = r.listGalleryByInstallsAsc
+	case filter.Sort == gallerySortInstalls:
+		query = r.listGalleryByInstallsDesc
+	case asc:
+		query = r.listGalleryAsc
+	default:
+		query = r.listGalleryDesc
+	}
+
+	queryArgs := struct {
+		UserID, Publisher, Pattern string
+		Installed                  bool
+		CursorID, CursorInstalls   int
+		Limit                      int
+	}{
+		UserID:    userID,
+		Publisher: filter.Publisher,
+		Pattern:   "%" + escapeLike(strings.ToLower(filter.Query)) + "%",
+		Installed: filter.Installed,
+		CursorID:  -1,
+		Limit:     args.Limit + 1,
+	}
+
+	if cursor != "" {
+		publisher, name, ok := parseMoodReference(cursor)
+		if !ok {
+			return nil, false, errCursorNotFound
+		}
+
+		var rec publishedMoodRec
+		err := r.findGalleryMood.Get(&rec, struct {
+			UserID, Publisher, Name string
+		}{userID, publisher, name})
+		if err == sql.ErrNoRows {
+			return nil, false, errCursorNotFound
+		} else if err != nil {
+			return nil, false, fmt.Errorf("finding gallery cursor %q: %v", cursor, err)
+		}
+
+		queryArgs.CursorID = rec.IntID
+		queryArgs.CursorInstalls = rec.Installs
+	}
+
+	rows, err := query.Queryx(queryArgs)
+	if err != nil {
+		return nil, false, fmt.Errorf("listing gallery moods: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rec publishedMoodRec
+		if err := rows.StructScan(&rec); err != nil {
+			return nil, false, fmt.Errorf("scanning gallery mood: %v", err)
+		}
+
+		moods = append(moods, rec.publishedMood(userID))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("listing gallery moods: %v", err)
+	}
+
+	hasMore := len(moods) > args.Limit
+	if hasMore {
+		moods = moods[:args.Limit]
+	}
+
+	return moods, hasMore, nil
+}
+
+// GetPublishedMood returns a mood from the gallery if it is published,
+// installed by the user or belongs to the user.
+func (r *repository) GetPublishedMood(userID, publisher, name string) (*PublishedMood, error) {
+	var rec publishedMoodRec
+	err := r.findGalleryMood.Get(&rec, struct {
+		UserID, Publisher, Name string
+	}{userID, publisher, name})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("getting published mood: %v", err)
+	}
+
+	mood := rec.publishedMood(userID)
+	if !(mood.Published || mood.Installed || mood.owned) {
+		return nil, nil
+	}
+
+	return &mood, nil
+}
+
+// InstallMood lets the user refer to a published mood. Installing a
+// mood more than once has no effect.
+func (r *repository) InstallMood(userID string, mood *PublishedMood) error {
+	if mood.owned {
+		return errOwnMood
+	}
+
+	_, err := r.installMood.Exec(struct {
+		UserID string
+		MoodID int
+	}{userID, mood.id})
+	if err != nil {
+		return fmt.Errorf("installing mood %s: %v", mood.Reference, err)
+	}
+
+	return nil
+}
+
+func (r *repository) UninstallMood(userID string, mood *PublishedMood) error {
+	return doDelete(r.uninstallMood, struct {
+		UserID string
+		MoodID int
+	}{userID, mood.id})
+}
+
+func (rec *publishedMoodRec) publishedMood(userID string) PublishedMood {
+	mood := rec.PublishedMood
+	mood.Reference = moodReference(mood.Publisher, mood.Name)
+	mood.id = rec.IntID
+	mood.owned = rec.UserID == userID
+	return mood
+}
+
+func (r *repository) ListConversations(userID string, args listArgs) ([]Conversation, bool, error) {
+	var convos []Conversation
+
+	cursor := args.After
+	query := r.listConvosAsc
+	if !sortAsc(args) {
+		cursor = args.Before
+		query = r.listConvosDesc
+	}
+
+	cursorID := -1
+	if cursor != "" {
+		var convo convoRec
+
+		err := r.getConvo.Get(&convo, struct {
+			UserID, PublicID string
+			Roles            pq.StringArray
+		}{userID, cursor, viewerRoles})
+		if err == sql.ErrNoRows {
+			return nil, false, errCursorNotFound
+		} else if err != nil {
+			return nil, false, fmt.Errorf("finding conversation cursor %q for user %q: %v", cursor, userID, err)
+		} else {
+			cursorID = convo.IntID
+		}
+	}
+
+	rows, err := query.Queryx(struct {
+		UserID          string
+		Roles           pq.StringArray
+		CursorID, Limit int
+	}{userID, viewerRoles, cursorID, args.Limit + 1})
+	if err != nil {
+		return nil, false, fmt.Errorf("listing conversations for user %s: %v", userID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rec convoRec
+		if err := rows.StructScan(&rec); err != nil {
+			return nil, false, fmt.Errorf("scanning conversation: %v", err)
+		}
+
+		rec.id = rec.IntID
+		convos = append(convos, rec.Conversation)
+	}
+
+	hasMore := len(convos) > args.Limit
+	if hasMore {
+		convos = convos[:args.Limit]
+	}
+
+	return convos, hasMore, nil
+}
+
+// NewConversation creates an empty conversation owned by the user. It
+// expires after expiresIn seconds if expiresIn is valid.
+func (r *repository) NewConversation(userID, heading string, expiresIn sql.NullInt64, events ...*changeEvent) (*Conversation, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	convo := Conversation{Heading: heading, Role: RoleOwner}
+	convo.ID, err = insertWithPublicID(tx, convoIDPrefix, func(publicID string) error {
+		return tx.NamedStmt(r.insertConvo).QueryRow(struct {
+			PublicID, UserID, Heading string
+			ExpiresIn                 sql.NullInt64
+		}{publicID, userID, heading, expiresIn}).Scan(&convo.id, &convo.Expires)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("inserting conversation: %v", err)
+	}
+
+	if err := r.insertMemberTx(tx, convo.id, userID, RoleOwner); err != nil {
+		return nil, err
+	}
+
+	if err := r.enforceQuotasTx(tx, userID, userID, convo.id, usageDelta{conversations: 1}); err != nil {
+		return nil, err
+	}
+
+	if err := r.queueEventsTx(tx, &convo, events); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing conversation: %v", err)
+	}
+
+	return &convo, nil
+}
+
+// GetConversation returns a conversation with up to lineLimit of its
+// first lines or all of its lines if lineLimit is negative.
+func (r *repository) GetConversation(userID, convoID string, lineLimit int) (*Conversation, error) {
+	return r.getConversation(func(stmt *sqlx.NamedStmt) *sqlx.NamedStmt { return stmt }, userID, convoID, lineLimit)
+}
+
+// getConversation is GetConversation with the statements passed
+// through stmt, such as tx.NamedStmt to read within a transaction.
+func (r *repository) getConversation(stmt func(*sqlx.NamedStmt) *sqlx.NamedStmt, userID, convoID string, lineLimit int) (*Conversation, error) {
+	var convo convoRec
+
+	err := stmt(r.getConvo).Get(&convo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, viewerRoles})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("finding conversation %q for user %q: %v", convoID, userID, err)
+	}
+
+	// A null limit returns every line
+	var limit sql.NullInt64
+	if lineLimit >= 0 {
+		limit.Int64 = int64(lineLimit) + 1
+		limit.Valid = true
+	}
+
+	rows, err := stmt(r.findConvoLines).Queryx(struct {
+		ID    int
+		Limit sql.NullInt64
+	}{convo.IntID, limit})
+	if err != nil {
+		return nil, fmt.Errorf("retrieving lines for %q: %v", convoID, err)
+	}
+	defer rows.Close()
+
+	convo.Lines, err = r.scanLines(rows, convoID)
+	if err != nil {
+		return nil, err
+	}
+
+	if lineLimit >= 0 && len(convo.Lines) > lineLimit {
+		convo.Lines = convo.Lines[:lineLimit]
+		convo.HasMoreLines = true
+	}
+
+	convo.Conversation.id = convo.IntID
+
+	return &convo.Conversation, nil
+}
+
+// ListLines returns a page of the lines in a conversation ordered by
+// their position. It returns errRecordNotFound if the conversation does
+// not exist.
+func (r *repository) ListLines(userID, convoID string, args listArgs) ([]Line, bool, error) {
+	var convo convoRec
+
+	err := r.getConvo.Get(&convo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, viewerRoles})
+	if err == sql.ErrNoRows {
+		return nil, false, errRecordNotFound
+	} else if err != nil {
+		return nil, false, fmt.Errorf("finding conversation %q for user %q: %v", convoID, userID, err)
+	}
+
+	cursor := args.After
+	query := r.listLinesAsc
+	if !sortAsc(args) {
+		cursor = args.Before
+		query = r.listLinesDesc
+	}
+
+	cursorPosition := -1
+	if cursor != "" {
+		var rec linePositionRec
+
+		err := r.findLinePosition.Get(&rec, struct {
+			ConversationID int
+			LineID         string
+		}{convo.IntID, cursor})
+		if err == sql.ErrNoRows {
+			return nil, false, errCursorNotFound
+		} else if err != nil {
+			return nil, false, fmt.Errorf("finding line cursor %q: %v", cursor, err)
+		}
+		cursorPosition = rec.Position
+	}
+
+	rows, err := query.Queryx(struct {
+		ConversationID, CursorPosition, Limit int
+	}{convo.IntID, cursorPosition, args.Limit + 1})
+	if err != nil {
+		return nil, false, fmt.Errorf("listing lines for %q: %v", convoID, err)
+	}
+	defer rows.Close()
+
+	lines, err := r.scanLines(rows, convoID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(lines) > args.Limit
+	if hasMore {
+		lines = lines[:args.Limit]
+	}
+
+	return lines, hasMore, nil
+}
+
+// Search returns a page of the conversations the user is a member of
+// and their lines whose heading or text matches query, best matches
+// first.
+func (r *repository) Search(userID, query string, args listArgs) ([]SearchHit, bool, error) {
+	cursor := args.After
+	stmt := r.listSearchHitsAfter
+	if !sortAsc(args) {
+		cursor = args.Before
+		stmt = r.listSearchHitsBefore
+	}
+
+	queryArgs := struct {
+		UserID, Query, CursorID string
+		Roles                   pq.StringArray
+		Limit                   int
+	}{userID, query, cursor, viewerRoles, args.Limit + 1}
+
+	if cursor != "" {
+		var cnt int
+		if err := r.countSearchCursor.Get(&cnt, queryArgs); err != nil {
+			return nil, false, fmt.Errorf("finding search cursor %q: %v", cursor, err)
+		}
+		if cnt == 0 {
+			return nil, false, errCursorNotFound
+		}
+	}
+
+	hits := make([]SearchHit, 0)
+	if err := stmt.Select(&hits, queryArgs); err != nil {
+		return nil, false, fmt.Errorf("searching for %q for user %q: %v", query, userID, err)
+	}
+	for i := range hits {
+		hits[i].Snippet = highlightSnippet(hits[i].Snippet)
+	}
+
+	hasMore := len(hits) > args.Limit
+	if hasMore {
+		hits = hits[:args.Limit]
+	}
+
+	return hits, hasMore, nil
+}
+
+func (r *repository) scanLines(rows *sqlx.Rows, convoID string) ([]Line, error) {
+	lines := make([]Line, 0)
+	for rows.Next() {
+		var rec lineRec
+		if err := rows.StructScan(&rec); err != nil {
+			return nil, fmt.Errorf("scanning line for %q: %v", convoID, err)
+		}
+
+		r.setLineMood(&rec)
+		setLineCharacter(&rec)
+
+		lines = append(lines, rec.Line)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading lines for %q: %v", convoID, err)
+	}
+
+	return lines, nil
+}
+
+// DeleteConversation moves a conversation to the trash, hiding it and
+// its lines until it is restored or purged.
+func (r *repository) DeleteConversation(userID, convoID string, events ...*changeEvent) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	args := struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, ownerRoles}
+
+	var convo convoRec
+	if err := tx.NamedStmt(r.lockConvo).Get(&convo, args); err == sql.ErrNoRows {
+		return errRecordNotFound
+	} else if err != nil {
+		return fmt.Errorf("locking conversation %q: %v", convoID, err)
+	}
+	convo.Conversation.id = convo.IntID
+
+	if err := doDelete(tx.NamedStmt(r.deleteConvo), args); err != nil {
+		return err
+	}
+
+	if err := r.queueEventsTx(tx, &convo.Conversation, events); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing deletion of conversation %q: %v", convoID, err)
+	}
+
+	return nil
+}
+
+// RestoreConversation takes a conversation out of the trash. It returns
+// errRecordNotFound if the conversation is not in the trash.
+func (r *repository) RestoreConversation(userID, convoID string) error {
+	return doDelete(r.restoreConvo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, ownerRoles})
+}
+
+// InsertLine adds a line to the conversation at the position given by
+// pos or after its last line. A user-defined mood of the line that has
+// not been saved, such as one made for a cowsay face, is created for
+// the user along with it.
+func (r *repository) InsertLine(userID, convoID string, line *Line, pos LinePosition, events ...*changeEvent) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var convo convoRec
+	err = tx.NamedStmt(r.lockConvo).Get(&convo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, editorRoles})
+	if err == sql.ErrNoRows {
+		return errRecordNotFound
+	} else if err != nil {
+		return fmt.Errorf("finding conversation %s for user %s: %v", convoID, userID, err)
+	}
+
+	position, err := r.placeLine(tx, convo.IntID, 0, pos)
+	if err != nil {
+		return err
+	}
+
+	usage := linesUsage(*line)
+	if line.mood.UserDefined && line.mood.id == 0 {
+		if err := r.insertMoodTx(tx, userID, line.mood); err != nil {
+			return err
+		}
+		line.MoodName = line.mood.Name
+		usage.moods = 1
+	}
+
+	line.ID, err = r.insertLineTx(tx, convo.IntID, position, line)
+	if err != nil {
+		return err
+	}
+
+	if err := r.enforceQuotasTx(tx, userID, convo.Creator, convo.IntID, usage); err != nil {
+		return err
+	}
+
+	convo.Conversation.id = convo.IntID
+	if err := r.queueEventsTx(tx, &convo.Conversation, events); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing line: %v", err)
+	}
+
+	return nil
+}
+
+// InsertLines appends lines to the conversation in order, all or
+// nothing.
+func (r *repository) InsertLines(userID, convoID string, lines []Line, events ...*changeEvent) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var convo convoRec
+	err = tx.NamedStmt(r.lockConvo).Get(&convo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, editorRoles})
+	if err == sql.ErrNoRows {
+		return errRecordNotFound
+	} else if err != nil {
+		return fmt.Errorf("finding conversation %s for user %s: %v", convoID, userID, err)
+	}
+
+	position, err := r.placeLine(tx, convo.IntID, 0, LinePosition{})
+	if err != nil {
+		return err
+	}
+
+	for i := range lines {
+		lines[i].ID, err = r.insertLineTx(tx, convo.IntID, position+i, &lines[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := r.enforceQuotasTx(tx, userID, convo.Creator, convo.IntID, linesUsage(lines...)); err != nil {
+		return err
+	}
+
+	convo.Conversation.id = convo.IntID
+	if err := r.queueEventsTx(tx, &convo.Conversation, events); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing lines: %v", err)
+	}
+
+	return nil
+}
+
+func (r *repository) insertLineTx(tx *sqlx.Tx, convoID, position int, line *Line) (string, error) {
+	var moodID sql.NullInt64
+	if line.mood.id != 0 {
+		moodID.Int64 = int64(line.mood.id)
+		moodID.Valid = true
+	}
+
+	var sentiment sql.NullFloat64
+	if line.Sentiment != nil {
+		sentiment.Float64 = *line.Sentiment
+		sentiment.Valid = true
+	}
+
+	var characterID sql.NullInt64
+	if line.character != nil {
+		characterID.Int64 = int64(line.character.id)
+		characterID.Valid = true
+	}
+
+	publicID, err := insertWithPublicID(tx, lineIDPrefix, func(publicID string) error {
+		_, err := tx.NamedStmt(r.insertLine).Exec(struct {
+			PublicID, Animal, Text, MoodName string
+			Think                            bool
+			Width                            int
+			MoodID                           sql.NullInt64
+			Sentiment                        sql.NullFloat64
+			CharacterID                      sql.NullInt64
+			ConversationID, Position         int
+		}{
+			publicID, line.Animal, line.Text, line.MoodName,
+			line.Think,
+			line.Width,
+			moodID,
+			sentiment,
+			characterID,
+			convoID, position,
+		})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("inserting line: %v", err)
+	}
+
+	_, err = tx.NamedStmt(r.addTextBytes).Exec(struct{ ID, Bytes int }{convoID, len(line.Text)})
+	if err != nil {
+		return "", fmt.Errorf("counting text of line: %v", err)
+	}
+
+	return publicID, nil
+}
+
+// ImportConversation creates a conversation with its characters, its
+// lines and any moods the lines need that the user does not have, all
+// or nothing. The lines must refer to moods that exist or are in moods
+// and to characters in characters, whose IDs are set. Moods the user
+// has created since are used in place of those in moods.
+func (r *repository) ImportConversation(userID, heading string, characters []*Character, lines []Line, moods []*Mood, events ...*changeEvent) (*Conversation, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, mood := range moods {
+		// The user may have created a mood with the same name since the
+		// bundle was mapped, in which case the lines use theirs instead.
+		if err := r.insertMoodTx(tx, userID, mood); err != nil {
+			return nil, err
+		}
+	}
+
+	convo := Conversation{Heading: heading}
+	convo.ID, err = insertWithPublicID(tx, convoIDPrefix, func(publicID string) error {
+		return tx.NamedStmt(r.insertConvo).QueryRow(struct {
+			PublicID, UserID, Heading string
+			ExpiresIn                 sql.NullInt64
+		}{publicID, userID, heading, sql.NullInt64{}}).Scan(&convo.id, &convo.Expires)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("inserting conversation: %v", err)
+	}
+
+	if err := r.insertMemberTx(tx, convo.id, userID, RoleOwner); err != nil {
+		return nil, err
+	}
+	convo.Role = RoleOwner
+
+	for _, character := range characters {
+		if err := r.insertCharacterTx(tx, convo.id, character); err != nil {
+			return nil, err
+		}
+	}
+
+	convo.Lines = make([]Line, len(lines))
+	for i, line := range lines {
+		line.ID, err = r.insertLineTx(tx, convo.id, i, &line)
+		if err != nil {
+			return nil, err
+		}
+		convo.Lines[i] = line
+	}
+
+	usage := linesUsage(lines...)
+	usage.conversations = 1
+	usage.moods = int64(len(moods))
+	if err := r.enforceQuotasTx(tx, userID, userID, convo.id, usage); err != nil {
+		return nil, err
+	}
+
+	if err := r.queueEventsTx(tx, &convo, events); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing conversation: %v", err)
+	}
+
+	return &convo, nil
+}
+
+// MoveLine places an existing line at the position given by pos.
+func (r *repository) MoveLine(userID, convoID, lineID string, pos LinePosition) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var convo convoRec
+	err = tx.NamedStmt(r.lockConvo).Get(&convo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, editorRoles})
+	if err == sql.ErrNoRows {
+		return errRecordNotFound
+	} else if err != nil {
+		return fmt.Errorf("locking conversation %q: %v", convoID, err)
+	}
+
+	var line linePositionRec
+	err = tx.NamedStmt(r.findLinePosition).Get(&line, struct {
+		ConversationID int
+		LineID         string
+	}{convo.IntID, lineID})
+	if err == sql.ErrNoRows {
+		return errRecordNotFound
+	} else if err != nil {
+		return fmt.Errorf("finding line %q: %v", lineID, err)
+	}
+
+	position, err := r.placeLine(tx, convo.IntID, line.ID, pos)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.NamedStmt(r.moveLine).Exec(struct{ ID, Position int }{line.ID, position})
+	if err != nil {
+		return fmt.Errorf("moving line %q: %v", lineID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing line %q: %v", lineID, err)
+	}
+
+	return nil
+}
+
+// placeLine returns the position for the line with the internal ID
+// lineID, or 0 for a new line, in a locked conversation. Lines at and
+// after the position are shifted to make room for it.
+func (r *repository) placeLine(tx *sqlx.Tx, convoID, lineID int, pos LinePosition) (int, error) {
+	anchorID, offset := pos.Before, 0
+	if pos.After != "" {
+		anchorID, offset = pos.After, 1
+	}
+
+	if anchorID == "" {
+		var position int
+		err := tx.NamedStmt(r.nextLinePosition).Get(&position, struct{ ConversationID int }{convoID})
+		if err != nil {
+			return 0, fmt.Errorf("finding last position in conversation %d: %v", convoID, err)
+		}
+		return position, nil
+	}
+
+	var anchor linePositionRec
+	err := tx.NamedStmt(r.findLinePosition).Get(&anchor, struct {
+		ConversationID int
+		LineID         string
+	}{convoID, anchorID})
+	if err == sql.ErrNoRows {
+		return 0, errAnchorNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("finding line %q: %v", anchorID, err)
+	}
+
+	position := anchor.Position + offset
+	_, err = tx.NamedStmt(r.shiftLines).Exec(struct {
+		ConversationID, Position, ID int
+	}{convoID, position, lineID})
+	if err != nil {
+		return 0, fmt.Errorf("shifting lines in conversation %d: %v", convoID, err)
+	}
+
+	return position, nil
+}
+
+func (r *repository) GetLine(userID, convoID, lineID string) (*Line, error) {
+	var rec lineRec
+
+	err := r.getLine.Get(&rec, struct {
+		UserID, ConvoID, LineID string
+		Roles                   pq.StringArray
+	}{userID, convoID, lineID, viewerRoles})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("getting line: %v", err)
+	}
+
+	r.setLineMood(&rec)
+	setLineCharacter(&rec)
+
+	return &rec.Line, nil
+}
+
+// UpdateConversation replaces the heading of a conversation, keeping
+// the prior heading as a revision.
+func (r *repository) UpdateConversation(userID string, convo *Conversation, events ...*changeEvent) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var rec convoRec
+	err = tx.NamedStmt(r.lockConvo).Get(&rec, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convo.ID, ownerRoles})
+	if err == sql.ErrNoRows {
+		return errRecordNotFound
+	} else if err != nil {
+		return fmt.Errorf("locking conversation %q: %v", convo.ID, err)
+	}
+
+	if rec.Heading != convo.Heading {
+		args := struct {
+			ID              int
+			UserID, Heading string
+		}{rec.IntID, userID, convo.Heading}
+
+		if _, err := tx.NamedStmt(r.insertConvoRevision).Exec(args); err != nil {
+			return fmt.Errorf("inserting revision for conversation %q: %v", convo.ID, err)
+		}
+		if _, err := tx.NamedStmt(r.updateConvo).Exec(args); err != nil {
+			return fmt.Errorf("updating conversation %q: %v", convo.ID, err)
+		}
+	}
+
+	convo.id = rec.IntID
+	if err := r.queueEventsTx(tx, convo, events); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing conversation %q: %v", convo.ID, err)
+	}
+
+	return nil
+}
+
+// UpdateLine replaces the content of a line, keeping the prior content
+// as a revision.
+func (r *repository) UpdateLine(userID, convoID string, line *Line) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var rec struct {
+		ID, ConversationID int
+		Creator            string
+	}
+	err = tx.NamedStmt(r.lockLine).Get(&rec, struct {
+		UserID, ConvoID, LineID string
+		Roles                   pq.StringArray
+	}{userID, convoID, line.ID, editorRoles})
+	if err == sql.ErrNoRows {
+		return errRecordNotFound
+	} else if err != nil {
+		return fmt.Errorf("locking line %q: %v", line.ID, err)
+	}
+
+	var moodID sql.NullInt64
+	if line.mood.id != 0 {
+		moodID.Int64 = int64(line.mood.id)
+		moodID.Valid = true
+	}
+
+	var sentiment sql.NullFloat64
+	if line.Sentiment != nil {
+		sentiment.Float64 = *line.Sentiment
+		sentiment.Valid = true
+	}
+
+	args := struct {
+		Animal, Text, MoodName string
+		Think                  bool
+		Width                  int
+		MoodID                 sql.NullInt64
+		Sentiment              sql.NullFloat64
+		ID                     int
+		UserID                 string
+	}{
+		line.Animal, line.Text, line.MoodName,
+		line.Think,
+		line.Width,
+		moodID,
+		sentiment,
+		rec.ID,
+		userID,
+	}
+
+	res, err := tx.NamedStmt(r.insertLineRevision).Exec(args)
+	if err != nil {
+		return fmt.Errorf("inserting revision for line %q: %v", line.ID, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("inserting revision for line %q: %v", line.ID, err)
+	} else if n == 0 {
+		// Nothing changed
+		return nil
+	}
+
+	if _, err := tx.NamedStmt(r.updateLine).Exec(args); err != nil {
+		return fmt.Errorf("updating line %q: %v", line.ID, err)
+	}
+
+	// The prior text is kept by the revision
+	_, err = tx.NamedStmt(r.addTextBytes).Exec(struct{ ID, Bytes int }{rec.ConversationID, len(line.Text)})
+	if err != nil {
+		return fmt.Errorf("counting text of line %q: %v", line.ID, err)
+	}
+
+	err = r.enforceQuotasTx(tx, userID, rec.Creator, rec.ConversationID, usageDelta{textBytes: int64(len(line.Text))})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing line %q: %v", line.ID, err)
+	}
+
+	return nil
+}
+
+// ListConversationRevisions returns the prior headings of a
+// conversation from oldest to newest or nil if the conversation does
+// not exist.
+func (r *repository) ListConversationRevisions(userID, convoID string) ([]ConversationRevision, error) {
+	convo, err := r.GetConversation(userID, convoID, 0)
+	if err != nil {
+		return nil, err
+	}
+	if convo == nil {
+		return nil, nil
+	}
+
+	revisions := make([]ConversationRevision, 0)
+	err = r.findConvoRevisions.Select(&revisions, struct {
+		UserID, ConvoID string
+		Roles           pq.StringArray
+	}{userID, convoID, viewerRoles})
+	if err != nil {
+		return nil, fmt.Errorf("listing revisions for conversation %q: %v", convoID, err)
+	}
+
+	return revisions, nil
+}
+
+// ListLineRevisions returns the prior revisions of a line from oldest
+// to newest or nil if the line does not exist.
+func (r *repository) ListLineRevisions(userID, convoID, lineID string) ([]LineRevision, error) {
+	line, err := r.GetLine(userID, convoID, lineID)
+	if err != nil {
+		return nil, err
+	}
+	if line == nil {
+		return nil, nil
+	}
+
+	revisions := make([]LineRevision, 0)
+	err = r.findLineRevisions.Select(&revisions, struct {
+		UserID, ConvoID, LineID string
+		Roles                   pq.StringArray
+	}{userID, convoID, lineID, viewerRoles})
+	if err != nil {
+		return nil, fmt.Errorf("listing revisions for line %q: %v", lineID, err)
+	}
+
+	return revisions, nil
+}
+
+// DeleteLine moves a line to the trash. The line keeps its position
+// so that restoring it puts it back where it was.
+func (r *repository) DeleteLine(userID, convoID, lineID string, events ...*changeEvent) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var convo convoRec
+	err = tx.NamedStmt(r.lockConvo).Get(&convo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, editorRoles})
+	if err == sql.ErrNoRows {
+		return errRecordNotFound
+	} else if err != nil {
+		return fmt.Errorf("locking conversation %q: %v", convoID, err)
+	}
+	convo.Conversation.id = convo.IntID
+
+	err = doDelete(tx.NamedStmt(r.deleteLine), struct {
+		UserID, ConvoID, LineID string
+		Roles                   pq.StringArray
+	}{userID, convoID, lineID, editorRoles})
+	if err != nil {
+		return err
+	}
+
+	if err := r.queueEventsTx(tx, &convo.Conversation, events); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing deletion of line %q: %v", lineID, err)
+	}
+
+	return nil
+}
+
+// RestoreLine takes a line out of the trash. It returns
+// errRecordNotFound if the line is not in the trash or its
+// conversation is.
+func (r *repository) RestoreLine(userID, convoID, lineID string) error {
+	return doDelete(r.restoreLine, struct {
+		UserID, ConvoID, LineID string
+		Roles                   pq.StringArray
+	}{userID, convoID, lineID, editorRoles})
+}
+
+func (r *repository) ListTrash(userID string, args listArgs) ([]TrashItem, bool, error) {
+	cursor := args.After
+	stmt := r.listTrashAfter
+	if !sortAsc(args) {
+		cursor = args.Before
+		stmt = r.listTrashBefore
+	}
+
+	queryArgs := struct {
+		UserID, CursorID string
+		Roles            pq.StringArray
+		Limit            int
+	}{userID, cursor, editorRoles, args.Limit + 1}
+
+	if cursor != "" {
+		var cnt int
+		if err := r.countTrashCursor.Get(&cnt, queryArgs); err != nil {
+			return nil, false, fmt.Errorf("finding trash cursor %q: %v", cursor, err)
+		}
+		if cnt == 0 {
+			return nil, false, errCursorNotFound
+		}
+	}
+
+	items := make([]TrashItem, 0)
+	if err := stmt.Select(&items, queryArgs); err != nil {
+		return nil, false, fmt.Errorf("listing trash for user %q: %v", userID, err)
+	}
+
+	hasMore := len(items) > args.Limit
+	if hasMore {
+		items = items[:args.Limit]
+	}
+
+	return items, hasMore, nil
+}
+
+// PurgeTrash permanently deletes the conversations and lines of every
+// user that have been in the trash for longer than retention.
+func (r *repository) PurgeTrash(retention time.Duration) (convos, lines int64, err error) {
+	args := struct{ Retention float64 }{retention.Seconds()}
+
+	res, err := r.purgeConvos.Exec(args)
+	if err != nil {
+		return 0, 0, fmt.Errorf("purging conversations: %v", err)
+	}
+	if convos, err = res.RowsAffected(); err != nil {
+		return 0, 0, err
+	}
+
+	if err := r.purgeLines.Get(&lines, args); err != nil {
+		return 0, 0, fmt.Errorf("purging lines: %v", err)
+	}
+
+	return convos, lines, nil
+}
+
+// ReapConversations permanently deletes up to limit conversations that
+// have expired and returns their IDs. It returns errReaperLocked if
+// another process is reaping at the same time.
+func (r *repository) ReapConversations(limit int) ([]string, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.NamedStmt(r.lockReaper).Get(&locked, struct{ Key int64 }{reaperLockKey}); err != nil {
+		return nil, fmt.Errorf("locking reaper: %v", err)
+	}
+	if !locked {
+		return nil, errReaperLocked
+	}
+
+	var ids []string
+	if err := tx.NamedStmt(r.reapConvos).Select(&ids, struct{ Limit int }{limit}); err != nil {
+		return nil, fmt.Errorf("reaping conversations: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing reaped conversations: %v", err)
+	}
+
+	return ids, nil
+}
+
+// InsertCharacter adds a character to a conversation, setting its ID
+// and creation time. It returns errCharacterExists if the conversation
+// has a character with the same name and errTooManyCharacters if it
+// already has maxCharacters characters.
+func (r *repository) InsertCharacter(userID, convoID string, character *Character) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Locking the conversation serializes changes to its characters
+	var convo convoRec
+	err = tx.NamedStmt(r.lockConvo).Get(&convo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, editorRoles})
+	if err == sql.ErrNoRows {
+		return errRecordNotFound
+	} else if err != nil {
+		return fmt.Errorf("finding conversation %s for user %s: %v", convoID, userID, err)
+	}
+
+	var count struct{ Total, Named int }
+	err = tx.NamedStmt(r.countCharacters).Get(&count, struct {
+		ConversationID int
+		Name           string
+	}{convo.IntID, character.Name})
+	if err != nil {
+		return fmt.Errorf("counting characters of conversation %q: %v", convoID, err)
+	}
+	if count.Named > 0 {
+		return errCharacterExists
+	}
+	if count.Total >= maxCharacters {
+		return errTooManyCharacters
+	}
+
+	if err := r.insertCharacterTx(tx, convo.IntID, character); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing character: %v", err)
+	}
+
+	return nil
+}
+
+// insertCharacterTx inserts a character without checking the
+// conversation's limits, setting its ID and creation time.
+func (r *repository) insertCharacterTx(tx *sqlx.Tx, convoID int, character *Character) error {
+	var rec characterRec
+	publicID, err := insertWithPublicID(tx, characterIDPrefix, func(publicID string) error {
+		return tx.NamedStmt(r.insertCharacter).Get(&rec, struct {
+			PublicID, Name, Animal, MoodName, Facing string
+			ConversationID                           int
+		}{publicID, character.Name, character.Animal, character.MoodName, character.Facing, convoID})
+	})
+	if err != nil {
+		return fmt.Errorf("inserting character %q: %v", character.Name, err)
+	}
+
+	character.ID = publicID
+	character.Created = rec.Created
+	character.id = rec.IntID
+	return nil
+}
+
+// ListCharacters returns the characters of a conversation from oldest
+// to newest. It returns errRecordNotFound if the conversation does not
+// exist.
+func (r *repository) ListCharacters(userID, convoID string) ([]Character, error) {
+	var convo convoRec
+	err := r.getConvo.Get(&convo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, viewerRoles})
+	if err == sql.ErrNoRows {
+		return nil, errRecordNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("finding conversation %q for user %q: %v", convoID, userID, err)
+	}
+
+	var recs []characterRec
+	if err := r.listCharacters.Select(&recs, struct{ ConversationID int }{convo.IntID}); err != nil {
+		return nil, fmt.Errorf("listing characters of conversation %q: %v", convoID, err)
+	}
+
+	characters := make([]Character, len(recs))
+	for i, rec := range recs {
+		characters[i] = rec.Character
+		characters[i].id = rec.IntID
+	}
+
+	return characters, nil
+}
+
+// GetCharacter returns the conversation's character with the name or
+// nil if there is none.
+func (r *repository) GetCharacter(userID, convoID, name string) (*Character, error) {
+	var rec characterRec
+	err := r.findCharacter.Get(&rec, struct {
+		UserID, ConvoID, Name string
+		Roles                 pq.StringArray
+	}{userID, convoID, name, viewerRoles})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("finding character %q: %v", name, err)
+	}
+
+	rec.Character.id = rec.IntID
+	return &rec.Character, nil
+}
+
+// DeleteCharacter deletes a character. Its lines keep their animal and
+// mood but are no longer labelled with its name.
+func (r *repository) DeleteCharacter(userID, convoID, characterID string) error {
+	return doDelete(r.deleteCharacter, struct {
+		UserID, ConvoID, CharacterID string
+		Roles                        pq.StringArray
+	}{userID, convoID, characterID, editorRoles})
+}
+
+// insertMemberTx adds the user to a conversation with the role.
+func (r *repository) insertMemberTx(tx *sqlx.Tx, convoID int, userID, role string) error {
+	_, err := insertWithPublicID(tx, memberIDPrefix, func(publicID string) error {
+		_, err := tx.NamedStmt(r.insertMember).Exec(struct {
+			PublicID, UserID, Role string
+			ConversationID         int
+		}{publicID, userID, role, convoID})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("inserting member of conversation %d: %v", convoID, err)
+	}
+
+	return nil
+}
+
+// GetRole returns the user's role in a conversation or an empty string
+// if the user is not a member.
+func (r *repository) GetRole(userID, convoID string) (string, error) {
+	var role string
+	err := r.getRole.Get(&role, struct{ UserID, ConvoID string }{userID, convoID})
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("finding role of user %q in conversation %q: %v", userID, convoID, err)
+	}
+
+	return role, nil
+}
+
+// ListMembers returns the members of a conversation from oldest to
+// newest. It returns errRecordNotFound if the conversation does not
+// exist.
+func (r *repository) ListMembers(userID, convoID string) ([]Member, error) {
+	var convo convoRec
+	err := r.getConvo.Get(&convo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, viewerRoles})
+	if err == sql.ErrNoRows {
+		return nil, errRecordNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("finding conversation %q for user %q: %v", convoID, userID, err)
+	}
+
+	members := make([]Member, 0)
+	err = r.listMembers.Select(&members, struct {
+		UserID         string
+		ConversationID int
+	}{userID, convo.IntID})
+	if err != nil {
+		return nil, fmt.Errorf("listing members of conversation %q: %v", convoID, err)
+	}
+
+	return members, nil
+}
+
+// UpdateMember changes the role of a member. It returns
+// errRecordNotFound unless the user is an owner of the conversation and
+// errLastOwner if the member is its only owner.
+func (r *repository) UpdateMember(userID, convoID, memberID, role string) (*Member, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Locking the conversation serializes changes to its members
+	var convo convoRec
+	err = tx.NamedStmt(r.lockConvo).Get(&convo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, ownerRoles})
+	if err == sql.ErrNoRows {
+		return nil, errRecordNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("locking conversation %q: %v", convoID, err)
+	}
+
+	rec, err := r.findMemberTx(tx, userID, convo.IntID, memberID)
+	if err != nil {
+		return nil, err
+	}
+
+	if rec.Role == RoleOwner && role != RoleOwner {
+		if err := r.checkOwnersTx(tx, convo.IntID); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.NamedStmt(r.updateMember).Exec(struct {
+		ID   int
+		Role string
+	}{rec.IntID, role})
+	if err != nil {
+		return nil, fmt.Errorf("updating member %q: %v", memberID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing member %q: %v", memberID, err)
+	}
+
+	rec.Member.Role = role
+	return &rec.Member, nil
+}
+
+// DeleteMember removes a member from a conversation. Owners may remove
+// any member and other members only themselves. It returns
+// errRecordNotFound if the user may not remove the member and
+// errLastOwner if the member is the conversation's only owner.
+func (r *repository) DeleteMember(userID, convoID, memberID string) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var convo convoRec
+	err = tx.NamedStmt(r.lockConvo).Get(&convo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, viewerRoles})
+	if err == sql.ErrNoRows {
+		return errRecordNotFound
+	} else if err != nil {
+		return fmt.Errorf("locking conversation %q: %v", convoID, err)
+	}
+
+	rec, err := r.findMemberTx(tx, userID, convo.IntID, memberID)
+	if err != nil {
+		return err
+	}
+	if !rec.Self && convo.Role != RoleOwner {
+		return errRecordNotFound
+	}
+
+	if rec.Role == RoleOwner {
+		if err := r.checkOwnersTx(tx, convo.IntID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.NamedStmt(r.deleteMember).Exec(struct{ ID int }{rec.IntID}); err != nil {
+		return fmt.Errorf("deleting member %q: %v", memberID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing member %q: %v", memberID, err)
+	}
+
+	return nil
+}
+
+func (r *repository) findMemberTx(tx *sqlx.Tx, userID string, convoID int, memberID string) (*memberRec, error) {
+	var rec memberRec
+	err := tx.NamedStmt(r.findMember).Get(&rec, struct {
+		UserID, MemberID string
+		ConversationID   int
+	}{userID, memberID, convoID})
+	if err == sql.ErrNoRows {
+		return nil, errRecordNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("finding member %q: %v", memberID, err)
+	}
+
+	return &rec, nil
+}
+
+// checkOwnersTx returns errLastOwner unless a locked conversation has
+// more than one owner.
+func (r *repository) checkOwnersTx(tx *sqlx.Tx, convoID int) error {
+	var count struct{ Total, Owners, Self int }
+	err := tx.NamedStmt(r.countMembers).Get(&count, struct {
+		UserID         string
+		ConversationID int
+	}{"", convoID})
+	if err != nil {
+		return fmt.Errorf("counting members of conversation %d: %v", convoID, err)
+	}
+	if count.Owners < 2 {
+		return errLastOwner
+	}
+
+	return nil
+}
+
+// InsertInvite creates an invite to a conversation with the random part
+// of its token. It returns errRecordNotFound unless the user is an
+// owner of the conversation.
+func (r *repository) InsertInvite(userID, convoID, tokenID, role string, expiresIn time.Duration) (*Invite, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	invite := Invite{Role: role}
+	invite.ID, err = insertWithPublicID(tx, inviteIDPrefix, func(publicID string) error {
+		return tx.NamedStmt(r.insertInvite).Get(&invite, struct {
+			PublicID, TokenID, Role, UserID, ConvoID string
+			Roles                                    pq.StringArray
+			ExpiresIn                                float64
+		}{publicID, tokenID, role, userID, convoID, ownerRoles, expiresIn.Seconds()})
+	})
+	if err == sql.ErrNoRows {
+		return nil, errRecordNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("inserting invite for conversation %q: %v", convoID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing invite: %v", err)
+	}
+
+	return &invite, nil
+}
+
+// ListInvites returns the unexpired invites to a conversation. It
+// returns errRecordNotFound unless the user is an owner of the
+// conversation.
+func (r *repository) ListInvites(userID, convoID string) ([]inviteRec, error) {
+	var convo convoRec
+	err := r.getConvo.Get(&convo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, ownerRoles})
+	if err == sql.ErrNoRows {
+		return nil, errRecordNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("finding conversation %q for user %q: %v", convoID, userID, err)
+	}
+
+	invites := make([]inviteRec, 0)
+	err = r.listInvites.Select(&invites, struct{ ConversationID int }{convo.IntID})
+	if err != nil {
+		return nil, fmt.Errorf("listing invites for conversation %q: %v", convoID, err)
+	}
+
+	return invites, nil
+}
 
-	return &rec.Line, nil
+func (r *repository) DeleteInvite(userID, convoID, inviteID string) error {
+	return doDelete(r.deleteInvite, struct {
+		UserID, ConvoID, InviteID string
+		Roles                     pq.StringArray
+	}{userID, convoID, inviteID, ownerRoles})
 }
 
-func (r *repository) DeleteLine(userID, convoID, lineID string) error {
-	if err := doDelete(r.deleteLine, struct{ UserID, ConvoID, LineID string }{userID, convoID, lineID}); err != nil {
-		return err
+// AcceptInvite makes the user a member of the conversation of an
+// unexpired invite with the random part of its token, using up the
+// invite, and returns the conversation's ID. It returns
+// errRecordNotFound if there is no such invite, errAlreadyMember if the
+// user is already a member and errTooManyMembers if the conversation
+// has maxMembers members.
+func (r *repository) AcceptInvite(userID, tokenID string) (string, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return "", fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var invite inviteConvoRec
+	err = tx.NamedStmt(r.lockInvite).Get(&invite, struct{ TokenID string }{tokenID})
+	if err == sql.ErrNoRows {
+		return "", errRecordNotFound
+	} else if err != nil {
+		return "", fmt.Errorf("finding invite: %v", err)
+	}
+
+	var count struct{ Total, Owners, Self int }
+	err = tx.NamedStmt(r.countMembers).Get(&count, struct {
+		UserID         string
+		ConversationID int
+	}{userID, invite.ConversationID})
+	if err != nil {
+		return "", fmt.Errorf("counting members of conversation %q: %v", invite.ConvoID, err)
+	}
+	if count.Self > 0 {
+		return "", errAlreadyMember
+	}
+	if count.Total >= maxMembers {
+		return "", errTooManyMembers
+	}
+
+	if err := r.insertMemberTx(tx, invite.ConversationID, userID, invite.Role); err != nil {
+		return "", err
+	}
+
+	if _, err := tx.NamedStmt(r.useInvite).Exec(struct{ ID int }{invite.ID}); err != nil {
+		return "", fmt.Errorf("using invite: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("committing member: %v", err)
+	}
+
+	return invite.ConvoID, nil
+}
+
+// GetUsage returns what the user stores against their quotas.
+func (r *repository) GetUsage(userID string) (*usageRec, error) {
+	var usage usageRec
+	if err := r.getUsage.Get(&usage, struct{ UserID string }{userID}); err != nil {
+		return nil, fmt.Errorf("finding usage of user %q: %v", userID, err)
+	}
+
+	return &usage, nil
+}
+
+// enforceQuotasTx returns QuotaExceeded if a change that added d to
+// the usage of its users exceeded one of their quotas, in which case
+// the change must be rolled back. It is called in the change's
+// transaction once the change is made. New conversations and moods
+// count against the user and lines and text against the creator of
+// the conversation with the internal ID convoID. Their quotas stay
+// locked until the transaction ends so that concurrent changes are
+// checked one after the other.
+func (r *repository) enforceQuotasTx(tx *sqlx.Tx, userID, creator string, convoID int, d usageDelta) error {
+	if r.quotas == (Quotas{}) {
+		return nil
+	}
+
+	// Locked in order so that changes by different users can't
+	// deadlock
+	users := []string{userID}
+	if creator < userID {
+		users = []string{creator, userID}
+	} else if creator > userID {
+		users = append(users, creator)
+	}
+	for _, user := range users {
+		_, err := tx.NamedStmt(r.lockUser).Exec(struct {
+			Key    int
+			UserID string
+		}{quotaLockKey, user})
+		if err != nil {
+			return fmt.Errorf("locking quotas of user %q: %v", user, err)
+		}
+	}
+
+	var usage usageRec
+	err := tx.NamedStmt(r.findQuotaUsage).Get(&usage, struct {
+		UserID, Creator string
+		ConversationID  int
+	}{userID, creator, convoID})
+	if err != nil {
+		return fmt.Errorf("finding usage of user %q: %v", userID, err)
+	}
+
+	for _, check := range []struct {
+		quota            string
+		limit, used, add int64
+	}{
+		{QuotaConversations, r.quotas.Conversations, usage.Conversations, d.conversations},
+		{QuotaLinesPerConversation, r.quotas.LinesPerConversation, usage.LinesPerConversation, d.lines},
+		{QuotaMoods, r.quotas.Moods, usage.Moods, d.moods},
+		{QuotaTextBytes, r.quotas.TextBytes, usage.TextBytes, d.textBytes},
+	} {
+		if check.limit > 0 && check.add > 0 && check.used > check.limit {
+			return QuotaExceeded{
+				Quota: check.quota,
+				Limit: check.limit,
+				Usage: check.used - check.add,
+			}
+		}
+	}
+
+	return nil
+}
+
+// InsertWebhook registers a webhook for the user, setting its ID and
+// creation time. It returns errTooManyWebhooks if the user already has
+// maxWebhooks webhooks.
+func (r *repository) InsertWebhook(userID string, hook *Webhook) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.NamedStmt(r.lockUser).Exec(struct {
+		Key    int
+		UserID string
+	}{webhookLockKey, userID})
+	if err != nil {
+		return fmt.Errorf("locking webhooks of user %q: %v", userID, err)
+	}
+
+	hook.ID, err = insertWithPublicID(tx, webhookIDPrefix, func(publicID string) error {
+		return tx.NamedStmt(r.insertWebhook).Get(&hook.Created, struct {
+			PublicID, UserID, URL, Secret string
+			MaxWebhooks                   int
+		}{publicID, userID, hook.URL, hook.Secret, maxWebhooks})
+	})
+	if err == sql.ErrNoRows {
+		return errTooManyWebhooks
+	} else if err != nil {
+		return fmt.Errorf("inserting webhook for user %q: %v", userID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing webhook: %v", err)
+	}
+
+	return nil
+}
+
+// ListWebhooks returns the webhooks of the user without their secrets.
+func (r *repository) ListWebhooks(userID string) ([]Webhook, error) {
+	hooks := make([]Webhook, 0)
+	if err := r.listWebhooks.Select(&hooks, struct{ UserID string }{userID}); err != nil {
+		return nil, fmt.Errorf("listing webhooks for user %q: %v", userID, err)
+	}
+
+	return hooks, nil
+}
+
+// DeleteWebhook deletes a webhook along with its deliveries.
+func (r *repository) DeleteWebhook(userID, webhookID string) error {
+	return doDelete(r.deleteWebhook, struct{ UserID, WebhookID string }{userID, webhookID})
+}
+
+// queueEventsTx queues a delivery of each event of a change to each of
+// the webhooks of the conversation's members in the change's
+// transaction, so that the deliveries are only sent if the change is
+// committed. The data of events that have a build function is set
+// first.
+func (r *repository) queueEventsTx(tx *sqlx.Tx, convo *Conversation, events []*changeEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	for _, event := range events {
+		if event.build == nil {
+			continue
+		}
+
+		var err error
+		if event.Data, err = event.build(convo); err != nil {
+			return err
+		}
+	}
+
+	var webhookIDs []int64
+	err := tx.NamedStmt(r.lockConvoWebhooks).Select(&webhookIDs, struct{ ConversationID int }{convo.id})
+	if err != nil {
+		return fmt.Errorf("finding webhooks for conversation %q: %v", convo.ID, err)
+	}
+	if len(webhookIDs) == 0 {
+		return nil
+	}
+
+	for _, event := range events {
+		payload, err := webhookPayload(convo.ID, event)
+		if err != nil {
+			return err
+		}
+
+		_, err = insertWithPublicIDs(tx, deliveryIDPrefix, len(webhookIDs), func(publicIDs []string) error {
+			_, err := tx.NamedStmt(r.queueDeliveries).Exec(struct {
+				EventType, Payload    string
+				PublicIDs, WebhookIDs interface{}
+			}{event.Type, string(payload), pq.Array(publicIDs), pq.Array(webhookIDs)})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("queueing %s deliveries for conversation %q: %v", event.Type, convo.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// ClaimDeliveries returns up to limit deliveries that are due to be
+// sent. They are not claimed again until the lease expires unless
+// their attempt is recorded first.
+func (r *repository) ClaimDeliveries(limit int, lease time.Duration) ([]deliveryRec, error) {
+	var recs []deliveryRec
+	err := r.claimDeliveries.Select(&recs, struct {
+		Limit int
+		Lease float64
+	}{limit, lease.Seconds()})
+	if err != nil {
+		return nil, fmt.Errorf("claiming deliveries: %v", err)
+	}
+
+	return recs, nil
+}
+
+// RecordDelivery records an attempt to send a delivery. Unless it was
+// delivered, it is retried after retryDelay if retry is set and
+// abandoned otherwise.
+func (r *repository) RecordDelivery(rec *deliveryRec, delivered, retry bool, retryDelay time.Duration) error {
+	_, err := r.recordDelivery.Exec(struct {
+		IntID            int
+		ResponseCode     *int
+		Error            string
+		Delivered, Retry bool
+		RetryDelay       float64
+	}{rec.IntID, rec.ResponseCode, rec.Error, delivered, retry && !delivered, retryDelay.Seconds()})
+	if err != nil {
+		return fmt.Errorf("recording delivery %q: %v", rec.ID, err)
 	}
 
 	return nil
 }
 
-func setLineMood(rec *lineRec) {
+// PruneDeliveries deletes up to limit of the deliveries that were
+// queued more than retention ago and have been delivered or abandoned,
+// returning the number deleted.
+func (r *repository) PruneDeliveries(retention time.Duration, limit int) (int64, error) {
+	res, err := r.pruneDeliveries.Exec(struct {
+		Retention float64
+		Limit     int
+	}{retention.Seconds(), limit})
+	if err != nil {
+		return 0, fmt.Errorf("pruning deliveries: %v", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// ListDeliveries lists the deliveries of a webhook, most recent first.
+// It returns errRecordNotFound if the webhook does not exist.
+func (r *repository) ListDeliveries(userID, webhookID string, args listArgs) ([]WebhookDelivery, bool, error) {
+	cursor := args.After
+	stmt := r.listDeliveriesAfter
+	if !sortAsc(args) {
+		cursor = args.Before
+		stmt = r.listDeliveriesBefore
+	}
+
+	queryArgs := struct {
+		UserID, WebhookID, CursorID string
+		Limit                       int
+	}{userID, webhookID, cursor, args.Limit + 1}
+
+	var hook Webhook
+	if err := r.findWebhook.Get(&hook, queryArgs); err == sql.ErrNoRows {
+		return nil, false, errRecordNotFound
+	} else if err != nil {
+		return nil, false, fmt.Errorf("finding webhook %q for user %q: %v", webhookID, userID, err)
+	}
+
+	if cursor != "" {
+		var cnt int
+		if err := r.countDeliveryCursor.Get(&cnt, queryArgs); err != nil {
+			return nil, false, fmt.Errorf("finding delivery cursor %q: %v", cursor, err)
+		}
+		if cnt == 0 {
+			return nil, false, errCursorNotFound
+		}
+	}
+
+	var recs []deliveryRec
+	if err := stmt.Select(&recs, queryArgs); err != nil {
+		return nil, false, fmt.Errorf("listing deliveries for webhook %q: %v", webhookID, err)
+	}
+
+	hasMore := len(recs) > args.Limit
+	if hasMore {
+		recs = recs[:args.Limit]
+	}
+
+	deliveries := make([]WebhookDelivery, len(recs))
+	for i, rec := range recs {
+		deliveries[i] = rec.WebhookDelivery
+		deliveries[i].Payload = json.RawMessage(rec.Body)
+	}
+
+	return deliveries, hasMore, nil
+}
+
+// setLineCharacter sets the character of a line from the columns
+// joined from its character, if any.
+func setLineCharacter(rec *lineRec) {
+	if !rec.CharacterID.Valid {
+		return
+	}
+
+	rec.character = &Character{
+		Name:     rec.Line.Character,
+		Animal:   rec.Animal,
+		MoodName: rec.CharacterMood.String,
+		Facing:   rec.Facing.String,
+		id:       int(rec.CharacterID.Int64),
+	}
+}
+
+func (r *repository) setLineMood(rec *lineRec) {
 	if rec.Eyes.Valid {
 		rec.mood = &Mood{
 			Name:        rec.MoodName,
 			Eyes:        rec.Eyes.String,
 			Tongue:      rec.Tongue.String,
 			UserDefined: true,
+			id:          int(rec.MoodID.Int64),
 		}
 		return
 	}
 
-	for _, mood := range builtinMoods {
+	for _, mood := range r.builtins {
 		if strings.EqualFold(mood.Name, rec.MoodName) {
 			m := *mood
 			rec.mood = &m
 			return
 		}
 	}
+
+	// The built-in mood was removed from the catalog since the line was
+	// created, so draw it with the default face under its own name.
+	m := *r.builtins[r.builtinIndex("default")]
+	m.Name = rec.MoodName
+	rec.mood = &m
 }
 
-func isBuiltin(name string) bool {
-	for _, builtin := range builtinMoods {
+func (r *repository) isBuiltin(name string) bool {
+	for _, builtin := range r.builtins {
 		if strings.EqualFold(builtin.Name, name) {
 			return true
 		}
@@ -657,6 +3915,306 @@ func isBuiltin(name string) bool {
 	return false
 }
 
+func (r *repository) builtinIndex(name string) int {
+	for i, builtin := range r.builtins {
+		if strings.EqualFold(builtin.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// moodLess reports whether a sorts before b in ascending order.
+func (r *repository) moodLess(a, b *Mood, sort string) bool {
+	if sort == moodSortName {
+		return a.Name < b.Name
+	}
+
+	if a.UserDefined != b.UserDefined {
+		return a.UserDefined
+	}
+	if a.UserDefined {
+		return a.id < b.id
+	}
+	return r.builtinIndex(a.Name) < r.builtinIndex(b.Name)
+}
+
+func (f moodFilter) matches(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, strings.ToLower(f.NamePrefix)) &&
+		strings.Contains(name, strings.ToLower(f.NameContains))
+}
+
+// escapeLike escapes LIKE wildcards so s only matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// InsertShare creates a share for the conversation with the random
+// part of its token. It returns errRecordNotFound if the conversation
+// does not exist.
+func (r *repository) InsertShare(userID, convoID, tokenID string, expiresIn sql.NullInt64) (*Share, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var share Share
+	share.ID, err = insertWithPublicID(tx, shareIDPrefix, func(publicID string) error {
+		return tx.NamedStmt(r.insertShare).Get(&share, struct {
+			PublicID, TokenID, UserID, ConvoID string
+			Roles                              pq.StringArray
+			ExpiresIn                          sql.NullInt64
+		}{publicID, tokenID, userID, convoID, ownerRoles, expiresIn})
+	})
+	if err == sql.ErrNoRows {
+		return nil, errRecordNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("inserting share for conversation %q: %v", convoID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing share: %v", err)
+	}
+
+	return &share, nil
+}
+
+// ListShares returns the shares of a conversation, including expired
+// ones, or nil if the conversation does not exist or the user is not
+// one of its owners.
+func (r *repository) ListShares(userID, convoID string) ([]shareRec, error) {
+	var convo convoRec
+	err := r.getConvo.Get(&convo, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, ownerRoles})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("finding conversation %q for user %q: %v", convoID, userID, err)
+	}
+
+	shares := make([]shareRec, 0)
+	err = r.listShares.Select(&shares, struct{ ConversationID int }{convo.IntID})
+	if err != nil {
+		return nil, fmt.Errorf("listing shares for conversation %q: %v", convoID, err)
+	}
+
+	return shares, nil
+}
+
+// FindShare returns the conversation shared by an unexpired share with
+// the token ID or nil if there is none.
+func (r *repository) FindShare(tokenID string) (*sharedConvoRec, error) {
+	var rec sharedConvoRec
+	err := r.findShare.Get(&rec, struct{ TokenID string }{tokenID})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("finding share: %v", err)
+	}
+
+	return &rec, nil
+}
+
+func (r *repository) DeleteShare(userID, convoID, shareID string) error {
+	return doDelete(r.deleteShare, struct {
+		UserID, ConvoID, ShareID string
+		Roles                    pq.StringArray
+	}{userID, convoID, shareID, ownerRoles})
+}
+
+// ForkConversation copies a conversation and its lines, up to and
+// including the line throughID if it is not empty, into a new
+// conversation that records the original as its parent. The copy keeps
+// the heading of the original if heading is nil. It returns
+// errRecordNotFound if the conversation does not exist and
+// errAnchorNotFound if the line does not exist.
+func (r *repository) ForkConversation(userID, convoID string, heading *string, throughID string, events ...*changeEvent) (string, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return "", fmt.Errorf("beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var parent convoRec
+	err = tx.NamedStmt(r.lockConvo).Get(&parent, struct {
+		UserID, PublicID string
+		Roles            pq.StringArray
+	}{userID, convoID, viewerRoles})
+	if err == sql.ErrNoRows {
+		return "", errRecordNotFound
+	} else if err != nil {
+		return "", fmt.Errorf("locking conversation %q: %v", convoID, err)
+	}
+
+	if heading == nil {
+		heading = &parent.Heading
+	}
+
+	through := -1
+	if throughID != "" {
+		var line linePositionRec
+		err := tx.NamedStmt(r.findLinePosition).Get(&line, struct {
+			ConversationID int
+			LineID         string
+		}{parent.IntID, throughID})
+		if err == sql.ErrNoRows {
+			return "", errAnchorNotFound
+		} else if err != nil {
+			return "", fmt.Errorf("finding line %q: %v", throughID, err)
+		}
+		through = line.Position
+	}
+
+	var id int
+	publicID, err := insertWithPublicID(tx, convoIDPrefix, func(publicID string) error {
+		return tx.NamedStmt(r.forkConvo).Get(&id, struct {
+			PublicID, UserID, Heading string
+			ParentID                  int
+		}{publicID, userID, *heading, parent.IntID})
+	})
+	if err != nil {
+		return "", fmt.Errorf("inserting fork of conversation %q: %v", convoID, err)
+	}
+
+	if err := r.insertMemberTx(tx, id, userID, RoleOwner); err != nil {
+		return "", err
+	}
+
+	var characters struct{ Total, Named int }
+	err = tx.NamedStmt(r.countCharacters).Get(&characters, struct {
+		ConversationID int
+		Name           string
+	}{parent.IntID, ""})
+	if err != nil {
+		return "", fmt.Errorf("counting characters of conversation %q: %v", convoID, err)
+	}
+
+	_, err = insertWithPublicIDs(tx, characterIDPrefix, characters.Total, func(characterIDs []string) error {
+		_, err := tx.NamedStmt(r.forkCharacters).Exec(struct {
+			ID, ParentID int
+			PublicIDs    interface{}
+		}{id, parent.IntID, pq.Array(characterIDs)})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("copying characters of conversation %q: %v", convoID, err)
+	}
+
+	var count int
+	err = tx.NamedStmt(r.countForkLines).Get(&count, struct{ ParentID, Through int }{parent.IntID, through})
+	if err != nil {
+		return "", fmt.Errorf("counting lines of conversation %q: %v", convoID, err)
+	}
+
+	// Lines can't keep using moods of other users, which would stop them
+	// deleting the moods and change the fork when they edit them.
+	res, err := tx.NamedStmt(r.forkMoods).Exec(struct {
+		UserID            string
+		ParentID, Through int
+	}{userID, parent.IntID, through})
+	if err != nil {
+		return "", fmt.Errorf("copying moods of conversation %q: %v", convoID, err)
+	}
+	moods, err := res.RowsAffected()
+	if err != nil {
+		return "", fmt.Errorf("copying moods of conversation %q: %v", convoID, err)
+	}
+
+	_, err = insertWithPublicIDs(tx, lineIDPrefix, count, func(lineIDs []string) error {
+		_, err := tx.NamedStmt(r.forkLines).Exec(struct {
+			UserID                string
+			ID, ParentID, Through int
+			PublicIDs             interface{}
+		}{userID, id, parent.IntID, through, pq.Array(lineIDs)})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("copying lines of conversation %q: %v", convoID, err)
+	}
+
+	var textBytes int64
+	if err := tx.NamedStmt(r.countTextBytes).Get(&textBytes, struct{ ID int }{id}); err != nil {
+		return "", fmt.Errorf("counting text of fork of conversation %q: %v", convoID, err)
+	}
+
+	usage := usageDelta{conversations: 1, lines: int64(count), moods: moods, textBytes: textBytes}
+	if err := r.enforceQuotasTx(tx, userID, userID, id, usage); err != nil {
+		return "", err
+	}
+
+	if len(events) > 0 {
+		fork, err := r.getConversation(tx.NamedStmt, userID, publicID, -1)
+		if err != nil {
+			return "", err
+		}
+		if err := r.queueEventsTx(tx, fork, events); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("committing fork of conversation %q: %v", convoID, err)
+	}
+
+	return publicID, nil
+}
+
+// insertWithPublicID calls insert with new public IDs starting with
+// prefix until it succeeds or fails for a reason other than the ID
+// already existing, returning the ID that was inserted.
+func insertWithPublicID(tx *sqlx.Tx, prefix string, insert func(publicID string) error) (string, error) {
+	publicIDs, err := insertWithPublicIDs(tx, prefix, 1, func(publicIDs []string) error {
+		return insert(publicIDs[0])
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return publicIDs[0], nil
+}
+
+// insertWithPublicIDs is like insertWithPublicID for inserting n
+// records at once. Every ID is replaced if any of them already exists.
+func insertWithPublicIDs(tx *sqlx.Tx, prefix string, n int, insert func(publicIDs []string) error) ([]string, error) {
+	publicIDs := make([]string, n)
+
+	for i := 0; i < maxInsertRetries; i++ {
+		for j := range publicIDs {
+			rv, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+			if err != nil {
+				return nil, fmt.Errorf("generating random ID: %v", err)
+			}
+			publicIDs[j] = prefix + strconv.FormatUint(rv.Uint64(), 36)
+		}
+
+		// A failed statement aborts the whole transaction unless we
+		// roll back to a savepoint before retrying.
+		if _, err := tx.Exec("SAVEPOINT insert_public_id"); err != nil {
+			return nil, fmt.Errorf("creating savepoint: %v", err)
+		}
+
+		err := insert(publicIDs)
+		if err == nil {
+			return publicIDs, nil
+		}
+
+		dbErr, ok := err.(*pq.Error)
+		if !ok || dbErr.Code != dbErrDupUnique {
+			return nil, err
+		}
+
+		if _, err := tx.Exec("ROLLBACK TO SAVEPOINT insert_public_id"); err != nil {
+			return nil, fmt.Errorf("rolling back to savepoint: %v", err)
+		}
+	}
+
+	return nil, fmt.Errorf("unable to insert new, unique %s IDs", prefix)
+}
+
 func sortAsc(args listArgs) bool {
 	return args.After != "" || args.Before == ""
 }
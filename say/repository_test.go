@@ -1,6 +1,8 @@
 package say
 
 import (
+	"database/sql"
+	"math/rand"
 	"reflect"
 	"testing"
 
@@ -17,7 +19,7 @@ func TestListMoods(t *testing.T) {
 	defer tdb.Close()
 	defer db.Close()
 
-	repo, err := newRepository(db)
+	repo, err := newRepository(db, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -85,7 +87,7 @@ func TestListMoods(t *testing.T) {
 	}
 
 	for i, testcase := range testcases {
-		actual, hasMore, err := repo.ListMoods(testUID, testcase.args)
+		actual, hasMore, err := repo.ListMoods(testUID, testcase.args, moodFilter{})
 		if err != nil {
 			t.Errorf("%d: %s", i, err)
 			continue
@@ -108,13 +110,170 @@ func TestListMoods(t *testing.T) {
 
 	// Check for the correct behavior with an invalid cursor
 	for i, args := range []listArgs{{After: "nope"}, {Before: "nope"}} {
-		_, _, err = repo.ListMoods(testUID, args)
+		_, _, err = repo.ListMoods(testUID, args, moodFilter{})
 		if err != errCursorNotFound {
 			t.Errorf("%d: err=%s, expected errCursorNotFound", i, err)
 		}
 	}
 }
 
+func TestListMoodsFilter(t *testing.T) {
+	tdb, db, err := dbutil.NewTestDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	defer db.Close()
+
+	repo, err := newRepository(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"snooze", "bored", "tipsy", "50%_off"} {
+		if err := repo.SetMood(testUID, &Mood{Name: name, Eyes: "oo", Tongue: "  "}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	userDefined, builtin := true, false
+
+	testcases := []struct {
+		args    listArgs
+		filter  moodFilter
+		hasMore bool
+		expect  []string
+	}{
+		// Sorting by name merges built-in and user moods
+		0: {listArgs{Limit: 4}, moodFilter{Sort: moodSortName}, true, []string{"50%_off", "bored", "borg", "dead"}},
+		1: {listArgs{After: "borg", Limit: 3}, moodFilter{Sort: moodSortName}, true, []string{"dead", "default", "greedy"}},
+		2: {listArgs{Before: "tipsy", Limit: 3}, moodFilter{Sort: moodSortName}, true, []string{"stoned", "snooze", "greedy"}},
+		3: {listArgs{After: "wired", Limit: 3}, moodFilter{Sort: moodSortName}, false, []string{"young"}},
+		// Filtering by source
+		4: {listArgs{Limit: 10}, moodFilter{UserDefined: &userDefined}, false, []string{"snooze", "bored", "tipsy", "50%_off"}},
+		5: {listArgs{Limit: 2}, moodFilter{UserDefined: &builtin}, true, []string{"default", "borg"}},
+		6: {listArgs{After: "snooze", Limit: 2}, moodFilter{UserDefined: &builtin}, true, []string{"default", "borg"}},
+		// Searching by name
+		7:  {listArgs{Limit: 10}, moodFilter{NamePrefix: "T"}, false, []string{"tipsy", "tired"}},
+		8:  {listArgs{Limit: 10}, moodFilter{NameContains: "re", Sort: moodSortName}, false, []string{"bored", "greedy", "tired", "wired"}},
+		9:  {listArgs{Limit: 10}, moodFilter{NameContains: "%_"}, false, []string{"50%_off"}},
+		10: {listArgs{Limit: 10}, moodFilter{NamePrefix: "t", NameContains: "s"}, false, []string{"tipsy"}},
+		// Created order places built-ins after user moods
+		11: {listArgs{After: "50%_off", Limit: 1}, moodFilter{}, true, []string{"default"}},
+		12: {listArgs{Before: "default", Limit: 1}, moodFilter{}, true, []string{"50%_off"}},
+	}
+
+	for i, testcase := range testcases {
+		if testcase.filter.Sort == "" {
+			testcase.filter.Sort = moodSortCreated
+		}
+
+		actual, hasMore, err := repo.ListMoods(testUID, testcase.args, testcase.filter)
+		if err != nil {
+			t.Errorf("%d: %s", i, err)
+			continue
+		}
+
+		if hasMore != testcase.hasMore {
+			t.Errorf("%d: hasMore=%t, expected %t", i, hasMore, testcase.hasMore)
+		}
+
+		var names []string
+		for _, mood := range actual {
+			names = append(names, mood.Name)
+		}
+		if !reflect.DeepEqual(names, testcase.expect) {
+			t.Errorf("%d: expected moods %s but got %s", i, testcase.expect, names)
+		}
+	}
+}
+
+func TestPickMood(t *testing.T) {
+	tdb, db, err := dbutil.NewTestDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	defer db.Close()
+
+	repo, err := newRepository(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"cross", "gone"} {
+		if err := repo.SetMood(testUID, &Mood{Name: name, Eyes: "><", Tongue: "  "}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set := MoodSet{Name: "grumpy", Moods: []MoodSetEntry{{"cross", 3}, {"dead", 1}, {"gone", 2}}}
+	if err := repo.SetMoodSet(testUID, &set); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := repo.GetMoodSet(testUID, "Grumpy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, &set) {
+		t.Errorf("expected mood set %#v but got %#v", set, got)
+	}
+
+	// The same seed always picks the same mood
+	for _, setName := range []string{"", "grumpy"} {
+		first, err := repo.PickMood(testUID, setName, rand.New(rand.NewSource(42)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			again, err := repo.PickMood(testUID, setName, rand.New(rand.NewSource(42)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.Name != first.Name {
+				t.Errorf("%q: seeded pick returned %q then %q", setName, first.Name, again.Name)
+			}
+		}
+	}
+
+	// Every mood is eventually chosen and deleted moods are skipped
+	if err := repo.DeleteMood(testUID, "gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	seen := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		mood, err := repo.PickMood(testUID, "grumpy", rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[mood.Name]++
+	}
+	if len(seen) != 2 || seen["cross"] == 0 || seen["dead"] == 0 {
+		t.Errorf("expected picks of only cross and dead but got %v", seen)
+	}
+	if seen["cross"] < seen["dead"] {
+		t.Errorf("expected cross to be weighted above dead but got %v", seen)
+	}
+
+	empty := MoodSet{Name: "empty", Moods: []MoodSetEntry{{"cross", 1}}}
+	if err := repo.SetMoodSet(testUID, &empty); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DeleteMood(testUID, "cross"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.PickMood(testUID, "empty", rng); err != errNoMoods {
+		t.Errorf("err=%v, expected errNoMoods", err)
+	}
+
+	if _, err := repo.PickMood(testUID, "nope", rng); err != errMoodSetNotFound {
+		t.Errorf("err=%v, expected errMoodSetNotFound", err)
+	}
+}
+
 func TestListConversations(t *testing.T) {
 	tdb, db, err := dbutil.NewTestDB()
 	if err != nil {
@@ -123,7 +282,7 @@ func TestListConversations(t *testing.T) {
 	defer tdb.Close()
 	defer db.Close()
 
-	repo, err := newRepository(db)
+	repo, err := newRepository(db, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -133,7 +292,7 @@ func TestListConversations(t *testing.T) {
 	convos := make([]Conversation, len(headings))
 	revConvos := make([]Conversation, len(headings))
 	for i, heading := range headings {
-		convo, err := repo.NewConversation(testUID, heading)
+		convo, err := repo.NewConversation(testUID, heading, sql.NullInt64{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -199,3 +358,209 @@ func TestListConversations(t *testing.T) {
 		}
 	}
 }
+
+func TestReapConversations(t *testing.T) {
+	tdb, db, err := dbutil.NewTestDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	defer db.Close()
+
+	repo, err := newRepository(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expired []string
+	for i := 0; i < 2; i++ {
+		convo, err := repo.NewConversation(testUID, "ephemeral", sql.NullInt64{Int64: 60, Valid: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if convo.Expires == nil {
+			t.Fatal("expected the conversation to expire")
+		}
+
+		// Expire the conversations in the order they were created
+		_, err = db.Exec("UPDATE conversations SET expires_at = NOW() - CAST($1 AS DOUBLE PRECISION) * interval '1 minute' WHERE public_id = $2", 2-i, convo.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired = append(expired, convo.ID)
+	}
+
+	kept, err := repo.NewConversation(testUID, "permanent", sql.NullInt64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", reaperLockKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.ReapConversations(10); err != errReaperLocked {
+		t.Errorf("err=%v, expected errReaperLocked", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expect := range [][]string{expired[:1], expired[1:], nil} {
+		ids, err := repo.ReapConversations(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, expect) {
+			t.Errorf("%d: reaped %v, expected %v", i, ids, expect)
+		}
+	}
+
+	convo, err := repo.GetConversation(testUID, kept.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if convo == nil {
+		t.Error("expected a conversation without an expiry to be kept")
+	}
+}
+
+func TestBuiltinCatalogChanges(t *testing.T) {
+	tdb, db, err := dbutil.NewTestDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	defer db.Close()
+
+	repo, err := newRepository(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	convo, err := repo.NewConversation(testUID, "", sql.NullInt64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	borg, err := repo.GetMood(testUID, "Borg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if borg == nil {
+		t.Fatal("expected to find a built-in mood regardless of case")
+	}
+
+	line := Line{Animal: "default", Text: "resistance is futile", MoodName: borg.Name, mood: borg}
+	if err := repo.InsertLine(testUID, convo.ID, &line, LinePosition{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.SetMood(testUID, &Mood{Name: "oncall", Eyes: "--", Tongue: "  "}); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog := []Mood{
+		{Name: "default", Eyes: "^^", Tongue: "  "},
+		{Name: "OnCall", Eyes: "@@", Tongue: "U "},
+	}
+	catRepo, err := newRepository(db, catalog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer catRepo.Close()
+
+	// The user's mood shadows the built-in mood added after it
+	oncall, err := catRepo.GetMood(testUID, "OnCall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oncall == nil || !oncall.UserDefined || oncall.Eyes != "--" {
+		t.Errorf("expected the user's mood to shadow the built-in but got %#v", oncall)
+	}
+	moods, _, err := catRepo.ListMoods(testUID, listArgs{Limit: 10}, moodFilter{Sort: moodSortName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, mood := range moods {
+		names = append(names, mood.Name)
+	}
+	if expect := []string{"default", "oncall"}; !reflect.DeepEqual(names, expect) {
+		t.Errorf("expected moods %s but got %s", expect, names)
+	}
+
+	if oncall, err := catRepo.GetMood("other", "oncall"); err != nil {
+		t.Fatal(err)
+	} else if oncall == nil || oncall.UserDefined || oncall.Eyes != "@@" {
+		t.Errorf("expected other users to get the built-in mood but got %#v", oncall)
+	}
+
+	if err := catRepo.DeleteMood(testUID, "oncall"); err != nil {
+		t.Fatal(err)
+	}
+	if err := catRepo.DeleteMood(testUID, "oncall"); err != errBuiltinMood {
+		t.Errorf("expected errBuiltinMood deleting a built-in mood but got %v", err)
+	}
+	if oncall, err := catRepo.GetMood(testUID, "oncall"); err != nil {
+		t.Fatal(err)
+	} else if oncall == nil || oncall.UserDefined {
+		t.Errorf("expected the built-in mood once the user's was deleted but got %#v", oncall)
+	}
+
+	got, err := catRepo.GetLine(testUID, convo.ID, line.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := Mood{Name: "borg", Eyes: "^^", Tongue: "  "}
+	if got == nil || !reflect.DeepEqual(*got.mood, expect) {
+		t.Errorf("expected a line with a removed built-in mood to use %#v but got %#v", expect, got)
+	}
+}
+
+func TestImportConversationMoodConflict(t *testing.T) {
+	tdb, db, err := dbutil.NewTestDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.Close()
+	defer db.Close()
+
+	repo, err := newRepository(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Created after the bundle's moods were mapped
+	existing := Mood{Name: "glum", Eyes: "__", Tongue: "  "}
+	if err := repo.SetMood(testUID, &existing); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := &Mood{Name: "glum", Eyes: "..", Tongue: "  ", UserDefined: true}
+	lines := []Line{{Animal: "default", Text: "meh", MoodName: imported.Name, mood: imported}}
+	convo, err := repo.ImportConversation(testUID, "imported", nil, lines, []*Mood{imported})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := repo.GetLine(testUID, convo.ID, convo.Lines[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing.UserDefined = true
+	if got == nil || !reflect.DeepEqual(*got.mood, existing) {
+		t.Errorf("expected the line to use the existing mood %#v but got %#v", existing, got)
+	}
+
+	mood, err := repo.GetMood(testUID, "glum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mood == nil || mood.Eyes != existing.Eyes {
+		t.Errorf("expected the existing mood to be kept but got %#v", mood)
+	}
+}
@@ -1,9 +1,10 @@
 package say
 
 import (
-	"database/sql"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -11,6 +12,8 @@ import (
 	"goji.io/pat"
 	"goji.io/pattern"
 
+	"gopkg.in/throttled/throttled.v2"
+
 	"github.com/gorilla/schema"
 	"github.com/jmoiron/sqlx"
 	"github.com/metcalf/saypi/auth"
@@ -25,11 +28,34 @@ const (
 	maxListLimit     = 100
 	maxHeadingLength = 60
 	maxTextLength    = 1024
+	maxLineWidth     = 200
 )
 
 type Controller struct {
 	repo *repository
 	cows map[string]*cow
+
+	shareSecret []byte
+	events      *eventBroker
+
+	sessions       *sessionHub
+	sessionLimiter throttled.RateLimiter
+
+	// Default sentiment moods available in the built-in catalog
+	sentimentMoods []SentimentMood
+
+	// Set while the trash purger is running
+	stopPurger, purgerDone chan struct{}
+
+	// Set while the reaper is running
+	stopReaper, reaperDone chan struct{}
+
+	webhookClient      *http.Client
+	webhookAllowedNets []*net.IPNet
+	wakeDeliveries     chan struct{}
+
+	// Set while webhook deliveries are being sent
+	stopDeliveries, deliveriesDone chan struct{}
 }
 
 type getAnimalsRes struct {
@@ -59,7 +85,58 @@ type Line struct {
 	Text     string `json:"text" url:"text"`
 	Output   string `json:"output" url:"-"`
 
-	mood *Mood
+	// Width is the column at which Text is wrapped, or zero for the
+	// default width.
+	Width int `json:"width,omitempty" url:"width,omitempty"`
+
+	// Sentiment is the score of Text for lines created with `mood=auto`.
+	Sentiment *float64 `json:"sentiment,omitempty" url:"-"`
+
+	// Character is the name of the character speaking the line, if
+	// any. The line takes its animal and default mood from the
+	// character.
+	Character string `json:"character,omitempty" url:"character,omitempty"`
+
+	mood      *Mood
+	character *Character
+}
+
+// LinePosition places a line immediately before or after another line
+// in the same conversation. At most one of Before and After is set.
+type LinePosition struct {
+	Before string `url:"before,omitempty"`
+	After  string `url:"after,omitempty"`
+}
+
+// LineRevision is a prior version of a Line that was replaced by an
+// edit.
+type LineRevision struct {
+	Revision  int      `json:"revision"`
+	Animal    string   `json:"animal"`
+	Think     bool     `json:"think"`
+	Width     int      `json:"width,omitempty"`
+	MoodName  string   `json:"mood"`
+	Text      string   `json:"text"`
+	Sentiment *float64 `json:"sentiment,omitempty"`
+	Edited    int64    `json:"edited"` // Unix time at which the revision was replaced
+
+	// EditedBy is the member ID of the user who replaced the revision,
+	// empty if they are no longer a member. Self is true if it was the
+	// requesting user.
+	EditedBy string `json:"edited_by,omitempty"`
+	Self     bool   `json:"self"`
+}
+
+// ConversationRevision is a prior heading of a Conversation that was
+// replaced by an edit.
+type ConversationRevision struct {
+	Revision int    `json:"revision"`
+	Heading  string `json:"heading"`
+	Edited   int64  `json:"edited"` // Unix time at which the revision was replaced
+
+	// EditedBy and Self identify the editor as for LineRevision
+	EditedBy string `json:"edited_by,omitempty"`
+	Self     bool   `json:"self"`
 }
 
 type Conversation struct {
@@ -67,6 +144,20 @@ type Conversation struct {
 	Heading string `json:"heading" url:"heading"`
 	Lines   []Line `json:"lines,omitempty"`
 
+	// ParentID is set for conversations forked from another
+	// conversation that still exists.
+	ParentID string `json:"parent_id,omitempty" url:"-"`
+
+	// HasMoreLines is set when Lines was limited by `line_limit`.
+	HasMoreLines bool `json:"has_more_lines,omitempty" url:"-"`
+
+	// Role is the user's role in the conversation.
+	Role string `json:"role,omitempty" url:"-"`
+
+	// Expires is the Unix time after which the conversation is
+	// deleted, or nil if it does not expire.
+	Expires *int64 `json:"expires,omitempty" url:"expires_at,omitempty"`
+
 	id int
 }
 
@@ -91,14 +182,25 @@ func init() {
 	decoder.SetAliasTag("url") // For compatibility with go-querystring
 }
 
-func New(db *sqlx.DB) (*Controller, error) {
-	var ctrl Controller
+// New creates a Controller backed by the given database. If builtins
+// is nil, the default catalog of built-in moods is used. Share tokens
+// are signed with shareSecret.
+func New(db *sqlx.DB, builtins []Mood, shareSecret []byte) (*Controller, error) {
+	ctrl := Controller{
+		shareSecret: shareSecret,
+		events:      newEventBroker(),
+		sessions:    newSessionHub(),
+
+		wakeDeliveries: make(chan struct{}, 1),
+	}
+	ctrl.webhookClient = ctrl.newWebhookClient()
 	var err error
 
-	ctrl.repo, err = newRepository(db)
+	ctrl.repo, err = newRepository(db, builtins)
 	if err != nil {
 		return nil, err
 	}
+	ctrl.sentimentMoods = catalogSentimentMoods(ctrl.repo)
 
 	animals := listAnimals()
 	ctrl.cows = make(map[string]*cow, len(animals))
@@ -113,6 +215,26 @@ func New(db *sqlx.DB) (*Controller, error) {
 }
 
 func (c *Controller) Close() error {
+	c.events.close()
+
+	if c.stopPurger != nil {
+		close(c.stopPurger)
+		<-c.purgerDone
+		c.stopPurger = nil
+	}
+
+	if c.stopReaper != nil {
+		close(c.stopReaper)
+		<-c.reaperDone
+		c.stopReaper = nil
+	}
+
+	if c.stopDeliveries != nil {
+		close(c.stopDeliveries)
+		<-c.deliveriesDone
+		c.stopDeliveries = nil
+	}
+
 	if err := c.repo.Close(); err != nil {
 		return err
 	}
@@ -139,7 +261,13 @@ func (c *Controller) ListMoods(ctx context.Context, w http.ResponseWriter, r *ht
 		return
 	}
 
-	moods, hasMore, err := c.repo.ListMoods(userID, lArgs)
+	filter, uerr := getMoodFilter(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	moods, hasMore, err := c.repo.ListMoods(userID, lArgs, filter)
 	if err == errCursorNotFound {
 		respondCursorNotFound(ctx, w, lArgs)
 		return
@@ -148,8 +276,13 @@ func (c *Controller) ListMoods(ctx context.Context, w http.ResponseWriter, r *ht
 		return
 	}
 
+	var cursor string
+	if len(moods) > 0 {
+		cursor = moods[len(moods)-1].Name
+	}
+
 	respond.Data(ctx, w, http.StatusOK, listRes{
-		Cursor:  moods[len(moods)-1].Name,
+		Cursor:  cursor,
 		Type:    "mood",
 		HasMore: hasMore,
 		Data:    moods,
@@ -185,26 +318,15 @@ func (c *Controller) SetMood(ctx context.Context, w http.ResponseWriter, r *http
 		return
 	}
 
-	mood.Eyes = strings.Replace(mood.Eyes, "\x00", "", -1)
-	mood.Tongue = strings.Replace(mood.Tongue, "\x00", "", -1)
-
-	var uerr usererrors.InvalidParams
-	if !(mood.Eyes == "" || utf8.RuneCountInString(mood.Eyes) == 2) {
-		uerr = append(uerr, usererrors.InvalidParamsEntry{
-			Params:  []string{"eyes"},
-			Message: "must be a string containing two characters",
-		})
+	if uerr := validateMood(&mood); uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
 	}
 
-	if !(mood.Tongue == "" || utf8.RuneCountInString(mood.Tongue) == 2) {
-		uerr = append(uerr, usererrors.InvalidParamsEntry{
-			Params:  []string{"tongue"},
-			Message: "must be a string containing two characters",
+	if isReservedMoodName(name) {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
+			Action: fmt.Sprintf("use reserved mood name %s", name),
 		})
-	}
-
-	if uerr != nil {
-		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
 		return
 	}
 
@@ -217,6 +339,9 @@ func (c *Controller) SetMood(ctx context.Context, w http.ResponseWriter, r *http
 			Action: fmt.Sprintf("update built-in mood %s", name),
 		})
 		return
+	} else if uerr, ok := err.(QuotaExceeded); ok {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
 	} else if err != nil {
 		respond.InternalError(ctx, w, err)
 		return
@@ -235,6 +360,10 @@ func (c *Controller) DeleteMood(ctx context.Context, w http.ResponseWriter, r *h
 		})
 	} else if err == errRecordNotFound {
 		respond.NotFound(ctx, w, r)
+	} else if err == errMoodInUse {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
+			Action: fmt.Sprintf("delete mood %s while other users' lines use it; unpublish it instead", name),
+		})
 	} else if conflict, ok := err.(conflictErr); ok {
 		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
 			Action: fmt.Sprintf("delete a mood associated with %d conversation lines", len(conflict.IDs)),
@@ -271,24 +400,36 @@ func (c *Controller) ListConversations(ctx context.Context, w http.ResponseWrite
 	})
 }
 
+// CreateConversation creates an empty conversation with the `heading`
+// parameter. Conversations created with either the `expires_at` or
+// `ttl` parameter are deleted once they expire.
 func (c *Controller) CreateConversation(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	userID := mustUserID(ctx)
 
-	heading := strings.Replace(r.PostFormValue("heading"), "\x00", "", -1)
-	if cnt := utf8.RuneCountInString(heading); cnt > maxHeadingLength {
-		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
-			Params:  []string{"heading"},
-			Message: fmt.Sprintf("must be a string of less than %d characters", maxHeadingLength),
-		}})
+	heading, uerr := parseHeading(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
 		return
 	}
 
-	convo, err := c.repo.NewConversation(userID, heading)
-	if err != nil {
+	expiresIn, uerr := parseExpiry(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	created := c.convoCreated()
+	convo, err := c.repo.NewConversation(userID, heading, expiresIn, created)
+	if uerr, ok := err.(QuotaExceeded); ok {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	} else if err != nil {
 		respond.InternalError(ctx, w, err)
 		return
 	}
 
+	c.publishEvent(ctx, convo.ID, created)
+
 	respond.Data(ctx, w, http.StatusOK, convo)
 }
 
@@ -296,7 +437,13 @@ func (c *Controller) GetConversation(ctx context.Context, w http.ResponseWriter,
 	userID := mustUserID(ctx)
 	convoID := pat.Param(ctx, "conversation")
 
-	convo, err := c.repo.GetConversation(userID, convoID)
+	lineLimit, uerr := getLineLimit(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	convo, err := c.repo.GetConversation(userID, convoID, lineLimit)
 	if err != nil {
 		respond.InternalError(ctx, w, err)
 		return
@@ -317,75 +464,239 @@ func (c *Controller) GetConversation(ctx context.Context, w http.ResponseWriter,
 	respond.Data(ctx, w, http.StatusOK, convo)
 }
 
-func (c *Controller) DeleteConversation(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+// UpdateConversation changes the heading of a conversation, keeping
+// the prior heading as a revision.
+func (c *Controller) UpdateConversation(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	userID := mustUserID(ctx)
 	convoID := pat.Param(ctx, "conversation")
 
-	if err := c.repo.DeleteConversation(userID, convoID); err == errRecordNotFound {
+	lineLimit, uerr := getLineLimit(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	convo, err := c.repo.GetConversation(userID, convoID, lineLimit)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if convo == nil {
 		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	r.ParseForm()
+	if _, ok := r.PostForm["heading"]; ok {
+		heading, uerr := parseHeading(r)
+		if uerr != nil {
+			respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+			return
+		}
+		convo.Heading = heading
+	}
+
+	updated := &changeEvent{Type: EventConvoUpdated, Data: Conversation{
+		ID:       convo.ID,
+		Heading:  convo.Heading,
+		ParentID: convo.ParentID,
+	}}
+	if err := c.repo.UpdateConversation(userID, convo, updated); err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleOwner)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	for i, line := range convo.Lines {
+		convo.Lines[i].Output, err = c.renderLine(&line)
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+	}
+
+	c.publishEvent(ctx, convoID, updated)
+
+	respond.Data(ctx, w, http.StatusOK, convo)
+}
+
+func (c *Controller) DeleteConversation(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	deleted := &changeEvent{Type: EventConvoDeleted, Data: struct {
+		ID string `json:"id"`
+	}{convoID}}
+	if err := c.repo.DeleteConversation(userID, convoID, deleted); err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleOwner)
+		return
 	} else if err != nil {
 		respond.InternalError(ctx, w, err)
 		return
 	}
 
+	c.publishEvent(ctx, convoID, deleted)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// ForkConversation copies a conversation into a new conversation,
+// including only the lines up to and including the line in the
+// `through` parameter if it is provided.
+func (c *Controller) ForkConversation(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	lineLimit, uerr := getLineLimit(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	var heading *string
+	r.ParseForm()
+	if _, ok := r.PostForm["heading"]; ok {
+		value, uerr := parseHeading(r)
+		if uerr != nil {
+			respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+			return
+		}
+		heading = &value
+	}
+
+	through := r.PostFormValue("through")
+
+	// Every line is published even if the response is limited
+	created := c.convoCreated()
+	forkID, err := c.repo.ForkConversation(userID, convoID, heading, through, created)
+	if err == errRecordNotFound {
+		respond.NotFound(ctx, w, r)
+		return
+	} else if err == errAnchorNotFound {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+			Params:  []string{"through"},
+			Message: fmt.Sprintf("line %q does not exist in the conversation", through),
+		}})
+		return
+	} else if uerr, ok := err.(QuotaExceeded); ok {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	c.publishEvent(ctx, forkID, created)
+
+	convo := *created.Data.(*Conversation)
+	if lineLimit >= 0 && len(convo.Lines) > lineLimit {
+		convo.Lines = convo.Lines[:lineLimit]
+		convo.HasMoreLines = true
+	}
+
+	respond.Data(ctx, w, http.StatusOK, convo)
+}
+
 // TODO: use gorilla schema here
 func (c *Controller) CreateLine(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	userID := mustUserID(ctx)
 	convoID := pat.Param(ctx, "conversation")
 
-	var uerr usererrors.InvalidParams
+	line := Line{
+		Animal:   "default",
+		MoodName: "default",
+	}
 
-	var think bool
-	switch r.PostFormValue("think") {
-	case "", "false":
-		think = false
-	case "true":
-		think = true
-	default:
-		uerr = append(uerr, usererrors.InvalidParamsEntry{
-			Params:  []string{"think"},
-			Message: "must be either 'true' or 'false'",
-		})
+	r.ParseForm()
+	uerr, err := c.setCharacter(userID, convoID, r.PostForm, &line)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
 	}
+	uerr = append(uerr, c.parseLine(r.PostForm, &line)...)
+
+	pos, posErr := parseLinePosition(r, false)
+	uerr = append(uerr, posErr...)
 
-	animal := r.PostFormValue("animal")
-	if animal == "" {
-		animal = "default"
+	moodErr, err := c.resolveMood(userID, &line, r.PostFormValue("seed"))
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
 	}
-	if _, ok := c.cows[animal]; !ok {
-		uerr = append(uerr, usererrors.InvalidParamsEntry{
-			Params:  []string{"animal"},
-			Message: fmt.Sprintf("%q does not exist", animal),
-		})
+	uerr = append(uerr, moodErr...)
+
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
 	}
 
-	text := strings.Replace(r.PostFormValue("text"), "\x00", "", -1)
-	if cnt := utf8.RuneCountInString(text); cnt > maxTextLength {
-		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
-			Params:  []string{"text"},
-			Message: fmt.Sprintf("must be a string of less than %d characters", maxTextLength),
-		}})
+	line.Output, err = c.renderLine(&line)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
 		return
 	}
 
-	moodName := strings.Replace(r.PostFormValue("mood"), "\x00", "", -1)
-	if moodName == "" {
-		moodName = "default"
+	created := &changeEvent{Type: EventLineCreated, Data: &line}
+	if err := c.repo.InsertLine(userID, convoID, &line, pos, created); err == errRecordNotFound {
+		// The underlying conversation does not exist
+		c.respondMissingRole(ctx, w, r, convoID, RoleEditor)
+		return
+	} else if err == errAnchorNotFound {
+		respondAnchorNotFound(ctx, w, pos)
+		return
+	} else if uerr, ok := err.(QuotaExceeded); ok {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
 	}
 
-	mood, err := c.repo.GetMood(userID, moodName)
+	c.publishEvent(ctx, convoID, created)
+
+	respond.Data(ctx, w, http.StatusOK, line)
+}
+
+// UpdateLine changes the parameters of a line that are present in the
+// request, keeping the prior version as a revision.
+func (c *Controller) UpdateLine(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+	lineID := pat.Param(ctx, "line")
+
+	line, err := c.repo.GetLine(userID, convoID, lineID)
 	if err != nil {
 		respond.InternalError(ctx, w, err)
 		return
 	}
-	if mood == nil {
-		uerr = append(uerr, usererrors.InvalidParamsEntry{
-			Params:  []string{"mood"},
-			Message: fmt.Sprintf("%q does not exist", moodName),
-		})
+	if line == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	text := line.Text
+
+	r.ParseForm()
+	uerr := c.parseLine(r.PostForm, line)
+
+	_, setMood := r.PostForm["mood"]
+	if !setMood && line.Sentiment != nil && line.Text != text {
+		// The mood was chosen from the sentiment of the prior text
+		line.MoodName = autoMoodName
+		setMood = true
+	}
+
+	if setMood {
+		line.Sentiment = nil
+
+		moodErr, err := c.resolveMood(userID, line, r.PostFormValue("seed"))
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+		uerr = append(uerr, moodErr...)
 	}
 
 	if uerr != nil {
@@ -393,23 +704,104 @@ func (c *Controller) CreateLine(ctx context.Context, w http.ResponseWriter, r *h
 		return
 	}
 
-	line := Line{
-		Animal:   animal,
-		Think:    think,
-		MoodName: moodName,
-		Text:     text,
-		mood:     mood,
+	if err := c.repo.UpdateLine(userID, convoID, line); err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleEditor)
+		return
+	} else if uerr, ok := err.(QuotaExceeded); ok {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
 	}
 
-	if err := c.repo.InsertLine(userID, convoID, &line); err == sql.ErrNoRows {
-		// The underlying conversation does not exist
+	line.Output, err = c.renderLine(line)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, line)
+}
+
+func (c *Controller) ListLines(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	lArgs, uerr := getListArgs(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	lines, hasMore, err := c.repo.ListLines(userID, convoID, lArgs)
+	if err == errRecordNotFound {
 		respond.NotFound(ctx, w, r)
+		return
+	} else if err == errCursorNotFound {
+		respondCursorNotFound(ctx, w, lArgs)
+		return
 	} else if err != nil {
 		respond.InternalError(ctx, w, err)
 		return
 	}
 
-	line.Output, err = c.renderLine(&line)
+	for i, line := range lines {
+		lines[i].Output, err = c.renderLine(&line)
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+	}
+
+	var cursor string
+	if len(lines) > 0 {
+		cursor = lines[len(lines)-1].ID
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Cursor:  cursor,
+		Type:    "line",
+		HasMore: hasMore,
+		Data:    lines,
+	})
+}
+
+// MoveLine places a line immediately before or after another line in
+// the same conversation.
+func (c *Controller) MoveLine(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+	lineID := pat.Param(ctx, "line")
+
+	pos, uerr := parseLinePosition(r, true)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	if err := c.repo.MoveLine(userID, convoID, lineID, pos); err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleEditor)
+		return
+	} else if err == errAnchorNotFound {
+		respondAnchorNotFound(ctx, w, pos)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	line, err := c.repo.GetLine(userID, convoID, lineID)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if line == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	line.Output, err = c.renderLine(line)
 	if err != nil {
 		respond.InternalError(ctx, w, err)
 		return
@@ -418,6 +810,47 @@ func (c *Controller) CreateLine(ctx context.Context, w http.ResponseWriter, r *h
 	respond.Data(ctx, w, http.StatusOK, line)
 }
 
+func (c *Controller) ListConversationRevisions(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	revisions, err := c.repo.ListConversationRevisions(userID, convoID)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if revisions == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Type: "conversation_revision",
+		Data: revisions,
+	})
+}
+
+func (c *Controller) ListLineRevisions(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+	lineID := pat.Param(ctx, "line")
+
+	revisions, err := c.repo.ListLineRevisions(userID, convoID, lineID)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if revisions == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Type: "line_revision",
+		Data: revisions,
+	})
+}
+
 func (c *Controller) GetLine(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	userID := mustUserID(ctx)
 	convoID := pat.Param(ctx, "conversation")
@@ -447,23 +880,237 @@ func (c *Controller) DeleteLine(ctx context.Context, w http.ResponseWriter, r *h
 	convoID := pat.Param(ctx, "conversation")
 	lineID := pat.Param(ctx, "line")
 
-	if err := c.repo.DeleteLine(userID, convoID, lineID); err == errRecordNotFound {
-		respond.NotFound(ctx, w, r)
+	deleted := &changeEvent{Type: EventLineDeleted, Data: struct {
+		ID string `json:"id"`
+	}{lineID}}
+	if err := c.repo.DeleteLine(userID, convoID, lineID, deleted); err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleEditor)
+		return
 	} else if err != nil {
 		respond.InternalError(ctx, w, err)
 		return
 	}
 
+	c.publishEvent(ctx, convoID, deleted)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// resolveMood sets the mood of a new line from the name in its
+// MoodName. Random moods are chosen using seed, if not empty, and
+// automatic moods from the sentiment of the line's text.
+func (c *Controller) resolveMood(userID string, line *Line, seed string) (usererrors.InvalidParams, error) {
+	var mood *Mood
+	var uerr usererrors.InvalidParams
+	var err error
+
+	if strings.EqualFold(line.MoodName, autoMoodName) {
+		var score float64
+		mood, score, uerr, err = c.autoMood(userID, line.Text)
+		line.Sentiment = &score
+	} else if setName, ok := parseRandomMood(line.MoodName); ok {
+		mood, uerr, err = c.randomMood(userID, setName, seed)
+	} else {
+		mood, err = c.repo.GetMood(userID, line.MoodName)
+		if err == nil && mood == nil {
+			uerr = usererrors.InvalidParams{{
+				Params:  []string{"mood"},
+				Message: fmt.Sprintf("%q does not exist", line.MoodName),
+			}}
+		}
+	}
+
+	if mood != nil {
+		line.MoodName = mood.Name
+		line.mood = mood
+	}
+
+	return uerr, err
+}
+
+func (c *Controller) randomMood(userID, setName, seed string) (*Mood, usererrors.InvalidParams, error) {
+	rng, err := newRand(seed)
+	if err != nil {
+		return nil, usererrors.InvalidParams{{
+			Params:  []string{"seed"},
+			Message: "must be an integer",
+		}}, nil
+	}
+
+	mood, err := c.repo.PickMood(userID, setName, rng)
+	if err == errMoodSetNotFound {
+		return nil, usererrors.InvalidParams{{
+			Params:  []string{"mood"},
+			Message: fmt.Sprintf("mood set %q does not exist", setName),
+		}}, nil
+	} else if err == errNoMoods {
+		return nil, usererrors.InvalidParams{{
+			Params:  []string{"mood"},
+			Message: fmt.Sprintf("mood set %q does not contain any existing moods", setName),
+		}}, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return mood, nil, nil
+}
+
+// parseLine validates the line parameters present in form and sets
+// them on line. Empty values select the same defaults as creating a
+// line, or those of the line's character if it has one. The mood name
+// is set but not resolved.
+func (c *Controller) parseLine(form url.Values, line *Line) usererrors.InvalidParams {
+	var uerr usererrors.InvalidParams
+
+	if _, ok := form["think"]; ok {
+		switch form.Get("think") {
+		case "", "false":
+			line.Think = false
+		case "true":
+			line.Think = true
+		default:
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"think"},
+				Message: "must be either 'true' or 'false'",
+			})
+		}
+	}
+
+	if _, ok := form["width"]; ok {
+		var width int
+		var err error
+		if s := form.Get("width"); s != "" {
+			width, err = strconv.Atoi(s)
+		}
+		if err != nil || width < 0 || width > maxLineWidth {
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"width"},
+				Message: fmt.Sprintf("must be an integer between 0 and %d", maxLineWidth),
+			})
+		}
+		line.Width = width
+	}
+
+	if _, ok := form["animal"]; ok {
+		animal := form.Get("animal")
+		if line.character != nil {
+			// The animal of a character's lines is fixed
+			if animal != "" && animal != line.character.Animal {
+				uerr = append(uerr, usererrors.InvalidParamsEntry{
+					Params:  []string{"animal"},
+					Message: fmt.Sprintf("must be %q, the animal of character %q", line.character.Animal, line.character.Name),
+				})
+			}
+			animal = line.character.Animal
+		} else if animal == "" {
+			animal = "default"
+		}
+		if _, ok := c.cows[animal]; !ok {
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"animal"},
+				Message: fmt.Sprintf("%q does not exist", animal),
+			})
+		}
+		line.Animal = animal
+	}
+
+	if _, ok := form["text"]; ok {
+		text := strings.Replace(form.Get("text"), "\x00", "", -1)
+		if cnt := utf8.RuneCountInString(text); cnt > maxTextLength {
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"text"},
+				Message: fmt.Sprintf("must be a string of less than %d characters", maxTextLength),
+			})
+		}
+		line.Text = text
+	}
+
+	if _, ok := form["mood"]; ok {
+		moodName := strings.Replace(form.Get("mood"), "\x00", "", -1)
+		if moodName == "" && line.character != nil {
+			moodName = line.character.MoodName
+		} else if moodName == "" {
+			moodName = "default"
+		}
+		line.MoodName = moodName
+	}
+
+	return uerr
+}
+
+// parseLinePosition reads the `before` and `after` parameters of the
+// request. If required is false, neither may be provided to append a
+// line to its conversation.
+func parseLinePosition(r *http.Request, required bool) (LinePosition, usererrors.InvalidParams) {
+	r.ParseForm()
+
+	pos := LinePosition{
+		Before: r.PostFormValue("before"),
+		After:  r.PostFormValue("after"),
+	}
+
+	if pos.Before != "" && pos.After != "" {
+		return LinePosition{}, usererrors.InvalidParams{{
+			Params:  []string{"before", "after"},
+			Message: "only one of before or after may be provided",
+		}}
+	}
+	if required && pos.Before == "" && pos.After == "" {
+		return LinePosition{}, usererrors.InvalidParams{{
+			Params:  []string{"before", "after"},
+			Message: "one of before or after must be provided",
+		}}
+	}
+
+	return pos, nil
+}
+
 func (c *Controller) renderLine(line *Line) (string, error) {
 	cow, ok := c.cows[line.Animal]
 	if !ok {
 		return "", fmt.Errorf("Unknown animal %q", line.Animal)
 	}
 
-	return cow.Say(line.Text, line.mood.Eyes, line.mood.Tongue, line.Think)
+	if line.character != nil && line.character.Facing == FacingRight {
+		return cow.SayMirrored(line.Text, line.mood.Eyes, line.mood.Tongue, line.Think, line.Width)
+	}
+	return cow.Say(line.Text, line.mood.Eyes, line.mood.Tongue, line.Think, line.Width)
+}
+
+// validateMood strips null bytes from the eyes and tongue of the mood
+// and checks that each is either empty or exactly two characters.
+func validateMood(mood *Mood) usererrors.InvalidParams {
+	mood.Eyes = strings.Replace(mood.Eyes, "\x00", "", -1)
+	mood.Tongue = strings.Replace(mood.Tongue, "\x00", "", -1)
+
+	var uerr usererrors.InvalidParams
+	if !(mood.Eyes == "" || utf8.RuneCountInString(mood.Eyes) == 2) {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"eyes"},
+			Message: "must be a string containing two characters",
+		})
+	}
+
+	if !(mood.Tongue == "" || utf8.RuneCountInString(mood.Tongue) == 2) {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"tongue"},
+			Message: "must be a string containing two characters",
+		})
+	}
+
+	return uerr
+}
+
+func parseHeading(r *http.Request) (string, usererrors.UserError) {
+	heading := strings.Replace(r.PostFormValue("heading"), "\x00", "", -1)
+	if cnt := utf8.RuneCountInString(heading); cnt > maxHeadingLength {
+		return "", usererrors.InvalidParams{{
+			Params:  []string{"heading"},
+			Message: fmt.Sprintf("must be a string of less than %d characters", maxHeadingLength),
+		}}
+	}
+
+	return heading, nil
 }
 
 func mustUserID(ctx context.Context) string {
@@ -506,6 +1153,78 @@ func getListArgs(r *http.Request) (listArgs, usererrors.UserError) {
 	return res, nil
 }
 
+// getLineLimit reads the `line_limit` parameter that caps the number of
+// lines embedded in a conversation. It returns -1 if the parameter is
+// not provided.
+func getLineLimit(r *http.Request) (int, usererrors.UserError) {
+	limitStr := r.FormValue("line_limit")
+	if limitStr == "" {
+		return -1, nil
+	}
+
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit < 0 {
+		return 0, usererrors.InvalidParams{{
+			Params:  []string{"line_limit"},
+			Message: "must be a non-negative integer",
+		}}
+	}
+
+	return limit, nil
+}
+
+func getMoodFilter(r *http.Request) (moodFilter, usererrors.UserError) {
+	var uerr usererrors.InvalidParams
+
+	res := moodFilter{
+		NamePrefix:   r.FormValue("name_prefix"),
+		NameContains: r.FormValue("name_contains"),
+		Sort:         r.FormValue("sort"),
+	}
+
+	switch r.FormValue("user_defined") {
+	case "":
+	case "true":
+		res.UserDefined = new(bool)
+		*res.UserDefined = true
+	case "false":
+		res.UserDefined = new(bool)
+	default:
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"user_defined"},
+			Message: "must be either 'true' or 'false'",
+		})
+	}
+
+	switch res.Sort {
+	case "":
+		res.Sort = moodSortCreated
+	case moodSortCreated, moodSortName:
+	default:
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"sort"},
+			Message: fmt.Sprintf("must be either '%s' or '%s'", moodSortCreated, moodSortName),
+		})
+	}
+
+	if uerr != nil {
+		return moodFilter{}, uerr
+	}
+	return res, nil
+}
+
+func respondAnchorNotFound(ctx context.Context, w http.ResponseWriter, pos LinePosition) {
+	param, lineID := "before", pos.Before
+	if pos.After != "" {
+		param, lineID = "after", pos.After
+	}
+
+	respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+		Params:  []string{param},
+		Message: fmt.Sprintf("line %q does not exist in this conversation", lineID),
+	}})
+}
+
 func respondCursorNotFound(ctx context.Context, w http.ResponseWriter, args listArgs) {
 	var cursorParam string
 	if args.After == "" {
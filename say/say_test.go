@@ -1,13 +1,24 @@
 package say_test
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/metcalf/saypi/app"
 	"github.com/metcalf/saypi/apptest"
@@ -102,7 +113,7 @@ func TestAppBuiltinMoods(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	iter := cli.ListMoods(client.ListParams{})
+	iter := cli.ListMoods(client.MoodListParams{})
 
 	var names []string
 	for iter.Next() {
@@ -142,6 +153,57 @@ func TestAppBuiltinMoods(t *testing.T) {
 	}
 }
 
+func TestAppMoodCatalog(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "saypi-catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "catalog.json")
+
+	catalog := `[{"name": "default", "eyes": "oo"}, {"name": "oncall", "eyes": "@@", "tongue": "U "}]`
+	if err := ioutil.WriteFile(path, []byte(catalog), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	catCfg := cfg
+	catCfg.MoodCatalog = path
+
+	cli, err := client.NewTestClient(&catCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	builtin := false
+	iter := cli.ListMoods(client.MoodListParams{UserDefined: &builtin})
+
+	var names []string
+	for iter.Next() {
+		names = append(names, iter.Mood().Name)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"default", "oncall"}) {
+		t.Errorf("Expected the configured built-in moods but got %s", names)
+	}
+
+	err = cli.SetMood(&say.Mood{Name: "oncall", Eyes: "--"})
+	if _, ok := client.UserError(err).(usererrors.ActionNotAllowed); !ok {
+		t.Errorf("expected an ActionNotAllowed but got %s", err)
+	}
+
+	if _, err := cli.GetMood("borg"); err == nil {
+		t.Error("expected default built-in moods to be replaced by the catalog")
+	}
+}
+
 func TestAppMoods(t *testing.T) {
 	t.Parallel()
 
@@ -181,7 +243,7 @@ func TestAppMoods(t *testing.T) {
 	}
 
 	// List including created mood
-	iter := cli.ListMoods(client.ListParams{})
+	iter := cli.ListMoods(client.MoodListParams{})
 
 	var names []string
 	for iter.Next() {
@@ -194,6 +256,26 @@ func TestAppMoods(t *testing.T) {
 		t.Errorf("Expected %d moods but got %d", want, have)
 	}
 
+	// List only user-defined moods matching a search
+	userDefined := true
+	iter = cli.ListMoods(client.MoodListParams{
+		ListParams:   client.ListParams{Limit: 1},
+		UserDefined:  &userDefined,
+		NameContains: "ros",
+		Sort:         "name",
+	})
+
+	names = nil
+	for iter.Next() {
+		names = append(names, iter.Mood().Name)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"cross"}) {
+		t.Errorf("Expected only the created mood but got %s", names)
+	}
+
 	// Update
 	got.Eyes = "<>"
 	if err := cli.SetMood(got); err != nil {
@@ -225,7 +307,7 @@ func TestAppMoods(t *testing.T) {
 
 }
 
-func TestConversation(t *testing.T) {
+func TestAppMoodSets(t *testing.T) {
 	t.Parallel()
 
 	cli, err := client.NewTestClient(&cfg)
@@ -237,148 +319,376 @@ func TestConversation(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// CREATE
-	heading := "top of the world"
-	convo := say.Conversation{Heading: heading}
+	if err := cli.SetMood(&say.Mood{Name: "cross", Eyes: "><"}); err != nil {
+		t.Fatal(err)
+	}
 
-	if err := cli.CreateConversation(&convo); err != nil {
+	// Create a set and read it back
+	set := say.MoodSet{
+		Name:  "grumpy",
+		Moods: []say.MoodSetEntry{{Mood: "cross", Weight: 5}, {Mood: "dead", Weight: 1}},
+	}
+	if err := cli.SetMoodSet(&set); err != nil {
 		t.Fatal(err)
 	}
-	if convo.ID == "" {
-		t.Errorf("conversation ID was not set")
+
+	got, err := cli.GetMoodSet("grumpy")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if convo.Heading != heading {
-		t.Errorf("heading=%q, expected %q", convo.Heading, heading)
+	if !reflect.DeepEqual(got, &set) {
+		t.Errorf("got mood set %#v but expected %#v", got, set)
 	}
-	if len(convo.Lines) != 0 {
-		t.Errorf("unexpected lines in new conversation: %s", convo.Lines)
+
+	iter := cli.ListMoodSets(client.ListParams{})
+	var names []string
+	for iter.Next() {
+		names = append(names, iter.MoodSet().Name)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"grumpy"}) {
+		t.Errorf("expected to list the grumpy mood set but got %s", names)
 	}
 
-	// GET with no lines
-	got, err := cli.GetConversation(convo.ID)
-	if err != nil {
+	// Random lines record the mood that was chosen
+	convo := say.Conversation{Heading: "random"}
+	if err := cli.CreateConversation(&convo); err != nil {
 		t.Fatal(err)
 	}
-	if !reflect.DeepEqual(&convo, got) {
-		t.Errorf("got %#v != created %#v", got, convo)
+
+	for _, moodName := range []string{"random", "random:grumpy"} {
+		line1 := say.Line{MoodName: moodName, Text: "hmph"}
+		if err := cli.CreateRandomLine(convo.ID, &line1, 7); err != nil {
+			t.Fatal(err)
+		}
+		line2 := say.Line{MoodName: moodName, Text: "hmph"}
+		if err := cli.CreateRandomLine(convo.ID, &line2, 7); err != nil {
+			t.Fatal(err)
+		}
+
+		if line1.MoodName == moodName {
+			t.Errorf("%s: line did not record the chosen mood", moodName)
+		}
+		if line1.MoodName != line2.MoodName {
+			t.Errorf("%s: the same seed chose %q and %q", moodName, line1.MoodName, line2.MoodName)
+		}
+		if moodName == "random:grumpy" && line1.MoodName != "cross" && line1.MoodName != "dead" {
+			t.Errorf("%s: chose %q from outside the set", moodName, line1.MoodName)
+		}
 	}
 
-	// Add line with builtin and created mood
-	line1 := say.Line{
-		Animal: "bunny",
-		Text:   "hi there",
+	// Invalid sets and random moods
+	err = cli.SetMoodSet(&say.MoodSet{
+		Name:  "bad",
+		Moods: []say.MoodSetEntry{{Mood: "nope", Weight: 1}, {Mood: "dead", Weight: 0}},
+	})
+	if ip, ok := client.UserError(err).(usererrors.InvalidParams); !ok || len(ip) != 2 {
+		t.Errorf("expected two InvalidParams entries but got %s", err)
 	}
-	if err := cli.CreateLine(convo.ID, &line1); err != nil {
+
+	err = cli.CreateLine(convo.ID, &say.Line{MoodName: "random:nope"})
+	if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+		t.Errorf("expected InvalidParams for a missing set but got %s", err)
+	}
+
+	err = cli.SetMood(&say.Mood{Name: "random", Eyes: "??"})
+	if _, ok := client.UserError(err).(usererrors.ActionNotAllowed); !ok {
+		t.Errorf("expected ActionNotAllowed for a reserved mood name but got %s", err)
+	}
+
+	// Delete
+	if err := cli.DeleteMoodSet("grumpy"); err != nil {
 		t.Fatal(err)
 	}
-	t.Log(line1.Output)
+	_, err = cli.GetMoodSet("grumpy")
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound after deleting mood set but got %s", err)
+	}
+}
 
-	mood := say.Mood{
-		Name:   "cross",
-		Eyes:   "><",
-		Tongue: "<>",
+func TestAppAutoMood(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if err := cli.SetMood(&mood); err != nil {
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
 		t.Fatal(err)
 	}
 
-	line2 := say.Line{
-		Think:    true,
-		MoodName: "cross",
-		Text:     "simmer down now",
+	convo := say.Conversation{Heading: "feelings"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
 	}
-	if err := cli.CreateLine(convo.ID, &line2); err != nil {
+
+	// Default mapping
+	moods, err := cli.GetSentimentMoods()
+	if err != nil {
 		t.Fatal(err)
 	}
-	t.Log(line2.Output)
+	if moods.UserDefined || len(moods.Ranges) == 0 {
+		t.Errorf("expected default sentiment moods but got %#v", moods)
+	}
+
+	cases := []struct{ text, mood string }{
+		{"We shipped it! Amazing work, everyone is thrilled!!", "wired"},
+		{"Major outage: the database crashed and we lost data", "dead"},
+		{"The cow jumped over the moon", "default"},
+	}
+	for i, testcase := range cases {
+		line := say.Line{MoodName: "auto", Text: testcase.text}
+		if err := cli.CreateLine(convo.ID, &line); err != nil {
+			t.Fatal(err)
+		}
+		if line.MoodName != testcase.mood {
+			t.Errorf("%d: expected mood %q but got %q", i, testcase.mood, line.MoodName)
+		}
+		if line.Sentiment == nil {
+			t.Errorf("%d: expected a sentiment score", i)
+		}
 
-	// Get lines
-	for i, line := range []say.Line{line1, line2} {
 		got, err := cli.GetLine(convo.ID, line.ID)
 		if err != nil {
-			t.Fatalf("%d: %s", i, err)
+			t.Fatal(err)
 		}
 		if !reflect.DeepEqual(got, &line) {
-			t.Errorf("%d: expected to get line %#v but got %#v", i, line, got)
+			t.Errorf("%d: got line %#v but expected %#v", i, got, line)
 		}
 	}
 
-	// Get with lines
-	got, err = cli.GetConversation(convo.ID)
+	// Editing the text chooses the mood again
+	line := say.Line{MoodName: "auto", Text: cases[0].text}
+	if err := cli.CreateLine(convo.ID, &line); err != nil {
+		t.Fatal(err)
+	}
+	text := cases[1].text
+	updated, err := cli.UpdateLine(convo.ID, line.ID, client.LineUpdateParams{Text: &text})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(got.Lines) != 2 {
-		t.Errorf("Expected 2 lines but got %d", len(got.Lines))
-	} else {
-		for i, line := range []say.Line{line1, line2} {
-			if !reflect.DeepEqual(got.Lines[i], line) {
-				t.Errorf("%d: expected line %#v but got %#v", i, line, got.Lines[i])
-			}
+	if updated.MoodName != cases[1].mood {
+		t.Errorf("expected mood %q after editing the text but got %q", cases[1].mood, updated.MoodName)
+	}
+	if updated.Sentiment == nil || *updated.Sentiment >= 0 {
+		t.Errorf("expected a negative sentiment score after editing the text but got %v", updated.Sentiment)
+	}
+
+	// Custom mapping
+	if err := cli.SetMood(&say.Mood{Name: "glum", Eyes: "__"}); err != nil {
+		t.Fatal(err)
+	}
+	ranges := []say.SentimentMood{
+		{MinScore: 0, Mood: "greedy"},
+		{MinScore: -0.2, Mood: "glum"},
+	}
+	moods, err = cli.SetSentimentMoods(ranges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &say.SentimentMoods{
+		Ranges:      []say.SentimentMood{ranges[1], ranges[0]},
+		UserDefined: true,
+	}
+	if !reflect.DeepEqual(moods, expect) {
+		t.Errorf("got sentiment moods %#v but expected %#v", moods, expect)
+	}
+	if moods, err = cli.GetSentimentMoods(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(moods, expect) {
+		t.Errorf("got sentiment moods %#v but expected %#v", moods, expect)
+	}
+
+	for i, testcase := range []struct{ text, mood string }{
+		{"this is bad", "glum"},
+		{"this is good", "greedy"},
+	} {
+		line := say.Line{MoodName: "auto", Text: testcase.text}
+		if err := cli.CreateLine(convo.ID, &line); err != nil {
+			t.Fatal(err)
+		}
+		if line.MoodName != testcase.mood {
+			t.Errorf("%d: expected mood %q but got %q", i, testcase.mood, line.MoodName)
 		}
 	}
 
-	// List conversations
-	iter := cli.ListConversations(client.ListParams{})
+	// Invalid mappings
+	_, err = cli.SetSentimentMoods([]say.SentimentMood{
+		{MinScore: 2, Mood: "dead"},
+		{MinScore: 0, Mood: "nope"},
+	})
+	if ip, ok := client.UserError(err).(usererrors.InvalidParams); !ok || len(ip) != 2 {
+		t.Errorf("expected two InvalidParams entries but got %s", err)
+	}
 
-	iter.Next()
-	if err := iter.Err(); err != nil {
+	err = cli.SetMood(&say.Mood{Name: "auto", Eyes: "??"})
+	if _, ok := client.UserError(err).(usererrors.ActionNotAllowed); !ok {
+		t.Errorf("expected ActionNotAllowed for a reserved mood name but got %s", err)
+	}
+
+	// Reset
+	if err := cli.ResetSentimentMoods(); err != nil {
 		t.Fatal(err)
 	}
-	curr := iter.Conversation()
-	got = &curr
+	if moods, err = cli.GetSentimentMoods(); err != nil {
+		t.Fatal(err)
+	} else if moods.UserDefined {
+		t.Errorf("expected default sentiment moods after reset but got %#v", moods)
+	}
+}
 
-	if iter.Next() {
-		t.Fatalf("got multiple conversations, extra is: %s", iter.Conversation())
+func TestAppGallery(t *testing.T) {
+	t.Parallel()
+
+	var clis [2]*client.TestClient
+	for i := range clis {
+		cli, err := client.NewTestClient(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		if err := cli.Authorize(); err != nil {
+			t.Fatal(err)
+		}
+		clis[i] = cli
 	}
+	author, fan := clis[0], clis[1]
 
-	if got.Heading != heading {
-		t.Errorf("Expected heading %s but got %s", heading, got.Heading)
+	if err := author.SetMood(&say.Mood{Name: "smug", Eyes: "^^"}); err != nil {
+		t.Fatal(err)
 	}
-	if len(got.Lines) > 0 {
-		t.Errorf("Expected a list entry with no lines but got %d", len(got.Lines))
+
+	// Publishing requires a publisher name
+	_, err := author.PublishMood("smug")
+	if _, ok := client.UserError(err).(usererrors.ActionNotAllowed); !ok {
+		t.Errorf("expected ActionNotAllowed without a publisher but got %s", err)
 	}
 
-	// Delete an in-use mood fails
-	err = cli.DeleteMood("cross")
-	if action, ok := client.UserError(err).(usererrors.ActionNotAllowed); !ok {
-		t.Errorf("expected ActionNotAllowed error, got %q", err)
-	} else if !strings.Contains(action.Action, "1") {
-		t.Errorf("expected error Action to reference to 1 line, got %q", action.Action)
+	pub := say.Publisher{Name: "Gallery_Author"}
+	if err := author.SetPublisher(&pub); err != nil {
+		t.Fatal(err)
+	}
+	if pub.Name != "gallery_author" {
+		t.Errorf("expected a lowercase publisher name but got %q", pub.Name)
 	}
 
-	// Delete line
-	if err := cli.DeleteLine(convo.ID, line1.ID); err != nil {
+	err = fan.SetPublisher(&say.Publisher{Name: "gallery_author"})
+	if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+		t.Errorf("expected InvalidParams for a taken publisher name but got %s", err)
+	}
+	err = author.SetPublisher(&say.Publisher{Name: "someone_else"})
+	if _, ok := client.UserError(err).(usererrors.ActionNotAllowed); !ok {
+		t.Errorf("expected ActionNotAllowed for a publisher rename but got %s", err)
+	}
+
+	published, err := author.PublishMood("smug")
+	if err != nil {
 		t.Fatal(err)
 	}
+	if published.Reference != "@gallery_author/smug" || !published.Published {
+		t.Errorf("unexpected published mood %#v", published)
+	}
 
-	got, err = cli.GetConversation(convo.ID)
-	if len(got.Lines) != 1 {
-		t.Errorf("Expected 1 line but got %d", len(got.Lines))
+	// Unpublished moods are not visible to other users
+	if err := author.SetMood(&say.Mood{Name: "secret", Eyes: "--"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fan.GetGalleryMood("gallery_author", "secret"); err == nil {
+		t.Errorf("expected an unpublished mood to be hidden")
 	}
 
-	err = cli.DeleteLine(convo.ID, line1.ID)
-	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
-		t.Errorf("expected not found on already deleted line, got %s", err)
+	iter := fan.ListGallery(client.GalleryListParams{Publisher: "gallery_author"})
+	var refs []string
+	for iter.Next() {
+		refs = append(refs, iter.PublishedMood().Reference)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(refs, []string{"@gallery_author/smug"}) {
+		t.Errorf("expected to list the published mood but got %s", refs)
 	}
 
-	// delete conversation
-	if err := cli.DeleteConversation(convo.ID); err != nil {
+	iter = fan.ListGallery(client.GalleryListParams{Query: "gallery_auth", Sort: "installs"})
+	if !iter.Next() {
+		t.Errorf("expected to find the published mood by publisher name: %v", iter.Err())
+	}
+
+	// References require an install
+	convo := say.Conversation{Heading: "borrowed"}
+	if err := fan.CreateConversation(&convo); err != nil {
 		t.Fatal(err)
 	}
+	err = fan.CreateLine(convo.ID, &say.Line{MoodName: "@gallery_author/smug"})
+	if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+		t.Errorf("expected InvalidParams for a mood that is not installed but got %s", err)
+	}
 
-	_, err = cli.GetConversation(convo.ID)
-	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
-		t.Fatalf("expected NotFound for deleted conversation but got %s", err)
+	installed, err := fan.InstallMood("gallery_author", "smug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if installed.Installs != 1 || !installed.Installed {
+		t.Errorf("unexpected installed mood %#v", installed)
+	}
+	if _, err := fan.InstallMood("gallery_author", "smug"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := author.InstallMood("gallery_author", "smug"); err == nil {
+		t.Errorf("expected an error installing your own mood")
 	}
 
-	err = cli.DeleteConversation(convo.ID)
-	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
-		t.Errorf("expected not found on already deleted conversation, got %s", err)
+	line := say.Line{MoodName: "@gallery_author/smug", Text: "told you"}
+	if err := fan.CreateLine(convo.ID, &line); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unpublishing keeps the mood available to existing installs and lines
+	if _, err := author.UnpublishMood("smug"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fan.GetGalleryMood("gallery_author", "smug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Published || got.Installs != 1 {
+		t.Errorf("unexpected unpublished mood %#v", got)
+	}
+	if gotLine, err := fan.GetLine(convo.ID, line.ID); err != nil {
+		t.Fatal(err)
+	} else if gotLine.Output != line.Output {
+		t.Errorf("line output changed after unpublishing from %q to %q", line.Output, gotLine.Output)
+	}
+
+	err = author.DeleteMood("smug")
+	if _, ok := client.UserError(err).(usererrors.ActionNotAllowed); !ok {
+		t.Errorf("expected ActionNotAllowed deleting a mood used by other users but got %s", err)
+	}
+
+	// Copies are independent of the original
+	copied, err := fan.CopyMood("gallery_author", "smug", "my_smug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.Eyes != "^^" || !copied.UserDefined {
+		t.Errorf("unexpected copied mood %#v", copied)
+	}
+	if _, err := fan.CopyMood("gallery_author", "smug", "my_smug"); err == nil {
+		t.Errorf("expected an error copying over an existing mood")
+	}
+
+	if err := fan.UninstallMood("gallery_author", "smug"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fan.GetGalleryMood("gallery_author", "smug"); err == nil {
+		t.Errorf("expected an unpublished, uninstalled mood to be hidden")
 	}
 }
 
-func TestInvalidParams(t *testing.T) {
+func TestAppEdit(t *testing.T) {
 	t.Parallel()
 
 	cli, err := client.NewTestClient(&cfg)
@@ -390,110 +700,2731 @@ func TestInvalidParams(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	moodTests := []struct {
-		Mood    say.Mood
-		Invalid []string
-	}{
-		{},
-		{say.Mood{Eyes: "a\x00", Tongue: "a\x00"}, []string{"eyes", "tongue"}},
-		{say.Mood{Eyes: " "}, []string{"eyes"}},
-		{say.Mood{Tongue: " "}, []string{"tongue"}},
-		{say.Mood{Eyes: "abc"}, []string{"eyes"}},
-		{say.Mood{Tongue: "abc"}, []string{"tongue"}},
-		{say.Mood{Eyes: "abc", Tongue: "abc"}, []string{"eyes", "tongue"}},
+	convo := say.Conversation{Heading: "typos"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
 	}
 
-	for i, test := range moodTests {
-		test.Mood.Name = strconv.Itoa(i)
+	line := say.Line{Animal: "bunny", MoodName: "tired", Text: "teh end"}
+	if err := cli.CreateLine(convo.ID, &line); err != nil {
+		t.Fatal(err)
+	}
 
-		err := cli.SetMood(&test.Mood)
-		if len(test.Invalid) == 0 {
-			if err != nil {
-				t.Errorf("%d: unexpected %s", i, err)
-			}
-		} else {
-			ip, ok := client.UserError(err).(usererrors.InvalidParams)
-			if !ok {
-				t.Errorf("%d: expected InvalidParams got %s", i, err)
-				continue
-			}
+	// Edit the conversation heading
+	convo.Heading = "no typos"
+	if err := cli.UpdateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cli.GetConversation(convo.ID); err != nil {
+		t.Fatal(err)
+	} else if got.Heading != "no typos" {
+		t.Errorf("expected updated heading but got %q", got.Heading)
+	}
 
-			var actual []string
-			for _, p := range ip {
-				actual = append(actual, p.Params...)
-			}
-			if !reflect.DeepEqual(actual, test.Invalid) {
-				t.Errorf("%d: invalid=%s, expected %s", i, actual, test.Invalid)
-			}
+	// Only the provided line parameters change
+	text := "the end"
+	updated, err := cli.UpdateLine(convo.ID, line.ID, client.LineUpdateParams{Text: &text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := line
+	expect.Text = text
+	expect.Output = updated.Output
+	if !reflect.DeepEqual(updated, &expect) {
+		t.Errorf("got updated line %#v but expected %#v", updated, expect)
+	}
+	if !strings.Contains(updated.Output, "the end") {
+		t.Errorf("expected output to be re-rendered but got %q", updated.Output)
+	}
+
+	mood := "wired"
+	updated, err = cli.UpdateLine(convo.ID, line.ID, client.LineUpdateParams{MoodName: &mood})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.MoodName != "wired" || updated.Text != text || updated.Animal != "bunny" {
+		t.Errorf("unexpected updated line %#v", updated)
+	}
+
+	// Edits that change nothing do not create a revision
+	if _, err := cli.UpdateLine(convo.ID, line.ID, client.LineUpdateParams{MoodName: &mood, Text: &text}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid edits are rejected without creating a revision
+	animal, badMood := "unicorn", "nope"
+	_, err = cli.UpdateLine(convo.ID, line.ID, client.LineUpdateParams{Animal: &animal, MoodName: &badMood})
+	if ip, ok := client.UserError(err).(usererrors.InvalidParams); !ok || len(ip) != 2 {
+		t.Errorf("expected two InvalidParams entries but got %s", err)
+	}
+
+	revisions, err := cli.ListLineRevisions(convo.ID, line.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("expected 2 revisions but got %#v", revisions)
+	}
+	for i, expect := range []say.LineRevision{
+		{Revision: 1, Animal: "bunny", MoodName: "tired", Text: "teh end", Self: true},
+		{Revision: 2, Animal: "bunny", MoodName: "tired", Text: "the end", Self: true},
+	} {
+		expect.Edited = revisions[i].Edited
+		expect.EditedBy = revisions[i].EditedBy
+		if !reflect.DeepEqual(revisions[i], expect) {
+			t.Errorf("got revision %#v but expected %#v", revisions[i], expect)
+		}
+		if expect.Edited == 0 {
+			t.Errorf("expected revision %d to record when it was edited", i+1)
+		}
+		if expect.EditedBy == "" {
+			t.Errorf("expected revision %d to record who edited it", i+1)
 		}
 	}
 
-	conversationTests := []struct {
-		Conversation say.Conversation
-		Invalid      []string
+	if _, err := cli.ListLineRevisions(convo.ID, "ln_nope"); err == nil {
+		t.Errorf("expected an error listing revisions for a missing line")
+	}
+
+	// Conversation revisions
+	if err := cli.UpdateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	convoRevisions, err := cli.ListConversationRevisions(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(convoRevisions) != 1 {
+		t.Fatalf("expected 1 conversation revision but got %#v", convoRevisions)
+	}
+	if rev := convoRevisions[0]; rev.Revision != 1 || rev.Heading != "typos" || !rev.Self || rev.EditedBy == "" || rev.Edited == 0 {
+		t.Errorf("unexpected conversation revision %#v", rev)
+	}
+}
+
+func TestAppLineOrder(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	convo := say.Conversation{Heading: "script"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(map[string]*say.Line)
+	for _, text := range []string{"one", "three"} {
+		line := say.Line{Text: text}
+		if err := cli.CreateLine(convo.ID, &line); err != nil {
+			t.Fatal(err)
+		}
+		lines[text] = &line
+	}
+
+	// Insert the forgotten lines mid-conversation
+	for _, insert := range []struct {
+		text string
+		pos  say.LinePosition
 	}{
-		{say.Conversation{Heading: "Foo"}, nil},
-		{say.Conversation{Heading: strings.Repeat("a", 70)}, []string{"heading"}},
-		{say.Conversation{Heading: "Foo \x00"}, nil},
+		{"two", say.LinePosition{Before: lines["three"].ID}},
+		{"four", say.LinePosition{After: lines["three"].ID}},
+		{"zero", say.LinePosition{Before: lines["one"].ID}},
+	} {
+		line := say.Line{Text: insert.text}
+		if err := cli.InsertLine(convo.ID, &line, insert.pos); err != nil {
+			t.Fatal(err)
+		}
+		lines[insert.text] = &line
 	}
 
-	for i, test := range conversationTests {
-		err := cli.CreateConversation(&test.Conversation)
-		if len(test.Invalid) == 0 {
-			if err != nil {
-				t.Errorf("%d: unexpected %s", i, err)
-			}
-		} else {
-			ip, ok := client.UserError(err).(usererrors.InvalidParams)
-			if !ok {
-				t.Errorf("%d: expected InvalidParams got %s", i, err)
-				continue
-			}
+	assertOrder := func(expect ...string) {
+		got, err := cli.GetConversation(convo.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-			var actual []string
-			for _, p := range ip {
-				actual = append(actual, p.Params...)
-			}
-			if !reflect.DeepEqual(actual, test.Invalid) {
-				t.Errorf("%d: invalid=%s, expected %s", i, actual, test.Invalid)
-			}
+		var texts []string
+		for _, line := range got.Lines {
+			texts = append(texts, line.Text)
+		}
+		if !reflect.DeepEqual(texts, expect) {
+			t.Errorf("expected lines %s but got %s", expect, texts)
 		}
 	}
+	assertOrder("zero", "one", "two", "three", "four")
 
-	convo := say.Conversation{Heading: "Foo"}
+	if _, err := cli.MoveLine(convo.ID, lines["zero"].ID, say.LinePosition{After: lines["four"].ID}); err != nil {
+		t.Fatal(err)
+	}
+	assertOrder("one", "two", "three", "four", "zero")
+
+	moved, err := cli.MoveLine(convo.ID, lines["four"].ID, say.LinePosition{Before: lines["two"].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.ID != lines["four"].ID || moved.Text != "four" {
+		t.Errorf("expected the moved line but got %#v", moved)
+	}
+	assertOrder("one", "four", "two", "three", "zero")
+
+	// Appending follows the last line regardless of how it got there
+	line := say.Line{Text: "five"}
+	if err := cli.CreateLine(convo.ID, &line); err != nil {
+		t.Fatal(err)
+	}
+	assertOrder("one", "four", "two", "three", "zero", "five")
+
+	for _, pos := range []say.LinePosition{
+		{},
+		{Before: lines["one"].ID, After: lines["two"].ID},
+		{Before: "ln_nope"},
+	} {
+		_, err := cli.MoveLine(convo.ID, lines["one"].ID, pos)
+		if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+			t.Errorf("expected InvalidParams moving to %#v but got %s", pos, err)
+		}
+	}
+
+	other := say.Conversation{Heading: "other"}
+	if err := cli.CreateConversation(&other); err != nil {
+		t.Fatal(err)
+	}
+	err = cli.InsertLine(other.ID, &say.Line{Text: "hi"}, say.LinePosition{After: lines["one"].ID})
+	if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+		t.Errorf("expected InvalidParams positioning after a line in another conversation but got %s", err)
+	}
+}
+
+func TestAppListLines(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	convo := say.Conversation{Heading: "long"}
 	if err := cli.CreateConversation(&convo); err != nil {
 		t.Fatal(err)
 	}
 
-	lineTests := []struct {
-		Line    say.Line
-		Invalid []string
+	var expect []string
+	for i := 0; i < 7; i++ {
+		line := say.Line{Text: strconv.Itoa(i)}
+		if err := cli.CreateLine(convo.ID, &line); err != nil {
+			t.Fatal(err)
+		}
+		expect = append(expect, line.Text)
+	}
+
+	// Iterate over lines two at a time
+	var texts []string
+	iter := cli.ListLines(convo.ID, client.ListParams{Limit: 2})
+	for iter.Next() {
+		line := iter.Line()
+		if line.Output == "" {
+			t.Errorf("expected line %s to be rendered", line.ID)
+		}
+		texts = append(texts, line.Text)
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(texts, expect) {
+		t.Errorf("expected lines %s but got %s", expect, texts)
+	}
+
+	if iter := cli.ListLines(convo.ID, client.ListParams{After: "ln_nope"}); iter.Next() {
+		t.Errorf("expected no lines after a missing cursor")
+	} else if _, ok := client.UserError(iter.Err()).(usererrors.InvalidParams); !ok {
+		t.Errorf("expected InvalidParams for a missing cursor but got %s", iter.Err())
+	}
+
+	if iter := cli.ListLines("cv_nope", client.ListParams{}); iter.Next() {
+		t.Errorf("expected no lines for a missing conversation")
+	} else if _, ok := client.UserError(iter.Err()).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound for a missing conversation but got %s", iter.Err())
+	}
+
+	// Cap or omit the embedded lines
+	for _, limit := range []int{0, 3, 7, 10} {
+		got, err := cli.GetConversationWithLineLimit(convo.ID, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := limit
+		if n > len(expect) {
+			n = len(expect)
+		}
+		if len(got.Lines) != n {
+			t.Errorf("expected %d lines with line_limit=%d but got %d", n, limit, len(got.Lines))
+		}
+		if got.HasMoreLines != (limit < len(expect)) {
+			t.Errorf("unexpected HasMoreLines=%t with line_limit=%d", got.HasMoreLines, limit)
+		}
+	}
+
+	got, err := cli.GetConversation(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Lines) != len(expect) || got.HasMoreLines {
+		t.Errorf("expected all %d lines by default but got %d", len(expect), len(got.Lines))
+	}
+}
+
+func TestAppSearch(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	release := say.Conversation{Heading: "Deploy day"}
+	misc := say.Conversation{Heading: "Misc"}
+	for _, convo := range []*say.Conversation{&release, &misc} {
+		if err := cli.CreateConversation(convo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dragon := say.Line{Animal: "dragon", Text: "Ship it, I said deploy!"}
+	for _, create := range []struct {
+		convo *say.Conversation
+		line  *say.Line
 	}{
-		{},
-		{say.Line{Animal: "foo\x00", MoodName: "bar\x00", Text: "f"}, []string{"animal", "mood"}},
-		{say.Line{Text: strings.Repeat("f", 2000)}, []string{"text"}},
+		{&release, &dragon},
+		{&release, &say.Line{Text: "Time for lunch"}},
+		{&misc, &say.Line{Text: "Deploying on Fridays is scary"}},
+	} {
+		if err := cli.CreateLine(create.convo.ID, create.line); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	for i, test := range lineTests {
-		err := cli.CreateLine(convo.ID, &test.Line)
-		if len(test.Invalid) == 0 {
-			if err != nil {
-				t.Errorf("%d: unexpected %s", i, err)
-			}
-		} else {
-			ip, ok := client.UserError(err).(usererrors.InvalidParams)
-			if !ok {
-				t.Errorf("%d: expected InvalidParams got %s", i, err)
-				continue
-			}
+	search := func(q string, limit int) []say.SearchHit {
+		var hits []say.SearchHit
+		iter := cli.Search(client.SearchParams{ListParams: client.ListParams{Limit: limit}, Query: q})
+		for iter.Next() {
+			hits = append(hits, iter.SearchHit())
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return hits
+	}
 
-			var actual []string
-			for _, p := range ip {
-				actual = append(actual, p.Params...)
-			}
-			if !reflect.DeepEqual(actual, test.Invalid) {
-				t.Errorf("%d: invalid=%s, expected %s", i, actual, test.Invalid)
-			}
+	// Paging through matches for the heading and both lines
+	hits := search("deploy", 1)
+	if len(hits) != 3 {
+		t.Fatalf("expected 3 hits but got %#v", hits)
+	}
+	seen := make(map[string]bool)
+	for _, hit := range hits {
+		if seen[hit.ID] {
+			t.Errorf("got hit %s more than once", hit.ID)
+		}
+		seen[hit.ID] = true
+
+		if !strings.Contains(strings.ToLower(hit.Snippet), "<b>deploy") {
+			t.Errorf("expected a highlighted snippet but got %q", hit.Snippet)
+		}
+	}
+	if !seen[release.ID] || !seen[dragon.ID] {
+		t.Errorf("expected hits for %s and %s but got %#v", release.ID, dragon.ID, hits)
+	}
+
+	hits = search("dragon said deploy", 10)
+	if len(hits) != 0 {
+		t.Errorf("expected the animal not to be searched but got %#v", hits)
+	}
+
+	hits = search("said deploy", 10)
+	expect := say.SearchHit{
+		ID:             dragon.ID,
+		Type:           "line",
+		ConversationID: release.ID,
+		LineID:         dragon.ID,
+		Heading:        "Deploy day",
+	}
+	if len(hits) != 1 {
+		t.Fatalf("expected 1 hit but got %#v", hits)
+	}
+	expect.Snippet = hits[0].Snippet
+	if !reflect.DeepEqual(hits[0], expect) {
+		t.Errorf("got hit %#v but expected %#v", hits[0], expect)
+	}
+
+	// Snippets escape markup in the text
+	markup := say.Line{Text: "<img src=x onerror=alert(1)> rollback"}
+	if err := cli.CreateLine(misc.ID, &markup); err != nil {
+		t.Fatal(err)
+	}
+	hits = search("rollback", 10)
+	if len(hits) != 1 {
+		t.Fatalf("expected 1 hit but got %#v", hits)
+	}
+	if snippet := hits[0].Snippet; strings.Contains(snippet, "<img") || !strings.Contains(snippet, "&lt;img") || !strings.Contains(snippet, "<b>rollback</b>") {
+		t.Errorf("expected an escaped snippet but got %q", snippet)
+	}
+
+	iter := cli.Search(client.SearchParams{})
+	if iter.Next() {
+		t.Errorf("expected no hits without a query")
+	} else if _, ok := client.UserError(iter.Err()).(usererrors.InvalidParams); !ok {
+		t.Errorf("expected InvalidParams without a query but got %s", iter.Err())
+	}
+}
+
+func TestAppExportImport(t *testing.T) {
+	t.Parallel()
+
+	var clis [2]*client.TestClient
+	for i := range clis {
+		cli, err := client.NewTestClient(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		if err := cli.Authorize(); err != nil {
+			t.Fatal(err)
 		}
+		clis[i] = cli
+	}
+	staging, prod := clis[0], clis[1]
+
+	for _, mood := range []*say.Mood{
+		{Name: "sly", Eyes: "<>"},
+		{Name: "grin", Eyes: "^^", Tongue: "U "},
+	} {
+		if err := staging.SetMood(mood); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	convo := say.Conversation{Heading: "release plan"}
+	if err := staging.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	characters := []say.Character{
+		{Name: "Alice", Animal: "bunny", MoodName: "sly", Facing: say.FacingRight},
+		{Name: "Bob", MoodName: "grin"},
+	}
+	for i := range characters {
+		if err := staging.CreateCharacter(convo.ID, &characters[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := []say.Line{
+		{Animal: "bunny", MoodName: "sly", Text: "psst"},
+		{Think: true, MoodName: "tired", Text: "zzz"},
+		{MoodName: "grin", Text: "shipped"},
+		{MoodName: "sly", Text: "again"},
+		{Character: "Alice", Text: "mirrored"},
+	}
+	for i := range lines {
+		if err := staging.CreateLine(convo.ID, &lines[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bundle, err := staging.ExportConversation(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.Heading != convo.Heading || len(bundle.Lines) != len(lines) {
+		t.Fatalf("unexpected bundle %#v", bundle)
+	}
+	if len(bundle.Moods) != 3 {
+		t.Errorf("expected the 3 moods used by the lines but got %#v", bundle.Moods)
+	}
+	if len(bundle.Characters) != len(characters) || bundle.Lines[4].Character != "Alice" {
+		t.Errorf("expected the bundle to include the characters but got %#v", bundle)
+	}
+
+	// Existing moods are used rather than replaced
+	if err := prod.SetMood(&say.Mood{Name: "grin", Eyes: "@@"}); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := prod.ImportConversation(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.ID == convo.ID || imported.Heading != convo.Heading {
+		t.Errorf("unexpected imported conversation %#v", imported)
+	}
+	if len(imported.Lines) != len(lines) {
+		t.Fatalf("expected %d lines but got %d", len(lines), len(imported.Lines))
+	}
+	for i, line := range imported.Lines {
+		if line.Text != lines[i].Text || line.MoodName != lines[i].MoodName || line.Think != lines[i].Think ||
+			line.Character != lines[i].Character {
+			t.Errorf("got imported line %#v but expected %#v", line, lines[i])
+		}
+		if line.MoodName != "grin" && line.Output != lines[i].Output {
+			t.Errorf("expected line %d to render the same but got %q", i, line.Output)
+		}
+	}
+
+	if mood, err := prod.GetMood("sly"); err != nil {
+		t.Fatal(err)
+	} else if mood.Eyes != "<>" || !mood.UserDefined {
+		t.Errorf("expected the mood to be created but got %#v", mood)
+	}
+	if mood, err := prod.GetMood("grin"); err != nil {
+		t.Fatal(err)
+	} else if mood.Eyes != "@@" {
+		t.Errorf("expected the existing mood to be kept but got %#v", mood)
+	}
+
+	got, err := prod.GetConversation(imported.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, imported) {
+		t.Errorf("got conversation %#v but imported %#v", got, imported)
+	}
+
+	importedCharacters, err := prod.ListCharacters(imported.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(importedCharacters) != len(characters) {
+		t.Fatalf("expected %d characters but got %#v", len(characters), importedCharacters)
+	}
+	for i, character := range importedCharacters {
+		expect := characters[i]
+		if character.Name != expect.Name || character.Animal != expect.Animal ||
+			character.MoodName != expect.MoodName || character.Facing != expect.Facing {
+			t.Errorf("got imported character %#v but expected %#v", character, expect)
+		}
+	}
+
+	// Invalid bundles are rejected as a whole
+	alice := say.BundleCharacter{Name: "Alice", Animal: "bunny"}
+	for _, invalid := range []say.ConversationBundle{
+		{Version: 2},
+		{Version: 1, Lines: []say.BundleLine{{MoodName: "sly"}, {Animal: "unicorn"}}},
+		{Version: 1, Lines: []say.BundleLine{{MoodName: "missing"}}},
+		{Version: 1, Moods: []say.Mood{{Name: "wide", Eyes: "ooo"}}},
+		{Version: 1, Lines: []say.BundleLine{{Character: "Alice"}}},
+		{Version: 1, Characters: []say.BundleCharacter{alice}, Lines: []say.BundleLine{{Character: "Alice", Animal: "dragon"}}},
+		{Version: 1, Characters: []say.BundleCharacter{alice, alice}},
+		{Version: 1, Characters: []say.BundleCharacter{{Name: "Carol", Facing: "up"}}},
+		{Version: 1, Characters: []say.BundleCharacter{{Name: "Carol", MoodName: "missing"}}},
+	} {
+		_, err := prod.ImportConversation(&invalid)
+		if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+			t.Errorf("expected InvalidParams importing %#v but got %s", invalid, err)
+		}
+	}
+
+	iter := prod.ListConversations(client.ListParams{})
+	var cnt int
+	for iter.Next() {
+		cnt++
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if cnt != 1 {
+		t.Errorf("expected only the imported conversation but got %d", cnt)
+	}
+}
+
+func TestAppTranscript(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	convo := say.Conversation{Heading: "Newsletter <3"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	lines := []say.Line{{Text: "hello"}, {Animal: "bunny", Text: "a < b"}}
+	for i := range lines {
+		if err := cli.CreateLine(convo.ID, &lines[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	txt, err := cli.GetTranscript(convo.ID, "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "Newsletter <3\n\n" +
+		strings.TrimRight(lines[0].Output, "\n") + "\n\n" +
+		strings.TrimRight(lines[1].Output, "\n") + "\n"
+	if string(txt) != expect {
+		t.Errorf("got text transcript %q but expected %q", txt, expect)
+	}
+
+	md, err := cli.GetTranscript(convo.ID, "md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(md), "# Newsletter <3\n\n```\n") || strings.Count(string(md), "```") != 4 {
+		t.Errorf("unexpected Markdown transcript %q", md)
+	}
+
+	page, err := cli.GetTranscript(convo.ID, "html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(page), "<h1>Newsletter &lt;3</h1>") || strings.Count(string(page), "<pre>") != 2 {
+		t.Errorf("unexpected HTML transcript %q", page)
+	}
+	if strings.Contains(string(page), "a < b") {
+		t.Errorf("expected line text to be escaped in %q", page)
+	}
+
+	_, err = cli.GetTranscript(convo.ID, "pdf")
+	if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+		t.Errorf("expected InvalidParams for an unknown format but got %s", err)
+	}
+}
+
+func TestAppRender(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	convo := say.Conversation{Heading: "Chat"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	lines := []say.Line{{Text: "hello"}, {Animal: "bunny", Text: "hi"}}
+	for i := range lines {
+		if err := cli.CreateLine(convo.ID, &lines[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stacked, err := cli.RenderConversation(convo.ID, client.RenderParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := strings.TrimRight(lines[0].Output, "\n") + "\n\n" + strings.TrimRight(lines[1].Output, "\n") + "\n"
+	if string(stacked) != expect {
+		t.Errorf("got %q but expected %q", stacked, expect)
+	}
+
+	chat, err := cli.RenderConversation(convo.ID, client.RenderParams{
+		Layout:      say.LayoutChat,
+		Width:       60,
+		Separator:   "~",
+		LineNumbers: true,
+		Banner:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := strings.Split(string(chat), "\n")
+	if len(rows) < 4 || rows[0] != "+"+strings.Repeat("-", 58)+"+" || !strings.Contains(rows[1], "Chat") || rows[3] != strings.Repeat("~", 60) {
+		t.Errorf("expected a banner and separator in %q", chat)
+	}
+	if !strings.Contains(string(chat), "\n1.\n") || !strings.Contains(string(chat), " 2.\n") {
+		t.Errorf("expected the second speaker to be aligned right in %q", chat)
+	}
+
+	// Balloons are wrapped to fit the chat layout
+	long := say.Line{Text: strings.Repeat("blah ", 20)}
+	if err := cli.CreateLine(convo.ID, &long); err != nil {
+		t.Fatal(err)
+	}
+	chat, err = cli.RenderConversation(convo.ID, client.RenderParams{Layout: say.LayoutChat, Width: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range strings.Split(string(chat), "\n") {
+		if n := utf8.RuneCountInString(row); n > 40 {
+			t.Errorf("expected rows to fit in 40 columns but got %d in %q", n, chat)
+			break
+		}
+	}
+
+	_, err = cli.RenderConversation(convo.ID, client.RenderParams{Width: 1000})
+	if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+		t.Errorf("expected InvalidParams for a width that is too large but got %s", err)
+	}
+}
+
+func TestAppCharacters(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	convo := say.Conversation{Heading: "standup"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := say.Character{Name: "Alice", Animal: "bunny", MoodName: "tired", Facing: say.FacingRight}
+	bob := say.Character{Name: "Bob"}
+	for _, character := range []*say.Character{&alice, &bob} {
+		if err := cli.CreateCharacter(convo.ID, character); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bob.Animal != "default" || bob.MoodName != "default" || bob.Facing != say.FacingLeft {
+		t.Errorf("expected defaults for %#v", bob)
+	}
+
+	for _, invalid := range []say.Character{
+		{Name: "Alice"},
+		{Name: ""},
+		{Name: "Carol", Animal: "unicorn"},
+		{Name: "Carol", MoodName: "missing"},
+		{Name: "Carol", Facing: "up"},
+	} {
+		err := cli.CreateCharacter(convo.ID, &invalid)
+		if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+			t.Errorf("expected InvalidParams creating %#v but got %s", invalid, err)
+		}
+	}
+
+	characters, err := cli.ListCharacters(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(characters, []say.Character{alice, bob}) {
+		t.Errorf("got characters %#v", characters)
+	}
+
+	said := say.Line{Character: "Alice", Text: "I'm blocked"}
+	if err := cli.CreateLine(convo.ID, &said); err != nil {
+		t.Fatal(err)
+	}
+	if said.Character != "Alice" || said.Animal != "bunny" || said.MoodName != "tired" {
+		t.Errorf("expected the line to take Alice's animal and mood but got %#v", said)
+	}
+
+	// Alice faces right so her lines are drawn mirrored
+	plain := say.Line{Animal: "bunny", MoodName: "tired", Text: "I'm blocked"}
+	if err := cli.CreateLine(convo.ID, &plain); err != nil {
+		t.Fatal(err)
+	}
+	if said.Output == plain.Output {
+		t.Errorf("expected a mirrored bunny but got %q", said.Output)
+	}
+
+	wired := say.Line{Character: "Bob", MoodName: "wired", Text: "me too"}
+	if err := cli.CreateLine(convo.ID, &wired); err != nil {
+		t.Fatal(err)
+	}
+	if wired.Character != "Bob" || wired.Animal != "default" || wired.MoodName != "wired" {
+		t.Errorf("expected the mood to override Bob's but got %#v", wired)
+	}
+
+	for _, invalid := range []say.Line{
+		{Character: "Alice", Animal: "dragon"},
+		{Character: "Carol"},
+	} {
+		err := cli.CreateLine(convo.ID, &invalid)
+		if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+			t.Errorf("expected InvalidParams creating %#v but got %s", invalid, err)
+		}
+	}
+
+	txt, err := cli.GetTranscript(convo.ID, "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(txt), "\n\nAlice:\n"+strings.TrimRight(said.Output, "\n")) ||
+		!strings.Contains(string(txt), "\n\nBob:\n") {
+		t.Errorf("expected lines to be labelled in %q", txt)
+	}
+
+	fork, err := cli.ForkConversation(convo.ID, client.ForkParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fork.Lines[0].Character != "Alice" || fork.Lines[0].Output != said.Output {
+		t.Errorf("expected the fork to keep Alice's line but got %#v", fork.Lines[0])
+	}
+	forked, err := cli.ListCharacters(fork.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forked) != 2 || forked[0].Name != "Alice" || forked[0].ID == alice.ID {
+		t.Errorf("expected copies of the characters in the fork but got %#v", forked)
+	}
+
+	if err := cli.DeleteCharacter(convo.ID, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	line, err := cli.GetLine(convo.ID, said.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line.Character != "" || line.Animal != "bunny" || line.Output != plain.Output {
+		t.Errorf("expected the line to keep its animal without Alice but got %#v", line)
+	}
+
+	err = cli.DeleteCharacter(convo.ID, alice.ID)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound deleting a deleted character but got %s", err)
+	}
+}
+
+func TestAppScript(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	script := "# The end\n\n@Alice = bunny[tired,facing=right]\n\n" +
+		"dragon[dead,think]: I have seen things\nbunny: so\\nmany things\n@Alice: me too\n@Alice[default]: rested\n"
+	convo, err := cli.ImportScript(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if convo.Heading != "The end" {
+		t.Errorf("got heading %q but expected %q", convo.Heading, "The end")
+	}
+
+	expect := []say.Line{
+		{Animal: "dragon", MoodName: "dead", Think: true, Text: "I have seen things"},
+		{Animal: "bunny", MoodName: "default", Text: "so\nmany things"},
+		{Character: "Alice", Animal: "bunny", MoodName: "tired", Text: "me too"},
+		{Character: "Alice", Animal: "bunny", MoodName: "default", Text: "rested"},
+	}
+	if len(convo.Lines) != len(expect) {
+		t.Fatalf("got %d lines but expected %d", len(convo.Lines), len(expect))
+	}
+	for i, line := range convo.Lines {
+		if line.Animal != expect[i].Animal || line.MoodName != expect[i].MoodName ||
+			line.Think != expect[i].Think || line.Text != expect[i].Text || line.Character != expect[i].Character {
+			t.Errorf("%d: got line %#v but expected %#v", i, line, expect[i])
+		}
+		if line.Output == "" {
+			t.Errorf("%d: expected line to be rendered", i)
+		}
+	}
+
+	characters, err := cli.ListCharacters(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(characters) != 1 || characters[0].Name != "Alice" || characters[0].Animal != "bunny" ||
+		characters[0].MoodName != "tired" || characters[0].Facing != say.FacingRight {
+		t.Errorf("unexpected characters %#v", characters)
+	}
+
+	got, err := cli.GetScript(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != script {
+		t.Errorf("got script %q but expected %q", got, script)
+	}
+
+	_, err = cli.ImportScript("dragon: fine\nunicorn[dead]: hi\ncow[nonexistent]: hi")
+	uerr, ok := client.UserError(err).(usererrors.InvalidParams)
+	if !ok {
+		t.Fatalf("expected InvalidParams but got %s", err)
+	}
+	if len(uerr) != 2 || !strings.HasPrefix(uerr[0].Message, "line 2:") || !strings.HasPrefix(uerr[1].Message, "line 3:") {
+		t.Errorf("expected errors on lines 2 and 3 but got %v", uerr)
+	}
+
+	_, err = cli.ImportScript("@Alice = bunny\n@Alice = dragon\n@Bob: hi")
+	uerr, ok = client.UserError(err).(usererrors.InvalidParams)
+	if !ok {
+		t.Fatalf("expected InvalidParams but got %s", err)
+	}
+	if len(uerr) != 2 || !strings.HasPrefix(uerr[0].Message, "line 2:") || !strings.HasPrefix(uerr[1].Message, "line 3:") {
+		t.Errorf("expected errors on lines 2 and 3 but got %v", uerr)
+	}
+
+	if _, err := cli.GetScript("cv_nonexistent"); err == nil {
+		t.Error("expected an error getting the script of a missing conversation")
+	}
+}
+
+func TestAppShares(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	user, err := cli.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetAuthorization(user.ID)
+
+	convo := say.Conversation{Heading: "shared"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	line := say.Line{Text: "hello"}
+	if err := cli.CreateLine(convo.ID, &line); err != nil {
+		t.Fatal(err)
+	}
+
+	forever, err := cli.CreateShare(convo.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forever.Expires != nil {
+		t.Errorf("expected share without expiry but got %d", *forever.Expires)
+	}
+	expiring, err := cli.CreateShare(convo.ID, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiring.Expires == nil || *expiring.Expires != expiring.Created+3600 {
+		t.Errorf("expected share to expire an hour after creation but got %#v", expiring)
+	}
+
+	shares, err := cli.ListShares(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(shares, []say.Share{*forever, *expiring}) {
+		t.Errorf("expected shares %#v but got %#v", []say.Share{*forever, *expiring}, shares)
+	}
+
+	_, err = cli.CreateShare(convo.ID, -1)
+	if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+		t.Errorf("expected InvalidParams for a negative expiry but got %s", err)
+	}
+	_, err = cli.CreateShare("cv_missing", 0)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound sharing a missing conversation but got %s", err)
+	}
+
+	// Shared conversations are readable without authorization
+	cli.SetAuthorization("")
+
+	for _, share := range []*say.Share{forever, expiring} {
+		got, err := cli.GetShared(share.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != convo.ID || len(got.Lines) != 1 || got.Lines[0].Output != line.Output {
+			t.Errorf("expected shared conversation %#v but got %#v", convo, got)
+		}
+	}
+
+	// Flip a bit of the signature
+	raw, err := base64.URLEncoding.DecodeString(forever.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 1
+	for _, token := range []string{base64.URLEncoding.EncodeToString(raw), "nope"} {
+		_, err = cli.GetShared(token)
+		if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+			t.Errorf("expected NotFound for token %q but got %s", token, err)
+		}
+	}
+
+	_, err = cli.ListShares(convo.ID)
+	if _, ok := client.UserError(err).(auth.BearerAuthRequired); !ok {
+		t.Errorf("expected BearerAuthRequired listing shares anonymously but got %s", err)
+	}
+
+	cli.SetAuthorization(user.ID)
+	if err := cli.RevokeShare(convo.ID, forever.ID); err != nil {
+		t.Fatal(err)
+	}
+	err = cli.RevokeShare(convo.ID, forever.ID)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound revoking a revoked share but got %s", err)
+	}
+
+	_, err = cli.GetShared(forever.Token)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound for a revoked share but got %s", err)
+	}
+	if _, err := cli.GetShared(expiring.Token); err != nil {
+		t.Errorf("expected other shares to remain valid but got %s", err)
+	}
+
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.ListShares(convo.ID); err == nil {
+		t.Errorf("expected another user to be unable to list shares")
+	}
+	err = cli.RevokeShare(convo.ID, expiring.ID)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound revoking another user's share but got %s", err)
+	}
+}
+
+func TestAppForkConversation(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cli.SetMood(&say.Mood{Name: "sly", Eyes: "><"}); err != nil {
+		t.Fatal(err)
+	}
+
+	convo := say.Conversation{Heading: "original"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	lines := []say.Line{{Text: "one"}, {Text: "two", MoodName: "sly"}, {Animal: "bunny", Text: "three"}}
+	for i := range lines {
+		if err := cli.CreateLine(convo.ID, &lines[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fork, err := cli.ForkConversation(convo.ID, client.ForkParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fork.ID == convo.ID || !strings.HasPrefix(fork.ID, "cv_") {
+		t.Errorf("expected a new conversation ID but got %q", fork.ID)
+	}
+	if fork.Heading != convo.Heading || fork.ParentID != convo.ID {
+		t.Errorf("expected fork of %q with heading %q but got %#v", convo.ID, convo.Heading, fork)
+	}
+	if len(fork.Lines) != len(lines) {
+		t.Fatalf("expected %d lines but got %#v", len(lines), fork.Lines)
+	}
+	for i, line := range fork.Lines {
+		if line.ID == lines[i].ID {
+			t.Errorf("expected line %d to have a new ID but got %q", i, line.ID)
+		}
+		line.ID = lines[i].ID
+		if !reflect.DeepEqual(line, lines[i]) {
+			t.Errorf("expected line %d to be copied as %#v but got %#v", i, lines[i], line)
+		}
+	}
+
+	heading := "alternative"
+	partial, err := cli.ForkConversation(convo.ID, client.ForkParams{Heading: &heading, Through: lines[1].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial.Heading != heading || len(partial.Lines) != 2 || partial.Lines[1].Text != "two" {
+		t.Errorf("expected fork through the second line but got %#v", partial)
+	}
+
+	// Forks are independent of the original
+	if err := cli.DeleteLine(partial.ID, partial.Lines[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	got, err := cli.GetConversation(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Lines) != len(lines) || got.ParentID != "" {
+		t.Errorf("expected original conversation to be unchanged but got %#v", got)
+	}
+
+	_, err = cli.ForkConversation(convo.ID, client.ForkParams{Through: "ln_missing"})
+	if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+		t.Errorf("expected InvalidParams for a missing line but got %s", err)
+	}
+	_, err = cli.ForkConversation("cv_missing", client.ForkParams{})
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound for a missing conversation but got %s", err)
+	}
+
+	if err := cli.DeleteConversation(convo.ID); err != nil {
+		t.Fatal(err)
+	}
+	got, err = cli.GetConversation(fork.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ParentID != "" || len(got.Lines) != len(lines) {
+		t.Errorf("expected fork to remain without a parent but got %#v", got)
+	}
+}
+
+func TestAppForkConversationAsViewer(t *testing.T) {
+	t.Parallel()
+
+	clients := make([]*client.TestClient, 2)
+	for i := range clients {
+		cli, err := client.NewTestClient(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		if err := cli.Authorize(); err != nil {
+			t.Fatal(err)
+		}
+		clients[i] = cli
+	}
+	owner, viewer := clients[0], clients[1]
+
+	if err := owner.SetMood(&say.Mood{Name: "sly", Eyes: "><"}); err != nil {
+		t.Fatal(err)
+	}
+	convo := say.Conversation{Heading: "shared"}
+	if err := owner.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	line := say.Line{Text: "psst", MoodName: "sly"}
+	if err := owner.CreateLine(convo.ID, &line); err != nil {
+		t.Fatal(err)
+	}
+
+	invite, err := owner.CreateInvite(convo.ID, say.RoleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := viewer.AcceptInvite(invite.Token); err != nil {
+		t.Fatal(err)
+	}
+
+	fork, err := viewer.ForkConversation(convo.ID, client.ForkParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fork.Lines) != 1 || fork.Lines[0].Output != line.Output {
+		t.Fatalf("expected the line to be copied with its face but got %#v", fork.Lines)
+	}
+
+	// The viewer gets their own copy of the owner's mood
+	mood, err := viewer.GetMood("sly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mood == nil || !mood.UserDefined || mood.Eyes != "><" {
+		t.Errorf("expected the mood to be copied to the viewer but got %#v", mood)
+	}
+
+	// So the owner can change and delete theirs without affecting the fork
+	if err := owner.SetMood(&say.Mood{Name: "sly", Eyes: "^^"}); err != nil {
+		t.Fatal(err)
+	}
+	moodName := "default"
+	if _, err := owner.UpdateLine(convo.ID, line.ID, client.LineUpdateParams{MoodName: &moodName}); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.DeleteMood("sly"); err != nil {
+		t.Errorf("expected the owner to be able to delete their mood but got %s", err)
+	}
+
+	got, err := viewer.GetConversation(fork.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Lines) != 1 || got.Lines[0].Output != line.Output {
+		t.Errorf("expected the fork to be unchanged but got %#v", got.Lines)
+	}
+}
+
+func TestAppTrash(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	listTrash := func() []say.TrashItem {
+		var items []say.TrashItem
+		iter := cli.ListTrash(client.ListParams{})
+		for iter.Next() {
+			items = append(items, iter.TrashItem())
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	convo := say.Conversation{Heading: "scripted"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	lines := []say.Line{{Text: "one"}, {Text: "two"}, {Text: "three"}}
+	for i := range lines {
+		if err := cli.CreateLine(convo.ID, &lines[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cli.DeleteLine(convo.ID, lines[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.GetLine(convo.ID, lines[1].ID); err == nil {
+		t.Errorf("expected deleted line to be hidden")
+	}
+	items := listTrash()
+	if len(items) != 1 || items[0].ID != lines[1].ID || items[0].Type != "line" ||
+		items[0].ConversationID != convo.ID || items[0].Text != "two" {
+		t.Errorf("expected the deleted line in the trash but got %#v", items)
+	}
+
+	// Restored lines return to their position
+	restored, err := cli.RestoreLine(convo.ID, lines[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*restored, lines[1]) {
+		t.Errorf("expected restored line %#v but got %#v", lines[1], restored)
+	}
+	got, err := cli.GetConversation(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Lines, lines) {
+		t.Errorf("expected lines %#v after restoring but got %#v", lines, got.Lines)
+	}
+	_, err = cli.RestoreLine(convo.ID, lines[1].ID)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound restoring a line that is not deleted but got %s", err)
+	}
+
+	// Lines deleted before their conversation stay deleted when the
+	// conversation is restored
+	if err := cli.DeleteLine(convo.ID, lines[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.DeleteConversation(convo.ID); err != nil {
+		t.Fatal(err)
+	}
+	items = listTrash()
+	if len(items) != 1 || items[0].ID != convo.ID || items[0].Type != "conversation" || items[0].Heading != "scripted" {
+		t.Errorf("expected only the deleted conversation in the trash but got %#v", items)
+	}
+
+	iter := cli.ListConversations(client.ListParams{})
+	if iter.Next() {
+		t.Errorf("expected deleted conversation not to be listed but got %#v", iter.Conversation())
+	}
+	_, err = cli.RestoreLine(convo.ID, lines[0].ID)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound restoring a line of a deleted conversation but got %s", err)
+	}
+
+	got, err = cli.RestoreConversation(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Lines, lines[1:]) {
+		t.Errorf("expected lines %#v after restoring but got %#v", lines[1:], got.Lines)
+	}
+	items = listTrash()
+	if len(items) != 1 || items[0].ID != lines[0].ID {
+		t.Errorf("expected the line deleted first in the trash but got %#v", items)
+	}
+
+	other, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := other.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+	if iter := other.ListTrash(client.ListParams{}); iter.Next() {
+		t.Errorf("expected another user's trash to be empty but got %#v", iter.TrashItem())
+	}
+	_, err = other.RestoreLine(convo.ID, lines[0].ID)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound restoring another user's line but got %s", err)
+	}
+}
+
+func TestAppTrashPurge(t *testing.T) {
+	t.Parallel()
+
+	// Use a separate database since purging affects every user
+	cli, err := client.NewTestClient(&app.Configuration{
+		TrashRetention:     time.Millisecond,
+		TrashPurgeInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	convo := say.Conversation{Heading: "temporary"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.DeleteConversation(convo.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		iter := cli.ListTrash(client.ListParams{})
+		if !iter.Next() {
+			if err := iter.Err(); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the trash to be purged but got %#v", iter.TrashItem())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	_, err = cli.RestoreConversation(convo.ID)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound restoring a purged conversation but got %s", err)
+	}
+}
+
+func TestAppExpiry(t *testing.T) {
+	t.Parallel()
+
+	// Use a separate database since reaping affects every user
+	cli, err := client.NewTestClient(&app.Configuration{
+		ReapInterval:  10 * time.Millisecond,
+		ReapBatchSize: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().Add(-time.Minute).Unix()
+	err = cli.CreateConversation(&say.Conversation{Heading: "too late", Expires: &past})
+	if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+		t.Errorf("expected InvalidParams for an expiry in the past but got %s", err)
+	}
+
+	kept := say.Conversation{Heading: "permanent"}
+	if err := cli.CreateConversation(&kept); err != nil {
+		t.Fatal(err)
+	}
+	if kept.Expires != nil {
+		t.Errorf("expected no expiry but got %d", *kept.Expires)
+	}
+
+	expires := time.Now().Add(2 * time.Second).Unix()
+	convos := make([]say.Conversation, 2)
+	for i := range convos {
+		convos[i] = say.Conversation{Heading: "ephemeral", Expires: &expires}
+		if err := cli.CreateConversation(&convos[i]); err != nil {
+			t.Fatal(err)
+		}
+		if convos[i].Expires == nil || *convos[i].Expires < expires-1 || *convos[i].Expires > expires+1 {
+			t.Errorf("expected to expire at about %d but got %v", expires, convos[i].Expires)
+		}
+	}
+
+	for _, convo := range convos {
+		for deadline := time.Now().Add(10 * time.Second); ; {
+			_, err := cli.GetConversation(convo.ID)
+			if _, ok := client.UserError(err).(usererrors.NotFound); ok {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected conversation %s to be reaped", convo.ID)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	if _, err := cli.GetConversation(kept.ID); err != nil {
+		t.Errorf("expected a conversation without an expiry to be kept but got %s", err)
+	}
+}
+
+func TestAppExpiryUnreaped(t *testing.T) {
+	t.Parallel()
+
+	// The shared configuration never reaps
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	expires := time.Now().Add(time.Second).Unix()
+	convo := say.Conversation{Heading: "lingering", Expires: &expires}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Until(time.Unix(expires+1, 0)))
+
+	// Expired conversations are gone before they are reaped
+	_, err = cli.GetConversation(convo.ID)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound getting an expired conversation but got %s", err)
+	}
+	err = cli.CreateLine(convo.ID, &say.Line{Text: "too late"})
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound adding a line to an expired conversation but got %s", err)
+	}
+	convo.Heading = "renamed"
+	err = cli.UpdateConversation(&convo)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound updating an expired conversation but got %s", err)
+	}
+
+	iter := cli.ListConversations(client.ListParams{})
+	for iter.Next() {
+		if iter.Conversation().ID == convo.ID {
+			t.Error("expected an expired conversation not to be listed")
+		}
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppCreateLines(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	convo := say.Conversation{Heading: "imported"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	first := say.Line{Text: "first"}
+	if err := cli.CreateLine(convo.ID, &first); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []say.Line{{Text: "ok"}, {Animal: "unicorn"}, {MoodName: "missing"}, {Text: strings.Repeat("a", 1025)}}
+	err = cli.CreateLines(convo.ID, invalid)
+	if ip, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+		t.Errorf("expected InvalidParams for invalid lines but got %s", err)
+	} else {
+		var actual []string
+		for _, p := range ip {
+			actual = append(actual, p.Params...)
+		}
+		expect := []string{"lines[1].animal", "lines[2].mood", "lines[3].text"}
+		if !reflect.DeepEqual(actual, expect) {
+			t.Errorf("invalid=%s, expected %s", actual, expect)
+		}
+	}
+
+	lines := []say.Line{{Text: "second"}, {Animal: "bunny", Think: true, Text: "third"}, {MoodName: "tired"}}
+	if err := cli.CreateLines(convo.ID, lines); err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range lines {
+		if line.ID == "" || line.Output == "" {
+			t.Errorf("%d: expected line to be created but got %#v", i, line)
+		}
+	}
+
+	got, err := cli.GetConversation(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := append([]say.Line{first}, lines...)
+	if !reflect.DeepEqual(got.Lines, expect) {
+		t.Errorf("expected lines %#v but got %#v", expect, got.Lines)
+	}
+
+	err = cli.CreateLines(convo.ID, nil)
+	if _, ok := client.UserError(err).(usererrors.InvalidParams); !ok {
+		t.Errorf("expected InvalidParams for an empty batch but got %s", err)
+	}
+	err = cli.CreateLines("cv_missing", []say.Line{{Text: "lost"}})
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound for a missing conversation but got %s", err)
+	}
+}
+
+func TestConversation(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	// CREATE
+	heading := "top of the world"
+	convo := say.Conversation{Heading: heading}
+
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	if convo.ID == "" {
+		t.Errorf("conversation ID was not set")
+	}
+	if convo.Heading != heading {
+		t.Errorf("heading=%q, expected %q", convo.Heading, heading)
+	}
+	if len(convo.Lines) != 0 {
+		t.Errorf("unexpected lines in new conversation: %s", convo.Lines)
+	}
+
+	// GET with no lines
+	got, err := cli.GetConversation(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&convo, got) {
+		t.Errorf("got %#v != created %#v", got, convo)
+	}
+
+	// Add line with builtin and created mood
+	line1 := say.Line{
+		Animal: "bunny",
+		Text:   "hi there",
+	}
+	if err := cli.CreateLine(convo.ID, &line1); err != nil {
+		t.Fatal(err)
+	}
+	t.Log(line1.Output)
+
+	mood := say.Mood{
+		Name:   "cross",
+		Eyes:   "><",
+		Tongue: "<>",
+	}
+	if err := cli.SetMood(&mood); err != nil {
+		t.Fatal(err)
+	}
+
+	line2 := say.Line{
+		Think:    true,
+		MoodName: "cross",
+		Text:     "simmer down now",
+	}
+	if err := cli.CreateLine(convo.ID, &line2); err != nil {
+		t.Fatal(err)
+	}
+	t.Log(line2.Output)
+
+	// Get lines
+	for i, line := range []say.Line{line1, line2} {
+		got, err := cli.GetLine(convo.ID, line.ID)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if !reflect.DeepEqual(got, &line) {
+			t.Errorf("%d: expected to get line %#v but got %#v", i, line, got)
+		}
+	}
+
+	// Get with lines
+	got, err = cli.GetConversation(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Lines) != 2 {
+		t.Errorf("Expected 2 lines but got %d", len(got.Lines))
+	} else {
+		for i, line := range []say.Line{line1, line2} {
+			if !reflect.DeepEqual(got.Lines[i], line) {
+				t.Errorf("%d: expected line %#v but got %#v", i, line, got.Lines[i])
+			}
+		}
+	}
+
+	// List conversations
+	iter := cli.ListConversations(client.ListParams{})
+
+	iter.Next()
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	curr := iter.Conversation()
+	got = &curr
+
+	if iter.Next() {
+		t.Fatalf("got multiple conversations, extra is: %s", iter.Conversation())
+	}
+
+	if got.Heading != heading {
+		t.Errorf("Expected heading %s but got %s", heading, got.Heading)
+	}
+	if len(got.Lines) > 0 {
+		t.Errorf("Expected a list entry with no lines but got %d", len(got.Lines))
+	}
+
+	// Delete an in-use mood fails
+	err = cli.DeleteMood("cross")
+	if action, ok := client.UserError(err).(usererrors.ActionNotAllowed); !ok {
+		t.Errorf("expected ActionNotAllowed error, got %q", err)
+	} else if !strings.Contains(action.Action, "1") {
+		t.Errorf("expected error Action to reference to 1 line, got %q", action.Action)
+	}
+
+	// Delete line
+	if err := cli.DeleteLine(convo.ID, line1.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = cli.GetConversation(convo.ID)
+	if len(got.Lines) != 1 {
+		t.Errorf("Expected 1 line but got %d", len(got.Lines))
+	}
+
+	err = cli.DeleteLine(convo.ID, line1.ID)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected not found on already deleted line, got %s", err)
+	}
+
+	// delete conversation
+	if err := cli.DeleteConversation(convo.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cli.GetConversation(convo.ID)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Fatalf("expected NotFound for deleted conversation but got %s", err)
+	}
+
+	err = cli.DeleteConversation(convo.ID)
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected not found on already deleted conversation, got %s", err)
+	}
+}
+
+func TestInvalidParams(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	moodTests := []struct {
+		Mood    say.Mood
+		Invalid []string
+	}{
+		{},
+		{say.Mood{Eyes: "a\x00", Tongue: "a\x00"}, []string{"eyes", "tongue"}},
+		{say.Mood{Eyes: " "}, []string{"eyes"}},
+		{say.Mood{Tongue: " "}, []string{"tongue"}},
+		{say.Mood{Eyes: "abc"}, []string{"eyes"}},
+		{say.Mood{Tongue: "abc"}, []string{"tongue"}},
+		{say.Mood{Eyes: "abc", Tongue: "abc"}, []string{"eyes", "tongue"}},
+	}
+
+	for i, test := range moodTests {
+		test.Mood.Name = strconv.Itoa(i)
+
+		err := cli.SetMood(&test.Mood)
+		if len(test.Invalid) == 0 {
+			if err != nil {
+				t.Errorf("%d: unexpected %s", i, err)
+			}
+		} else {
+			ip, ok := client.UserError(err).(usererrors.InvalidParams)
+			if !ok {
+				t.Errorf("%d: expected InvalidParams got %s", i, err)
+				continue
+			}
+
+			var actual []string
+			for _, p := range ip {
+				actual = append(actual, p.Params...)
+			}
+			if !reflect.DeepEqual(actual, test.Invalid) {
+				t.Errorf("%d: invalid=%s, expected %s", i, actual, test.Invalid)
+			}
+		}
+	}
+
+	conversationTests := []struct {
+		Conversation say.Conversation
+		Invalid      []string
+	}{
+		{say.Conversation{Heading: "Foo"}, nil},
+		{say.Conversation{Heading: strings.Repeat("a", 70)}, []string{"heading"}},
+		{say.Conversation{Heading: "Foo \x00"}, nil},
+	}
+
+	for i, test := range conversationTests {
+		err := cli.CreateConversation(&test.Conversation)
+		if len(test.Invalid) == 0 {
+			if err != nil {
+				t.Errorf("%d: unexpected %s", i, err)
+			}
+		} else {
+			ip, ok := client.UserError(err).(usererrors.InvalidParams)
+			if !ok {
+				t.Errorf("%d: expected InvalidParams got %s", i, err)
+				continue
+			}
+
+			var actual []string
+			for _, p := range ip {
+				actual = append(actual, p.Params...)
+			}
+			if !reflect.DeepEqual(actual, test.Invalid) {
+				t.Errorf("%d: invalid=%s, expected %s", i, actual, test.Invalid)
+			}
+		}
+	}
+
+	convo := say.Conversation{Heading: "Foo"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+
+	lineTests := []struct {
+		Line    say.Line
+		Invalid []string
+	}{
+		{},
+		{say.Line{Animal: "foo\x00", MoodName: "bar\x00", Text: "f"}, []string{"animal", "mood"}},
+		{say.Line{Text: strings.Repeat("f", 2000)}, []string{"text"}},
+	}
+
+	for i, test := range lineTests {
+		err := cli.CreateLine(convo.ID, &test.Line)
+		if len(test.Invalid) == 0 {
+			if err != nil {
+				t.Errorf("%d: unexpected %s", i, err)
+			}
+		} else {
+			ip, ok := client.UserError(err).(usererrors.InvalidParams)
+			if !ok {
+				t.Errorf("%d: expected InvalidParams got %s", i, err)
+				continue
+			}
+
+			var actual []string
+			for _, p := range ip {
+				actual = append(actual, p.Params...)
+			}
+			if !reflect.DeepEqual(actual, test.Invalid) {
+				t.Errorf("%d: invalid=%s, expected %s", i, actual, test.Invalid)
+			}
+		}
+	}
+}
+
+func TestAppCowsayLine(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	convo := say.Conversation{Heading: "pasted"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+
+	text := "a fairly long line of text to wrap"
+	cases := []struct {
+		command string
+		expect  say.Line
+	}{
+		{
+			// No mood has the face, so one is created for it
+			"cowsay -f bunny -e '^^' -T 'U ' -W 10 " + text,
+			say.Line{Animal: "bunny", MoodName: "face-5e5e5520", Width: 10, Text: text},
+		},
+		{
+			"cowsay -e ^^ -T U again",
+			say.Line{Animal: "default", MoodName: "face-5e5e5520", Text: "again"},
+		},
+		{
+			"cowthink -d 'I have seen things'",
+			say.Line{Animal: "default", MoodName: "dead", Think: true, Text: "I have seen things"},
+		},
+		{
+			"cowsay -e xx -T 'U ' hello",
+			say.Line{Animal: "default", MoodName: "dead", Text: "hello"},
+		},
+	}
+
+	for i, testcase := range cases {
+		line, err := cli.CreateCowsayLine(convo.ID, testcase.command)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+
+		testcase.expect.ID = line.ID
+		testcase.expect.Output = line.Output
+		if !reflect.DeepEqual(*line, testcase.expect) {
+			t.Errorf("%d: got line %#v but expected %#v", i, *line, testcase.expect)
+		}
+
+		got, err := cli.GetLine(convo.ID, line.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, line) {
+			t.Errorf("%d: got stored line %#v but expected %#v", i, got, line)
+		}
+	}
+
+	if mood, err := cli.GetMood("face-5e5e5520"); err != nil {
+		t.Fatal(err)
+	} else if mood.Eyes != "^^" || mood.Tongue != "U " || !mood.UserDefined {
+		t.Errorf("expected a mood with the face but got %#v", mood)
+	}
+
+	// Existing moods with the face are preferred
+	if err := cli.SetMood(&say.Mood{Name: "happy", Eyes: "**", Tongue: "U "}); err != nil {
+		t.Fatal(err)
+	}
+	happy, err := cli.CreateCowsayLine(convo.ID, "cowsay -e '**' -T 'U ' hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if happy.MoodName != "happy" {
+		t.Errorf("expected the line to use the existing mood but got %#v", happy)
+	}
+
+	narrow, err := cli.CreateCowsayLine(convo.ID, "cowsay -W 10 "+text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wide, err := cli.CreateCowsayLine(convo.ID, "cowsay "+text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(narrow.Output, "\n") <= strings.Count(wide.Output, "\n") {
+		t.Errorf("expected a narrow line to wrap onto more lines than\n%s\nbut got\n%s", wide.Output, narrow.Output)
+	}
+
+	invalid := []string{
+		"cowsay -n hello",
+		"cowsay -f unicorn hello",
+		"cowsay -p hello",
+		"cowsay -e '<<<' hello",
+	}
+	for _, command := range invalid {
+		_, err := cli.CreateCowsayLine(convo.ID, command)
+		if ip, ok := client.UserError(err).(usererrors.InvalidParams); !ok || len(ip) != 1 || ip[0].Params[0] != "command" {
+			t.Errorf("expected an InvalidParams entry for command %q but got %s", command, err)
+		}
+	}
+
+	_, err = cli.CreateCowsayLine("cv_missing", "cowsay lost")
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound for a missing conversation but got %s", err)
+	}
+}
+
+func TestAppEvents(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestServer(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	convo := say.Conversation{Heading: "live"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := cli.StreamEvents(convo.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := say.Line{Text: "hello"}
+	if err := cli.CreateLine(convo.ID, &line); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.DeleteLine(convo.ID, line.ID); err != nil {
+		t.Fatal(err)
+	}
+	convo.Heading = "still live"
+	if err := cli.UpdateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+
+	var created say.Line
+	expectEvent(t, stream, say.EventLineCreated, &created)
+	if !reflect.DeepEqual(created, line) {
+		t.Errorf("got created line %#v but expected %#v", created, line)
+	}
+	var deleted say.Line
+	expectEvent(t, stream, say.EventLineDeleted, &deleted)
+	if deleted.ID != line.ID {
+		t.Errorf("got deleted line %q but expected %q", deleted.ID, line.ID)
+	}
+	var updated say.Conversation
+	expectEvent(t, stream, say.EventConvoUpdated, &updated)
+	if updated.ID != convo.ID || updated.Heading != convo.Heading {
+		t.Errorf("got updated conversation %#v but expected %#v", updated, convo)
+	}
+
+	// Resume after missing an event
+	lastID := stream.LastID()
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	missed := say.Line{Text: "missed"}
+	if err := cli.CreateLine(convo.ID, &missed); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err = cli.StreamEvents(convo.ID, lastID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, stream, say.EventLineCreated, &created)
+	if created.ID != missed.ID {
+		t.Errorf("got resumed line %q but expected %q", created.ID, missed.ID)
+	}
+	stream.Close()
+
+	stream, err = cli.StreamEvents(convo.ID, "unknown-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, stream, say.EventStreamReset, nil)
+
+	// Streams end when the app shuts down
+	cli.App.CloseStreams()
+	if _, err := stream.Next(); err != io.EOF {
+		t.Errorf("expected the stream to end but got %v", err)
+	}
+
+	if _, err := cli.StreamEvents("cv_missing", ""); err == nil {
+		t.Error("expected an error streaming a missing conversation")
+	}
+}
+
+func expectEvent(t *testing.T, stream *client.EventStream, typ string, data interface{}) {
+	done := make(chan struct{})
+	var ev *say.Event
+	var err error
+	go func() {
+		defer close(done)
+		ev, err = stream.Next()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a %s event", typ)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != typ {
+		t.Fatalf("got a %s event but expected %s", ev.Type, typ)
+	}
+	if data != nil {
+		if err := json.Unmarshal(ev.Data, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAppSession(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestServer(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	convo := say.Conversation{Heading: "improv"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err := cli.JoinSession(convo.ID, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	welcome := receiveSession(t, alice, 1)[say.SessionWelcome]
+	if welcome == nil || welcome.Member.Name != "alice" || len(welcome.Members) != 1 {
+		t.Fatalf("got welcome %#v", welcome)
+	}
+
+	bob, err := cli.JoinSession(convo.ID, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiveSession(t, bob, 1)
+	presence := receiveSession(t, alice, 1)[say.SessionPresence]
+	if presence == nil || len(presence.Members) != 2 || presence.Members[1].Name != "bob" {
+		t.Fatalf("got presence %#v", presence)
+	}
+
+	if err := bob.SetTyping(true); err != nil {
+		t.Fatal(err)
+	}
+	typing := receiveSession(t, alice, 1)[say.SessionTyping]
+	if typing == nil || typing.Member.Name != "bob" || !typing.Member.Typing {
+		t.Fatalf("got typing %#v", typing)
+	}
+
+	// Bob gets the line and the event; Alice gets the event and the end
+	// of Bob's typing, in either order.
+	if err := bob.CreateLine("r1", &say.Line{Text: "moo", MoodName: "dead"}); err != nil {
+		t.Fatal(err)
+	}
+	msgs := receiveSession(t, bob, 2)
+	line := msgs[say.SessionLine]
+	if line == nil || line.Ref != "r1" || line.Line.ID == "" || line.Line.MoodName != "dead" || line.Line.Output == "" {
+		t.Fatalf("got line %#v", line)
+	}
+	var created say.Line
+	expectSessionEvent(t, msgs[say.SessionEvent], say.EventLineCreated, &created)
+	if !reflect.DeepEqual(created, *line.Line) {
+		t.Errorf("got created line %#v but expected %#v", created, *line.Line)
+	}
+
+	msgs = receiveSession(t, alice, 2)
+	expectSessionEvent(t, msgs[say.SessionEvent], say.EventLineCreated, nil)
+	if typing := msgs[say.SessionTyping]; typing == nil || typing.Member.Typing {
+		t.Errorf("expected bob to stop typing but got %#v", typing)
+	}
+
+	// Lines created outside of the session are seen too
+	if err := cli.CreateLine(convo.ID, &say.Line{Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	expectSessionEvent(t, receiveSession(t, alice, 1)[say.SessionEvent], say.EventLineCreated, nil)
+	receiveSession(t, bob, 1)
+
+	if err := bob.CreateLine("r2", &say.Line{MoodName: "cv_missing"}); err != nil {
+		t.Fatal(err)
+	}
+	errMsg := receiveSession(t, bob, 1)[say.SessionError]
+	if errMsg == nil || errMsg.Ref != "r2" {
+		t.Fatalf("got error %#v", errMsg)
+	}
+	uerr, err := usererrors.UnmarshalJSON(errMsg.Error)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := uerr.(usererrors.InvalidParams); !ok {
+		t.Errorf("expected invalid params but got %#v", uerr)
+	}
+
+	if err := bob.Close(); err != nil {
+		t.Fatal(err)
+	}
+	presence = receiveSession(t, alice, 1)[say.SessionPresence]
+	if presence == nil || len(presence.Members) != 1 {
+		t.Fatalf("got presence %#v", presence)
+	}
+
+	// Sessions end when the app shuts down
+	cli.App.CloseStreams()
+	if _, err := alice.Receive(); err == nil {
+		t.Error("expected the session to end")
+	}
+
+	if _, err := cli.JoinSession("cv_missing", ""); err == nil {
+		t.Error("expected an error joining a missing conversation")
+	}
+}
+
+func TestAppSessionRateLimit(t *testing.T) {
+	t.Parallel()
+
+	limited := cfg
+	limited.SessionPerMinute = 1
+	limited.SessionRateBurst = 1
+
+	cli, err := client.NewTestServer(&limited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	convo := say.Conversation{Heading: "too fast"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := cli.JoinSession(convo.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	receiveSession(t, sess, 1)
+
+	// Typing indicators aren't echoed, so the only replies are errors
+	for i := 0; i < 5; i++ {
+		if err := sess.SetTyping(i%2 == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errMsg := receiveSession(t, sess, 1)[say.SessionError]
+	if errMsg == nil {
+		t.Fatal("expected an error")
+	}
+	uerr, err := usererrors.UnmarshalJSON(errMsg.Error)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := uerr.(say.RateLimited); !ok {
+		t.Errorf("expected a rate limit error but got %#v", uerr)
+	}
+}
+
+// receiveSession receives count messages from a session and returns
+// them by type.
+func receiveSession(t *testing.T, sess *client.Session, count int) map[string]*say.SessionMessage {
+	msgs := make(map[string]*say.SessionMessage)
+	for i := 0; i < count; i++ {
+		done := make(chan struct{})
+		var msg *say.SessionMessage
+		var err error
+		go func() {
+			defer close(done)
+			msg, err = sess.Receive()
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a session message")
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := msgs[msg.Type]; ok {
+			t.Fatalf("got a second %s message", msg.Type)
+		}
+		msgs[msg.Type] = msg
+	}
+	return msgs
+}
+
+func expectSessionEvent(t *testing.T, msg *say.SessionMessage, typ string, data interface{}) {
+	if msg == nil || msg.Event == nil {
+		t.Fatalf("expected a %s event but got %#v", typ, msg)
+	}
+	if msg.Event.Type != typ {
+		t.Fatalf("got a %s event but expected %s", msg.Event.Type, typ)
+	}
+	if data != nil {
+		if err := json.Unmarshal(msg.Event.Data, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAppWebhooks(t *testing.T) {
+	t.Parallel()
+
+	cli, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	type received struct {
+		header  http.Header
+		body    []byte
+		payload say.WebhookPayload
+	}
+
+	// The receiver fails the first request to exercise retries
+	requests := make(chan received, 10)
+	var mu sync.Mutex
+	failed := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		var payload say.WebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+		requests <- received{r.Header, body, payload}
+	}))
+	defer receiver.Close()
+
+	if _, err := cli.CreateWebhook("ftp://example.com"); err == nil {
+		t.Error("expected an error creating a webhook with an invalid URL")
+	}
+	if _, err := cli.CreateWebhook("http://169.254.169.254/latest"); err == nil {
+		t.Error("expected an error creating a webhook for a link-local address")
+	}
+
+	hook, err := cli.CreateWebhook(receiver.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hook.Secret, "whsec_") {
+		t.Errorf("got secret %q", hook.Secret)
+	}
+
+	receive := func() received {
+		select {
+		case req := <-requests:
+			got := req.header.Get(say.WebhookSignatureHeader)
+			var timestamp int64
+			if _, err := fmt.Sscanf(got, "t=%d,", &timestamp); err != nil {
+				t.Errorf("got signature %q without a timestamp", got)
+			} else if age := time.Now().Unix() - timestamp; age < -5 || age > 60 {
+				t.Errorf("got signature %q with a timestamp %ds old", got, age)
+			}
+			if sig := say.WebhookSignature(hook.Secret, timestamp, req.body); got != sig {
+				t.Errorf("got signature %q but expected %q", got, sig)
+			}
+			if got := req.header.Get(say.WebhookEventHeader); got != req.payload.Type {
+				t.Errorf("got event header %q for a %s event", got, req.payload.Type)
+			}
+			return req
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a webhook")
+		}
+		return received{}
+	}
+
+	convo := say.Conversation{Heading: "mirrored"}
+	if err := cli.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+
+	created := receive()
+	if created.payload.Type != say.EventConvoCreated || created.payload.ConversationID != convo.ID {
+		t.Fatalf("got payload %#v", created.payload)
+	}
+	createdID := created.header.Get(say.WebhookDeliveryHeader)
+
+	line := say.Line{Text: "hello"}
+	if err := cli.CreateLine(convo.ID, &line); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.DeleteLine(convo.ID, line.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.DeleteConversation(convo.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deliveries may arrive in any order
+	types := make(map[string]say.WebhookPayload)
+	for i := 0; i < 3; i++ {
+		req := receive()
+		types[req.payload.Type] = req.payload
+	}
+	var createdLine say.Line
+	if err := json.Unmarshal(types[say.EventLineCreated].Data, &createdLine); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(createdLine, line) {
+		t.Errorf("got created line %#v but expected %#v", createdLine, line)
+	}
+	for _, typ := range []string{say.EventLineDeleted, say.EventConvoDeleted} {
+		if payload, ok := types[typ]; !ok || payload.ConversationID != convo.ID {
+			t.Errorf("got %s payload %#v", typ, payload)
+		}
+	}
+
+	var deliveries []say.WebhookDelivery
+	iter := cli.ListDeliveries(hook.ID, client.ListParams{})
+	for iter.Next() {
+		deliveries = append(deliveries, iter.WebhookDelivery())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 4 {
+		t.Fatalf("expected 4 deliveries but got %d", len(deliveries))
+	}
+
+	first := deliveries[len(deliveries)-1]
+	if first.ID != createdID || first.Type != say.EventConvoCreated {
+		t.Errorf("expected the oldest delivery to be %q but got %#v", createdID, first)
+	}
+	if first.Status != say.DeliveryDelivered || first.Attempts != 2 ||
+		first.ResponseCode == nil || *first.ResponseCode != http.StatusOK {
+		t.Errorf("got delivery %#v", first)
+	}
+
+	hooks, err := cli.ListWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 1 || hooks[0].ID != hook.ID || hooks[0].Secret != "" {
+		t.Errorf("got webhooks %#v", hooks)
+	}
+
+	if err := cli.DeleteWebhook(hook.ID); err != nil {
+		t.Fatal(err)
+	}
+	iter = cli.ListDeliveries(hook.ID, client.ListParams{})
+	if iter.Next() || iter.Err() == nil {
+		t.Error("expected an error listing the deliveries of a deleted webhook")
+	}
+}
+
+func TestAppWebhooksRoles(t *testing.T) {
+	t.Parallel()
+
+	clients := make([]*client.TestClient, 3)
+	for i := range clients {
+		cli, err := client.NewTestClient(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		if err := cli.Authorize(); err != nil {
+			t.Fatal(err)
+		}
+		clients[i] = cli
+	}
+	owner, editor, viewer := clients[0], clients[1], clients[2]
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+
+	convo := say.Conversation{Heading: "watched"}
+	if err := owner.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+
+	members := map[string]*client.TestClient{say.RoleEditor: editor, say.RoleViewer: viewer}
+	hooks := make(map[string]*say.Webhook)
+	for role, cli := range members {
+		invite, err := owner.CreateInvite(convo.ID, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cli.AcceptInvite(invite.Token); err != nil {
+			t.Fatal(err)
+		}
+		if hooks[role], err = cli.CreateWebhook(receiver.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Deliveries are queued along with the change
+	line := say.Line{Text: "hello"}
+	if err := owner.CreateLine(convo.ID, &line); err != nil {
+		t.Fatal(err)
+	}
+
+	for role, want := range map[string]int{say.RoleEditor: 1, say.RoleViewer: 0} {
+		var deliveries []say.WebhookDelivery
+		iter := members[role].ListDeliveries(hooks[role].ID, client.ListParams{})
+		for iter.Next() {
+			deliveries = append(deliveries, iter.WebhookDelivery())
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != want {
+			t.Errorf("expected %d deliveries to the %s's webhook but got %d", want, role, len(deliveries))
+		}
+	}
+}
+
+func TestAppMembers(t *testing.T) {
+	t.Parallel()
+
+	clients := make([]*client.TestClient, 4)
+	for i := range clients {
+		cli, err := client.NewTestClient(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		if err := cli.Authorize(); err != nil {
+			t.Fatal(err)
+		}
+		clients[i] = cli
+	}
+	owner, editor, viewer, stranger := clients[0], clients[1], clients[2], clients[3]
+
+	convo := say.Conversation{Heading: "co-written"}
+	if err := owner.CreateConversation(&convo); err != nil {
+		t.Fatal(err)
+	}
+	if convo.Role != say.RoleOwner {
+		t.Errorf("expected the creator to be an owner but got %q", convo.Role)
+	}
+
+	if _, err := owner.CreateInvite(convo.ID, "admin"); err == nil {
+		t.Error("expected an error inviting with an invalid role")
+	}
+
+	editorInvite, err := owner.CreateInvite(convo.ID, say.RoleEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewerInvite, err := owner.CreateInvite(convo.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if viewerInvite.Role != say.RoleViewer {
+		t.Errorf("expected a viewer invite but got %q", viewerInvite.Role)
+	}
+
+	invites, err := owner.ListInvites(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(invites, []say.Invite{*editorInvite, *viewerInvite}) {
+		t.Errorf("got invites %#v", invites)
+	}
+
+	joined, err := editor.AcceptInvite(editorInvite.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined.ID != convo.ID || joined.Role != say.RoleEditor {
+		t.Errorf("expected to join as an editor but got %#v", joined)
+	}
+	if _, err := viewer.AcceptInvite(viewerInvite.Token); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invites can only be used once
+	if _, err := stranger.AcceptInvite(editorInvite.Token); err == nil {
+		t.Error("expected an error accepting a used invite")
+	}
+	if _, err := stranger.AcceptInvite(editorInvite.ID); err == nil {
+		t.Error("expected an error accepting an invalid token")
+	}
+
+	// Editors can add lines but not change the conversation
+	line := say.Line{Text: "written by the editor"}
+	if err := editor.CreateLine(convo.ID, &line); err != nil {
+		t.Fatal(err)
+	}
+	err = editor.UpdateConversation(&say.Conversation{ID: convo.ID, Heading: "taken over"})
+	if uerr, ok := client.UserError(err).(say.RoleRequired); !ok || uerr.Role != say.RoleOwner {
+		t.Errorf("expected RoleRequired for an editor but got %s", err)
+	}
+
+	// Viewers can read but not write
+	read, err := viewer.GetConversation(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Role != say.RoleViewer || len(read.Lines) != 1 || read.Lines[0].ID != line.ID {
+		t.Errorf("expected the viewer to see the editor's line but got %#v", read)
+	}
+	err = viewer.CreateLine(convo.ID, &say.Line{Text: "not allowed"})
+	if uerr, ok := client.UserError(err).(say.RoleRequired); !ok || uerr.Role != say.RoleEditor {
+		t.Errorf("expected RoleRequired for a viewer but got %s", err)
+	}
+	err = viewer.DeleteLine(convo.ID, line.ID)
+	if _, ok := client.UserError(err).(say.RoleRequired); !ok {
+		t.Errorf("expected RoleRequired for a viewer but got %s", err)
+	}
+
+	// The conversation doesn't exist for anyone else
+	if _, err := stranger.GetConversation(convo.ID); err == nil {
+		t.Error("expected an error reading the conversation of others")
+	}
+	err = stranger.CreateLine(convo.ID, &say.Line{Text: "not allowed"})
+	if _, ok := client.UserError(err).(usererrors.NotFound); !ok {
+		t.Errorf("expected NotFound for a stranger but got %s", err)
+	}
+
+	members, err := viewer.ListMembers(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 {
+		t.Fatalf("expected 3 members but got %#v", members)
+	}
+	roles := []string{say.RoleOwner, say.RoleEditor, say.RoleViewer}
+	for i, member := range members {
+		if member.Role != roles[i] || member.Self != (i == 2) {
+			t.Errorf("%d: got member %#v", i, member)
+		}
+	}
+
+	// Only owners manage members, and the last owner must stay one
+	_, err = editor.UpdateMember(convo.ID, members[2].ID, say.RoleEditor)
+	if _, ok := client.UserError(err).(say.RoleRequired); !ok {
+		t.Errorf("expected RoleRequired for an editor but got %s", err)
+	}
+	_, err = owner.UpdateMember(convo.ID, members[0].ID, say.RoleViewer)
+	if _, ok := client.UserError(err).(usererrors.ActionNotAllowed); !ok {
+		t.Errorf("expected ActionNotAllowed demoting the last owner but got %s", err)
+	}
+	promoted, err := owner.UpdateMember(convo.ID, members[2].ID, say.RoleEditor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promoted.Role != say.RoleEditor || promoted.Self {
+		t.Errorf("got member %#v", promoted)
+	}
+
+	// Members can leave but only owners can remove others
+	if err := editor.DeleteMember(convo.ID, members[2].ID); err == nil {
+		t.Error("expected an error removing another member as an editor")
+	}
+	if err := viewer.DeleteMember(convo.ID, members[2].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := viewer.GetConversation(convo.ID); err == nil {
+		t.Error("expected an error reading the conversation after leaving")
+	}
+	if err := owner.DeleteMember(convo.ID, members[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := editor.CreateLine(convo.ID, &say.Line{Text: "removed"}); err == nil {
+		t.Error("expected an error writing after being removed")
+	}
+
+	if err := owner.RevokeInvite(convo.ID, viewerInvite.ID); err == nil {
+		t.Error("expected an error revoking an accepted invite")
+	}
+	invites, err = owner.ListInvites(convo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invites) != 0 {
+		t.Errorf("expected no invites but got %#v", invites)
+	}
+}
+
+func TestAppQuotas(t *testing.T) {
+	t.Parallel()
+
+	limited := cfg
+	limited.MaxConversations = 2
+	limited.MaxConversationLines = 2
+	limited.MaxMoods = 1
+	limited.MaxTextBytes = 20
+
+	cli, err := client.NewTestClient(&limited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectQuota := func(err error, quota string, usage int64) {
+		uerr, ok := client.UserError(err).(say.QuotaExceeded)
+		if !ok {
+			t.Errorf("expected QuotaExceeded but got %v", err)
+			return
+		}
+		if uerr.Quota != quota || uerr.Usage != usage {
+			t.Errorf("expected %s quota with usage %d but got %#v", quota, usage, uerr)
+		}
+	}
+
+	if err := cli.SetMood(&say.Mood{Name: "happy", Eyes: "^^", Tongue: "  "}); err != nil {
+		t.Fatal(err)
+	}
+	expectQuota(cli.SetMood(&say.Mood{Name: "sad", Eyes: "..", Tongue: "  "}), say.QuotaMoods, 1)
+	// Replacing a mood doesn't add to the usage
+	if err := cli.SetMood(&say.Mood{Name: "happy", Eyes: "^o", Tongue: "  "}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := say.Conversation{Heading: "first"}
+	if err := cli.CreateConversation(&first); err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"hello", "world"} {
+		if err := cli.CreateLine(first.ID, &say.Line{Text: text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectQuota(cli.CreateLine(first.ID, &say.Line{Text: "!"}), say.QuotaLinesPerConversation, 2)
+
+	second := say.Conversation{Heading: "second"}
+	if err := cli.CreateConversation(&second); err != nil {
+		t.Fatal(err)
+	}
+	expectQuota(cli.CreateLine(second.ID, &say.Line{Text: "hello again"}), say.QuotaTextBytes, 10)
+	line := say.Line{Text: "0123456789"}
+	if err := cli.CreateLine(second.ID, &line); err != nil {
+		t.Fatal(err)
+	}
+
+	// Edits keep the prior text as a revision
+	text := "0"
+	_, err = cli.UpdateLine(second.ID, line.ID, client.LineUpdateParams{Text: &text})
+	expectQuota(err, say.QuotaTextBytes, 20)
+
+	// Conversations in the trash still count
+	if err := cli.DeleteConversation(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	expectQuota(cli.CreateConversation(&say.Conversation{Heading: "third"}), say.QuotaConversations, 2)
+	_, err = cli.ForkConversation(first.ID, client.ForkParams{})
+	expectQuota(err, say.QuotaConversations, 2)
+
+	usage, err := cli.GetUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, entry := range map[string]say.UsageEntry{
+		say.QuotaConversations:        usage.Conversations,
+		say.QuotaLinesPerConversation: usage.LinesPerConversation,
+		say.QuotaMoods:                usage.Moods,
+		say.QuotaTextBytes:            usage.TextBytes,
+	} {
+		if entry.Limit == nil || entry.Used != *entry.Limit {
+			t.Errorf("expected %s to be used up but got %#v", name, entry)
+		}
+	}
+
+	unlimited, err := client.NewTestClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlimited.Close()
+	if err := unlimited.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err = unlimited.GetUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Conversations.Used != 0 || usage.Conversations.Limit != nil {
+		t.Errorf("expected no usage or limit but got %#v", usage.Conversations)
+	}
+}
+
+func TestAppQuotasConcurrent(t *testing.T) {
+	t.Parallel()
+
+	limited := cfg
+	limited.MaxConversations = 1
+
+	cli, err := client.NewTestClient(&limited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.Authorize(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes that each fit the quota can't exceed it together
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- cli.CreateConversation(&say.Conversation{Heading: "racing"})
+		}()
+	}
+
+	created := 0
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err == nil {
+			created++
+		} else if _, ok := client.UserError(err).(say.QuotaExceeded); !ok {
+			t.Errorf("expected QuotaExceeded but got %v", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("expected 1 conversation to be created but got %d", created)
 	}
 }
@@ -0,0 +1,544 @@
+package say
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"goji.io/pat"
+
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	scriptThink        = "think"
+	scriptWidth        = "width="
+	scriptFacing       = "facing="
+	scriptSyntaxMsg    = `must be of the form "animal[mood,think]: text"`
+	scriptCharacterMsg = `must be of the form "@name = animal[mood,facing=right]"`
+)
+
+// scriptLine is a line of a script with its parameters as they would be
+// provided to CreateLine or, for character definitions, to
+// CreateCharacter.
+type scriptLine struct {
+	number int
+	form   url.Values
+}
+
+// scriptOption is one of the bracketed options of a script line.
+// Quoted options are always moods.
+type scriptOption struct {
+	value  string
+	quoted bool
+}
+
+// ImportScript creates a conversation from the screenplay in the
+// `script` parameter. Each line of the script has the form
+// `animal[mood,think,width=30]: text`, where the bracketed options are
+// optional and `\n` in the text stands for a newline. Moods may be
+// quoted as `"mood"`. Lines of the form `@Name = animal[mood,facing=right]`
+// define characters, whose lines start with `@Name` in place of the
+// animal; names may also be quoted. An optional first line of the form
+// `# Heading` sets the heading. Blank lines are ignored.
+func (c *Controller) ImportScript(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	heading, scharacters, slines, uerr := parseScript(r.PostFormValue("script"))
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	report := func(number int, entries usererrors.InvalidParams) {
+		for _, entry := range entries {
+			uerr = append(uerr, usererrors.InvalidParamsEntry{
+				Params:  []string{"script"},
+				Message: fmt.Sprintf("line %d: %s %s", number, strings.Join(entry.Params, ", "), entry.Message),
+			})
+		}
+	}
+
+	heading = strings.Replace(heading, "\x00", "", -1)
+	if utf8.RuneCountInString(heading) > maxHeadingLength {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"script"},
+			Message: fmt.Sprintf("heading must be a string of less than %d characters", maxHeadingLength),
+		})
+	}
+
+	if len(scharacters) > maxCharacters {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"script"},
+			Message: fmt.Sprintf("scripts may define no more than %d characters", maxCharacters),
+		})
+	}
+
+	characters := make([]*Character, len(scharacters))
+	byName := make(map[string]*Character, len(scharacters))
+	for i, sc := range scharacters {
+		character := &Character{
+			Name:     strings.Replace(sc.form.Get("name"), "\x00", "", -1),
+			Animal:   sc.form.Get("animal"),
+			MoodName: strings.Replace(sc.form.Get("mood"), "\x00", "", -1),
+			Facing:   sc.form.Get("facing"),
+		}
+
+		charErr := c.validateCharacter(character)
+
+		moodErr, err := c.resolveMood(userID, &Line{MoodName: character.MoodName}, "")
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+		charErr = append(charErr, moodErr...)
+
+		if _, ok := byName[character.Name]; ok {
+			charErr = append(charErr, usererrors.InvalidParamsEntry{
+				Params:  []string{"name"},
+				Message: fmt.Sprintf("%q is already a character in the script", character.Name),
+			})
+		}
+		report(sc.number, charErr)
+
+		characters[i] = character
+		byName[character.Name] = character
+	}
+
+	lines := make([]Line, len(slines))
+	for i, sl := range slines {
+		line := &lines[i]
+		line.Animal = "default"
+		line.MoodName = "default"
+
+		var lineErr usererrors.InvalidParams
+		if name, ok := sl.form["character"]; ok {
+			if character := byName[name[0]]; character != nil {
+				applyCharacter(line, character)
+			} else {
+				lineErr = append(lineErr, usererrors.InvalidParamsEntry{
+					Params:  []string{"character"},
+					Message: fmt.Sprintf("%q is not defined in the script", name[0]),
+				})
+			}
+		}
+
+		lineErr = append(lineErr, c.parseLine(sl.form, line)...)
+
+		moodErr, err := c.resolveMood(userID, line, "")
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+		lineErr = append(lineErr, moodErr...)
+
+		report(sl.number, lineErr)
+	}
+
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	imported := c.convoCreated()
+	convo, err := c.repo.ImportConversation(userID, heading, characters, lines, nil, imported)
+	if uerr, ok := err.(QuotaExceeded); ok {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	// The lines were rendered for the event
+	c.publishEvent(ctx, convo.ID, imported)
+
+	respond.Data(ctx, w, http.StatusOK, convo)
+}
+
+// GetScript emits a conversation in the script format accepted by
+// ImportScript.
+func (c *Controller) GetScript(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	convo, err := c.repo.GetConversation(userID, convoID, -1)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if convo == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	characters, err := c.repo.ListCharacters(userID, convoID)
+	if err == errRecordNotFound {
+		respond.NotFound(ctx, w, r)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Raw(ctx, w, http.StatusOK, "text/plain; charset=utf-8", formatScript(convo.Heading, characters, convo.Lines))
+}
+
+// parseScript splits a script into its heading, character definitions
+// and lines. Only the syntax is checked here; the values are validated
+// like any other character or line parameters.
+func parseScript(script string) (string, []scriptLine, []scriptLine, usererrors.InvalidParams) {
+	var heading string
+	var characters, lines []scriptLine
+	var uerr usererrors.InvalidParams
+
+	invalid := func(number int, format string, args ...interface{}) {
+		uerr = append(uerr, usererrors.InvalidParamsEntry{
+			Params:  []string{"script"},
+			Message: fmt.Sprintf("line %d: %s", number, fmt.Sprintf(format, args...)),
+		})
+	}
+
+	seenContent := false
+	for i, raw := range strings.Split(script, "\n") {
+		number := i + 1
+		raw = strings.TrimSuffix(raw, "\r")
+
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+
+		if strings.HasPrefix(raw, "#") {
+			if seenContent {
+				invalid(number, "the heading must come before every line")
+			} else {
+				heading = unescapeScript(strings.TrimSpace(raw[1:]))
+			}
+			seenContent = true
+			continue
+		}
+		seenContent = true
+
+		form := url.Values{}
+		var rest string
+		if strings.HasPrefix(raw, "@") {
+			var name, msg string
+			name, rest, msg = parseScriptName(raw[1:])
+			if msg != "" {
+				invalid(number, msg)
+				continue
+			}
+
+			if def := strings.TrimLeft(rest, " \t"); strings.HasPrefix(def, "=") {
+				form.Set("name", name)
+				if msg := parseScriptCharacter(def[1:], form); msg != "" {
+					invalid(number, msg)
+				} else {
+					characters = append(characters, scriptLine{number, form})
+				}
+				continue
+			}
+
+			if name == "" {
+				invalid(number, "must name a character")
+				continue
+			}
+			form.Set("character", name)
+		} else {
+			i := strings.IndexAny(raw, "[:")
+			if i < 0 {
+				invalid(number, scriptSyntaxMsg)
+				continue
+			}
+
+			animal := strings.TrimSpace(raw[:i])
+			if animal == "" {
+				invalid(number, "must start with an animal")
+				continue
+			}
+			form.Set("animal", animal)
+			rest = raw[i:]
+		}
+
+		if len(lines) == maxBundleLines {
+			invalid(number, "scripts may contain no more than %d lines", maxBundleLines)
+			break
+		}
+
+		rest = strings.TrimLeft(rest, " \t")
+		if strings.HasPrefix(rest, "[") {
+			var options []scriptOption
+			var msg string
+			options, rest, msg = parseScriptOptions(rest[1:])
+			if msg == "" {
+				msg = setScriptOptions(form, options, false)
+			}
+			if msg != "" {
+				invalid(number, msg)
+				continue
+			}
+		}
+
+		rest = strings.TrimLeft(rest, " \t")
+		if !strings.HasPrefix(rest, ":") {
+			invalid(number, scriptSyntaxMsg)
+			continue
+		}
+		form.Set("text", unescapeScript(strings.TrimPrefix(rest[1:], " ")))
+
+		lines = append(lines, scriptLine{number, form})
+	}
+
+	return heading, characters, lines, uerr
+}
+
+// parseScriptName reads the character name at the start of s, which
+// may be quoted, returning the name and the rest of s. It returns a
+// message if the name is malformed.
+func parseScriptName(s string) (string, string, string) {
+	s = strings.TrimLeft(s, " \t")
+	if strings.HasPrefix(s, `"`) {
+		name, rest, ok := unquoteScript(s)
+		if !ok {
+			return "", "", "has an unterminated quote"
+		}
+		return name, rest, ""
+	}
+
+	i := strings.IndexAny(s, "=[:")
+	if i < 0 {
+		return "", "", scriptSyntaxMsg
+	}
+	return strings.TrimSpace(s[:i]), s[i:], ""
+}
+
+// parseScriptCharacter reads the animal and options of a character
+// definition into form. It returns a message if they are malformed.
+func parseScriptCharacter(s string, form url.Values) string {
+	animal, rest := s, ""
+	if i := strings.Index(s, "["); i >= 0 {
+		animal, rest = s[:i], s[i:]
+	}
+	form.Set("animal", strings.TrimSpace(animal))
+
+	if rest == "" {
+		return ""
+	}
+
+	options, rest, msg := parseScriptOptions(rest[1:])
+	if msg != "" {
+		return msg
+	}
+	if strings.TrimSpace(rest) != "" {
+		return scriptCharacterMsg
+	}
+	return setScriptOptions(form, options, true)
+}
+
+// setScriptOptions sets the parameters given by the options of a line
+// or, if definition is set, a character definition. Any other option
+// is a mood. It returns a message if there is more than one mood.
+func setScriptOptions(form url.Values, options []scriptOption, definition bool) string {
+	for _, opt := range options {
+		switch {
+		case opt.quoted:
+		case opt.value == "":
+			continue
+		case definition && strings.HasPrefix(opt.value, scriptFacing):
+			form.Set("facing", strings.TrimPrefix(opt.value, scriptFacing))
+			continue
+		case !definition && strings.EqualFold(opt.value, scriptThink):
+			form.Set("think", "true")
+			continue
+		case !definition && strings.HasPrefix(opt.value, scriptWidth):
+			form.Set("width", strings.TrimPrefix(opt.value, scriptWidth))
+			continue
+		}
+
+		if _, dup := form["mood"]; dup {
+			return fmt.Sprintf("may have only one mood but has %q and %q", form.Get("mood"), opt.value)
+		}
+		form.Set("mood", opt.value)
+	}
+
+	return ""
+}
+
+// formatScript writes a heading, character definitions and lines in
+// the script format. Moods are omitted for lines in the default mood
+// or, for a character's lines, in the character's mood.
+func formatScript(heading string, characters []Character, lines []Line) []byte {
+	var buf bytes.Buffer
+
+	if heading != "" {
+		fmt.Fprintf(&buf, "# %s\n\n", escapeScript(heading))
+	}
+
+	byName := make(map[string]*Character, len(characters))
+	for i, character := range characters {
+		byName[character.Name] = &characters[i]
+
+		var options []string
+		if !strings.EqualFold(character.MoodName, "default") {
+			options = append(options, formatScriptMood(character.MoodName))
+		}
+		if character.Facing != "" && character.Facing != FacingLeft {
+			options = append(options, scriptFacing+character.Facing)
+		}
+
+		fmt.Fprintf(&buf, "@%s = %s", formatScriptName(character.Name), character.Animal)
+		if len(options) > 0 {
+			fmt.Fprintf(&buf, "[%s]", strings.Join(options, ","))
+		}
+		buf.WriteString("\n")
+	}
+	if len(characters) > 0 {
+		buf.WriteString("\n")
+	}
+
+	for _, line := range lines {
+		character := byName[line.Character]
+
+		defaultMood := "default"
+		if character != nil {
+			defaultMood = character.MoodName
+		}
+
+		var options []string
+		if !strings.EqualFold(line.MoodName, defaultMood) {
+			options = append(options, formatScriptMood(line.MoodName))
+		}
+		if line.Think {
+			options = append(options, scriptThink)
+		}
+		if line.Width != 0 {
+			options = append(options, fmt.Sprintf("%s%d", scriptWidth, line.Width))
+		}
+
+		if character != nil {
+			fmt.Fprintf(&buf, "@%s", formatScriptName(character.Name))
+		} else {
+			buf.WriteString(line.Animal)
+		}
+		if len(options) > 0 {
+			fmt.Fprintf(&buf, "[%s]", strings.Join(options, ","))
+		}
+		fmt.Fprintf(&buf, ": %s\n", escapeScript(line.Text))
+	}
+
+	return buf.Bytes()
+}
+
+// parseScriptOptions splits the comma-separated options at the start
+// of s up to the closing ']', returning the options and the rest of s.
+// Options in double quotes may contain any character, escaped as in
+// text with `\"` for a quote. It returns a message if the options are
+// malformed.
+func parseScriptOptions(s string) ([]scriptOption, string, string) {
+	var options []scriptOption
+
+	for {
+		s = strings.TrimLeft(s, " \t")
+
+		var opt scriptOption
+		if strings.HasPrefix(s, `"`) {
+			var ok bool
+			opt.value, s, ok = unquoteScript(s)
+			if !ok {
+				return nil, "", "has an unterminated quote"
+			}
+			opt.quoted = true
+			s = strings.TrimLeft(s, " \t")
+		} else {
+			i := strings.IndexAny(s, ",]")
+			if i < 0 {
+				return nil, "", "is missing a closing ']'"
+			}
+			opt.value = strings.TrimSpace(s[:i])
+			s = s[i:]
+		}
+		options = append(options, opt)
+
+		switch {
+		case strings.HasPrefix(s, ","):
+			s = s[1:]
+		case strings.HasPrefix(s, "]"):
+			return options, s[1:], ""
+		case s == "":
+			return nil, "", "is missing a closing ']'"
+		default:
+			return nil, "", scriptSyntaxMsg
+		}
+	}
+}
+
+// formatScriptMood quotes a mood name if it would otherwise be read as
+// another option or would not survive parsing.
+func formatScriptMood(name string) string {
+	if name == "" || strings.TrimSpace(name) != name || strings.ContainsAny(name, ",]\"\\\n\r") ||
+		strings.EqualFold(name, scriptThink) || strings.HasPrefix(name, scriptWidth) ||
+		strings.HasPrefix(name, scriptFacing) {
+		return quoteScript(name)
+	}
+	return name
+}
+
+// formatScriptName quotes a character name if it would otherwise not
+// survive parsing.
+func formatScriptName(name string) string {
+	if name == "" || strings.TrimSpace(name) != name || strings.ContainsAny(name, "=[:\"\\\n\r") {
+		return quoteScript(name)
+	}
+	return name
+}
+
+var (
+	scriptEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+	scriptUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r")
+	scriptQuoter    = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+)
+
+func quoteScript(s string) string {
+	return `"` + scriptQuoter.Replace(s) + `"`
+}
+
+// unquoteScript reads the quoted value at the start of s, returning
+// the value and the rest of s after the closing quote.
+func unquoteScript(s string) (string, string, bool) {
+	var buf bytes.Buffer
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return buf.String(), s[i+1:], true
+		case '\\':
+			if i++; i == len(s) {
+				return "", "", false
+			}
+			switch s[i] {
+			case 'n':
+				buf.WriteByte('\n')
+			case 'r':
+				buf.WriteByte('\r')
+			default:
+				buf.WriteByte(s[i])
+			}
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+	return "", "", false
+}
+
+func escapeScript(s string) string {
+	return scriptEscaper.Replace(s)
+}
+
+func unescapeScript(s string) string {
+	return scriptUnescaper.Replace(s)
+}
@@ -0,0 +1,172 @@
+package say
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseScript(t *testing.T) {
+	script := strings.Join([]string{
+		"# A \\\\ heading",
+		"",
+		"dragon[dead,think]: I have seen things",
+		"  bunny : hello\\nworld",
+		"default[ think ]:",
+		"cow[]:  two spaces",
+		`cow["think", width=3 ]: quoted`,
+		"@Alice = bunny[tired, facing=right]",
+		`@"Dr. = [Bob]" = default`,
+		"@Alice[think]: hi",
+		`@"Dr. = [Bob]": hello`,
+		"\r",
+	}, "\n")
+
+	heading, characters, lines, uerr := parseScript(script)
+	if uerr != nil {
+		t.Fatal(uerr)
+	}
+	if expect := `A \ heading`; heading != expect {
+		t.Errorf("got heading %q but expected %q", heading, expect)
+	}
+
+	expect := []scriptLine{
+		{3, map[string][]string{"animal": {"dragon"}, "mood": {"dead"}, "think": {"true"}, "text": {"I have seen things"}}},
+		{4, map[string][]string{"animal": {"bunny"}, "text": {"hello\nworld"}}},
+		{5, map[string][]string{"animal": {"default"}, "think": {"true"}, "text": {""}}},
+		{6, map[string][]string{"animal": {"cow"}, "text": {" two spaces"}}},
+		{7, map[string][]string{"animal": {"cow"}, "mood": {"think"}, "width": {"3"}, "text": {"quoted"}}},
+		{10, map[string][]string{"character": {"Alice"}, "think": {"true"}, "text": {"hi"}}},
+		{11, map[string][]string{"character": {"Dr. = [Bob]"}, "text": {"hello"}}},
+	}
+	if !reflect.DeepEqual(lines, expect) {
+		t.Errorf("got lines %#v but expected %#v", lines, expect)
+	}
+
+	expectCharacters := []scriptLine{
+		{8, map[string][]string{"name": {"Alice"}, "animal": {"bunny"}, "mood": {"tired"}, "facing": {"right"}}},
+		{9, map[string][]string{"name": {"Dr. = [Bob]"}, "animal": {"default"}}},
+	}
+	if !reflect.DeepEqual(characters, expectCharacters) {
+		t.Errorf("got characters %#v but expected %#v", characters, expectCharacters)
+	}
+
+	invalid := []string{
+		"no colon here",
+		"dragon[dead: text",
+		"dragon[dead] text",
+		": no animal",
+		"dragon[dead,tired]: text",
+		`dragon["dead]: text`,
+		`dragon["dead"x]: text`,
+		"dragon: text\n# late heading",
+		"@: no name",
+		"@Alice text",
+		`@"Alice: text`,
+		"@Alice = bunny[tired,sad]",
+		"@Alice = bunny[tired] extra",
+	}
+	for _, script := range invalid {
+		if _, _, _, uerr := parseScript(script); uerr == nil {
+			t.Errorf("expected an error parsing %q", script)
+		}
+	}
+
+	_, _, _, uerr = parseScript("dragon: ok\n\nbroken")
+	if len(uerr) != 1 || !strings.HasPrefix(uerr[0].Message, "line 3:") {
+		t.Errorf("expected a single error on line 3 but got %v", uerr)
+	}
+}
+
+func TestFormatScript(t *testing.T) {
+	lines := []Line{
+		{Animal: "dragon", MoodName: "dead", Think: true, Text: "I have seen things"},
+		{Animal: "bunny", MoodName: "default", Text: "back\\slash\nnewline"},
+	}
+
+	script := string(formatScript("Heading", nil, lines))
+	expect := "# Heading\n\ndragon[dead,think]: I have seen things\nbunny: back\\\\slash\\nnewline\n"
+	if script != expect {
+		t.Fatalf("got script %q but expected %q", script, expect)
+	}
+
+	heading, _, parsed, uerr := parseScript(script)
+	if uerr != nil {
+		t.Fatal(uerr)
+	}
+	if heading != "Heading" {
+		t.Errorf("got heading %q after round trip", heading)
+	}
+	if text := parsed[1].form.Get("text"); text != lines[1].Text {
+		t.Errorf("got text %q after round trip but expected %q", text, lines[1].Text)
+	}
+
+	// Mood names that look like other options or syntax
+	for _, name := range []string{"a,b", "x]y", "c:d", "Think", "width=3", `q"u\o`, " padded", "new\nline"} {
+		script := formatScript("", nil, []Line{{Animal: "cow", MoodName: name, Text: "hi"}})
+
+		_, _, parsed, uerr := parseScript(string(script))
+		if uerr != nil {
+			t.Errorf("parsing script %q for mood %q: %v", script, name, uerr)
+			continue
+		}
+		if len(parsed) != 1 || parsed[0].form.Get("mood") != name || parsed[0].form.Get("text") != "hi" {
+			t.Errorf("got lines %#v after round trip of mood %q", parsed, name)
+		}
+	}
+}
+
+func TestFormatScriptCharacters(t *testing.T) {
+	characters := []Character{
+		{Name: "Alice", Animal: "bunny", MoodName: "tired", Facing: FacingRight},
+		{Name: "Dr. [Bob]", Animal: "default", MoodName: "default", Facing: FacingLeft},
+	}
+	lines := []Line{
+		{Character: "Alice", Animal: "bunny", MoodName: "tired", Text: "hi"},
+		{Character: "Alice", Animal: "bunny", MoodName: "default", Text: "rested"},
+		{Character: "Dr. [Bob]", Animal: "default", MoodName: "facing=left", Text: "odd"},
+		{Animal: "dragon", MoodName: "default", Text: "no one"},
+	}
+
+	script := string(formatScript("", characters, lines))
+	expect := strings.Join([]string{
+		"@Alice = bunny[tired,facing=right]",
+		`@"Dr. [Bob]" = default`,
+		"",
+		"@Alice: hi",
+		"@Alice[default]: rested",
+		`@"Dr. [Bob]"["facing=left"]: odd`,
+		"dragon: no one",
+		"",
+	}, "\n")
+	if script != expect {
+		t.Fatalf("got script %q but expected %q", script, expect)
+	}
+
+	_, parsedCharacters, parsed, uerr := parseScript(script)
+	if uerr != nil {
+		t.Fatal(uerr)
+	}
+	if len(parsedCharacters) != len(characters) {
+		t.Fatalf("got characters %#v after round trip", parsedCharacters)
+	}
+	for i, sc := range parsedCharacters {
+		if name := sc.form.Get("name"); name != characters[i].Name {
+			t.Errorf("got character %q after round trip but expected %q", name, characters[i].Name)
+		}
+	}
+	if facing := parsedCharacters[0].form.Get("facing"); facing != FacingRight {
+		t.Errorf("got facing %q after round trip but expected %q", facing, FacingRight)
+	}
+	if len(parsed) != len(lines) {
+		t.Fatalf("got lines %#v after round trip", parsed)
+	}
+	for i, sl := range parsed {
+		if name := sl.form.Get("character"); name != lines[i].Character {
+			t.Errorf("%d: got character %q after round trip but expected %q", i, name, lines[i].Character)
+		}
+	}
+	if mood := parsed[2].form.Get("mood"); mood != "facing=left" {
+		t.Errorf("got mood %q after round trip but expected %q", mood, "facing=left")
+	}
+}
@@ -0,0 +1,84 @@
+package say
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+const maxQueryLength = 200
+
+// Markers around matched words in snippets from the database
+const (
+	snippetStartSel = "\x01"
+	snippetStopSel  = "\x02"
+)
+
+var snippetHighlighter = strings.NewReplacer(snippetStartSel, "<b>", snippetStopSel, "</b>")
+
+// SearchHit is a conversation whose heading or a line whose text
+// matched a search. Snippet contains the matching text, escaped as
+// HTML, with the matched words wrapped in <b> tags.
+type SearchHit struct {
+	ID             string `json:"id"`
+	Type           string `json:"type"` // "conversation" or "line"
+	ConversationID string `json:"conversation_id"`
+	LineID         string `json:"line_id,omitempty"`
+	Heading        string `json:"heading"`
+	Snippet        string `json:"snippet"`
+}
+
+// highlightSnippet escapes the text of a snippet as HTML and wraps the
+// matched words in <b> tags.
+func highlightSnippet(snippet string) string {
+	return snippetHighlighter.Replace(html.EscapeString(snippet))
+}
+
+// Search finds the user's conversations and lines matching the `q`
+// parameter using full-text search.
+func (c *Controller) Search(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	lArgs, uerr := getListArgs(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	query := strings.TrimSpace(strings.Replace(r.FormValue("q"), "\x00", "", -1))
+	if query == "" || utf8.RuneCountInString(query) > maxQueryLength {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+			Params:  []string{"q"},
+			Message: fmt.Sprintf("must be a string of between 1 and %d characters", maxQueryLength),
+		}})
+		return
+	}
+
+	hits, hasMore, err := c.repo.Search(userID, query, lArgs)
+	if err == errCursorNotFound {
+		respondCursorNotFound(ctx, w, lArgs)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	var cursor string
+	if len(hits) > 0 {
+		cursor = hits[len(hits)-1].ID
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Cursor:  cursor,
+		Type:    "search_hit",
+		HasMore: hasMore,
+		Data:    hits,
+	})
+}
@@ -0,0 +1,11 @@
+package say
+
+import "testing"
+
+func TestHighlightSnippet(t *testing.T) {
+	snippet := "<script>alert(1)</script> \x01deploy\x02 & \x01ship\x02 it"
+	expect := "&lt;script&gt;alert(1)&lt;/script&gt; <b>deploy</b> &amp; <b>ship</b> it"
+	if got := highlightSnippet(snippet); got != expect {
+		t.Errorf("expected snippet %q but got %q", expect, got)
+	}
+}
@@ -0,0 +1,436 @@
+package say
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"goji.io/pat"
+
+	"gopkg.in/throttled/throttled.v2"
+
+	"github.com/metcalf/saypi/reqlog"
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+// Types of SessionRequest and SessionMessage
+const (
+	SessionLine     = "line"
+	SessionTyping   = "typing"
+	SessionWelcome  = "welcome"
+	SessionPresence = "presence"
+	SessionEvent    = "event"
+	SessionError    = "error"
+)
+
+const (
+	maxSessionNameLength = 30
+	maxSessionMessage    = 64 << 10         // bytes in a message from a client
+	sessionBuffer        = 32               // messages queued per connection before it is dropped
+	sessionWriteTimeout  = 10 * time.Second // time allowed to write a message to a connection
+	sessionMemberIDLen   = 9
+)
+
+// SessionMember is a connection to the live session of a conversation.
+// Members are identified by connection rather than by user so that the
+// same user can join from several clients.
+type SessionMember struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Typing bool   `json:"typing"`
+}
+
+// SessionRequest is a message from a member of a session. A "line"
+// request creates a line with the parameters of Line and a "typing"
+// request sets whether the member is typing.
+type SessionRequest struct {
+	Type   string     `json:"type"`
+	Ref    string     `json:"ref,omitempty"`
+	Line   *BatchLine `json:"line,omitempty"`
+	Typing bool       `json:"typing,omitempty"`
+}
+
+// SessionMessage is a message to a member of a session. Replies to a
+// request, either the created line or an error, carry the Ref of the
+// request.
+type SessionMessage struct {
+	Type    string          `json:"type"`
+	Ref     string          `json:"ref,omitempty"`
+	Member  *SessionMember  `json:"member,omitempty"`
+	Members []SessionMember `json:"members,omitempty"`
+	Line    *Line           `json:"line,omitempty"`
+	Event   *Event          `json:"event,omitempty"`
+	Error   json.RawMessage `json:"error,omitempty"`
+}
+
+// sessionHub tracks the members of the live session of each
+// conversation and relays presence and typing indicators between them.
+// Changes to the conversation are relayed through the event broker.
+type sessionHub struct {
+	mu       sync.Mutex
+	sessions map[string][]*sessionConn
+	closed   bool
+}
+
+type sessionConn struct {
+	member SessionMember // guarded by the hub
+	out    chan SessionMessage
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newSessionHub() *sessionHub {
+	return &sessionHub{sessions: make(map[string][]*sessionConn)}
+}
+
+func newSessionConn(member SessionMember) *sessionConn {
+	return &sessionConn{
+		member: member,
+		out:    make(chan SessionMessage, sessionBuffer),
+		done:   make(chan struct{}),
+	}
+}
+
+// send queues a message for the connection. Typing indicators are
+// discarded if the connection is not keeping up, but missing any other
+// message would leave the client out of sync so the connection is
+// dropped instead.
+func (sc *sessionConn) send(msg SessionMessage) {
+	select {
+	case sc.out <- msg:
+	default:
+		if msg.Type != SessionTyping {
+			sc.drop()
+		}
+	}
+}
+
+func (sc *sessionConn) drop() {
+	sc.once.Do(func() { close(sc.done) })
+}
+
+// join adds a connection to the conversation's session, welcoming it
+// and announcing it to the other members.
+func (h *sessionHub) join(convoID string, sc *sessionConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		sc.drop()
+		return
+	}
+
+	h.sessions[convoID] = append(h.sessions[convoID], sc)
+	members := h.members(convoID)
+
+	for _, other := range h.sessions[convoID] {
+		if other == sc {
+			member := sc.member
+			other.send(SessionMessage{Type: SessionWelcome, Member: &member, Members: members})
+		} else {
+			other.send(SessionMessage{Type: SessionPresence, Members: members})
+		}
+	}
+}
+
+// leave removes a connection from the conversation's session and
+// announces its departure to the remaining members.
+func (h *sessionHub) leave(convoID string, sc *sessionConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	conns := h.sessions[convoID]
+	for i, other := range conns {
+		if other == sc {
+			conns = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(h.sessions, convoID)
+		return
+	}
+	h.sessions[convoID] = conns
+
+	members := h.members(convoID)
+	for _, other := range conns {
+		other.send(SessionMessage{Type: SessionPresence, Members: members})
+	}
+}
+
+// setTyping records whether a member is typing and tells the other
+// members if it changed.
+func (h *sessionHub) setTyping(convoID string, sc *sessionConn, typing bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if sc.member.Typing == typing {
+		return
+	}
+	sc.member.Typing = typing
+
+	member := sc.member
+	for _, other := range h.sessions[convoID] {
+		if other != sc {
+			other.send(SessionMessage{Type: SessionTyping, Member: &member})
+		}
+	}
+}
+
+// close drops every connection, ending its session, and drops
+// connections that join later.
+func (h *sessionHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, conns := range h.sessions {
+		for _, sc := range conns {
+			sc.drop()
+		}
+	}
+}
+
+// members lists the members of a session in the order they joined.
+// The caller must hold the lock.
+func (h *sessionHub) members(convoID string) []SessionMember {
+	conns := h.sessions[convoID]
+	members := make([]SessionMember, len(conns))
+	for i, sc := range conns {
+		members[i] = sc.member
+	}
+	return members
+}
+
+// SetSessionLimiter limits the rate of messages on each session
+// connection. Sessions are not limited if it is never called.
+func (c *Controller) SetSessionLimiter(limiter throttled.RateLimiter) {
+	c.sessionLimiter = limiter
+}
+
+// JoinSession upgrades the request to a WebSocket connection to the
+// live session of a conversation. Members see each other's presence,
+// typing indicators and changes to the conversation, and can create
+// lines over the connection. The optional `name` parameter is shown to
+// the other members.
+func (c *Controller) JoinSession(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	name := r.URL.Query().Get("name")
+	if utf8.RuneCountInString(name) > maxSessionNameLength {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+			Params:  []string{"name"},
+			Message: fmt.Sprintf("must be a string of no more than %d characters", maxSessionNameLength),
+		}})
+		return
+	}
+
+	convo, err := c.repo.GetConversation(userID, convoID, 0)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if convo == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	id := make([]byte, sessionMemberIDLen)
+	if _, err := rand.Read(id); err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	member := SessionMember{ID: base64.URLEncoding.EncodeToString(id), Name: name}
+
+	// Clients authenticate with the Authorization header rather than
+	// cookies, so the origin of the request doesn't need to be checked.
+	srv := websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.MaxPayloadBytes = maxSessionMessage
+		c.runSession(ctx, ws, userID, convoID, member)
+	}}
+	srv.ServeHTTP(w, r)
+}
+
+// runSession relays messages between a connection and its session
+// until either end closes it.
+func (c *Controller) runSession(ctx context.Context, ws *websocket.Conn, userID, convoID string, member SessionMember) {
+	defer ws.Close()
+
+	sub, _ := c.events.subscribe(convoID, "")
+	if sub == nil {
+		return
+	}
+	defer c.events.unsubscribe(sub)
+
+	sc := newSessionConn(member)
+	c.sessions.join(convoID, sc)
+	defer c.sessions.leave(convoID, sc)
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		writeSession(ws, sc, sub)
+	}()
+	defer func() { <-written }()
+	defer sc.drop()
+
+	received := 0
+	defer func() {
+		reqlog.SetContext(ctx, "messages_received", strconv.Itoa(received))
+	}()
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			return
+		}
+		received++
+
+		// Every message counts against the limit, including those that
+		// turn out to be invalid, so the limit is checked before decoding.
+		if c.sessionLimiter != nil {
+			limited, _, err := c.sessionLimiter.RateLimit(member.ID, 1)
+			if err != nil {
+				reqlog.Printf(ctx, "Error limiting session. event=session_limit_error error=%q", err)
+			} else if limited {
+				sc.send(sessionError("", RateLimited{}))
+				continue
+			}
+		}
+
+		var req SessionRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			sc.send(sessionError("", usererrors.InvalidParams{{
+				Params:  []string{"message"},
+				Message: "must be a JSON object",
+			}}))
+			continue
+		}
+
+		switch req.Type {
+		case SessionTyping:
+			c.sessions.setTyping(convoID, sc, req.Typing)
+		case SessionLine:
+			line, uerr := c.createSessionLine(ctx, userID, convoID, req.Line)
+			if uerr != nil {
+				sc.send(sessionError(req.Ref, uerr))
+				continue
+			}
+			c.sessions.setTyping(convoID, sc, false)
+			sc.send(SessionMessage{Type: SessionLine, Ref: req.Ref, Line: line})
+		default:
+			sc.send(sessionError(req.Ref, usererrors.InvalidParams{{
+				Params:  []string{"type"},
+				Message: fmt.Sprintf("must be either %q or %q", SessionLine, SessionTyping),
+			}}))
+		}
+	}
+}
+
+// writeSession writes the messages and events of a connection to it
+// until the connection is dropped or falls behind on events.
+func writeSession(ws *websocket.Conn, sc *sessionConn, sub *eventSub) {
+	// Closing the connection also ends the read loop
+	defer ws.Close()
+	defer sc.drop()
+
+	for {
+		var msg SessionMessage
+		select {
+		case ev, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			msg = SessionMessage{Type: SessionEvent, Event: &ev}
+		case msg = <-sc.out:
+		case <-sc.done:
+			return
+		}
+
+		ws.SetWriteDeadline(time.Now().Add(sessionWriteTimeout))
+		if err := websocket.JSON.Send(ws, msg); err != nil {
+			return
+		}
+	}
+}
+
+// createSessionLine appends a line to the conversation with the same
+// validation as CreateLine.
+func (c *Controller) createSessionLine(ctx context.Context, userID, convoID string, bl *BatchLine) (*Line, usererrors.UserError) {
+	if bl == nil {
+		return nil, usererrors.InvalidParams{{
+			Params:  []string{"line"},
+			Message: "is required to create a line",
+		}}
+	}
+
+	line := Line{
+		Animal:   "default",
+		MoodName: "default",
+	}
+
+	form := bl.form()
+	uerr, err := c.setCharacter(userID, convoID, form, &line)
+	if err != nil {
+		reqlog.Printf(ctx, "Error finding character. event=session_error error=%q", err)
+		return nil, usererrors.InternalFailure{}
+	}
+	uerr = append(uerr, c.parseLine(form, &line)...)
+
+	moodErr, err := c.resolveMood(userID, &line, form.Get("seed"))
+	if err != nil {
+		reqlog.Printf(ctx, "Error resolving mood. event=session_error error=%q", err)
+		return nil, usererrors.InternalFailure{}
+	}
+	uerr = append(uerr, moodErr...)
+
+	if uerr != nil {
+		return nil, uerr
+	}
+
+	line.Output, err = c.renderLine(&line)
+	if err != nil {
+		reqlog.Printf(ctx, "Error rendering line. event=session_error error=%q", err)
+		return nil, usererrors.InternalFailure{}
+	}
+
+	created := &changeEvent{Type: EventLineCreated, Data: &line}
+	if err := c.repo.InsertLine(userID, convoID, &line, LinePosition{}, created); err == errRecordNotFound {
+		// Either the member's role doesn't allow new lines or the
+		// conversation was deleted during the session
+		uerr, err := c.missingRole(userID, convoID, RoleEditor)
+		if err != nil {
+			reqlog.Printf(ctx, "Error finding role. event=session_error error=%q", err)
+			return nil, usererrors.InternalFailure{}
+		}
+		return nil, uerr
+	} else if uerr, ok := err.(QuotaExceeded); ok {
+		return nil, uerr
+	} else if err != nil {
+		reqlog.Printf(ctx, "Error inserting line. event=session_error error=%q", err)
+		return nil, usererrors.InternalFailure{}
+	}
+
+	c.publishEvent(ctx, convoID, created)
+
+	return &line, nil
+}
+
+func sessionError(ref string, uerr usererrors.UserError) SessionMessage {
+	raw, err := usererrors.MarshalJSON(uerr)
+	if err != nil {
+		raw, _ = usererrors.MarshalJSON(usererrors.InternalFailure{})
+	}
+	return SessionMessage{Type: SessionError, Ref: ref, Error: raw}
+}
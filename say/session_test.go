@@ -0,0 +1,87 @@
+package say
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSessionHub(t *testing.T) {
+	hub := newSessionHub()
+
+	alice := newSessionConn(SessionMember{ID: "a", Name: "alice"})
+	bob := newSessionConn(SessionMember{ID: "b", Name: "bob"})
+	other := newSessionConn(SessionMember{ID: "o"})
+
+	hub.join("cv1", alice)
+	hub.join("cv1", bob)
+	hub.join("cv2", other)
+
+	both := []SessionMember{alice.member, bob.member}
+	expectSessionMessage(t, alice, SessionMessage{Type: SessionWelcome, Member: &alice.member, Members: both[:1]})
+	expectSessionMessage(t, alice, SessionMessage{Type: SessionPresence, Members: both})
+	expectSessionMessage(t, bob, SessionMessage{Type: SessionWelcome, Member: &bob.member, Members: both})
+	expectSessionMessage(t, other, SessionMessage{Type: SessionWelcome, Member: &other.member, Members: []SessionMember{other.member}})
+
+	hub.setTyping("cv1", bob, true)
+	hub.setTyping("cv1", bob, true)
+	expectSessionMessage(t, alice, SessionMessage{Type: SessionTyping, Member: &SessionMember{ID: "b", Name: "bob", Typing: true}})
+
+	hub.leave("cv1", bob)
+	expectSessionMessage(t, alice, SessionMessage{Type: SessionPresence, Members: []SessionMember{alice.member}})
+
+	for _, sc := range []*sessionConn{alice, bob, other} {
+		if len(sc.out) > 0 {
+			t.Errorf("unexpected message for %s: %#v", sc.member.Name, <-sc.out)
+		}
+	}
+
+	// Typing indicators are dropped for slow connections but other
+	// messages drop the connection.
+	for i := 0; i < sessionBuffer; i++ {
+		alice.send(SessionMessage{Type: SessionPresence})
+	}
+	alice.send(SessionMessage{Type: SessionTyping})
+	select {
+	case <-alice.done:
+		t.Fatal("expected the connection to survive a dropped typing indicator")
+	default:
+	}
+
+	alice.send(SessionMessage{Type: SessionPresence})
+	select {
+	case <-alice.done:
+	default:
+		t.Fatal("expected the connection to be dropped")
+	}
+
+	hub.leave("cv1", alice)
+	hub.leave("cv2", other)
+	if len(hub.sessions) != 0 {
+		t.Errorf("expected no sessions but got %v", hub.sessions)
+	}
+
+	// Closing drops current and later connections
+	open := newSessionConn(SessionMember{ID: "c"})
+	hub.join("cv1", open)
+	hub.close()
+	late := newSessionConn(SessionMember{ID: "l"})
+	hub.join("cv1", late)
+	for _, sc := range []*sessionConn{open, late} {
+		select {
+		case <-sc.done:
+		default:
+			t.Errorf("expected connection %s to be dropped", sc.member.ID)
+		}
+	}
+}
+
+func expectSessionMessage(t *testing.T, sc *sessionConn, expect SessionMessage) {
+	select {
+	case msg := <-sc.out:
+		if !reflect.DeepEqual(msg, expect) {
+			t.Errorf("got message %#v for %s but expected %#v", msg, sc.member.Name, expect)
+		}
+	default:
+		t.Errorf("expected a %s message for %s", expect.Type, sc.member.Name)
+	}
+}
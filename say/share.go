@@ -0,0 +1,224 @@
+package say
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+
+	"goji.io/pat"
+	"goji.io/pattern"
+
+	"github.com/metcalf/saypi/reqlog"
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	tokenIDLen      = 16
+	maxShareSeconds = 365 * 24 * 60 * 60
+)
+
+// Token contexts separate the signatures of each kind of token from
+// other values signed with the same secret.
+var (
+	shareTokenContext  = []byte("share:")
+	inviteTokenContext = []byte("invite:")
+)
+
+// Share grants read-only access to a conversation to anyone holding
+// its token. Expires is nil if the share does not expire.
+type Share struct {
+	ID      string `json:"id"`
+	Token   string `json:"token"`
+	Created int64  `json:"created"`
+	Expires *int64 `json:"expires"`
+}
+
+func (s *Share) Vars() map[pattern.Variable]string {
+	return map[pattern.Variable]string{
+		"share": s.ID,
+	}
+}
+
+// CreateShare mints a share token for a conversation that expires
+// after the number of seconds in the `expires_in` parameter, if
+// provided.
+func (c *Controller) CreateShare(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	var expiresIn sql.NullInt64
+	if value := r.PostFormValue("expires_in"); value != "" {
+		secs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || secs <= 0 || secs > maxShareSeconds {
+			respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+				Params:  []string{"expires_in"},
+				Message: "must be a number of seconds from 1 to " + strconv.Itoa(maxShareSeconds),
+			}})
+			return
+		}
+		expiresIn = sql.NullInt64{Int64: secs, Valid: true}
+	}
+
+	id := make([]byte, tokenIDLen)
+	if _, err := rand.Read(id); err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	tokenID := base64.URLEncoding.EncodeToString(id)
+
+	share, err := c.repo.InsertShare(userID, convoID, tokenID, expiresIn)
+	if err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleOwner)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	share.Token = c.signToken(shareTokenContext, id)
+
+	respond.Data(ctx, w, http.StatusOK, share)
+}
+
+func (c *Controller) ListShares(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	recs, err := c.repo.ListShares(userID, convoID)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if recs == nil {
+		c.respondMissingRole(ctx, w, r, convoID, RoleOwner)
+		return
+	}
+
+	shares := make([]Share, len(recs))
+	for i, rec := range recs {
+		id, err := base64.URLEncoding.DecodeString(rec.TokenID)
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+
+		shares[i] = rec.Share
+		shares[i].Token = c.signToken(shareTokenContext, id)
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Type: "share",
+		Data: shares,
+	})
+}
+
+// RevokeShare deletes a share so that its token no longer grants
+// access to the conversation.
+func (c *Controller) RevokeShare(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+	shareID := pat.Param(ctx, "share")
+
+	if err := c.repo.DeleteShare(userID, convoID, shareID); err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleOwner)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetShared responds with the conversation shared by the token in the
+// URL. It does not require authentication, so tokens that are
+// malformed, forged, revoked or expired are all reported as not found.
+func (c *Controller) GetShared(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	tokenID, ok := c.verifyToken(shareTokenContext, pat.Param(ctx, "token"))
+	if !ok {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	lineLimit, uerr := getLineLimit(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	shared, err := c.repo.FindShare(tokenID)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if shared == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	reqlog.SetContext(ctx, "share_id", shared.ID)
+
+	convo, err := c.repo.GetConversation(shared.UserID, shared.ConversationID, lineLimit)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if convo == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+	// The role is that of the owner the conversation was read as
+	convo.Role = ""
+
+	for i, line := range convo.Lines {
+		convo.Lines[i].Output, err = c.renderLine(&line)
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+	}
+
+	respond.Data(ctx, w, http.StatusOK, convo)
+}
+
+// signToken returns a token of the kind given by tokenContext with the
+// random part id.
+func (c *Controller) signToken(tokenContext, id []byte) string {
+	token := make([]byte, 0, tokenIDLen+sha256.Size)
+	token = append(token, id...)
+	token = append(token, c.tokenMAC(tokenContext, id)...)
+
+	return base64.URLEncoding.EncodeToString(token)
+}
+
+func (c *Controller) tokenMAC(tokenContext, id []byte) []byte {
+	mac := hmac.New(sha256.New, c.shareSecret)
+	mac.Write(tokenContext)
+	mac.Write(id)
+
+	return mac.Sum(nil)
+}
+
+// verifyToken checks the signature of a token of the kind given by
+// tokenContext and returns the encoded random part that identifies its
+// share or invite.
+func (c *Controller) verifyToken(tokenContext []byte, token string) (string, bool) {
+	raw, err := base64.URLEncoding.DecodeString(token)
+	if err != nil || len(raw) != tokenIDLen+sha256.Size {
+		return "", false
+	}
+
+	id := raw[:tokenIDLen]
+	if !hmac.Equal(raw[tokenIDLen:], c.tokenMAC(tokenContext, id)) {
+		return "", false
+	}
+
+	return base64.URLEncoding.EncodeToString(id), true
+}
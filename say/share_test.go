@@ -0,0 +1,45 @@
+package say
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestToken(t *testing.T) {
+	ctrl := Controller{shareSecret: []byte("secret")}
+	other := Controller{shareSecret: []byte("other")}
+
+	id := bytes.Repeat([]byte{7}, tokenIDLen)
+	token := ctrl.signToken(shareTokenContext, id)
+
+	tokenID, ok := ctrl.verifyToken(shareTokenContext, token)
+	if !ok {
+		t.Fatalf("expected token %q to verify", token)
+	}
+	if expect := base64.URLEncoding.EncodeToString(id); tokenID != expect {
+		t.Errorf("got token ID %q but expected %q", tokenID, expect)
+	}
+
+	raw, _ := base64.URLEncoding.DecodeString(token)
+	raw[0] ^= 1
+	forged := base64.URLEncoding.EncodeToString(raw)
+
+	cases := []struct {
+		ctrl  *Controller
+		token string
+	}{
+		{&other, token},
+		{&ctrl, forged},
+		{&ctrl, ctrl.signToken(inviteTokenContext, id)},
+		{&ctrl, base64.URLEncoding.EncodeToString(id)},
+		{&ctrl, "not a token"},
+		{&ctrl, ""},
+	}
+
+	for i, testcase := range cases {
+		if _, ok := testcase.ctrl.verifyToken(shareTokenContext, testcase.token); ok {
+			t.Errorf("%d: expected token %q not to verify", i, testcase.token)
+		}
+	}
+}
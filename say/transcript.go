@@ -0,0 +1,167 @@
+package say
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"goji.io/pat"
+
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	transcriptMarkdown = "md"
+	transcriptHTML     = "html"
+	transcriptText     = "txt"
+)
+
+// markdownEscaper escapes characters in headings and labels that
+// Markdown would otherwise treat as formatting.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "<", `\<`,
+	">", `\>`, "#", `\#`, "&", `\&`, "!", `\!`, "|", `\|`, "~", `\~`,
+)
+
+var transcriptContentTypes = map[string]string{
+	transcriptMarkdown: "text/markdown; charset=utf-8",
+	transcriptHTML:     "text/html; charset=utf-8",
+	transcriptText:     "text/plain; charset=utf-8",
+}
+
+// GetTranscript renders every line of a conversation into a single
+// document in the format given by the `format` parameter.
+func (c *Controller) GetTranscript(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = transcriptText
+	}
+	contentType, ok := transcriptContentTypes[format]
+	if !ok {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+			Params:  []string{"format"},
+			Message: fmt.Sprintf("must be one of '%s', '%s' or '%s'", transcriptMarkdown, transcriptHTML, transcriptText),
+		}})
+		return
+	}
+
+	convo, err := c.repo.GetConversation(userID, convoID, -1)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if convo == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	outputs := make([]string, len(convo.Lines))
+	labels := make([]string, len(convo.Lines))
+	for i, line := range convo.Lines {
+		outputs[i], err = c.renderLine(&line)
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+		labels[i] = line.Character
+	}
+
+	respond.Raw(ctx, w, http.StatusOK, contentType, renderTranscript(format, convo.Heading, outputs, labels))
+}
+
+// renderTranscript joins the rendered output of each line into a
+// document with the conversation's heading. Lines are separated by a
+// blank line in Markdown and plain text. Each output is preceded by
+// the label at the same index, if any, such as the name of the line's
+// character.
+func renderTranscript(format, heading string, outputs, labels []string) []byte {
+	var blocks []string
+
+	label := func(i int) string {
+		if i < len(labels) {
+			return labels[i]
+		}
+		return ""
+	}
+
+	switch format {
+	case transcriptHTML:
+		var buf bytes.Buffer
+
+		title := heading
+		if title == "" {
+			title = "Conversation"
+		}
+		fmt.Fprintf(&buf, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n", html.EscapeString(title))
+		if heading != "" {
+			fmt.Fprintf(&buf, "<h1>%s</h1>\n", html.EscapeString(heading))
+		}
+		for i, output := range outputs {
+			if l := label(i); l != "" {
+				fmt.Fprintf(&buf, "<p><strong>%s</strong></p>\n", html.EscapeString(l))
+			}
+			fmt.Fprintf(&buf, "<pre>%s</pre>\n", html.EscapeString(strings.TrimRight(output, "\n")))
+		}
+		buf.WriteString("</body>\n</html>\n")
+
+		return buf.Bytes()
+	case transcriptMarkdown:
+		if heading != "" {
+			// A heading must stay on a single line
+			blocks = append(blocks, "# "+markdownEscaper.Replace(strings.Join(strings.Fields(heading), " ")))
+		}
+		for i, output := range outputs {
+			// The fence must be longer than any run of backticks in
+			// the text so the block is not closed early.
+			fence := "```"
+			if n := maxRun(output, '`'); n >= len(fence) {
+				fence = strings.Repeat("`", n+1)
+			}
+			block := fence + "\n" + strings.TrimRight(output, "\n") + "\n" + fence
+			if l := label(i); l != "" {
+				block = "**" + markdownEscaper.Replace(l) + "**\n\n" + block
+			}
+			blocks = append(blocks, block)
+		}
+	default:
+		if heading != "" {
+			blocks = append(blocks, heading)
+		}
+		for i, output := range outputs {
+			block := strings.TrimRight(output, "\n")
+			if l := label(i); l != "" {
+				block = l + ":\n" + block
+			}
+			blocks = append(blocks, block)
+		}
+	}
+
+	if len(blocks) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(blocks, "\n\n") + "\n")
+}
+
+// maxRun returns the length of the longest run of b in s.
+func maxRun(s string, b byte) int {
+	var max, cur int
+	for i := 0; i < len(s); i++ {
+		if s[i] != b {
+			cur = 0
+			continue
+		}
+		cur++
+		if cur > max {
+			max = cur
+		}
+	}
+	return max
+}
@@ -0,0 +1,51 @@
+package say
+
+import "testing"
+
+func TestRenderTranscript(t *testing.T) {
+	outputs := []string{" ___\n< a >\n ---\n", " _____\n< ``` >\n -----\n"}
+
+	cases := []struct {
+		format, heading string
+		outputs, labels []string
+		expect          string
+	}{
+		{transcriptText, "Hi", outputs, nil, "Hi\n\n ___\n< a >\n ---\n\n _____\n< ``` >\n -----\n"},
+		{transcriptText, "", outputs[:1], nil, " ___\n< a >\n ---\n"},
+		{transcriptText, "", nil, nil, ""},
+		{transcriptText, "", outputs, []string{"Al", ""}, "Al:\n ___\n< a >\n ---\n\n _____\n< ``` >\n -----\n"},
+		{
+			transcriptMarkdown, "Hi", outputs, nil,
+			"# Hi\n\n```\n ___\n< a >\n ---\n```\n\n````\n _____\n< ``` >\n -----\n````\n",
+		},
+		{
+			transcriptMarkdown, "**Hi** #1\n<b>&amp;</b>\n\n# Bye", outputs[:1], nil,
+			"# \\*\\*Hi\\*\\* \\#1 \\<b\\>\\&amp;\\</b\\> \\# Bye\n\n```\n ___\n< a >\n ---\n```\n",
+		},
+		{
+			transcriptMarkdown, "", outputs[:1], []string{"*Al*"},
+			"**\\*Al\\***\n\n```\n ___\n< a >\n ---\n```\n",
+		},
+		{
+			transcriptHTML, "<Hi>", outputs[:1], nil,
+			"<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>&lt;Hi&gt;</title>\n</head>\n<body>\n" +
+				"<h1>&lt;Hi&gt;</h1>\n<pre> ___\n&lt; a &gt;\n ---</pre>\n</body>\n</html>\n",
+		},
+		{
+			transcriptHTML, "", nil, nil,
+			"<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Conversation</title>\n</head>\n<body>\n</body>\n</html>\n",
+		},
+		{
+			transcriptHTML, "", outputs[:1], []string{"<Al>"},
+			"<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Conversation</title>\n</head>\n<body>\n" +
+				"<p><strong>&lt;Al&gt;</strong></p>\n<pre> ___\n&lt; a &gt;\n ---</pre>\n</body>\n</html>\n",
+		},
+	}
+
+	for i, testcase := range cases {
+		got := string(renderTranscript(testcase.format, testcase.heading, testcase.outputs, testcase.labels))
+		if got != testcase.expect {
+			t.Errorf("%d: renderTranscript(%q) = %q but expected %q", i, testcase.format, got, testcase.expect)
+		}
+	}
+}
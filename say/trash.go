@@ -0,0 +1,159 @@
+package say
+
+import (
+	"net/http"
+	"time"
+
+	"goji.io/pat"
+
+	"github.com/metcalf/saypi/reqlog"
+	"github.com/metcalf/saypi/respond"
+
+	"golang.org/x/net/context"
+)
+
+// TrashItem is a deleted conversation or line that can be restored
+// until it is purged. Lines of deleted conversations are not listed
+// separately since they are restored with their conversation.
+type TrashItem struct {
+	ID             string `json:"id"`
+	Type           string `json:"type"` // "conversation" or "line"
+	ConversationID string `json:"conversation_id"`
+	Heading        string `json:"heading"`
+	Text           string `json:"text,omitempty"`
+	Deleted        int64  `json:"deleted"`
+}
+
+func (c *Controller) ListTrash(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	lArgs, uerr := getListArgs(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	items, hasMore, err := c.repo.ListTrash(userID, lArgs)
+	if err == errCursorNotFound {
+		respondCursorNotFound(ctx, w, lArgs)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	var cursor string
+	if len(items) > 0 {
+		cursor = items[len(items)-1].ID
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Cursor:  cursor,
+		Type:    "trash_item",
+		HasMore: hasMore,
+		Data:    items,
+	})
+}
+
+func (c *Controller) RestoreConversation(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+
+	if err := c.repo.RestoreConversation(userID, convoID); err == errRecordNotFound {
+		respond.NotFound(ctx, w, r)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	convo, err := c.repo.GetConversation(userID, convoID, -1)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if convo == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	for i, line := range convo.Lines {
+		convo.Lines[i].Output, err = c.renderLine(&line)
+		if err != nil {
+			respond.InternalError(ctx, w, err)
+			return
+		}
+	}
+
+	respond.Data(ctx, w, http.StatusOK, convo)
+}
+
+func (c *Controller) RestoreLine(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	convoID := pat.Param(ctx, "conversation")
+	lineID := pat.Param(ctx, "line")
+
+	if err := c.repo.RestoreLine(userID, convoID, lineID); err == errRecordNotFound {
+		c.respondMissingRole(ctx, w, r, convoID, RoleEditor)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	line, err := c.repo.GetLine(userID, convoID, lineID)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	if line == nil {
+		respond.NotFound(ctx, w, r)
+		return
+	}
+
+	line.Output, err = c.renderLine(line)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, line)
+}
+
+// StartPurger permanently deletes conversations and lines that have
+// been in the trash for longer than retention, checking every interval
+// until the Controller is closed.
+func (c *Controller) StartPurger(retention, interval time.Duration) {
+	c.stopPurger = make(chan struct{})
+	c.purgerDone = make(chan struct{})
+
+	go func() {
+		defer close(c.purgerDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.purgeTrash(retention)
+			case <-c.stopPurger:
+				return
+			}
+		}
+	}()
+}
+
+func (c *Controller) purgeTrash(retention time.Duration) {
+	ctx := context.Background()
+
+	convos, lines, err := c.repo.PurgeTrash(retention)
+	if err != nil {
+		reqlog.Printf(ctx, "Error purging trash. event=purge_error error=%q", err)
+		return
+	}
+
+	if convos > 0 || lines > 0 {
+		reqlog.Printf(ctx, "Purged trash. event=trash_purged conversations=%d lines=%d", convos, lines)
+	}
+}
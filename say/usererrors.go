@@ -0,0 +1,63 @@
+package say
+
+import (
+	"fmt"
+
+	"github.com/metcalf/saypi/usererrors"
+)
+
+// RateLimited indicates that a client sent messages faster than it is
+// allowed to.
+type RateLimited struct{}
+
+// Code returns "rate_limited"
+func (e RateLimited) Code() string { return "rate_limited" }
+
+// Message returns a human-readable description of the error.
+func (e RateLimited) Message() string {
+	return "You are sending messages too quickly. Wait a moment and try again."
+}
+
+// RoleRequired indicates that a member of a conversation tried to do
+// something that their role in it does not allow.
+type RoleRequired struct {
+	Role string `json:"role"`
+}
+
+// Code returns "role_required"
+func (e RoleRequired) Code() string { return "role_required" }
+
+// Message returns a human-readable description of the error.
+func (e RoleRequired) Message() string {
+	if e.Role == RoleOwner {
+		return "You must be an owner of the conversation to do that."
+	}
+	return fmt.Sprintf("You must be an %s or owner of the conversation to do that.", e.Role)
+}
+
+// QuotaExceeded indicates that a change would store more than one of
+// the user's quotas allows. Usage is the amount stored before the
+// change.
+type QuotaExceeded struct {
+	Quota string `json:"quota"`
+	Limit int64  `json:"limit"`
+	Usage int64  `json:"usage"`
+}
+
+// Code returns "quota_exceeded"
+func (e QuotaExceeded) Code() string { return "quota_exceeded" }
+
+// Message returns a human-readable description of the error.
+func (e QuotaExceeded) Message() string {
+	return fmt.Sprintf("This would exceed the quota of %d %s, of which %d are used.", e.Limit, quotaUnits[e.Quota], e.Usage)
+}
+
+// Error lets the repository return QuotaExceeded from the change that
+// exceeded the quota.
+func (e QuotaExceeded) Error() string { return e.Message() }
+
+func init() {
+	usererrors.Register(RateLimited{})
+	usererrors.Register(RoleRequired{})
+	usererrors.Register(QuotaExceeded{})
+}
@@ -0,0 +1,445 @@
+package say
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"goji.io/pat"
+	"goji.io/pattern"
+
+	"github.com/metcalf/saypi/reqlog"
+	"github.com/metcalf/saypi/respond"
+	"github.com/metcalf/saypi/usererrors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	maxWebhooks          = 10
+	maxWebhookURLLength  = 2048
+	maxWebhookAttempts   = 10
+	webhookSecretLen     = 24
+	webhookSecretPrefix  = "whsec_"
+	webhookTimeout       = 10 * time.Second    // time allowed for an endpoint to respond
+	webhookLease         = time.Minute         // time before a delivery that was not recorded is sent again
+	webhookBatch         = 20                  // deliveries sent at once
+	webhookResponseLimit = 64 << 10            // bytes of a response read before it is discarded
+	webhookRetention     = 30 * 24 * time.Hour // time finished deliveries are kept
+	webhookPruneBatch    = 1000                // finished deliveries deleted at once
+)
+
+// webhookBlockedNets are the loopback, private, link-local and other
+// special networks that webhooks are not sent to unless they are
+// allowed with SetWebhookAllowedNets, so that webhooks cannot reach
+// internal services.
+var webhookBlockedNets = mustParseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+	"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16",
+	"198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// Headers of webhook requests
+const (
+	WebhookEventHeader     = "Saypi-Event"
+	WebhookDeliveryHeader  = "Saypi-Delivery"
+	WebhookSignatureHeader = "Saypi-Signature"
+)
+
+// Statuses of WebhookDelivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is an endpoint that receives the events of every
+// conversation its user is a member of. Secret is only returned when the webhook
+// is created.
+type Webhook struct {
+	ID      string `json:"id"`
+	URL     string `json:"url"`
+	Secret  string `json:"secret,omitempty"`
+	Created int64  `json:"created"`
+}
+
+func (wh *Webhook) Vars() map[pattern.Variable]string {
+	return map[pattern.Variable]string{
+		"webhook": wh.ID,
+	}
+}
+
+// WebhookPayload is the body of a webhook request.
+type WebhookPayload struct {
+	Type           string          `json:"type"`
+	ConversationID string          `json:"conversation_id"`
+	Created        int64           `json:"created"`
+	Data           json.RawMessage `json:"data"`
+}
+
+// WebhookDelivery records the attempts to send an event to a webhook.
+// ResponseCode is the status of the last attempt and is nil if no
+// response was received.
+type WebhookDelivery struct {
+	ID           string          `json:"id"`
+	Type         string          `json:"type"`
+	Status       string          `json:"status"`
+	Attempts     int             `json:"attempts"`
+	ResponseCode *int            `json:"response_code"`
+	Error        string          `json:"error,omitempty"`
+	Created      int64           `json:"created"`
+	LastAttempt  *int64          `json:"last_attempt"`
+	NextAttempt  *int64          `json:"next_attempt"`
+	Payload      json.RawMessage `json:"payload"`
+}
+
+// WebhookSignature returns the value of the signature header of a
+// webhook request with the body sent at timestamp, in seconds since
+// the Unix epoch. The timestamp is signed along with the body so that
+// receivers can reject replayed requests: they should compute the
+// signature with their webhook's secret and the header's timestamp,
+// compare it to the header in constant time and reject requests whose
+// timestamp is more than a few minutes old.
+func WebhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%d,sha256=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// SetWebhookAllowedNets allows webhooks to be sent to addresses in
+// nets even if they are in a network that is otherwise blocked, such
+// as loopback addresses for tests.
+func (c *Controller) SetWebhookAllowedNets(nets []*net.IPNet) {
+	c.webhookAllowedNets = nets
+}
+
+// webhookAllowed reports whether webhooks may be sent to the IP.
+func (c *Controller) webhookAllowed(ip net.IP) bool {
+	for _, allowed := range c.webhookAllowedNets {
+		if allowed.Contains(ip) {
+			return true
+		}
+	}
+	for _, blocked := range webhookBlockedNets {
+		if blocked.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newWebhookClient returns a client that only connects to addresses
+// that webhooks may be sent to. The address is checked after the host
+// is resolved so that a host cannot resolve to an internal address,
+// and redirects are returned rather than followed since they could
+// lead anywhere.
+func (c *Controller) newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !c.webhookAllowed(ip) {
+				return fmt.Errorf("webhooks may not be sent to %s", host)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = ipNet
+	}
+	return nets
+}
+
+// CreateWebhook registers the URL in the `url` parameter to receive
+// the events of every conversation. The response includes the secret
+// used to sign its requests, which cannot be retrieved later.
+func (c *Controller) CreateWebhook(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	hook := Webhook{URL: r.PostFormValue("url")}
+
+	loc, err := url.Parse(hook.URL)
+	if err != nil || (loc.Scheme != "http" && loc.Scheme != "https") || loc.Host == "" || len(hook.URL) > maxWebhookURLLength {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+			Params:  []string{"url"},
+			Message: fmt.Sprintf("must be an absolute http or https URL of no more than %d characters", maxWebhookURLLength),
+		}})
+		return
+	}
+	// Hosts are checked again once they are resolved, when the webhook
+	// is sent
+	if ip := net.ParseIP(loc.Hostname()); ip != nil && !c.webhookAllowed(ip) {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.InvalidParams{{
+			Params:  []string{"url"},
+			Message: "must not be a loopback, private or link-local address",
+		}})
+		return
+	}
+
+	secret := make([]byte, webhookSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+	hook.Secret = webhookSecretPrefix + base64.URLEncoding.EncodeToString(secret)
+
+	if err := c.repo.InsertWebhook(userID, &hook); err == errTooManyWebhooks {
+		respond.UserError(ctx, w, http.StatusBadRequest, usererrors.ActionNotAllowed{
+			Action: fmt.Sprintf("create more than %d webhooks", maxWebhooks),
+		})
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, hook)
+}
+
+func (c *Controller) ListWebhooks(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+
+	hooks, err := c.repo.ListWebhooks(userID)
+	if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Type: "webhook",
+		Data: hooks,
+	})
+}
+
+// DeleteWebhook stops sending events to a webhook and deletes its
+// deliveries, including any that are pending.
+func (c *Controller) DeleteWebhook(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	webhookID := pat.Param(ctx, "webhook")
+
+	if err := c.repo.DeleteWebhook(userID, webhookID); err == errRecordNotFound {
+		respond.NotFound(ctx, w, r)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListDeliveries lists the deliveries of events to a webhook, most
+// recent first.
+func (c *Controller) ListDeliveries(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	userID := mustUserID(ctx)
+	webhookID := pat.Param(ctx, "webhook")
+
+	lArgs, uerr := getListArgs(r)
+	if uerr != nil {
+		respond.UserError(ctx, w, http.StatusBadRequest, uerr)
+		return
+	}
+
+	deliveries, hasMore, err := c.repo.ListDeliveries(userID, webhookID, lArgs)
+	if err == errRecordNotFound {
+		respond.NotFound(ctx, w, r)
+		return
+	} else if err == errCursorNotFound {
+		respondCursorNotFound(ctx, w, lArgs)
+		return
+	} else if err != nil {
+		respond.InternalError(ctx, w, err)
+		return
+	}
+
+	var cursor string
+	if len(deliveries) > 0 {
+		cursor = deliveries[len(deliveries)-1].ID
+	}
+
+	respond.Data(ctx, w, http.StatusOK, listRes{
+		Cursor:  cursor,
+		Type:    "webhook_delivery",
+		HasMore: hasMore,
+		Data:    deliveries,
+	})
+}
+
+// webhookPayload encodes the body of the webhook requests of an event.
+func webhookPayload(convoID string, event *changeEvent) ([]byte, error) {
+	raw, err := json.Marshal(event.Data)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s event: %v", event.Type, err)
+	}
+
+	payload, err := json.Marshal(WebhookPayload{
+		Type:           event.Type,
+		ConversationID: convoID,
+		Created:        time.Now().Unix(),
+		Data:           raw,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s payload: %v", event.Type, err)
+	}
+
+	return payload, nil
+}
+
+// wakeWebhooks sends the deliveries that were queued by a change
+// without waiting for the next interval.
+func (c *Controller) wakeWebhooks() {
+	select {
+	case c.wakeDeliveries <- struct{}{}:
+	default:
+	}
+}
+
+// StartDeliveries sends queued webhook deliveries as they are queued
+// and every interval until the Controller is closed. Failed deliveries
+// are retried after retryDelay, doubling the delay after each attempt,
+// until they have been attempted maxWebhookAttempts times. Deliveries
+// that have finished are deleted after webhookRetention.
+func (c *Controller) StartDeliveries(interval, retryDelay time.Duration) {
+	c.stopDeliveries = make(chan struct{})
+	c.deliveriesDone = make(chan struct{})
+
+	go func() {
+		defer close(c.deliveriesDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.pruneDeliveries()
+			case <-c.wakeDeliveries:
+			case <-c.stopDeliveries:
+				return
+			}
+			c.sendDeliveries(retryDelay)
+		}
+	}()
+}
+
+func (c *Controller) pruneDeliveries() {
+	if _, err := c.repo.PruneDeliveries(webhookRetention, webhookPruneBatch); err != nil {
+		reqlog.Printf(context.Background(), "Error pruning webhook deliveries. event=webhook_error error=%q", err)
+	}
+}
+
+func (c *Controller) sendDeliveries(retryDelay time.Duration) {
+	ctx := context.Background()
+
+	for {
+		recs, err := c.repo.ClaimDeliveries(webhookBatch, webhookLease)
+		if err != nil {
+			reqlog.Printf(ctx, "Error claiming webhook deliveries. event=webhook_error error=%q", err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		for i := range recs {
+			wg.Add(1)
+			go func(rec *deliveryRec) {
+				defer wg.Done()
+				c.sendDelivery(ctx, rec, retryDelay)
+			}(&recs[i])
+		}
+		wg.Wait()
+
+		if len(recs) < webhookBatch {
+			return
+		}
+		select {
+		case <-c.stopDeliveries:
+			return
+		default:
+		}
+	}
+}
+
+// sendDelivery makes one attempt to send a delivery and records the
+// outcome.
+func (c *Controller) sendDelivery(ctx context.Context, rec *deliveryRec, retryDelay time.Duration) {
+	rec.ResponseCode = nil
+	rec.Error = ""
+
+	req, err := http.NewRequest("POST", rec.URL, bytes.NewBufferString(rec.Body))
+	if err != nil {
+		rec.Error = err.Error()
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "saypi-webhooks")
+		req.Header.Set(WebhookEventHeader, rec.Type)
+		req.Header.Set(WebhookDeliveryHeader, rec.ID)
+		req.Header.Set(WebhookSignatureHeader, WebhookSignature(rec.Secret, time.Now().Unix(), []byte(rec.Body)))
+
+		resp, err := c.webhookClient.Do(req)
+		if err != nil {
+			rec.Error = err.Error()
+		} else {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, webhookResponseLimit))
+			resp.Body.Close()
+
+			code := resp.StatusCode
+			rec.ResponseCode = &code
+			if code < 200 || code > 299 {
+				rec.Error = fmt.Sprintf("endpoint responded with status %d", code)
+			}
+		}
+	}
+
+	delivered := rec.Error == ""
+	attempts := rec.Attempts + 1
+	retry := attempts < maxWebhookAttempts
+	delay := retryDelay << uint(attempts-1)
+
+	if err := c.repo.RecordDelivery(rec, delivered, retry, delay); err != nil {
+		reqlog.Printf(ctx, "Error recording webhook delivery. event=webhook_error error=%q", err)
+		return
+	}
+
+	if !delivered {
+		reqlog.Printf(ctx, "Webhook delivery failed. event=webhook_failed delivery=%s attempts=%d error=%q", rec.ID, attempts, rec.Error)
+	}
+}
@@ -0,0 +1,94 @@
+package say
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	// The key and message of HMAC-SHA256 test case 2 from RFC 4231,
+	// with the timestamp prepended to the message
+	sig := WebhookSignature("Jefe", 1700000000, []byte("what do ya want for nothing?"))
+	expect := "t=1700000000,sha256=1cdd0650c8be1cb0974b1788d458b1e781206cfef59b85faafc582d2e182c57e"
+	if sig != expect {
+		t.Errorf("got signature %q but expected %q", sig, expect)
+	}
+
+	if other := WebhookSignature("Jefe", 1700000001, []byte("what do ya want for nothing?")); other == sig {
+		t.Errorf("expected the signature to change with the timestamp")
+	}
+}
+
+func TestWebhookAllowed(t *testing.T) {
+	c := Controller{}
+
+	cases := map[string]bool{
+		"93.184.216.34":    true,
+		"2606:2800::1":     true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"::ffff:127.0.0.1": false,
+		"fd00::1":          false,
+		"fe80::1":          false,
+	}
+	for addr, expect := range cases {
+		if got := c.webhookAllowed(net.ParseIP(addr)); got != expect {
+			t.Errorf("expected webhookAllowed(%s) to be %t", addr, expect)
+		}
+	}
+
+	c.SetWebhookAllowedNets(mustParseCIDRs("127.0.0.0/8"))
+	if !c.webhookAllowed(net.ParseIP("127.0.0.1")) {
+		t.Errorf("expected an allowed network to be allowed")
+	}
+	if c.webhookAllowed(net.ParseIP("10.1.2.3")) {
+		t.Errorf("expected other blocked networks to stay blocked")
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := Controller{}
+	client := c.newWebhookClient()
+
+	if resp, err := client.Post(srv.URL, "application/json", nil); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected a request to a loopback address to fail")
+	}
+
+	c.SetWebhookAllowedNets(mustParseCIDRs("127.0.0.0/8", "::1/128"))
+
+	resp, err := client.Post(srv.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("got status %d from an allowed address", resp.StatusCode)
+	}
+
+	resp, err = client.Post(srv.URL+"/redirect", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("expected the redirect to be returned but got status %d", resp.StatusCode)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/metcalf/saypi/app"
@@ -42,6 +43,7 @@ func main() {
 	graceful.HandleSignals()
 	graceful.PreHook(func() {
 		log.Print("Shutting down. event=app_stop")
+		a.CloseStreams()
 	})
 	log.Printf("Starting. event=app_start address=%q", listener.Addr())
 	bind.Ready()
@@ -65,6 +67,29 @@ func readConfiguration() (*app.Configuration, *config, error) {
 	fl.IntVar(&appCfg.IPPerMinute, "per_ip_rpm", 12, "maximum number of requests per IP per minute")
 	fl.IntVar(&appCfg.IPRateBurst, "per_ip_burst", 5, "maximum instantaneous burst of requests per IP")
 
+	fl.IntVar(&appCfg.SharePerMinute, "per_share_rpm", 60, "maximum number of views per share link per minute")
+	fl.IntVar(&appCfg.ShareRateBurst, "per_share_burst", 20, "maximum instantaneous burst of views per share link")
+
+	fl.IntVar(&appCfg.SessionPerMinute, "per_session_rpm", 120, "maximum number of messages per session connection per minute")
+	fl.IntVar(&appCfg.SessionRateBurst, "per_session_burst", 20, "maximum instantaneous burst of messages per session connection")
+
+	fl.Int64Var(&appCfg.MaxConversations, "max_conversations", 1000, "maximum number of conversations per user, unlimited if zero")
+	fl.Int64Var(&appCfg.MaxConversationLines, "max_conversation_lines", 10000, "maximum number of lines per conversation, unlimited if zero")
+	fl.Int64Var(&appCfg.MaxMoods, "max_moods", 1000, "maximum number of moods per user, unlimited if zero")
+	fl.Int64Var(&appCfg.MaxTextBytes, "max_text_bytes", 10<<20, "maximum bytes of line text per user, including edit history, unlimited if zero")
+
+	fl.DurationVar(&appCfg.TrashRetention, "trash_retention", 30*24*time.Hour, "how long deleted conversations and lines can be restored, forever if zero")
+	fl.DurationVar(&appCfg.TrashPurgeInterval, "trash_purge_interval", time.Hour, "how often to purge expired conversations and lines from the trash")
+
+	fl.DurationVar(&appCfg.ReapInterval, "reap_interval", time.Minute, "how often to delete expired conversations, never if zero")
+	fl.IntVar(&appCfg.ReapBatchSize, "reap_batch_size", 100, "maximum number of expired conversations deleted at once")
+
+	fl.DurationVar(&appCfg.WebhookInterval, "webhook_interval", 10*time.Second, "how often to check for due webhook deliveries, never if zero")
+	fl.DurationVar(&appCfg.WebhookRetryDelay, "webhook_retry_delay", 30*time.Second, "delay before the first retry of a failed webhook delivery, doubling after each attempt")
+	webhookAllowedNets := fl.String("webhook_allowed_nets", "", "comma separated CIDRs of private networks webhooks may be sent to")
+
+	fl.StringVar(&appCfg.MoodCatalog, "mood_catalog", "", "path to a JSON or YAML file defining the built-in moods")
+
 	userSecretStr := flag.String("user_secret", "", "hex encoded secret for generating secure user tokens")
 
 	if err := fl.Parse(os.Args[1:]); err != nil {
@@ -77,5 +102,15 @@ func readConfiguration() (*app.Configuration, *config, error) {
 	}
 	appCfg.UserSecret = userSecret
 
+	if *webhookAllowedNets != "" {
+		for _, cidr := range strings.Split(*webhookAllowedNets, ",") {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return nil, nil, err
+			}
+			appCfg.WebhookAllowedNets = append(appCfg.WebhookAllowedNets, ipNet)
+		}
+	}
+
 	return &appCfg, &srvCfg, nil
 }
@@ -7,23 +7,94 @@ CREATE TABLE moods (
        eyes    CHAR(2) NOT NULL,
        tongue  CHAR(2) NOT NULL,
 
+       published_at  TIMESTAMP, -- null unless listed in the gallery
+       install_count INTEGER NOT NULL DEFAULT 0,
+
        PRIMARY KEY (id)
 );
 
 CREATE UNIQUE INDEX unique_user_moods ON moods (user_id, lower(name));
 
+CREATE INDEX published_moods_by_installs ON moods (install_count, id) WHERE published_at IS NOT NULL;
+
+CREATE TABLE publishers (
+       user_id    TEXT NOT NULL,
+       created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+       name TEXT NOT NULL,
+
+       PRIMARY KEY (user_id)
+);
+
+CREATE UNIQUE INDEX unique_publisher_names ON publishers (lower(name));
+
+CREATE TABLE mood_installs (
+       mood_id    INTEGER NOT NULL,
+       user_id    TEXT NOT NULL,
+       created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+       PRIMARY KEY (mood_id, user_id)
+);
+
+ALTER TABLE mood_installs ADD CONSTRAINT fk_mood_installs_mood
+  FOREIGN KEY (mood_id) REFERENCES moods(id) ON DELETE CASCADE;
+
+CREATE TABLE mood_sets (
+       id SERIAL,
+       created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+       user_id TEXT NOT NULL,
+       name    TEXT NOT NULL,
+
+       PRIMARY KEY (id)
+);
+
+CREATE UNIQUE INDEX unique_user_mood_sets ON mood_sets (user_id, lower(name));
+
+CREATE TABLE mood_set_entries (
+       mood_set_id INTEGER NOT NULL,
+       mood_name   TEXT NOT NULL, -- may refer to a built-in or user mood
+       weight      INTEGER NOT NULL CHECK (weight > 0),
+
+       PRIMARY KEY (mood_set_id, mood_name)
+);
+
+ALTER TABLE mood_set_entries ADD CONSTRAINT fk_mood_set_entries_mood_set
+  FOREIGN KEY (mood_set_id) REFERENCES mood_sets(id) ON DELETE CASCADE;
+
+CREATE TABLE sentiment_moods (
+       user_id   TEXT NOT NULL,
+       min_score DOUBLE PRECISION NOT NULL CHECK (min_score BETWEEN -1 AND 1),
+       mood_name TEXT NOT NULL, -- may refer to a built-in or user mood
+
+       PRIMARY KEY (user_id, min_score)
+);
+
 CREATE TABLE conversations (
        id SERIAL,
        public_id TEXT NOT NULL,
        created_at TIMESTAMP NOT NULL DEFAULT NOW(),
 
        heading TEXT NOT NULL,
-       user_id TEXT NOT NULL,
+       user_id TEXT NOT NULL, -- creator, access is granted by members
+       search TSVECTOR NOT NULL, -- heading for full-text search
+       parent_id INTEGER, -- conversation this was forked from, if any
+       deleted_at TIMESTAMP, -- set while the conversation is in the trash
+       expires_at TIMESTAMP, -- deleted by the reaper after this time, if set
+       text_bytes BIGINT NOT NULL DEFAULT 0, -- bytes of the text of its lines and their revisions, for quotas
 
        UNIQUE(public_id),
        PRIMARY KEY (id)
 );
 
+CREATE INDEX conversations_by_user ON conversations (user_id);
+CREATE INDEX conversations_search ON conversations USING GIN (search);
+CREATE INDEX conversations_deleted ON conversations (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX conversations_expires ON conversations (expires_at) WHERE expires_at IS NOT NULL;
+
+ALTER TABLE conversations ADD CONSTRAINT fk_conversations_parent
+  FOREIGN KEY (parent_id) REFERENCES conversations(id) ON DELETE SET NULL;
+
 CREATE TABLE lines (
        id SERIAL,
        public_id TEXT NOT NULL,
@@ -32,16 +103,185 @@ CREATE TABLE lines (
        animal TEXT NOT NULL,
        text TEXT NOT NULL,
        think BOOLEAN NOT NULL,
+       width INTEGER NOT NULL DEFAULT 0, -- wrapping column, 0 for the default
        mood_name TEXT NOT NULL,
        mood_id INTEGER, -- can be null if using a built-in mood
+       sentiment DOUBLE PRECISION, -- only set for lines created with mood=auto
+       character_id INTEGER, -- speaker of the line, if any
        conversation_id INTEGER NOT NULL,
+       position INTEGER NOT NULL, -- order within the conversation, may have gaps
+       search TSVECTOR NOT NULL, -- text for full-text search
+       deleted_at TIMESTAMP, -- set while the line is in the trash
 
        UNIQUE(public_id),
+       -- Deferred so that lines can be shifted to make room for another
+       UNIQUE(conversation_id, position) DEFERRABLE INITIALLY DEFERRED,
        PRIMARY KEY (id)
 );
 
+CREATE INDEX lines_search ON lines USING GIN (search);
+CREATE INDEX lines_deleted ON lines (deleted_at) WHERE deleted_at IS NOT NULL;
+
 ALTER TABLE lines ADD CONSTRAINT fk_lines_conversation
   FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE;
 
 ALTER TABLE lines ADD CONSTRAINT fk_lines_mood
   FOREIGN KEY (mood_id) REFERENCES moods(id);
+
+CREATE TABLE characters (
+       id SERIAL,
+       public_id TEXT NOT NULL,
+       created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+       conversation_id INTEGER NOT NULL,
+       name TEXT NOT NULL,
+       animal TEXT NOT NULL,
+       mood_name TEXT NOT NULL, -- default mood of the character's lines
+       facing TEXT NOT NULL, -- 'left' or 'right'
+
+       UNIQUE(public_id),
+       UNIQUE(conversation_id, name),
+       PRIMARY KEY (id)
+);
+
+ALTER TABLE characters ADD CONSTRAINT fk_characters_conversation
+  FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE;
+
+-- Lines keep their animal and mood if their character is deleted
+ALTER TABLE lines ADD CONSTRAINT fk_lines_character
+  FOREIGN KEY (character_id) REFERENCES characters(id) ON DELETE SET NULL;
+
+CREATE TABLE conversation_revisions (
+       id SERIAL,
+       created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+       conversation_id INTEGER NOT NULL,
+       user_id TEXT NOT NULL, -- user who replaced this revision
+       heading TEXT NOT NULL,
+
+       PRIMARY KEY (id)
+);
+
+ALTER TABLE conversation_revisions ADD CONSTRAINT fk_conversation_revisions_conversation
+  FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE;
+
+CREATE TABLE line_revisions (
+       id SERIAL,
+       created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+       line_id INTEGER NOT NULL,
+       revision INTEGER NOT NULL,
+       user_id TEXT NOT NULL, -- user who replaced this revision
+       animal TEXT NOT NULL,
+       text TEXT NOT NULL,
+       think BOOLEAN NOT NULL,
+       width INTEGER NOT NULL DEFAULT 0,
+       mood_name TEXT NOT NULL,
+       mood_id INTEGER,
+       sentiment DOUBLE PRECISION,
+
+       UNIQUE(line_id, revision),
+       PRIMARY KEY (id)
+);
+
+ALTER TABLE line_revisions ADD CONSTRAINT fk_line_revisions_line
+  FOREIGN KEY (line_id) REFERENCES lines(id) ON DELETE CASCADE;
+
+-- Revisions keep the mood name if the mood itself is deleted
+ALTER TABLE line_revisions ADD CONSTRAINT fk_line_revisions_mood
+  FOREIGN KEY (mood_id) REFERENCES moods(id) ON DELETE SET NULL;
+
+CREATE TABLE shares (
+       id SERIAL,
+       public_id TEXT NOT NULL,
+       created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+       token_id TEXT NOT NULL, -- random part of the signed share token
+       conversation_id INTEGER NOT NULL,
+       expires_at TIMESTAMP, -- null if the share does not expire
+
+       UNIQUE(public_id),
+       UNIQUE(token_id),
+       PRIMARY KEY (id)
+);
+
+ALTER TABLE shares ADD CONSTRAINT fk_shares_conversation
+  FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE;
+
+CREATE TABLE members (
+       id SERIAL,
+       public_id TEXT NOT NULL,
+       created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+       conversation_id INTEGER NOT NULL,
+       user_id TEXT NOT NULL,
+       role TEXT NOT NULL, -- 'owner', 'editor' or 'viewer'
+
+       UNIQUE(public_id),
+       UNIQUE(conversation_id, user_id),
+       PRIMARY KEY (id)
+);
+
+CREATE INDEX members_by_user ON members (user_id, conversation_id);
+
+ALTER TABLE members ADD CONSTRAINT fk_members_conversation
+  FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE;
+
+CREATE TABLE invites (
+       id SERIAL,
+       public_id TEXT NOT NULL,
+       created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+       token_id TEXT NOT NULL, -- random part of the signed invite token
+       conversation_id INTEGER NOT NULL,
+       role TEXT NOT NULL, -- role granted to the user who accepts it
+       expires_at TIMESTAMP NOT NULL,
+
+       UNIQUE(public_id),
+       UNIQUE(token_id),
+       PRIMARY KEY (id)
+);
+
+ALTER TABLE invites ADD CONSTRAINT fk_invites_conversation
+  FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE;
+
+CREATE TABLE webhooks (
+       id SERIAL,
+       public_id TEXT NOT NULL,
+       created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+       user_id TEXT NOT NULL,
+       url     TEXT NOT NULL,
+       secret  TEXT NOT NULL, -- key for signing payloads
+
+       UNIQUE(public_id),
+       PRIMARY KEY (id)
+);
+
+CREATE INDEX webhooks_by_user ON webhooks (user_id, id);
+
+CREATE TABLE webhook_deliveries (
+       id SERIAL,
+       public_id TEXT NOT NULL,
+       created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+       webhook_id INTEGER NOT NULL,
+       event_type TEXT NOT NULL,
+       payload    TEXT NOT NULL, -- JSON body, signed when it is sent
+       attempts   INTEGER NOT NULL DEFAULT 0,
+       response_code INTEGER, -- status of the last attempt, null if there was no response
+       error TEXT NOT NULL DEFAULT '', -- why the last attempt failed
+       last_attempt_at TIMESTAMP,
+       next_attempt_at TIMESTAMP, -- null once delivered or abandoned
+       delivered_at TIMESTAMP,
+
+       UNIQUE(public_id),
+       PRIMARY KEY (id)
+);
+
+CREATE INDEX webhook_deliveries_by_webhook ON webhook_deliveries (webhook_id, id);
+CREATE INDEX webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE next_attempt_at IS NOT NULL;
+CREATE INDEX webhook_deliveries_finished ON webhook_deliveries (created_at) WHERE next_attempt_at IS NULL;
+
+ALTER TABLE webhook_deliveries ADD CONSTRAINT fk_webhook_deliveries_webhook
+  FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE;
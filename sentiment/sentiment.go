@@ -0,0 +1,125 @@
+// Package sentiment scores the sentiment of short English text using
+// an embedded word lexicon. It handles simple negation ("not happy"),
+// intensifiers ("very happy") and exclamation marks but makes no
+// attempt at deeper language understanding.
+package sentiment
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+const (
+	// normalization controls how quickly the raw lexicon total
+	// approaches the bounds of the score.
+	normalization  = 15
+	negationWindow = 3
+	negationFactor = -0.75
+	boosterFactor  = 1.5
+	exclaimBoost   = 0.5
+	maxExclaims    = 4
+)
+
+// Score returns the sentiment of text from -1 (most negative) to 1
+// (most positive). Text without any recognized words scores 0.
+func Score(text string) float64 {
+	words := tokenize(text)
+
+	var total float64
+	for i, word := range words {
+		value, ok := lexicon[word]
+		if !ok {
+			continue
+		}
+
+		if i > 0 && boosters[words[i-1]] {
+			value *= boosterFactor
+		}
+
+		for j := i - 1; j >= 0 && j >= i-negationWindow; j-- {
+			if isNegation(words[j]) {
+				value *= negationFactor
+				break
+			}
+		}
+
+		total += value
+	}
+
+	if total != 0 {
+		exclaims := strings.Count(text, "!")
+		if exclaims > maxExclaims {
+			exclaims = maxExclaims
+		}
+		total += math.Copysign(exclaimBoost*float64(exclaims), total)
+	}
+
+	score := total / math.Sqrt(total*total+normalization)
+	return math.Round(score*1e4) / 1e4
+}
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !(unicode.IsLetter(r) || r == '\'')
+	})
+}
+
+func isNegation(word string) bool {
+	return negations[word] || strings.HasSuffix(word, "n't")
+}
+
+var negations = map[string]bool{
+	"not": true, "no": true, "never": true, "none": true, "nobody": true,
+	"nothing": true, "neither": true, "nor": true, "without": true,
+	"cannot": true, "dont": true, "wont": true, "isnt": true, "cant": true,
+}
+
+var boosters = map[string]bool{
+	"very": true, "really": true, "extremely": true, "so": true,
+	"totally": true, "completely": true, "absolutely": true, "incredibly": true,
+	"super": true, "utterly": true, "highly": true, "deeply": true,
+}
+
+// lexicon assigns each word a valence from -5 to 5, loosely following
+// the AFINN word list.
+var lexicon = map[string]float64{
+	// Strongly negative
+	"catastrophe": -4, "catastrophic": -4, "disaster": -4, "disastrous": -4,
+	"horrible": -3, "horrific": -4, "terrible": -3, "awful": -3, "worst": -3,
+	"dead": -3, "die": -3, "died": -3, "dying": -3, "death": -3, "kill": -3,
+	"killed": -3, "hate": -3, "hated": -3, "furious": -3, "miserable": -3,
+	"outage": -3, "down": -1, "crash": -3, "crashed": -3, "crashing": -3,
+	"broken": -2, "broke": -2, "fail": -2, "failed": -2, "failing": -2,
+	"failure": -2, "panic": -3, "fatal": -3, "corrupt": -3, "corrupted": -3,
+	"lost": -2, "loss": -3, "critical": -2, "severe": -2, "emergency": -2,
+
+	// Mildly negative
+	"bad": -3, "sad": -2, "angry": -3, "annoyed": -2, "annoying": -2,
+	"bored": -2, "boring": -3, "tired": -2, "sleepy": -1, "exhausted": -2,
+	"slow": -1, "sick": -2, "sorry": -1, "worried": -3, "worry": -3,
+	"afraid": -2, "scared": -2, "confused": -2, "error": -2, "errors": -2,
+	"bug": -2, "bugs": -2, "problem": -2, "problems": -2, "issue": -1,
+	"issues": -1, "degraded": -2, "delay": -1, "delayed": -1, "late": -1,
+	"wrong": -2, "ugly": -3, "stupid": -2, "ugh": -2, "meh": -1,
+	"unfortunately": -2, "unhappy": -2, "upset": -2, "lonely": -2, "pain": -2,
+	"hurt": -2, "cry": -1, "crying": -2, "frustrated": -2, "frustrating": -2,
+	"difficult": -1, "hard": -1, "unstable": -2, "flaky": -2, "timeout": -2,
+
+	// Mildly positive
+	"ok": 1, "okay": 1, "fine": 2, "good": 3, "nice": 3, "like": 2,
+	"liked": 2, "glad": 3, "happy": 3, "calm": 2, "better": 2, "fixed": 2,
+	"resolved": 2, "stable": 2, "recovered": 2, "restored": 2, "working": 1,
+	"works": 1, "thanks": 2, "thank": 2, "welcome": 2, "hope": 2,
+	"hopeful": 2, "safe": 1, "fun": 4, "funny": 4, "cool": 1, "smooth": 2,
+	"clean": 2, "ready": 1, "helpful": 2, "pleased": 3, "relieved": 2,
+	"yay": 2, "win": 4, "won": 3, "success": 2, "successful": 3,
+
+	// Strongly positive
+	"great": 3, "love": 3, "loved": 3, "excellent": 3, "wonderful": 4,
+	"amazing": 4, "awesome": 4, "fantastic": 4, "brilliant": 4,
+	"excited": 3, "exciting": 3, "thrilled": 5, "ecstatic": 4, "perfect": 3,
+	"superb": 5, "outstanding": 5, "incredible": 4, "celebrate": 3,
+	"shipped": 3, "ship": 2, "launched": 3, "launch": 2, "hooray": 4,
+	"woohoo": 4, "delighted": 3, "joy": 3, "best": 3, "epic": 3,
+}
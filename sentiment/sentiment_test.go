@@ -0,0 +1,46 @@
+package sentiment
+
+import "testing"
+
+func TestScore(t *testing.T) {
+	cases := []struct {
+		text     string
+		min, max float64
+	}{
+		{"", 0, 0},
+		{"the cow jumped over the moon", 0, 0},
+		{"this is good", 0.5, 0.7},
+		{"this is very good", 0.7, 0.8},
+		{"this is not good", -0.6, -0.4},
+		{"this isn't good", -0.6, -0.4},
+		{"this is bad", -0.7, -0.5},
+		{"We shipped it! Amazing work, everyone is thrilled!!", 0.9, 1},
+		{"Major outage: the database crashed and we lost data", -1, -0.85},
+		{"GOOD", 0.5, 0.7},
+	}
+
+	for i, testcase := range cases {
+		score := Score(testcase.text)
+		if score < testcase.min || score > testcase.max {
+			t.Errorf("%d: Score(%q)=%f, expected between %f and %f", i, testcase.text, score, testcase.min, testcase.max)
+		}
+	}
+}
+
+func TestScoreExclaims(t *testing.T) {
+	plain := Score("this is great")
+	excited := Score("this is great!!!")
+	if excited <= plain {
+		t.Errorf("expected exclamations to raise %f but got %f", plain, excited)
+	}
+
+	plain = Score("this is awful")
+	excited = Score("this is awful!!!")
+	if excited >= plain {
+		t.Errorf("expected exclamations to lower %f but got %f", plain, excited)
+	}
+
+	if score := Score("hello!!!"); score != 0 {
+		t.Errorf("expected exclamations alone to score 0 but got %f", score)
+	}
+}